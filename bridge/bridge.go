@@ -0,0 +1,326 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/packets"
+)
+
+// Direction 转发方向
+type Direction int
+
+// 转发方向
+const (
+	Out  Direction = iota // 本地 -> 远程
+	In                    // 远程 -> 本地
+	Both                  // 双向
+)
+
+// DefaultRetryInterval 默认的重连间隔
+const DefaultRetryInterval = 5 * time.Second
+
+// DefaultQueueSize 默认的每个方向的转发队列长度
+const DefaultQueueSize = 1024
+
+// Topic 桥接主题, 与mosquitto的topic配置含义相同
+// 本地订阅 LocalPrefix+Pattern, 转发时把主题的 LocalPrefix 替换为 RemotePrefix, 反之亦然
+type Topic struct {
+	Pattern      string
+	Direction    Direction
+	Qos          byte
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// Endpoint 桥接的一端
+type Endpoint struct {
+	Network string // 为空时使用tcp
+	Address string
+	Options client.Options
+
+	// Dial 不为空时用于建立连接, 代替 Network 和 Address, 例如连接进程内的服务端
+	Dial func() (net.Conn, error)
+}
+
+// Config 桥接配置
+type Config struct {
+	Local  Endpoint
+	Remote Endpoint
+	Topics []Topic
+
+	// PlainProtocol 不在协议级别中设置 packets.BridgeFlag
+	// 服务端不支持桥接标志时使用, 此时双向桥接同一主题会产生回环
+	PlainProtocol bool
+
+	RetryInterval time.Duration // 链路断开后的重连间隔, 为0时使用 DefaultRetryInterval
+	QueueSize     int           // 每个方向的转发队列长度, 为0时使用 DefaultQueueSize
+	Logger        *log.Logger   // 为nil时不输出日志
+}
+
+// Bridge 两个服务端之间的桥接
+// 使用持久会话连接两端, 消息被另一端确认后才确认来源的消息,
+// 链路断开后重连, 来源服务端重发未确认的消息
+type Bridge struct {
+	cfg Config
+	out chan *forward // 本地 -> 远程
+	in  chan *forward // 远程 -> 本地
+
+	// 上次链路断开时未转发成功的消息
+	mu       sync.Mutex
+	retryOut *forward
+	retryIn  *forward
+}
+
+// forward 一条待转发的消息
+type forward struct {
+	pk   *packets.PublishPacket // 发布到另一端的消息
+	from *client.Client         // 来源的连接
+	src  *packets.PublishPacket // 来源的消息, 另一端确认后确认
+}
+
+// New 新建桥接
+func New(cfg Config) (*Bridge, error) {
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	for _, ep := range []*Endpoint{&cfg.Local, &cfg.Remote} {
+		if ep.Network == "" {
+			ep.Network = "tcp"
+		}
+		if ep.Options.ClientID == "" {
+			return nil, errors.New("bridge endpoints need a client ID for a persistent session")
+		}
+		ep.Options.CleanSession = false
+		if !cfg.PlainProtocol {
+			ep.Options.ProtocolLevel = 4 | packets.BridgeFlag
+		}
+	}
+	for _, t := range cfg.Topics {
+		if !packets.ValidTopicFilter(t.LocalPrefix+t.Pattern) || !packets.ValidTopicFilter(t.RemotePrefix+t.Pattern) {
+			return nil, fmt.Errorf("invalid bridge topic %q", t.Pattern)
+		}
+		if t.Qos > 2 {
+			return nil, fmt.Errorf("invalid QoS %d for bridge topic %q", t.Qos, t.Pattern)
+		}
+	}
+	return &Bridge{
+		cfg: cfg,
+		out: make(chan *forward, cfg.QueueSize),
+		in:  make(chan *forward, cfg.QueueSize),
+	}, nil
+}
+
+// Run 运行桥接直到ctx结束, 链路断开时按 RetryInterval 重连
+func (b *Bridge) Run(ctx context.Context) error {
+	for {
+		err := b.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		b.logf("bridge link down: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(b.cfg.RetryInterval):
+		}
+	}
+}
+
+// session 建立一次链路并转发消息直到链路断开
+func (b *Bridge) session(ctx context.Context) error {
+	local, err := b.dial(b.cfg.Local, b.out, Out, &b.retryOut)
+	if err != nil {
+		return fmt.Errorf("local: %w", err)
+	}
+	defer local.Close()
+	remote, err := b.dial(b.cfg.Remote, b.in, In, &b.retryIn)
+	if err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+	defer remote.Close()
+
+	if err = b.subscribe(ctx, local, Out); err != nil {
+		return fmt.Errorf("local: %w", err)
+	}
+	if err = b.subscribe(ctx, remote, In); err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+	b.logf("bridge link up: %s <-> %s", b.cfg.Local.Address, b.cfg.Remote.Address)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() { errs <- b.pump(ctx, b.out, remote, &b.retryOut) }()
+	go func() { errs <- b.pump(ctx, b.in, local, &b.retryIn) }()
+
+	pending := 2
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-local.Done():
+		err = fmt.Errorf("local: %w", local.Err())
+	case <-remote.Done():
+		err = fmt.Errorf("remote: %w", remote.Err())
+	case err = <-errs:
+		pending--
+	}
+	cancel()
+	local.Close()
+	remote.Close()
+	// 等待转发协程退出, 以便保存未完成的消息
+	for ; pending > 0; pending-- {
+		<-errs
+	}
+	return err
+}
+
+// dial 连接一端, 收到的消息按方向重映射后放入队列, 消息在转发成功后才确认
+// retry 为该方向上次未转发成功的消息, 来源重发的同一消息不再放入队列
+func (b *Bridge) dial(ep Endpoint, queue chan *forward, dir Direction, retry **forward) (*client.Client, error) {
+	opts := ep.Options
+	opts.ManualAck = true
+	opts.OnMessage = func(c *client.Client, pk *packets.PublishPacket) {
+		topic, ok := b.remap(pk.TopicName, dir)
+		if !ok {
+			c.Ack(pk)
+			return
+		}
+		// 持久会话中未确认消息的报文标识符不变, 标识符相同的就是同一消息
+		b.mu.Lock()
+		if r := *retry; r != nil && pk.Qos > 0 && r.src.Qos > 0 && r.src.PacketID == pk.PacketID {
+			r.from, r.src = c, pk
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+		fwd := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		fwd.TopicName = topic
+		fwd.Qos = pk.Qos
+		fwd.Retain = pk.Retain
+		fwd.Payload = pk.Payload
+		select {
+		case queue <- &forward{pk: fwd, from: c, src: pk}:
+		case <-c.Done():
+		}
+	}
+	if ep.Dial != nil {
+		conn, err := ep.Dial()
+		if err != nil {
+			return nil, err
+		}
+		return client.Connect(conn, opts)
+	}
+	return client.Dial(ep.Network, ep.Address, opts)
+}
+
+// subscribe 订阅该方向需要转发的主题
+func (b *Bridge) subscribe(ctx context.Context, c *client.Client, dir Direction) error {
+	var topics []string
+	var qoss []byte
+	for _, t := range b.cfg.Topics {
+		if t.Direction != dir && t.Direction != Both {
+			continue
+		}
+		prefix := t.LocalPrefix
+		if dir == In {
+			prefix = t.RemotePrefix
+		}
+		topics = append(topics, prefix+t.Pattern)
+		qoss = append(qoss, t.Qos)
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+	codes, err := c.Subscribe(ctx, topics, qoss)
+	if err != nil {
+		return err
+	}
+	for i, code := range codes {
+		if code == 0x80 && i < len(topics) {
+			b.logf("bridge subscription to %s refused", topics[i])
+		}
+	}
+	return nil
+}
+
+// pump 把队列中的消息发布到另一端, 另一端确认后确认来源的消息
+// 发布失败的消息保存在retry中, 下次链路建立后首先重发
+func (b *Bridge) pump(ctx context.Context, queue chan *forward, c *client.Client, retry **forward) error {
+	for {
+		b.mu.Lock()
+		f := *retry
+		b.mu.Unlock()
+		if f == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case f = <-queue:
+			}
+			// 来源连接已断开时, 未确认的消息会在重连后由来源重发
+			if f.src.Qos > 0 && closed(f.from) {
+				continue
+			}
+		} else if f.pk.Qos > 0 {
+			// QoS 0消息不能设置DUP; 重发的消息沿用上次的报文标识符
+			f.pk.Dup = true
+		}
+		if err := c.Publish(ctx, f.pk); err != nil {
+			b.mu.Lock()
+			*retry = f
+			b.mu.Unlock()
+			return err
+		}
+		b.mu.Lock()
+		*retry = nil
+		from, src := f.from, f.src
+		b.mu.Unlock()
+		// 来源连接已断开时确认失败, 来源重发后再转发一次
+		from.Ack(src)
+	}
+}
+
+// closed 连接是否已断开
+func closed(c *client.Client) bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// remap 按桥接主题把消息主题映射到另一端, from 为消息的来源方向
+func (b *Bridge) remap(topic string, from Direction) (string, bool) {
+	for _, t := range b.cfg.Topics {
+		if t.Direction != from && t.Direction != Both {
+			continue
+		}
+		src, dst := t.LocalPrefix, t.RemotePrefix
+		if from == In {
+			src, dst = dst, src
+		}
+		if !strings.HasPrefix(topic, src) || !packets.MatchTopic(src+t.Pattern, topic) {
+			continue
+		}
+		return dst + strings.TrimPrefix(topic, src), true
+	}
+	return "", false
+}
+
+// logf 输出日志
+func (b *Bridge) logf(format string, args ...interface{}) {
+	if b.cfg.Logger != nil {
+		b.cfg.Logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/internal/testbroker"
+	"github.com/boxungo/mqtt/packets"
+)
+
+func TestRemap(t *testing.T) {
+	b, err := New(Config{
+		Local:  Endpoint{Options: client.Options{ClientID: "edge"}},
+		Remote: Endpoint{Options: client.Options{ClientID: "edge"}},
+		Topics: []Topic{
+			{Pattern: "sensors/#", Direction: Out, LocalPrefix: "site/", RemotePrefix: "edge1/"},
+			{Pattern: "cmd/+", Direction: In, RemotePrefix: "edge1/"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New returned error: %s", err)
+	}
+	cases := []struct {
+		topic string
+		from  Direction
+		res   string
+		ok    bool
+	}{
+		{"site/sensors/temp", Out, "edge1/sensors/temp", true},
+		{"sensors/temp", Out, "", false},
+		{"edge1/cmd/reboot", In, "cmd/reboot", true},
+		{"edge1/sensors/temp", In, "", false},
+	}
+	for _, c := range cases {
+		if res, ok := b.remap(c.topic, c.from); res != c.res || ok != c.ok {
+			t.Errorf("remap(%q) returned (%q, %t), should be (%q, %t)", c.topic, res, ok, c.res, c.ok)
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	local, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	b, err := New(Config{
+		Local:         Endpoint{Address: local.Addr(), Options: client.Options{ClientID: "bridge"}},
+		Remote:        Endpoint{Address: remote.Addr(), Options: client.Options{ClientID: "bridge"}},
+		Topics:        []Topic{{Pattern: "data/#", Direction: Both, Qos: 1, RemotePrefix: "edge/"}},
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New returned error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	got := make(chan *packets.PublishPacket, 10)
+	sub, err := client.Dial("tcp", remote.Addr(), client.Options{
+		ClientID:     "sub",
+		CleanSession: true,
+		OnMessage: func(c *client.Client, pk *packets.PublishPacket) {
+			got <- pk
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if _, err = sub.Subscribe(ctx, []string{"edge/#"}, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := client.Dial("tcp", local.Addr(), client.Options{ClientID: "pub", CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	// 等待桥接订阅完成后发布, 链路断开后应自动重连
+	deadline := time.After(5 * time.Second)
+	for round := 0; round < 2; round++ {
+		for {
+			pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+			pk.Qos = 1
+			pk.TopicName = "data/temp"
+			pk.Payload = []byte("21")
+			if err = pub.Publish(ctx, pk); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case pk = <-got:
+			case <-time.After(50 * time.Millisecond):
+				continue
+			case <-deadline:
+				t.Fatalf("message was not bridged in round %d", round)
+			}
+			if pk.TopicName != "edge/data/temp" || string(pk.Payload) != "21" || pk.Qos != 1 {
+				t.Errorf("bridged message is %s", pk)
+			}
+			break
+		}
+		if round == 0 {
+			remote.DropClients()
+			sub, err = client.Dial("tcp", remote.Addr(), client.Options{
+				ClientID:     "sub",
+				CleanSession: true,
+				OnMessage: func(c *client.Client, pk *packets.PublishPacket) {
+					got <- pk
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			if _, err = sub.Subscribe(ctx, []string{"edge/#"}, []byte{1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 双向桥接依靠桥接标志避免回环
+	for _, cp := range remote.Connects() {
+		if cp.ClientIdentifier == "bridge" && (cp.CleanSession || cp.ProtocolLevel != 4|packets.BridgeFlag) {
+			t.Errorf("bridge connected with %s", cp)
+		}
+	}
+}
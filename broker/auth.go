@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/packets"
+)
+
+// Auth 用户名密码认证钩子, 可并发使用
+// 密码为明文, 或 sha256:{十六进制摘要}
+type Auth struct {
+	hooks.Base
+
+	mu        sync.RWMutex
+	anonymous bool
+	users     map[string]string
+}
+
+// NewAuth 新建认证钩子, anonymous 表示是否允许不带用户名的连接
+func NewAuth(anonymous bool, users map[string]string) *Auth {
+	a := &Auth{}
+	a.Set(anonymous, users)
+	return a
+}
+
+// ID ...
+func (a *Auth) ID() string { return "auth" }
+
+// Set 替换用户表, 用于重新加载配置
+func (a *Auth) Set(anonymous bool, users map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.anonymous = anonymous
+	a.users = users
+}
+
+// OnConnect 验证用户名和密码
+func (a *Auth) OnConnect(pk *packets.ConnectPacket) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !pk.UsernameFlag {
+		if a.anonymous {
+			return nil
+		}
+		return hooks.ReturnCode(packets.ErrRefusedNotAuthorised)
+	}
+	expected, ok := a.users[pk.Username]
+	if !ok || !checkPassword(expected, pk.Password) {
+		return hooks.ReturnCode(packets.ErrRefusedBadUsernameOrPassword)
+	}
+	return nil
+}
+
+// ReadPasswordFile 读取密码文件, 每行为 用户名:密码, #开头的行为注释
+func ReadPasswordFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, line)
+		}
+		users[text[:i]] = text[i+1:]
+	}
+	return users, scanner.Err()
+}
+
+// checkPassword 比较密码
+func checkPassword(expected string, password []byte) bool {
+	if strings.HasPrefix(expected, "sha256:") {
+		sum := sha256.Sum256(password)
+		return subtle.ConstantTimeCompare([]byte(expected[7:]), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), password) == 1
+}
+
+// 访问权限
+const (
+	accessRead  = 1
+	accessWrite = 2
+)
+
+// aclRule 一条访问控制规则
+type aclRule struct {
+	filter  string
+	access  int
+	pattern bool // 过滤器中的 %c 和 %u 替换为客户端标识符和用户名
+}
+
+// ACL 主题访问控制钩子, 规则格式与mosquitto的acl_file相同, 可并发使用
+//
+//	topic [read|write|readwrite] <filter>    在任何user行之前时对所有客户端生效
+//	user <username>                          之后的topic行只对该用户生效
+//	pattern [read|write|readwrite] <filter>  对所有客户端生效, 支持 %c 和 %u
+//
+// 与mosquitto相同, 客户端标识符或用户名为空或含有 +, # 或 / 时, 使用它的pattern行不生效,
+// 否则替换后会成为通配符或跨越主题层级
+//
+// 与mosquitto不同, user行之前的topic行对带用户名的客户端也生效, mosquitto中只对匿名客户端生效;
+// 只允许匿名客户端访问的主题不能写在user行之前
+//
+// 用户名在会话注册表接受连接后按最终的客户端标识符记录, 被拒绝的连接不会改变已有客户端的权限
+// 服务端的可信连接(TrustedPipe)不受限制
+type ACL struct {
+	hooks.Base
+
+	mu       sync.RWMutex
+	general  []aclRule
+	users    map[string][]aclRule
+	patterns []aclRule
+	clients  map[string]aclClient // 客户端标识符 -> 用户名
+}
+
+// aclClient 已连接客户端的身份
+type aclClient struct {
+	username string
+	trusted  bool
+}
+
+// NewACL 新建访问控制钩子
+func NewACL() *ACL {
+	return &ACL{
+		users:   make(map[string][]aclRule),
+		clients: make(map[string]aclClient),
+	}
+}
+
+// ID ...
+func (a *ACL) ID() string { return "acl" }
+
+// Load 解析规则并替换现有规则, 用于重新加载配置
+// name 用于错误信息
+func (a *ACL) Load(name string, r io.Reader) error {
+	var general, patterns []aclRule
+	users := make(map[string][]aclRule)
+	var user *string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "user":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expected user <username>", name, line)
+			}
+			username := fields[1]
+			user = &username
+		case "topic", "pattern":
+			rule, err := parseRule(fields)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+			switch {
+			case fields[0] == "pattern":
+				rule.pattern = true
+				patterns = append(patterns, rule)
+			case user != nil:
+				users[*user] = append(users[*user], rule)
+			default:
+				general = append(general, rule)
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown directive %q", name, line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.general, a.users, a.patterns = general, users, patterns
+	return nil
+}
+
+// OnSessionStart 记录客户端的用户名
+func (a *ACL) OnSessionStart(clientID string, pk *packets.ConnectPacket, trusted bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clients[clientID] = aclClient{username: pk.Username, trusted: trusted}
+}
+
+// OnSessionEnd 清理会话结束时清除客户端的用户名
+func (a *ACL) OnSessionEnd(clientID string) {
+	a.OnSessionExpired(clientID)
+}
+
+// OnSubscribe 没有读权限的主题返回订阅失败
+func (a *ACL) OnSubscribe(clientID string, pk *packets.SubscribePacket) error {
+	for i, topic := range pk.Topics {
+		if _, filter, ok := packets.ParseSharedFilter(topic); ok {
+			topic = filter
+		}
+		if i < len(pk.Qoss) && !a.allowed(clientID, topic, accessRead) {
+			pk.Qoss[i] = 0x80
+		}
+	}
+	return nil
+}
+
+// OnPublish 丢弃没有写权限的消息
+func (a *ACL) OnPublish(clientID string, pk *packets.PublishPacket) (*packets.PublishPacket, error) {
+	if clientID != "" && !a.allowed(clientID, pk.TopicName, accessWrite) {
+		return nil, nil
+	}
+	return pk, nil
+}
+
+// OnDeliver 不投递没有读权限的消息
+func (a *ACL) OnDeliver(clientID string, pk *packets.PublishPacket) *packets.PublishPacket {
+	if !a.allowed(clientID, pk.TopicName, accessRead) {
+		return nil
+	}
+	return pk
+}
+
+// OnSessionExpired 清除客户端的用户名
+func (a *ACL) OnSessionExpired(clientID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.clients, clientID)
+}
+
+// allowed 检查客户端对主题的访问权限
+// 订阅时topic为过滤器, 要求过滤器被规则完全覆盖
+func (a *ACL) allowed(clientID string, topic string, access int) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	cl := a.clients[clientID]
+	if cl.trusted {
+		return true
+	}
+	username := cl.username
+	check := func(rules []aclRule) bool {
+		for _, r := range rules {
+			if r.access&access == 0 {
+				continue
+			}
+			filter := r.filter
+			if r.pattern {
+				if strings.Contains(filter, "%c") && !literalLevel(clientID) ||
+					strings.Contains(filter, "%u") && !literalLevel(username) {
+					continue
+				}
+				filter = strings.NewReplacer("%c", clientID, "%u", username).Replace(filter)
+			}
+			if filter == topic || packets.MatchTopic(filter, topic) {
+				return true
+			}
+		}
+		return false
+	}
+	if check(a.general) || check(a.patterns) {
+		return true
+	}
+	return username != "" && check(a.users[username])
+}
+
+// literalLevel 能否原样替换到主题过滤器中, 不为空且不含通配符和层级分隔符
+func literalLevel(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "+#/")
+}
+
+// parseRule 解析 topic/pattern 行
+func parseRule(fields []string) (aclRule, error) {
+	rule := aclRule{access: accessRead | accessWrite}
+	switch len(fields) {
+	case 2:
+		rule.filter = fields[1]
+	case 3:
+		switch fields[1] {
+		case "read":
+			rule.access = accessRead
+		case "write":
+			rule.access = accessWrite
+		case "readwrite":
+		default:
+			return rule, fmt.Errorf("unknown access %q, expected read, write or readwrite", fields[1])
+		}
+		rule.filter = fields[2]
+	default:
+		return rule, fmt.Errorf("expected %s [read|write|readwrite] <filter>", fields[0])
+	}
+	if !packets.ValidTopicFilter(strings.NewReplacer("%c", "c", "%u", "u").Replace(rule.filter)) {
+		return rule, fmt.Errorf("invalid topic filter %q", rule.filter)
+	}
+	return rule, nil
+}
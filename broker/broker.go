@@ -0,0 +1,477 @@
+// Package broker MQTT 3.1.1服务端
+// 把会话注册表, 钩子, 统计, 限流和持久化组合成一个可以监听网络连接的代理
+package broker
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxungo/mqtt/cluster"
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/ratelimit"
+	"github.com/boxungo/mqtt/session"
+	"github.com/boxungo/mqtt/stats"
+	"github.com/boxungo/mqtt/store"
+)
+
+// DefaultMaxInflight 默认的每个客户端出站飞行窗口大小
+const DefaultMaxInflight = 20
+
+// ConnectTimeout 建立连接后等待CONNECT报文的时间
+const ConnectTimeout = 10 * time.Second
+
+// ErrClosed 服务端已关闭
+var ErrClosed = errors.New("broker closed")
+
+// Options 服务端选项
+type Options struct {
+	Policy         session.Policy      // 客户端标识符重复时的处理策略
+	NewID          session.IDGenerator // 为空客户端标识符生成标识符
+	WillOnTakeover bool                // 被接管的连接是否发布遗嘱
+	Limits         session.Limits      // 持久会话离线队列的限制
+	SessionExpiry  time.Duration       // 持久会话断开后保留的时间, 0表示永久保留
+	MaxInflight    int                 // 每个客户端出站飞行窗口大小, 为0时使用 DefaultMaxInflight
+	SharedStrategy SharedStrategy      // 共享订阅在组内选择成员的策略
+
+	// 每个连接的写协程把排队的报文合并成一次写入
+	WriteBuffer  int           // 一次写入的字节数, 排队的报文达到该值时立即写出, 为0时使用 DefaultWriteBuffer
+	WriteDelay   time.Duration // 排队的PUBLISH不足 WriteBuffer 时等待更多报文的时间, 为0时不等待
+	WriteTimeout time.Duration // 写超时, 超时后关闭连接, 为0时使用 DefaultWriteTimeout, 小于0时不设置
+	WriteQueue   int           // 排队的PUBLISH字节数上限, 超过后QoS 0消息丢弃, QoS 1和2放入离线队列, 为0时使用 DefaultWriteQueue
+
+	Hooks       *hooks.Hooks       // 为nil时不调用钩子
+	Stats       *stats.Stats       // 为nil时新建
+	Limiter     *ratelimit.Limiter // 为nil时不限流
+	Store       *store.Store       // 为nil时不持久化
+	SysInterval time.Duration      // $SYS主题的发布间隔, 为0时不发布
+	Cluster     *cluster.Node      // 集群节点, 为nil时单机运行; 节点的回调由服务端设置, 节点的连接和关闭由调用方管理
+	Logger      *log.Logger        // 为nil时不输出日志
+}
+
+// Broker MQTT服务端
+type Broker struct {
+	opts     Options
+	registry *session.Registry
+	hooks    *hooks.Hooks
+	stats    *stats.Stats
+
+	mu        sync.Mutex
+	sessions  map[string]*session.Session // 客户端标识符 -> 会话, 会话的订阅受mu保护
+	conns     map[string]*conn            // 客户端标识符 -> 在线连接
+	retained  map[string]*packets.PublishPacket
+	shared    map[string]uint64 // 共享订阅的轮询计数
+	listeners map[net.Listener]bool
+	closed    bool
+
+	retainMu sync.Mutex // 保证保留消息按同样的顺序更新内存和持久化存储
+
+	sharedMu  sync.Mutex
+	sharedOut map[*packets.PublishPacket]string // 通过共享订阅投递, 还未完成的消息 -> 共享订阅过滤器
+
+	inflight atomic.Int64
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New 新建服务端, 配置了 Store 时恢复持久化的会话和保留消息
+func New(opts Options) *Broker {
+	if opts.MaxInflight <= 0 {
+		opts.MaxInflight = DefaultMaxInflight
+	}
+	if opts.WriteBuffer <= 0 {
+		opts.WriteBuffer = DefaultWriteBuffer
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = DefaultWriteTimeout
+	}
+	if opts.WriteQueue <= 0 {
+		opts.WriteQueue = DefaultWriteQueue
+	}
+	if opts.Hooks == nil {
+		opts.Hooks = &hooks.Hooks{}
+	}
+	if opts.Stats == nil {
+		opts.Stats = stats.New()
+	}
+	b := &Broker{
+		opts:      opts,
+		hooks:     opts.Hooks,
+		stats:     opts.Stats,
+		sessions:  make(map[string]*session.Session),
+		conns:     make(map[string]*conn),
+		retained:  make(map[string]*packets.PublishPacket),
+		shared:    make(map[string]uint64),
+		sharedOut: make(map[*packets.PublishPacket]string),
+		listeners: make(map[net.Listener]bool),
+		stop:      make(chan struct{}),
+	}
+	b.registry = &session.Registry{
+		Policy:         opts.Policy,
+		NewID:          opts.NewID,
+		Limits:         opts.Limits,
+		SessionExpiry:  opts.SessionExpiry,
+		WillOnTakeover: opts.WillOnTakeover,
+		// 注册表持有锁时调用, 在新协程中发布避免锁的嵌套
+		OnWill: func(s *session.Session, will *packets.PublishPacket) {
+			clientID := s.ClientID
+			go func() {
+				if will = b.hooks.OnWill(clientID, will); will != nil {
+					b.Publish(will)
+				}
+			}()
+		},
+		OnDrop: func(s *session.Session, pk *packets.PublishPacket) {
+			b.stats.Dropped()
+			b.untrack(s, pk)
+		},
+	}
+	b.restore()
+	b.joinCluster()
+
+	if opts.SessionExpiry > 0 || opts.Limits.MessageExpiry > 0 {
+		b.wg.Add(1)
+		go b.expireLoop()
+	}
+	if opts.SysInterval > 0 {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.stats.Publish(b.stop, opts.SysInterval, func(pk *packets.PublishPacket) {
+				b.route(pk, time.Now(), "", "", nil)
+			})
+		}()
+	}
+	return b
+}
+
+// Stats 统计信息
+func (b *Broker) Stats() *stats.Stats {
+	return b.stats
+}
+
+// Serve 接受监听上的连接, 直到监听或服务端关闭
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.listeners[l] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.listeners, l)
+		b.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go b.ServeConn(nc)
+	}
+}
+
+// ServeConn 处理一个已建立的连接, 直到连接断开
+func (b *Broker) ServeConn(nc net.Conn) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		nc.Close()
+		return
+	}
+	b.wg.Add(1)
+	b.mu.Unlock()
+	defer b.wg.Done()
+	newConn(b, nc).serve()
+}
+
+// serveTrusted 处理一个可信连接
+func (b *Broker) serveTrusted(nc net.Conn) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		nc.Close()
+		return
+	}
+	b.wg.Add(1)
+	b.mu.Unlock()
+	defer b.wg.Done()
+	c := newConn(b, nc)
+	c.trusted = true
+	c.serve()
+}
+
+// Pipe 返回一个进程内连接, 另一端由服务端处理, 用于嵌入的客户端和桥接
+// 连接两个方向各有缓冲, 与TCP连接一样写入不需要等待对端读取
+func (b *Broker) Pipe() net.Conn {
+	client, server := newPipe()
+	go b.ServeConn(server)
+	return client
+}
+
+// TrustedPipe 与 Pipe 相同, 但连接不经过 OnConnect 认证,
+// 实现了 hooks.SessionHook 的钩子在会话开始时得到 trusted 为true, 如 ACL 不限制可信连接的访问
+// 用于服务端自身的桥接等不需要凭据的进程内客户端
+func (b *Broker) TrustedPipe() net.Conn {
+	client, server := newPipe()
+	go b.serveTrusted(server)
+	return client
+}
+
+// Publish 以服务端身份发布消息, 经过钩子后路由给订阅者
+func (b *Broker) Publish(pk *packets.PublishPacket) {
+	pk, err := b.hooks.OnPublish("", pk)
+	if err != nil {
+		return
+	}
+	b.route(pk, time.Now(), "", "", b.forward(pk))
+}
+
+// Close 关闭所有监听和连接, 等待连接处理结束
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.closed = true
+	close(b.stop)
+	for l := range b.listeners {
+		l.Close()
+	}
+	for _, c := range b.conns {
+		c.shutdown()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+// route 把消息投递给匹配的订阅者, from 为发布者的客户端标识符, except 不为空时不投递给该客户端
+// groups 不为nil时只投递其中的共享订阅, 其他共享订阅由集群中的其他节点投递
+// 共享订阅与普通订阅分别投递: 同时有匹配的普通订阅和共享订阅的成员各收到一份
+// 匹配时在 mu 下遍历所有会话的全部订阅, 耗时与会话数×订阅数成正比, 期间其他连接的发布和订阅都要等待
+func (b *Broker) route(pk *packets.PublishPacket, received time.Time, from string, except string, groups map[string]bool) {
+	if pk.Retain {
+		b.retain(pk)
+	}
+	b.mu.Lock()
+	targets := make(map[string]*target)
+	members := make(map[string][]*target) // 共享订阅 -> 组内匹配的成员
+	for id, s := range b.sessions {
+		if id == except {
+			continue
+		}
+		for filter, qos := range s.Subscriptions {
+			if !packets.MatchTopic(filter, pk.TopicName) {
+				continue
+			}
+			if _, _, ok := packets.ParseSharedFilter(filter); ok {
+				if groups == nil || groups[filter] {
+					members[filter] = append(members[filter], &target{s: s, qos: qos})
+				}
+				continue
+			}
+			if t, ok := targets[id]; !ok || qos > t.qos {
+				targets[id] = &target{s: s, qos: qos}
+			}
+		}
+	}
+	picked := make(map[string]*target) // 共享订阅 -> 选中的成员
+	for filter, group := range members {
+		picked[filter] = b.pick(filter, group, pk, from)
+	}
+	b.mu.Unlock()
+
+	for _, t := range targets {
+		b.deliver(t.s, pk, t.qos, false, received, "")
+	}
+	for filter, t := range picked {
+		b.deliver(t.s, pk, t.qos, false, received, filter)
+	}
+}
+
+// deliver 按订阅的QoS投递消息给一个会话
+// shared 不为空时消息通过该共享订阅投递, 会话离开共享订阅组时转给组内的其他成员
+func (b *Broker) deliver(s *session.Session, pk *packets.PublishPacket, qos byte, retained bool, received time.Time, shared string) {
+	out := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	out.TopicName = pk.TopicName
+	out.Payload = pk.Payload
+	out.Retain = retained
+	out.Qos = pk.Qos
+	if qos < out.Qos {
+		out.Qos = qos
+	}
+	if out = b.hooks.OnDeliver(s.ClientID, out); out == nil {
+		return
+	}
+
+	b.mu.Lock()
+	c := b.conns[s.ClientID]
+	if c != nil && c.session != s {
+		c = nil
+	}
+	b.mu.Unlock()
+	if c == nil && (out.Qos == 0 || s.CleanSession) {
+		return
+	}
+	if out.Qos > 0 && !b.track(s, out, shared) {
+		return
+	}
+	if c != nil {
+		c.send(out, received)
+		return
+	}
+	s.Queue.Push(out, time.Now())
+}
+
+// track 为进入会话的QoS 1或QoS 2消息分配报文标识符并持久化, 标识符用完时丢弃消息
+func (b *Broker) track(s *session.Session, pk *packets.PublishPacket, shared string) bool {
+	id, ok := s.AllocateID()
+	if !ok {
+		b.stats.Dropped()
+		return false
+	}
+	pk.PacketID = id
+	if shared != "" {
+		b.sharedMu.Lock()
+		b.sharedOut[pk] = shared
+		b.sharedMu.Unlock()
+	}
+	if b.opts.Store != nil && !s.CleanSession {
+		if err := b.opts.Store.Enqueue(s.ClientID, pk); err != nil {
+			b.logf("persist message for %s: %v", s.ClientID, err)
+		}
+	}
+	return true
+}
+
+// untrack 消息投递完成或被丢弃, 释放报文标识符并从持久化存储中删除
+func (b *Broker) untrack(s *session.Session, pk *packets.PublishPacket) {
+	s.FreeID(pk.PacketID)
+	b.sharedMu.Lock()
+	delete(b.sharedOut, pk)
+	b.sharedMu.Unlock()
+	if b.opts.Store != nil && !s.CleanSession {
+		if err := b.opts.Store.Ack(s.ClientID, pk.PacketID); err != nil {
+			b.logf("persist ack for %s: %v", s.ClientID, err)
+		}
+	}
+}
+
+// retain 保存或删除保留消息, 持久化存储的写入不持有 mu
+func (b *Broker) retain(pk *packets.PublishPacket) {
+	b.retainMu.Lock()
+	defer b.retainMu.Unlock()
+	b.mu.Lock()
+	if len(pk.Payload) == 0 {
+		delete(b.retained, pk.TopicName)
+	} else {
+		copied := *pk
+		b.retained[pk.TopicName] = &copied
+	}
+	b.stats.SetRetained(int64(len(b.retained)))
+	b.mu.Unlock()
+	if b.opts.Store != nil {
+		if err := b.opts.Store.Retain(pk); err != nil {
+			b.logf("persist retained message %s: %v", pk.TopicName, err)
+		}
+	}
+}
+
+// subscriptions 订阅总数, 调用者需持有锁
+func (b *Broker) subscriptions() int64 {
+	var n int64
+	for _, s := range b.sessions {
+		n += int64(len(s.Subscriptions))
+	}
+	return n
+}
+
+// restore 从持久化存储恢复会话, 未完成投递的消息和保留消息
+func (b *Broker) restore() {
+	if b.opts.Store == nil {
+		return
+	}
+	st := b.opts.Store.State()
+	now := time.Now()
+	for id, ss := range st.Sessions {
+		if ss.CleanSession {
+			b.opts.Store.DeleteSession(id)
+			continue
+		}
+		s := b.registry.Restore(id, ss.Subscriptions)
+		for _, m := range ss.Messages() {
+			s.ReserveID(m.Packet.PacketID)
+			if m.Released {
+				s.Release(m.Packet.PacketID)
+			}
+			s.Queue.Push(m.Packet, now)
+		}
+		for pid := range ss.Received {
+			s.Receive(pid)
+		}
+		b.sessions[id] = s
+		b.stats.SessionRestored()
+	}
+	for topic, pk := range st.Retained {
+		b.retained[topic] = pk
+	}
+	b.stats.SetRetained(int64(len(b.retained)))
+	b.stats.SetSubscriptions(b.subscriptions())
+}
+
+// expireLoop 周期性清除过期的会话和消息
+func (b *Broker) expireLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-ticker.C:
+			for _, s := range b.registry.Expire(now) {
+				var removed []string
+				b.mu.Lock()
+				if b.sessions[s.ClientID] == s {
+					delete(b.sessions, s.ClientID)
+					removed = filters(s)
+				}
+				b.stats.SetSubscriptions(b.subscriptions())
+				b.mu.Unlock()
+				b.clusterUnsubscribe(removed)
+				if b.opts.Store != nil {
+					b.opts.Store.DeleteSession(s.ClientID)
+				}
+				b.stats.SessionRemoved()
+				b.hooks.OnSessionExpired(s.ClientID)
+			}
+		}
+	}
+}
+
+// logf 输出日志
+func (b *Broker) logf(format string, args ...interface{}) {
+	if b.opts.Logger != nil {
+		b.opts.Logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,897 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/cluster"
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/ratelimit"
+	"github.com/boxungo/mqtt/session"
+	"github.com/boxungo/mqtt/store"
+)
+
+// start 启动监听在随机端口上的服务端
+func start(t *testing.T, opts Options) (*Broker, string) {
+	b := New(opts)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(l)
+	t.Cleanup(func() { b.Close() })
+	return b, l.Addr().String()
+}
+
+// dial 连接服务端, 收到的消息放入返回的通道
+func dial(t *testing.T, addr string, opts client.Options) (*client.Client, chan *packets.PublishPacket) {
+	got := make(chan *packets.PublishPacket, 100)
+	opts.OnMessage = func(c *client.Client, pk *packets.PublishPacket) { got <- pk }
+	c, err := client.Dial("tcp", addr, opts)
+	if err != nil {
+		t.Fatalf("Dial returned error: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, got
+}
+
+// message 新建PUBLISH报文
+func message(topic string, qos byte, retain bool, payload string) *packets.PublishPacket {
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName = topic
+	pk.Qos = qos
+	pk.Retain = retain
+	pk.Payload = []byte(payload)
+	return pk
+}
+
+// expect 等待收到消息
+func expect(t *testing.T, got chan *packets.PublishPacket, topic string, payload string) *packets.PublishPacket {
+	t.Helper()
+	select {
+	case pk := <-got:
+		if pk.TopicName != topic || string(pk.Payload) != payload {
+			t.Fatalf("received %s %q, should be %s %q", pk.TopicName, pk.Payload, topic, payload)
+		}
+		return pk
+	case <-time.After(2 * time.Second):
+		t.Fatalf("did not receive %s %q", topic, payload)
+	}
+	return nil
+}
+
+// nothing 确认没有收到消息
+func nothing(t *testing.T, got chan *packets.PublishPacket) {
+	t.Helper()
+	select {
+	case pk := <-got:
+		t.Fatalf("unexpected message %s %q", pk.TopicName, pk.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// raw 不经过客户端以持久会话连接服务端, 返回连接和读取下一个报文的函数
+func raw(t *testing.T, addr string, clientID string) (net.Conn, func() packets.ControlPacket) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	cp := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolLevel = 4
+	cp.ClientIdentifier = clientID
+	cp.Write(nc)
+	next := func() packets.ControlPacket {
+		t.Helper()
+		nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		pk, err := packets.ReadPacket(nc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pk
+	}
+	if _, ok := next().(*packets.ConnackPacket); !ok {
+		t.Fatal("expected CONNACK")
+	}
+	return nc, next
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	_, addr := start(t, Options{})
+	ctx := context.Background()
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	if err := pub.Publish(ctx, message("status/dev1", 1, true, "online")); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, got := dial(t, addr, client.Options{ClientID: "sub", CleanSession: true})
+	codes, err := sub.Subscribe(ctx, []string{"status/+", "data/#", "bad/#/x"}, []byte{1, 2, 0})
+	if err != nil || string(codes) != "\x01\x02\x80" {
+		t.Fatalf("Subscribe returned (%v, %v)", codes, err)
+	}
+	if pk := expect(t, got, "status/dev1", "online"); !pk.Retain || pk.Qos != 1 {
+		t.Errorf("retained message delivered as %s", pk)
+	}
+	for qos := byte(0); qos <= 2; qos++ {
+		if err = pub.Publish(ctx, message("data/x", qos, false, "v")); err != nil {
+			t.Fatal(err)
+		}
+		if pk := expect(t, got, "data/x", "v"); pk.Qos != qos || pk.Retain {
+			t.Errorf("message delivered as %s, should be QoS %d", pk, qos)
+		}
+	}
+	pub.Publish(ctx, message("status/dev1", 2, false, "busy"))
+	if pk := expect(t, got, "status/dev1", "busy"); pk.Qos != 1 {
+		t.Errorf("QoS was not downgraded to the subscription: %s", pk)
+	}
+	sub.Unsubscribe(ctx, "data/#")
+	pub.Publish(ctx, message("data/x", 1, false, "v"))
+	nothing(t, got)
+}
+
+func TestRateLimitPublishOnly(t *testing.T) {
+	limiter := &ratelimit.Limiter{Client: ratelimit.Rule{PacketsPerSecond: 0.1, Action: ratelimit.Drop}}
+	_, addr := start(t, Options{Limiter: limiter})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, got := dial(t, addr, client.Options{ClientID: "sub", CleanSession: true})
+	sub.Subscribe(ctx, []string{"a"}, []byte{1})
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	// 第一个PUBLISH用完令牌, 之后的订阅和心跳不受限流影响
+	if err := pub.Publish(ctx, message("a", 1, false, "first")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, got, "a", "first")
+	if _, err := pub.Subscribe(ctx, []string{"x"}, []byte{0}); err != nil {
+		t.Fatalf("SUBSCRIBE over the limit: %v", err)
+	}
+	// 被丢弃的QoS 1和2消息仍然确认, 不会阻塞客户端
+	for qos := byte(1); qos <= 2; qos++ {
+		if err := pub.Publish(ctx, message("a", qos, false, "dropped")); err != nil {
+			t.Fatalf("QoS %d PUBLISH over the limit: %v", qos, err)
+		}
+	}
+	nothing(t, got)
+}
+
+func TestWillAndTakeover(t *testing.T) {
+	_, addr := start(t, Options{})
+	ctx := context.Background()
+	watcher, got := dial(t, addr, client.Options{ClientID: "watcher", CleanSession: true})
+	watcher.Subscribe(ctx, []string{"will/#"}, []byte{0})
+
+	dev, _ := dial(t, addr, client.Options{ClientID: "dev", CleanSession: true, WillTopic: "will/dev", WillMessage: []byte("gone")})
+	dev2, _ := dial(t, addr, client.Options{ClientID: "dev", CleanSession: true, WillTopic: "will/dev", WillMessage: []byte("gone2")})
+	select {
+	case <-dev.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("first connection was not closed on takeover")
+	}
+	nothing(t, got)
+
+	dev2.Close()
+	expect(t, got, "will/dev", "gone2")
+
+	dev3, _ := dial(t, addr, client.Options{ClientID: "dev3", CleanSession: true, WillTopic: "will/dev3", WillMessage: []byte("x")})
+	dev3.Disconnect()
+	nothing(t, got)
+}
+
+func TestPersistentSession(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.Open(store.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, addr := start(t, Options{Store: st})
+	ctx := context.Background()
+
+	sub, _ := dial(t, addr, client.Options{ClientID: "sub"})
+	sub.Subscribe(ctx, []string{"q/#"}, []byte{1})
+	sub.Disconnect()
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	pub.Publish(ctx, message("q/1", 1, false, "one"))
+	pub.Publish(ctx, message("q/0", 0, false, "zero"))
+	pub.Publish(ctx, message("q/2", 2, true, "two"))
+
+	sub, got := dial(t, addr, client.Options{ClientID: "sub"})
+	if !sub.SessionPresent() {
+		t.Errorf("SessionPresent should be true")
+	}
+	expect(t, got, "q/1", "one")
+	expect(t, got, "q/2", "two")
+	nothing(t, got)
+	sub.Disconnect()
+
+	// 重启后恢复订阅和保留消息
+	b.Close()
+	st.Close()
+	st, err = store.Open(store.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	_, addr = start(t, Options{Store: st})
+	sub, got = dial(t, addr, client.Options{ClientID: "sub"})
+	if !sub.SessionPresent() {
+		t.Errorf("SessionPresent should be true after restart")
+	}
+	pub, _ = dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	pub.Publish(ctx, message("q/3", 1, false, "three"))
+	expect(t, got, "q/3", "three")
+	other, got2 := dial(t, addr, client.Options{ClientID: "other", CleanSession: true})
+	other.Subscribe(ctx, []string{"q/2"}, []byte{0})
+	expect(t, got2, "q/2", "two")
+}
+
+func TestManualAck(t *testing.T) {
+	_, addr := start(t, Options{})
+	ctx := context.Background()
+	sub, _ := dial(t, addr, client.Options{ClientID: "sub"})
+	sub.Subscribe(ctx, []string{"q/#"}, []byte{2})
+	sub.Disconnect()
+
+	// 未确认的消息在重连后重发
+	sub, got := dial(t, addr, client.Options{ClientID: "sub", ManualAck: true})
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	pub.Publish(ctx, message("q/1", 1, false, "one"))
+	pub.Publish(ctx, message("q/2", 2, false, "two"))
+	expect(t, got, "q/1", "one")
+	expect(t, got, "q/2", "two")
+	sub.Close()
+	sub, got = dial(t, addr, client.Options{ClientID: "sub", ManualAck: true})
+	one := expect(t, got, "q/1", "one")
+	two := expect(t, got, "q/2", "two")
+	if !one.Dup || !two.Dup {
+		t.Errorf("redelivered messages should have DUP set")
+	}
+
+	// 确认后不再重发
+	if err := sub.Ack(one); err != nil {
+		t.Errorf("Ack returned error: %s", err)
+	}
+	if err := sub.Ack(two); err != nil {
+		t.Errorf("Ack returned error: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sub.Close()
+	_, got = dial(t, addr, client.Options{ClientID: "sub"})
+	nothing(t, got)
+}
+
+func TestResumeRelease(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.Open(store.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, addr := start(t, Options{Store: st})
+	ctx := context.Background()
+	sub, _ := dial(t, addr, client.Options{ClientID: "sub"})
+	sub.Subscribe(ctx, []string{"q"}, []byte{2})
+	sub.Disconnect()
+
+	nc, next := raw(t, addr, "sub")
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	pub.Publish(ctx, message("q", 2, false, "once"))
+	p, ok := next().(*packets.PublishPacket)
+	if !ok {
+		t.Fatal("expected PUBLISH")
+	}
+	rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+	rec.PacketID = p.PacketID
+	rec.Write(nc)
+	if rel, ok := next().(*packets.PubrelPacket); !ok || rel.PacketID != p.PacketID {
+		t.Fatalf("expected PUBREL %d", p.PacketID)
+	}
+	nc.Close()
+
+	// 已收到PUBREC的消息在重连和重启后重发PUBREL而不是PUBLISH
+	nc, next = raw(t, addr, "sub")
+	if rel, ok := next().(*packets.PubrelPacket); !ok || rel.PacketID != p.PacketID {
+		t.Fatalf("expected PUBREL %d after reconnect", p.PacketID)
+	}
+	nc.Close()
+	b.Close()
+	st.Close()
+	st, err = store.Open(store.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	_, addr = start(t, Options{Store: st})
+	nc, next = raw(t, addr, "sub")
+	if rel, ok := next().(*packets.PubrelPacket); !ok || rel.PacketID != p.PacketID {
+		t.Fatalf("expected PUBREL %d after restart", p.PacketID)
+	}
+	comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+	comp.PacketID = p.PacketID
+	comp.Write(nc)
+	time.Sleep(50 * time.Millisecond)
+	nc.Close()
+	_, got := dial(t, addr, client.Options{ClientID: "sub"})
+	nothing(t, got)
+}
+
+func TestResumeReceived(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.Open(store.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, addr := start(t, Options{Store: st})
+	ctx := context.Background()
+	sub, got := dial(t, addr, client.Options{ClientID: "sub", CleanSession: true})
+	sub.Subscribe(ctx, []string{"q"}, []byte{2})
+
+	// publish 发送QoS 2消息并等待PUBREC
+	publish := func(nc net.Conn, next func() packets.ControlPacket, dup bool) {
+		t.Helper()
+		pk := message("q", 2, false, "once")
+		pk.PacketID = 7
+		pk.Dup = dup
+		pk.Write(nc)
+		if rec, ok := next().(*packets.PubrecPacket); !ok || rec.PacketID != 7 {
+			t.Fatal("expected PUBREC 7")
+		}
+	}
+	nc, next := raw(t, addr, "pub")
+	publish(nc, next, false)
+	expect(t, got, "q", "once")
+	nc.Close()
+
+	// 收到PUBREL之前重连重发的消息不再投递, 重启后也能识别
+	nc, next = raw(t, addr, "pub")
+	publish(nc, next, true)
+	nothing(t, got)
+	nc.Close()
+	b.Close()
+	st.Close()
+	st, err = store.Open(store.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	_, addr = start(t, Options{Store: st})
+	sub, got = dial(t, addr, client.Options{ClientID: "sub", CleanSession: true})
+	sub.Subscribe(ctx, []string{"q"}, []byte{2})
+	nc, next = raw(t, addr, "pub")
+	publish(nc, next, true)
+	nothing(t, got)
+
+	// PUBREL之后同一标识符是新消息
+	rel := packets.NewControlPacket(packets.PUBREL).(*packets.PubrelPacket)
+	rel.PacketID = 7
+	rel.Write(nc)
+	if _, ok := next().(*packets.PubcompPacket); !ok {
+		t.Fatal("expected PUBCOMP")
+	}
+	publish(nc, next, false)
+	expect(t, got, "q", "once")
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	_, addr := start(t, Options{MaxInflight: 3})
+	ctx := context.Background()
+	sub, _ := dial(t, addr, client.Options{ClientID: "sub"})
+	sub.Subscribe(ctx, []string{"q"}, []byte{1})
+	sub.Disconnect()
+
+	// 飞行窗口中未确认的消息放回离线队列头部, 重连后与队列中的消息保持原来的顺序
+	sub, got := dial(t, addr, client.Options{ClientID: "sub", ManualAck: true})
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	for i := 0; i < 10; i++ {
+		pub.Publish(ctx, message("q", 1, false, fmt.Sprint(i)))
+	}
+	for i := 0; i < 3; i++ {
+		expect(t, got, "q", fmt.Sprint(i))
+	}
+	sub.Close()
+	_, got = dial(t, addr, client.Options{ClientID: "sub"})
+	for i := 0; i < 10; i++ {
+		expect(t, got, "q", fmt.Sprint(i))
+	}
+}
+
+func TestPersistentQueue(t *testing.T) {
+	dir := t.TempDir()
+	restart := func(b *Broker, st *store.Store) (*Broker, *store.Store, string) {
+		if b != nil {
+			b.Close()
+			st.Close()
+		}
+		st, err := store.Open(store.Options{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { st.Close() })
+		b, addr := start(t, Options{Store: st})
+		return b, st, addr
+	}
+	b, st, addr := restart(nil, nil)
+	ctx := context.Background()
+
+	sub, _ := dial(t, addr, client.Options{ClientID: "sub"})
+	sub.Subscribe(ctx, []string{"q/#"}, []byte{2})
+	sub.Disconnect()
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	pub.Publish(ctx, message("q/1", 1, false, "one"))
+	pub.Publish(ctx, message("q/2", 2, false, "two"))
+	pub.Disconnect()
+
+	// 离线队列中的消息在重启后恢复
+	b, st, addr = restart(b, st)
+	sub, got := dial(t, addr, client.Options{ClientID: "sub"})
+	expect(t, got, "q/1", "one")
+	expect(t, got, "q/2", "two")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(st.State().Sessions["sub"].Inflight) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages still stored after delivery", len(st.State().Sessions["sub"].Inflight))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sub.Disconnect()
+
+	// 已确认的消息不再投递
+	_, _, addr = restart(b, st)
+	_, got = dial(t, addr, client.Options{ClientID: "sub"})
+	nothing(t, got)
+}
+
+func TestSharedSubscription(t *testing.T) {
+	_, addr := start(t, Options{})
+	ctx := context.Background()
+	w1, got1 := dial(t, addr, client.Options{ClientID: "w1", CleanSession: true})
+	w2, got2 := dial(t, addr, client.Options{ClientID: "w2", CleanSession: true})
+	w1.Subscribe(ctx, []string{"$share/workers/jobs/+"}, []byte{1})
+	w2.Subscribe(ctx, []string{"$share/workers/jobs/+"}, []byte{1})
+
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	for i := 0; i < 4; i++ {
+		pub.Publish(ctx, message("jobs/a", 1, false, "job"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(got1) != 2 || len(got2) != 2 {
+		t.Errorf("jobs were distributed %d/%d, should be 2/2", len(got1), len(got2))
+	}
+}
+
+func TestSharedStrategy(t *testing.T) {
+	for _, strategy := range []SharedStrategy{StickyClient, HashTopic} {
+		_, addr := start(t, Options{SharedStrategy: strategy})
+		ctx := context.Background()
+		var got []chan *packets.PublishPacket
+		for _, id := range []string{"w1", "w2", "w3"} {
+			w, ch := dial(t, addr, client.Options{ClientID: id, CleanSession: true})
+			w.Subscribe(ctx, []string{"$share/workers/jobs/+"}, []byte{1})
+			got = append(got, ch)
+		}
+		pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+		for i := 0; i < 6; i++ {
+			pub.Publish(ctx, message("jobs/a", 1, false, "job"))
+		}
+		time.Sleep(100 * time.Millisecond)
+		// 同一发布者和同一主题的消息都投递给同一成员
+		var counts []int
+		for _, ch := range got {
+			counts = append(counts, len(ch))
+		}
+		if counts[0]+counts[1]+counts[2] != 6 || (counts[0] != 6 && counts[1] != 6 && counts[2] != 6) {
+			t.Errorf("strategy %d distributed jobs as %v", strategy, counts)
+		}
+	}
+}
+
+func TestSharedRedistribute(t *testing.T) {
+	_, addr := start(t, Options{})
+	ctx := context.Background()
+
+	// w1 收到消息后不确认就断开
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	cp.ProtocolName, cp.ProtocolLevel = "MQTT", 4
+	cp.ClientIdentifier, cp.CleanSession = "w1", true
+	sp := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+	sp.PacketID, sp.Topics, sp.Qoss = 1, []string{"$share/workers/jobs"}, []byte{1}
+	cp.Write(nc)
+	sp.Write(nc)
+	r := bufio.NewReader(nc)
+	for i := 0; i < 2; i++ {
+		if _, err = packets.ReadPacket(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w2, got2 := dial(t, addr, client.Options{ClientID: "w2", CleanSession: true})
+	w2.Subscribe(ctx, []string{"$share/workers/jobs"}, []byte{1})
+
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	pub.Publish(ctx, message("jobs", 1, false, "first"))
+	pub.Publish(ctx, message("jobs", 1, false, "second"))
+	nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if pk, err := packets.ReadPacket(r); err != nil || pk.(*packets.PublishPacket).TopicName != "jobs" {
+		t.Fatalf("w1 received %v, %v", pk, err)
+	}
+	expect(t, got2, "jobs", "second")
+	nc.Close()
+	expect(t, got2, "jobs", "first")
+}
+
+func TestSharedOverlap(t *testing.T) {
+	_, addr := start(t, Options{})
+	ctx := context.Background()
+
+	// w1 同时有普通订阅和共享订阅, 收到两份消息后不确认就断开
+	nc, next := raw(t, addr, "w1")
+	sp := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+	sp.PacketID, sp.Topics, sp.Qoss = 1, []string{"jobs", "$share/workers/jobs"}, []byte{1, 1}
+	sp.Write(nc)
+	if _, ok := next().(*packets.SubackPacket); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	w2, got2 := dial(t, addr, client.Options{ClientID: "w2", CleanSession: true})
+	w2.Subscribe(ctx, []string{"$share/workers/jobs"}, []byte{1})
+
+	pub, _ := dial(t, addr, client.Options{ClientID: "pub", CleanSession: true})
+	pub.Publish(ctx, message("jobs", 1, false, "job"))
+	for i := 0; i < 2; i++ {
+		if pk, ok := next().(*packets.PublishPacket); !ok || string(pk.Payload) != "job" {
+			t.Fatalf("w1 received %v", pk)
+		}
+	}
+	nothing(t, got2)
+
+	// 只有通过共享订阅投递的那一份转给组内的其他成员
+	nc.Close()
+	expect(t, got2, "jobs", "job")
+	nothing(t, got2)
+}
+
+func TestCluster(t *testing.T) {
+	na, nb := cluster.NewNode("a"), cluster.NewNode("b")
+	defer na.Close()
+	defer nb.Close()
+	_, addrA := start(t, Options{Cluster: na})
+	_, addrB := start(t, Options{Cluster: nb})
+	ca, cb := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- nb.Accept(cb) }()
+	if err := na.Join(ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	sub, got := dial(t, addrA, client.Options{ClientID: "sub", CleanSession: true})
+	sub.Subscribe(ctx, []string{"sensors/#"}, []byte{1})
+	pub, _ := dial(t, addrB, client.Options{ClientID: "pub", CleanSession: true})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pub.Publish(ctx, message("sensors/probe", 0, false, "probe"))
+		select {
+		case <-got:
+		case <-time.After(20 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("subscription was not exchanged")
+			}
+			continue
+		}
+		break
+	}
+	pub.Publish(ctx, message("sensors/temp", 1, true, "21"))
+	expect(t, got, "sensors/temp", "21")
+
+	// 保留消息复制到其他节点
+	other, got2 := dial(t, addrA, client.Options{ClientID: "other", CleanSession: true})
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		other.Subscribe(ctx, []string{"sensors/temp"}, []byte{0})
+		select {
+		case pk := <-got2:
+			if string(pk.Payload) != "21" || !pk.Retain {
+				t.Fatalf("received %s %q", pk.TopicName, pk.Payload)
+			}
+		case <-time.After(20 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("retained message was not replicated")
+			}
+			continue
+		}
+		break
+	}
+
+	// 共享订阅在整个集群中每条消息只投递给一个成员
+	w1, jobs1 := dial(t, addrA, client.Options{ClientID: "w1", CleanSession: true})
+	w1.Subscribe(ctx, []string{"$share/g/jobs/#"}, []byte{1})
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		pub.Publish(ctx, message("jobs/probe", 0, false, "probe"))
+		select {
+		case <-jobs1:
+		case <-time.After(20 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("shared subscription was not exchanged")
+			}
+			continue
+		}
+		break
+	}
+	w2, jobs2 := dial(t, addrB, client.Options{ClientID: "w2", CleanSession: true})
+	w2.Subscribe(ctx, []string{"$share/g/jobs/#"}, []byte{1})
+	for i := range 4 {
+		pub.Publish(ctx, message(fmt.Sprintf("jobs/%d", i), 1, false, "job"))
+	}
+	count := map[string]int{}
+	for range 4 {
+		select {
+		case pk := <-jobs1:
+			count["w1"]++
+			count[pk.TopicName]++
+		case pk := <-jobs2:
+			count["w2"]++
+			count[pk.TopicName]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("shared deliveries %v", count)
+		}
+	}
+	nothing(t, jobs1)
+	nothing(t, jobs2)
+	if count["w1"] != 2 || count["w2"] != 2 || len(count) != 6 {
+		t.Errorf("shared deliveries %v, should be 2 per node and 1 per message", count)
+	}
+
+	// 客户端连接到其他节点后断开本节点的连接
+	moved, _ := dial(t, addrB, client.Options{ClientID: "sub", CleanSession: true})
+	defer moved.Close()
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Error("connection was not closed after the client connected to another node")
+	}
+}
+
+func TestAuthACL(t *testing.T) {
+	var h hooks.Hooks
+	h.Add(NewAuth(false, map[string]string{
+		"alice": "secret",
+		"bob":   "sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+	}))
+	acl := NewACL()
+	err := acl.Load("acl", strings.NewReader(`
+topic read public/#
+user alice
+topic readwrite private/#
+pattern write devices/%u/status
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add(acl)
+	_, addr := start(t, Options{Hooks: &h})
+	ctx := context.Background()
+
+	var ce *client.ConnackError
+	if _, err = client.Dial("tcp", addr, client.Options{ClientID: "anon", CleanSession: true}); !errors.As(err, &ce) || ce.ReturnCode != packets.ErrRefusedNotAuthorised {
+		t.Errorf("anonymous connection returned %v", err)
+	}
+	if _, err = client.Dial("tcp", addr, client.Options{ClientID: "x", CleanSession: true, Username: "alice", Password: []byte("wrong")}); !errors.As(err, &ce) || ce.ReturnCode != packets.ErrRefusedBadUsernameOrPassword {
+		t.Errorf("wrong password returned %v", err)
+	}
+
+	alice, got := dial(t, addr, client.Options{ClientID: "alice", CleanSession: true, Username: "alice", Password: []byte("secret")})
+	bob, gotBob := dial(t, addr, client.Options{ClientID: "bob", CleanSession: true, Username: "bob", Password: []byte("secret")})
+	codes, _ := alice.Subscribe(ctx, []string{"private/#", "devices/#"}, []byte{1, 1})
+	if string(codes) != "\x01\x80" {
+		t.Errorf("alice subscriptions returned %v", codes)
+	}
+	codes, _ = bob.Subscribe(ctx, []string{"private/#", "public/#"}, []byte{1, 1})
+	if string(codes) != "\x80\x01" {
+		t.Errorf("bob subscriptions returned %v", codes)
+	}
+	alice.Subscribe(ctx, []string{"public/#"}, []byte{0})
+
+	bob.Publish(ctx, message("private/x", 1, false, "from bob"))
+	bob.Publish(ctx, message("public/x", 1, false, "denied"))
+	alice.Publish(ctx, message("private/y", 1, false, "from alice"))
+	expect(t, got, "private/y", "from alice")
+	nothing(t, got)
+	nothing(t, gotBob)
+}
+
+func TestACLRejectedConnect(t *testing.T) {
+	var h hooks.Hooks
+	h.Add(NewAuth(false, map[string]string{"alice": "secret", "bob": "secret"}))
+	acl := NewACL()
+	if err := acl.Load("acl", strings.NewReader("user alice\ntopic private/#\n")); err != nil {
+		t.Fatal(err)
+	}
+	h.Add(acl)
+	_, addr := start(t, Options{Hooks: &h, Policy: session.Reject})
+	ctx := context.Background()
+
+	alice, _ := dial(t, addr, client.Options{ClientID: "alice", CleanSession: true, Username: "alice", Password: []byte("secret")})
+	// 认证通过但被会话注册表拒绝的连接不能改变alice的权限
+	var ce *client.ConnackError
+	if _, err := client.Dial("tcp", addr, client.Options{ClientID: "alice", CleanSession: true, Username: "bob", Password: []byte("secret")}); !errors.As(err, &ce) || ce.ReturnCode != packets.ErrRefusedIDRejected {
+		t.Errorf("duplicate client identifier returned %v", err)
+	}
+	codes, _ := alice.Subscribe(ctx, []string{"private/#"}, []byte{1})
+	if string(codes) != "\x01" {
+		t.Errorf("alice subscription returned %v", codes)
+	}
+}
+
+func TestACLPatternWildcards(t *testing.T) {
+	acl := NewACL()
+	if err := acl.Load("acl", strings.NewReader("pattern readwrite devices/%c/#\npattern readwrite users/%u/#\n")); err != nil {
+		t.Fatal(err)
+	}
+	connect := func(clientID, username string) {
+		cp := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+		cp.ClientIdentifier = clientID
+		cp.Username = username
+		cp.UsernameFlag = username != ""
+		acl.OnSessionStart(clientID, cp, false)
+	}
+	connect("dev1", "alice")
+	connect("#", "+")
+	connect("a/b", "x/#")
+
+	cases := []struct {
+		clientID string
+		topic    string
+		allowed  bool
+	}{
+		{"dev1", "devices/dev1/cmd", true},
+		{"dev1", "users/alice/inbox", true},
+		{"dev1", "devices/victim/cmd", false},
+		// 含有通配符或层级分隔符的客户端标识符和用户名不能扩大pattern行的范围
+		{"#", "devices/victim/cmd", false},
+		{"#", "devices/#/cmd", false},
+		{"#", "users/victim/inbox", false},
+		{"a/b", "devices/a/b/cmd", false},
+		{"a/b", "users/x/inbox", false},
+	}
+	for _, c := range cases {
+		pk := message(c.topic, 1, false, "x")
+		if got, _ := acl.OnPublish(c.clientID, pk); (got != nil) != c.allowed {
+			t.Errorf("%q publishing to %s allowed = %t", c.clientID, c.topic, got != nil)
+		}
+		if got := acl.OnDeliver(c.clientID, pk); (got != nil) != c.allowed {
+			t.Errorf("%q receiving from %s allowed = %t", c.clientID, c.topic, got != nil)
+		}
+	}
+}
+
+func TestTrustedPipe(t *testing.T) {
+	var h hooks.Hooks
+	h.Add(NewAuth(false, nil))
+	acl := NewACL()
+	h.Add(acl)
+	b := New(Options{Hooks: &h})
+	defer b.Close()
+	ctx := context.Background()
+
+	var ce *client.ConnackError
+	if _, err := client.Connect(b.Pipe(), client.Options{ClientID: "local", CleanSession: true}); !errors.As(err, &ce) || ce.ReturnCode != packets.ErrRefusedNotAuthorised {
+		t.Errorf("anonymous pipe connection returned %v", err)
+	}
+	// 可信连接不需要凭据, 不受ACL限制
+	c, err := client.Connect(b.TrustedPipe(), client.Options{ClientID: "local", CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	codes, _ := c.Subscribe(ctx, []string{"#"}, []byte{1})
+	if string(codes) != "\x01" {
+		t.Errorf("trusted subscription returned %v", codes)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+	srv := httptest.NewServer(b.WebSocketHandler())
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/mqtt", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "mqtt")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Write(nc)
+	r := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("upgrade returned %v %v", resp, err)
+	}
+
+	cp := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolLevel = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = "ws"
+	var buf strings.Builder
+	cp.Write(&buf)
+	// 客户端帧带掩码
+	frame := []byte{0x82, 0x80 | byte(buf.Len()), 1, 2, 3, 4}
+	for i := 0; i < buf.Len(); i++ {
+		frame = append(frame, buf.String()[i]^frame[2+i%4])
+	}
+	nc.Write(frame)
+
+	head := make([]byte, 2)
+	if _, err = r.Read(head); err != nil || head[0] != 0x82 {
+		t.Fatalf("expected binary frame, got %v %v", head, err)
+	}
+	pk, err := packets.ReadPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, ok := pk.(*packets.ConnackPacket); !ok || ack.ReturnCode != packets.Accepted || int(head[1]) != 4 {
+		t.Errorf("received %s over WebSocket", pk)
+	}
+}
+
+func TestPipeQos2(t *testing.T) {
+	b := New(Options{})
+	defer b.Close()
+	got := make(chan *packets.PublishPacket, 2000)
+	sub, err := client.Connect(b.Pipe(), client.Options{ClientID: "sub", CleanSession: true, OnMessage: func(c *client.Client, pk *packets.PublishPacket) { got <- pk }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	sub.Subscribe(context.Background(), []string{"q2"}, []byte{2})
+
+	// 订阅者的读协程回复PUBREC的同时服务端的读协程回复PUBREL, 没有缓冲的管道会死锁
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		pub, err := client.Connect(b.Pipe(), client.Options{ClientID: "pub" + string(rune('0'+i)), CleanSession: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pub.Close()
+		go func() {
+			for n := 0; n < 500; n++ {
+				if err := pub.Publish(ctx, message("q2", 2, false, "x")); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		expect(t, got, "q2", "x")
+	}
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/session"
+)
+
+// 集群模式下服务端通过 Options.Cluster 与其他节点交换订阅表, 转发消息, 复制保留消息和协调客户端接管
+// 会话状态不在节点间迁移: 客户端连接到其他节点后本节点断开该客户端, 本节点上的持久会话保留到过期
+// 共享订阅由收到发布的节点在有成员的节点中选择一个, 被选中的节点在本地按 SharedStrategy 选择成员
+
+// joinCluster 设置集群节点的回调, 恢复的会话的订阅通知其他节点
+func (b *Broker) joinCluster() {
+	n := b.opts.Cluster
+	if n == nil {
+		return
+	}
+	n.OnPublish = func(pk *packets.PublishPacket, shared []string) {
+		// 保留消息由 OnRetain 复制, 这里只投递给本地订阅者
+		pk.Retain = false
+		b.route(pk, time.Now(), "", "", set(shared))
+	}
+	n.OnRetain = func(pk *packets.PublishPacket) {
+		b.retain(pk)
+	}
+	n.OnTakeover = func(clientID string) {
+		b.mu.Lock()
+		c := b.conns[clientID]
+		b.mu.Unlock()
+		if c != nil {
+			if !b.opts.WillOnTakeover {
+				c.graceful.Store(true)
+			}
+			c.nc.Close()
+		}
+	}
+	for _, s := range b.sessions {
+		b.clusterSubscribe(filters(s))
+	}
+}
+
+// forward 把本节点的客户端或服务端发布的消息转发给其他节点, 返回应由本节点投递的共享订阅
+// 没有集群时返回nil, 所有的共享订阅都由本节点投递
+func (b *Broker) forward(pk *packets.PublishPacket) map[string]bool {
+	n := b.opts.Cluster
+	if n == nil {
+		return nil
+	}
+	if pk.Retain {
+		n.Retain(pk)
+	}
+	_, local := n.Publish(pk)
+	return set(local)
+}
+
+// set 共享订阅列表转为集合, 空列表也返回非nil的集合
+func set(filters []string) map[string]bool {
+	m := make(map[string]bool, len(filters))
+	for _, filter := range filters {
+		m[filter] = true
+	}
+	return m
+}
+
+// clusterSubscribe 本地会话新增的订阅通知其他节点
+func (b *Broker) clusterSubscribe(filters []string) {
+	if n := b.opts.Cluster; n != nil {
+		for _, filter := range filters {
+			n.Subscribe(filter)
+		}
+	}
+}
+
+// clusterUnsubscribe 本地会话取消的订阅通知其他节点, 会话被删除时取消其全部订阅
+func (b *Broker) clusterUnsubscribe(filters []string) {
+	if n := b.opts.Cluster; n != nil {
+		for _, filter := range filters {
+			n.Unsubscribe(filter)
+		}
+	}
+}
+
+// filters 会话的主题过滤器, 调用者需持有锁
+func filters(s *session.Session) []string {
+	filters := make([]string, 0, len(s.Subscriptions))
+	for filter := range s.Subscriptions {
+		filters = append(filters, filter)
+	}
+	return filters
+}
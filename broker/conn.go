@@ -0,0 +1,638 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/ratelimit"
+	"github.com/boxungo/mqtt/session"
+)
+
+// errTakenOver 连接被同一客户端标识符的新连接接管
+var errTakenOver = errors.New("session taken over")
+
+// outbound 等待确认的出站消息
+type outbound struct {
+	packet   *packets.PublishPacket
+	received time.Time
+	expires  time.Time // 离线队列中的过期时间, 放回离线队列时保留
+	seq      uint64    // 发送顺序, 断开后按此顺序放回离线队列
+}
+
+// conn 一个客户端连接
+type conn struct {
+	b  *Broker
+	nc net.Conn
+
+	clientID  string
+	username  string
+	session   *session.Session
+	keepAlive time.Duration // 读超时, 为保持连接时间的1.5倍
+	bridge    bool          // 桥接连接, 不回送自己发布的消息
+	clean     bool          // CONNECT中的 CleanSession, 与会话的 CleanSession 相同, 不用加锁读取
+	graceful  atomic.Bool   // 收到了DISCONNECT或服务端关闭, 不发布遗嘱
+
+	readBytes int // 读协程独占
+	lastRead  int // 上一个报文的字节数
+	w         *writer
+	trusted   bool // 进程内的可信连接, 不经过认证和访问控制
+
+	// 串行化QoS 1和QoS 2消息的发送, 新消息排在离线队列中的消息之后
+	drainMu sync.Mutex
+
+	mu       sync.Mutex
+	inflight map[uint16]*outbound
+	window   *ratelimit.Window
+	closing  bool
+	seq      uint64
+}
+
+// newConn 新建连接
+func newConn(b *Broker, nc net.Conn) *conn {
+	c := &conn{
+		b:        b,
+		nc:       nc,
+		inflight: make(map[uint16]*outbound),
+		window:   ratelimit.NewWindow(b.opts.MaxInflight),
+	}
+	// 写队列有空间后继续发送离线队列中的消息
+	c.w = newWriter(nc, b.opts, b.stats, c.drain)
+	return c
+}
+
+// Read 统计读取的字节数
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.nc.Read(p)
+	c.readBytes += n
+	return n, err
+}
+
+// Close 关闭网络连接, 会话被接管时由注册表调用
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
+
+// RemoteAddr 客户端地址, 用于生成客户端标识符
+func (c *conn) RemoteAddr() net.Addr {
+	return c.nc.RemoteAddr()
+}
+
+// serve 处理连接直到断开
+func (c *conn) serve() {
+	defer c.nc.Close()
+	go c.w.run()
+	defer c.w.close()
+	if !c.connect() {
+		return
+	}
+	err := c.readLoop()
+	c.disconnect(err)
+}
+
+// connect 处理CONNECT报文, 成功时返回true
+func (c *conn) connect() bool {
+	c.nc.SetReadDeadline(time.Now().Add(ConnectTimeout))
+	pk, err := c.read()
+	if err != nil {
+		return false
+	}
+	c.nc.SetReadDeadline(time.Time{})
+	cp, ok := pk.(*packets.ConnectPacket)
+	if !ok {
+		return false
+	}
+
+	code := cp.Validate()
+	if code == packets.ErrProtocolViolation {
+		return false
+	}
+	var assigned string
+	if code == packets.Accepted && cp.ClientIdentifier == "" {
+		assigned = c.b.registry.AssignID(c)
+		cp.ClientIdentifier = assigned
+	}
+	if code == packets.Accepted && !c.trusted {
+		code = c.b.hooks.OnConnect(cp)
+	}
+	var s *session.Session
+	var present bool
+	if code == packets.Accepted {
+		s, present, code = c.b.registry.Connect(cp, c)
+	}
+	if assigned != "" {
+		// 被拒绝时释放分配的标识符, 已用于 Connect 时不做处理
+		c.b.registry.ReleaseID(assigned)
+	}
+	connack := packets.NewControlPacket(packets.CONNACK).(*packets.ConnackPacket)
+	connack.ReturnCode = code
+	connack.SessionPresent = present
+	c.b.stats.Connack(code)
+	if code != packets.Accepted {
+		c.write(connack)
+		return false
+	}
+
+	c.clientID = s.ClientID
+	c.clean = cp.CleanSession
+	c.username = cp.Username
+	c.session = s
+	c.bridge = cp.ProtocolLevel&packets.BridgeFlag != 0
+	b := c.b
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		b.registry.Disconnect(s, c, true)
+		return false
+	}
+	var replaced []string
+	if old := b.sessions[s.ClientID]; old != nil && old != s {
+		replaced = filters(old)
+	}
+	b.sessions[s.ClientID] = s
+	b.conns[s.ClientID] = c
+	b.stats.SetSubscriptions(b.subscriptions())
+	b.mu.Unlock()
+	b.clusterUnsubscribe(replaced)
+	if b.opts.Cluster != nil {
+		b.opts.Cluster.Connected(s.ClientID)
+	}
+	b.hooks.OnSessionStart(s.ClientID, cp, c.trusted)
+	if b.opts.Store != nil && !present {
+		if err = b.opts.Store.CreateSession(s.ClientID, c.clean); err != nil {
+			b.logf("persist session %s: %v", s.ClientID, err)
+		}
+	}
+	b.stats.ClientConnected()
+	if present {
+		// 重连的持久会话在统计中已计入客户端总数
+		b.stats.SessionRemoved()
+	}
+
+	if err = c.write(connack); err != nil {
+		return false
+	}
+	b.hooks.OnConnAck(s.ClientID, connack)
+	if cp.KeepAlive > 0 {
+		c.keepAlive = time.Duration(cp.KeepAlive) * time.Second * 3 / 2
+	}
+	c.drain()
+	return true
+}
+
+// readLoop 读取并处理报文
+func (c *conn) readLoop() error {
+	for {
+		if c.keepAlive > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(c.keepAlive))
+		}
+		pk, err := c.read()
+		if err != nil {
+			return err
+		}
+		// 只限制PUBLISH, 订阅, 确认和心跳报文总是处理, 否则QoS 1和2的握手和保持连接会停滞
+		if p, ok := pk.(*packets.PublishPacket); ok && c.b.opts.Limiter != nil {
+			res := c.b.opts.Limiter.Check(c.clientID, c.username, p.TopicName, c.lastRead, time.Now())
+			if !res.Allowed && res.Action == ratelimit.Disconnect {
+				return fmt.Errorf("rate limit exceeded")
+			}
+			if !res.Allowed {
+				c.b.stats.Dropped()
+				if err = c.publish(p, false); err != nil {
+					return err
+				}
+				continue
+			}
+			if res.Delay > 0 {
+				time.Sleep(res.Delay)
+			}
+		}
+		err = c.handle(pk)
+		release(pk)
+		if err != nil {
+			return err
+		}
+		if c.graceful.Load() {
+			return nil
+		}
+	}
+}
+
+// handle 处理一个报文
+func (c *conn) handle(pk packets.ControlPacket) error {
+	switch p := pk.(type) {
+	case *packets.PublishPacket:
+		return c.publish(p, true)
+	case *packets.PubackPacket:
+		c.complete(p.PacketID)
+	case *packets.PubrecPacket:
+		c.mu.Lock()
+		_, ok := c.inflight[p.PacketID]
+		c.mu.Unlock()
+		if ok {
+			c.session.Release(p.PacketID)
+			if b := c.b; b.opts.Store != nil && !c.clean {
+				if err := b.opts.Store.Release(c.clientID, p.PacketID); err != nil {
+					b.logf("persist release for %s: %v", c.clientID, err)
+				}
+			}
+			rel := packets.NewControlPacket(packets.PUBREL).(*packets.PubrelPacket)
+			rel.PacketID = p.PacketID
+			return c.write(rel)
+		}
+	case *packets.PubcompPacket:
+		c.complete(p.PacketID)
+	case *packets.PubrelPacket:
+		if c.session.Complete(p.PacketID) && c.b.opts.Store != nil && !c.clean {
+			if err := c.b.opts.Store.Complete(c.clientID, p.PacketID); err != nil {
+				c.b.logf("persist PUBREL from %s: %v", c.clientID, err)
+			}
+		}
+		comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+		comp.PacketID = p.PacketID
+		return c.write(comp)
+	case *packets.SubscribePacket:
+		return c.subscribe(p)
+	case *packets.UnsubscribePacket:
+		return c.unsubscribe(p)
+	case *packets.PingreqPacket:
+		return c.write(packets.NewControlPacket(packets.PINGRESP))
+	case *packets.DisconnectPacket:
+		c.graceful.Store(true)
+	default:
+		return fmt.Errorf("unexpected %s from client", packets.PacketNames[packets.HeaderOf(pk).PacketType])
+	}
+	return nil
+}
+
+// publish 处理客户端发布的消息, route 为false时只确认不投递, 用于被限流丢弃的消息
+func (c *conn) publish(p *packets.PublishPacket, route bool) error {
+	received := time.Now()
+	if p.Qos > 2 {
+		return fmt.Errorf("invalid QoS %d in PUBLISH", p.Qos)
+	}
+	if !packets.ValidTopicName(p.TopicName) {
+		return fmt.Errorf("invalid topic name %q", p.TopicName)
+	}
+	if p.Qos > 0 && p.PacketID == 0 {
+		return fmt.Errorf("PUBLISH with QoS %d and packet identifier 0", p.Qos)
+	}
+	c.b.stats.Payload(len(p.Payload))
+
+	dup := false
+	switch p.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+		ack.PacketID = p.PacketID
+		if err := c.write(ack); err != nil {
+			return err
+		}
+	case 2:
+		// 持久会话重连后重发的消息也能识别, 先持久化再回复PUBREC
+		dup = !c.session.Receive(p.PacketID)
+		if !dup && c.b.opts.Store != nil && !c.clean {
+			if err := c.b.opts.Store.Receive(c.clientID, p.PacketID); err != nil {
+				c.b.logf("persist QoS 2 message from %s: %v", c.clientID, err)
+			}
+		}
+		rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+		rec.PacketID = p.PacketID
+		if err := c.write(rec); err != nil {
+			return err
+		}
+	}
+	if dup || !route {
+		return nil
+	}
+
+	pk, err := c.b.hooks.OnPublish(c.clientID, p)
+	if err != nil {
+		if err != hooks.ErrDropped {
+			c.b.logf("publish from %s rejected: %v", c.clientID, err)
+		}
+		c.b.stats.Dropped()
+		return nil
+	}
+	except := ""
+	if c.bridge {
+		except = c.clientID
+	}
+	c.b.route(pk, received, c.clientID, except, c.b.forward(pk))
+	return nil
+}
+
+// subscribe 处理订阅, 发送SUBACK和匹配的保留消息
+func (c *conn) subscribe(p *packets.SubscribePacket) error {
+	if p.PacketID == 0 || len(p.Topics) == 0 || len(p.Topics) != len(p.Qoss) {
+		return fmt.Errorf("malformed SUBSCRIBE")
+	}
+	for i, topic := range p.Topics {
+		if p.Qoss[i] > 2 {
+			return fmt.Errorf("SUBSCRIBE requesting QoS %d for %q", p.Qoss[i], topic)
+		}
+		if !packets.ValidTopicFilter(topic) {
+			p.Qoss[i] = 0x80
+		}
+	}
+	codes := c.b.hooks.OnSubscribe(c.clientID, p)
+	ack := packets.NewControlPacket(packets.SUBACK).(*packets.SubackPacket)
+	ack.PacketID = p.PacketID
+	ack.ReturnCodes = codes
+
+	b := c.b
+	// 先持久化, 写入失败的订阅返回失败, 不加入会话
+	if b.opts.Store != nil {
+		for i, topic := range p.Topics {
+			if codes[i] > 2 {
+				continue
+			}
+			if err := b.opts.Store.Subscribe(c.clientID, topic, codes[i]); err != nil {
+				b.logf("persist subscription %s for %s: %v", topic, c.clientID, err)
+				codes[i] = 0x80
+			}
+		}
+	}
+	var retained []*packets.PublishPacket
+	var qoss []byte
+	var added []string
+	b.mu.Lock()
+	for i, topic := range p.Topics {
+		if codes[i] > 2 {
+			continue
+		}
+		if _, ok := c.session.Subscriptions[topic]; !ok {
+			added = append(added, topic)
+		}
+		c.session.Subscriptions[topic] = codes[i]
+		// 共享订阅不发送保留消息
+		if _, _, ok := packets.ParseSharedFilter(topic); ok {
+			continue
+		}
+		for name, pk := range b.retained {
+			if packets.MatchTopic(topic, name) {
+				retained = append(retained, pk)
+				qoss = append(qoss, codes[i])
+			}
+		}
+	}
+	b.stats.SetSubscriptions(b.subscriptions())
+	b.mu.Unlock()
+	b.clusterSubscribe(added)
+
+	if err := c.write(ack); err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, pk := range retained {
+		b.deliver(c.session, pk, qoss[i], true, now, "")
+	}
+	return nil
+}
+
+// unsubscribe 处理取消订阅
+func (c *conn) unsubscribe(p *packets.UnsubscribePacket) error {
+	if p.PacketID == 0 || len(p.Topics) == 0 {
+		return fmt.Errorf("malformed UNSUBSCRIBE")
+	}
+	b := c.b
+	var removed []string
+	b.mu.Lock()
+	for _, topic := range p.Topics {
+		if _, ok := c.session.Subscriptions[topic]; ok {
+			delete(c.session.Subscriptions, topic)
+			removed = append(removed, topic)
+		}
+	}
+	b.stats.SetSubscriptions(b.subscriptions())
+	b.mu.Unlock()
+	b.clusterUnsubscribe(removed)
+	if b.opts.Store != nil {
+		for _, topic := range p.Topics {
+			if err := b.opts.Store.Unsubscribe(c.clientID, topic); err != nil {
+				b.logf("persist unsubscription %s for %s: %v", topic, c.clientID, err)
+			}
+		}
+	}
+	b.hooks.OnUnsubscribe(c.clientID, p)
+
+	ack := packets.NewControlPacket(packets.UNSUBACK).(*packets.UnsubackPacket)
+	ack.PacketID = p.PacketID
+	return c.write(ack)
+}
+
+// send 发送投递给该连接的消息, 飞行窗口已满时放入会话的离线队列
+// QoS 1和QoS 2消息已由 Broker.track 分配报文标识符
+func (c *conn) send(pk *packets.PublishPacket, received time.Time) {
+	if pk.Qos == 0 {
+		switch c.write(pk) {
+		case nil:
+			c.b.stats.Delivered(time.Since(received))
+		case errBackpressure:
+			c.b.stats.Dropped()
+		}
+		return
+	}
+	// 先发送离线队列中的消息; 客户端读取跟不上时放入离线队列, 写队列有空间后由 drain 发送
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	c.flush()
+	if c.session.Queue.Len() > 0 || c.w.full() || !c.window.TryAcquire() {
+		c.enqueue(pk)
+		return
+	}
+	if !c.transmit(c.session.Queue.NewMessage(pk, received), received) {
+		c.enqueue(pk)
+	}
+}
+
+// transmit 发送已占用飞行窗口的消息, 连接正在关闭时释放窗口并返回false, 调用者需持有 drainMu
+func (c *conn) transmit(m session.Message, received time.Time) bool {
+	pk := m.Packet
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		c.window.Release()
+		return false
+	}
+	c.seq++
+	c.inflight[pk.PacketID] = &outbound{packet: pk, received: received, expires: m.Expires, seq: c.seq}
+	c.mu.Unlock()
+	c.b.stats.SetInflight(c.b.inflight.Add(1))
+	if c.session.Released(pk.PacketID) {
+		// 重连前已收到PUBREC的QoS 2消息继续发送PUBREL
+		rel := packets.NewControlPacket(packets.PUBREL).(*packets.PubrelPacket)
+		rel.PacketID = pk.PacketID
+		c.write(rel)
+		return true
+	}
+	c.write(pk)
+	return true
+}
+
+// enqueue 放入离线队列, 溢出策略为断开时关闭连接
+func (c *conn) enqueue(pk *packets.PublishPacket) {
+	if _, err := c.session.Queue.Push(pk, time.Now()); err == session.ErrQueueFull {
+		c.nc.Close()
+	}
+}
+
+// complete 出站消息投递完成, 从离线队列补充飞行窗口
+func (c *conn) complete(id uint16) {
+	c.mu.Lock()
+	out, ok := c.inflight[id]
+	delete(c.inflight, id)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.b.stats.SetInflight(c.b.inflight.Add(-1))
+	c.b.stats.Delivered(time.Since(out.received))
+	c.b.untrack(c.session, out.packet)
+	c.window.Release()
+	c.drain()
+}
+
+// drain 把离线队列中的消息按顺序发送到飞行窗口
+func (c *conn) drain() {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	c.flush()
+}
+
+// flush 在飞行窗口和写队列有空间时发送离线队列中的消息, 调用者需持有 drainMu
+func (c *conn) flush() {
+	for !c.w.full() && c.window.TryAcquire() {
+		m, ok := c.session.Queue.Pop(time.Now())
+		if !ok {
+			c.window.Release()
+			return
+		}
+		if !c.transmit(m, time.Now()) {
+			c.session.Queue.Requeue([]session.Message{m})
+			return
+		}
+	}
+}
+
+// disconnect 连接断开后的清理
+func (c *conn) disconnect(err error) {
+	b := c.b
+	c.mu.Lock()
+	c.closing = true
+	inflight := c.inflight
+	c.inflight = make(map[uint16]*outbound)
+	c.mu.Unlock()
+
+	pending := make([]*outbound, 0, len(inflight))
+	for _, out := range inflight {
+		pending = append(pending, out)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+	if n := len(inflight); n > 0 {
+		b.stats.SetInflight(b.inflight.Add(-int64(n)))
+	}
+
+	var removed []string
+	b.mu.Lock()
+	current := b.conns[c.clientID] == c
+	next := b.conns[c.clientID]
+	if current {
+		delete(b.conns, c.clientID)
+		if c.clean && b.sessions[c.clientID] == c.session {
+			delete(b.sessions, c.clientID)
+			removed = filters(c.session)
+			b.stats.SetSubscriptions(b.subscriptions())
+		}
+	}
+	b.mu.Unlock()
+	b.clusterUnsubscribe(removed)
+	if !current {
+		err = errTakenOver
+	}
+
+	// 未确认的消息按发送顺序放回持久会话离线队列的头部, 重连后首先重发
+	// 会话离开了共享订阅组(断开或清理会话被接管)时, 通过共享订阅投递的消息转给组内其他成员,
+	// 已发送PUBREL的QoS 2消息已被客户端收到, 不再转给其他成员
+	left := current || c.clean
+	moved := func(pk *packets.PublishPacket) bool {
+		return b.sharedFilter(pk) != "" && !c.session.Released(pk.PacketID)
+	}
+	var requeue []session.Message
+	var shared []*packets.PublishPacket
+	for _, out := range pending {
+		if left && moved(out.packet) {
+			shared = append(shared, out.packet)
+		} else if !c.clean {
+			out.packet.Dup = true
+			requeue = append(requeue, session.Message{Packet: out.packet, Expires: out.expires})
+		}
+	}
+	c.session.Queue.Requeue(requeue)
+	if left {
+		shared = append(shared, c.session.Queue.Remove(moved)...)
+		for _, pk := range shared {
+			b.redistribute(c.session, pk, b.sharedFilter(pk))
+		}
+	} else if next != nil && next.session == c.session && len(requeue) > 0 {
+		// 接管会话的新连接可能已经发送过离线队列, 放回的消息由新连接继续发送
+		next.drain()
+	}
+
+	b.registry.Disconnect(c.session, c, c.graceful.Load())
+	if current && c.clean {
+		if b.opts.Store != nil {
+			b.opts.Store.DeleteSession(c.clientID)
+		}
+		b.stats.SessionRemoved()
+		b.hooks.OnSessionEnd(c.clientID)
+	}
+	if b.opts.Limiter != nil {
+		b.opts.Limiter.Forget(c.clientID)
+	}
+	b.stats.ClientDisconnected()
+	b.hooks.OnDisconnect(c.clientID, err)
+}
+
+// shutdown 服务端关闭时断开连接, 视为正常断开不发布遗嘱
+func (c *conn) shutdown() {
+	c.graceful.Store(true)
+	c.nc.Close()
+}
+
+// read 读取报文并统计, 报文从池中取出, 处理完后调用 release
+func (c *conn) read() (packets.ControlPacket, error) {
+	before := c.readBytes
+	pk, err := packets.ReadPacketPooled(c)
+	if err != nil {
+		return nil, err
+	}
+	if fh := packets.HeaderOf(pk); !fh.ValidFlags() {
+		release(pk)
+		return nil, fmt.Errorf("invalid flags in %s fixed header", packets.PacketNames[fh.PacketType])
+	}
+	c.lastRead = c.readBytes - before
+	c.b.stats.Received(packets.HeaderOf(pk).PacketType, c.lastRead)
+	return pk, nil
+}
+
+// release 处理完的报文放回池中
+// PUBLISH报文处理完后仍被保留消息, 离线队列, 钩子和集群转发引用, CONNECT报文的遗嘱保存在会话中, 都不放回
+func release(pk packets.ControlPacket) {
+	switch pk.(type) {
+	case *packets.PublishPacket, *packets.ConnectPacket:
+		return
+	}
+	packets.ReleasePacket(pk)
+}
+
+// write 报文放入写队列, 由写协程合并写出并统计
+// 写入失败时写协程关闭连接, 之后返回错误
+func (c *conn) write(pk packets.ControlPacket) error {
+	return c.w.write(pk)
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// replay 反复读取同一段数据的连接
+type replay struct {
+	net.Conn
+	r    *bytes.Reader
+	data []byte
+}
+
+func (c *replay) Read(p []byte) (int, error) {
+	if c.r.Len() == 0 {
+		c.r.Reset(c.data)
+	}
+	return c.r.Read(p)
+}
+
+// BenchmarkConnRead 读取客户端确认QoS 1和QoS 2消息的报文, 比较不复用和复用报文
+func BenchmarkConnRead(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 1; i <= 100; i++ {
+		ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+		ack.PacketID = uint16(i)
+		ack.Write(&buf)
+		rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+		rec.PacketID = uint16(i)
+		rec.Write(&buf)
+		comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+		comp.PacketID = uint16(i)
+		comp.Write(&buf)
+	}
+	data := buf.Bytes()
+	c := newConn(New(Options{}), &replay{r: bytes.NewReader(data), data: data})
+
+	b.Run("ReadPacket", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := packets.ReadPacket(c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pk, err := c.read()
+			if err != nil {
+				b.Fatal(err)
+			}
+			release(pk)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package broker
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pipeBufferSize 每个方向的缓冲大小, 与常见的TCP套接字缓冲相当
+const pipeBufferSize = 64 * 1024
+
+// pipeAddr 进程内连接的地址
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeBuffer 一个方向的数据
+type pipeBuffer struct {
+	mu     sync.Mutex
+	data   []byte
+	closed bool          // 任意一端已关闭
+	notify chan struct{} // 状态变化时关闭并替换
+}
+
+// newPipeBuffer 新建缓冲
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{notify: make(chan struct{})}
+}
+
+// broadcast 唤醒等待的读写, 调用者需持有mu
+func (b *pipeBuffer) broadcast() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// pipeConn 带缓冲的进程内连接的一端
+// 与 net.Pipe 不同, 写入在缓冲未满时立即返回, 两端的读协程同时回复确认时不会互相阻塞
+type pipeConn struct {
+	in  *pipeBuffer
+	out *pipeBuffer
+
+	mu            sync.Mutex
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// newPipe 新建一对连接
+func newPipe() (net.Conn, net.Conn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return &pipeConn{in: a, out: b}, &pipeConn{in: b, out: a}
+}
+
+// wait 等待缓冲的状态变化或超时, 超时返回false
+func wait(ch chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-ch
+		return true
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// state 本端是否已关闭和截止时间
+func (c *pipeConn) state(read bool) (bool, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if read {
+		return c.closed, c.readDeadline
+	}
+	return c.closed, c.writeDeadline
+}
+
+// Read 读取对端写入的数据, 对端关闭且数据读完后返回 io.EOF
+func (c *pipeConn) Read(p []byte) (int, error) {
+	for {
+		closed, deadline := c.state(true)
+		if closed {
+			return 0, io.ErrClosedPipe
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b := c.in
+		b.mu.Lock()
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			if len(b.data) == 0 {
+				b.data = nil
+			}
+			b.broadcast()
+			b.mu.Unlock()
+			return n, nil
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		ch := b.notify
+		b.mu.Unlock()
+		if !wait(ch, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write 写入数据, 缓冲已满时等待对端读取
+func (c *pipeConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		closed, deadline := c.state(false)
+		if closed {
+			return written, io.ErrClosedPipe
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		b := c.out
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if free := pipeBufferSize - len(b.data); free > 0 {
+			n := min(free, len(p)-written)
+			b.data = append(b.data, p[written:written+n]...)
+			written += n
+			b.broadcast()
+			b.mu.Unlock()
+			continue
+		}
+		ch := b.notify
+		b.mu.Unlock()
+		if !wait(ch, deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+	return written, nil
+}
+
+// Close 关闭连接, 对端读完已写入的数据后收到 io.EOF
+func (c *pipeConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	c.closed = true
+	c.mu.Unlock()
+	for _, b := range []*pipeBuffer{c.in, c.out} {
+		b.mu.Lock()
+		b.closed = true
+		b.broadcast()
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.wake(c.in)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.wake(c.out)
+	return nil
+}
+
+// wake 截止时间改变后唤醒等待者重新计算
+func (c *pipeConn) wake(b *pipeBuffer) {
+	b.mu.Lock()
+	b.broadcast()
+	b.mu.Unlock()
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/session"
+)
+
+// SharedStrategy 共享订阅在组内选择成员的策略
+type SharedStrategy int
+
+// 选择策略, 都优先选择在线的成员
+const (
+	RoundRobin   SharedStrategy = iota // 按客户端标识符排序后轮流选择
+	Random                             // 随机选择
+	StickyClient                       // 同一发布者的消息投递给同一成员, 成员变化时重新分配
+	HashTopic                          // 同一主题的消息投递给同一成员, 成员变化时重新分配
+)
+
+// target 消息的一个接收者
+type target struct {
+	s   *session.Session
+	qos byte
+}
+
+// pick 按策略在共享订阅组内选择一个成员, from 为发布者的客户端标识符, 没有成员时返回nil
+// 调用者需持有锁
+func (b *Broker) pick(filter string, members []*target, pk *packets.PublishPacket, from string) *target {
+	if len(members) == 0 {
+		return nil
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].s.ClientID < members[j].s.ClientID })
+	var online []*target
+	for _, m := range members {
+		if b.conns[m.s.ClientID] != nil {
+			online = append(online, m)
+		}
+	}
+	if len(online) > 0 {
+		members = online
+	}
+
+	var n uint64
+	switch b.opts.SharedStrategy {
+	case Random:
+		n = uint64(rand.Intn(len(members)))
+	case StickyClient:
+		n = hash(from)
+	case HashTopic:
+		n = hash(pk.TopicName)
+	default:
+		n = b.shared[filter]
+		b.shared[filter] = n + 1
+	}
+	return members[n%uint64(len(members))]
+}
+
+// hash 字符串的FNV-1a哈希
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// sharedFilter 消息投递所经过的共享订阅, 不是通过共享订阅投递时返回空字符串
+func (b *Broker) sharedFilter(pk *packets.PublishPacket) string {
+	b.sharedMu.Lock()
+	defer b.sharedMu.Unlock()
+	return b.sharedOut[pk]
+}
+
+// redistribute 离开共享订阅组的成员未完成的消息转给组内其他在线的成员
+// 没有其他在线成员时, 持久会话保留消息, 清理会话丢弃消息
+func (b *Broker) redistribute(s *session.Session, pk *packets.PublishPacket, filter string) {
+	b.mu.Lock()
+	var members []*target
+	for id, m := range b.sessions {
+		if m == s || b.conns[id] == nil {
+			continue
+		}
+		if qos, ok := m.Subscriptions[filter]; ok {
+			members = append(members, &target{s: m, qos: qos})
+		}
+	}
+	t := b.pick(filter, members, pk, "")
+	b.mu.Unlock()
+
+	if t == nil {
+		if !s.CleanSession {
+			pk.Dup = true
+			s.Queue.Push(pk, time.Now())
+			return
+		}
+		b.stats.Dropped()
+	}
+	b.untrack(s, pk)
+	if t != nil {
+		b.deliver(t.s, pk, t.qos, false, time.Now(), filter)
+	}
+}
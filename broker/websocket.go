@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// websocketGUID RFC 6455中用于计算Sec-WebSocket-Accept的GUID
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket操作码
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocketHandler 把WebSocket连接(子协议mqtt)交给服务端处理
+func (b *Broker) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+			http.Error(w, "expected WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+			return
+		}
+		nc, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		sum := sha1.Sum([]byte(key + websocketGUID))
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n")
+		if headerContains(r.Header, "Sec-WebSocket-Protocol", "mqtt") {
+			rw.WriteString("Sec-WebSocket-Protocol: mqtt\r\n")
+		}
+		rw.WriteString("\r\n")
+		if err = rw.Flush(); err != nil {
+			nc.Close()
+			return
+		}
+		b.ServeConn(&wsConn{Conn: nc, r: rw.Reader})
+	})
+}
+
+// wsConn 把WebSocket二进制帧转换为字节流的服务端连接
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	remaining uint64 // 当前帧未读的负载长度
+	mask      [4]byte
+	masked    bool
+	pos       int // 掩码位置
+
+	wmu sync.Mutex
+}
+
+// Read 读取数据帧的负载, 处理控制帧
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// Write 把数据作为一个二进制帧写入
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// nextFrame 读取下一个数据帧的头部, 控制帧在此处理
+func (c *wsConn) nextFrame() error {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			return err
+		}
+		opcode := head[0] & 0x0f
+		c.masked = head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if !c.masked {
+			// 客户端发送的帧必须带掩码
+			return errors.New("websocket: unmasked client frame")
+		}
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+		c.pos = 0
+
+		switch opcode {
+		case wsBinary, wsContinuation:
+			c.remaining = length
+			return nil
+		case wsText:
+			return errors.New("websocket: MQTT requires binary frames")
+		case wsPing, wsPong, wsClose:
+			if length > 125 {
+				return errors.New("websocket: control frame too long")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.r, payload); err != nil {
+				return err
+			}
+			c.unmask(payload)
+			switch opcode {
+			case wsPing:
+				if err := c.writeFrame(wsPong, payload); err != nil {
+					return err
+				}
+			case wsClose:
+				c.writeFrame(wsClose, payload)
+				return io.EOF
+			}
+		default:
+			return errors.New("websocket: unknown opcode")
+		}
+	}
+}
+
+// unmask 去掉负载的掩码
+func (c *wsConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.pos&3]
+		c.pos++
+	}
+}
+
+// writeFrame 写入一个完整的帧, 服务端发送的帧不带掩码
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	head := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xffff:
+		head = append(head, 126, byte(n>>8), byte(n))
+	default:
+		head = append(head, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(head[2:], uint64(n))
+	}
+	if _, err := c.Conn.Write(append(head, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// headerContains 头部中是否包含某个以逗号分隔的值, 不区分大小写
+func headerContains(h http.Header, name string, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/stats"
+)
+
+// DefaultWriteBuffer 默认的一次合并写入的字节数
+const DefaultWriteBuffer = 64 * 1024
+
+// DefaultWriteQueue 默认的每个连接排队等待写出的PUBLISH字节数上限
+const DefaultWriteQueue = 4 * 1024 * 1024
+
+// DefaultWriteTimeout 默认的写超时
+const DefaultWriteTimeout = 30 * time.Second
+
+// errBackpressure 写队列已满, 客户端读取跟不上投递的速度
+var errBackpressure = errors.New("write queue full")
+
+// errWriterClosed 连接已关闭或写入失败
+var errWriterClosed = errors.New("connection closed")
+
+// queued 已编码, 等待写出的报文
+type queued struct {
+	packetType byte
+	buf        *bytes.Buffer
+}
+
+// writer 连接的写协程
+// 报文在调用方的协程中编码后排队, 写协程把排队的报文合并成一次写入,
+// 控制报文(PINGRESP, PUBACK等)排在PUBLISH之前写出, 不会被大量的出站消息延迟
+type writer struct {
+	nc      net.Conn
+	stats   *stats.Stats
+	batch   int
+	delay   time.Duration
+	timeout time.Duration
+	limit   int
+	resume  func() // 写队列从已满恢复时调用
+
+	mu        sync.Mutex
+	control   []queued
+	bulk      []queued
+	bulkBytes int
+	blocked   bool // 拒绝过消息或报告过已满, 恢复时调用 resume
+	closing   bool
+	err       error
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+// newWriter 新建写协程, 调用 run 开始写出
+func newWriter(nc net.Conn, opts Options, st *stats.Stats, resume func()) *writer {
+	return &writer{
+		nc:      nc,
+		stats:   st,
+		batch:   opts.WriteBuffer,
+		delay:   opts.WriteDelay,
+		timeout: opts.WriteTimeout,
+		limit:   opts.WriteQueue,
+		resume:  resume,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// write 编码报文并排队, 连接已关闭或写入失败时返回错误
+// 排队的PUBLISH超过上限时QoS 0消息返回 errBackpressure,
+// QoS 1和2的消息数量受飞行窗口限制, 调用方应先用 full 检查
+func (w *writer) write(pk packets.ControlPacket) error {
+	buf := packets.AcquireBuffer()
+	pk.Write(buf)
+	q := queued{packetType: packets.HeaderOf(pk).PacketType, buf: buf}
+
+	w.mu.Lock()
+	if w.err != nil {
+		err := w.err
+		w.mu.Unlock()
+		packets.ReleaseBuffer(buf)
+		return err
+	}
+	if q.packetType == packets.PUBLISH {
+		if packets.HeaderOf(pk).Qos == 0 && w.bulkBytes >= w.limit {
+			w.blocked = true
+			w.mu.Unlock()
+			packets.ReleaseBuffer(buf)
+			return errBackpressure
+		}
+		w.bulk = append(w.bulk, q)
+		w.bulkBytes += buf.Len()
+	} else {
+		w.control = append(w.control, q)
+	}
+	w.mu.Unlock()
+	w.signal()
+	return nil
+}
+
+// full 排队的PUBLISH是否超过上限
+func (w *writer) full() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.bulkBytes >= w.limit {
+		w.blocked = true
+		return true
+	}
+	return false
+}
+
+// signal 唤醒写协程
+func (w *writer) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close 写出排队的报文后停止写协程
+func (w *writer) close() {
+	w.mu.Lock()
+	w.closing = true
+	w.mu.Unlock()
+	w.signal()
+	<-w.done
+}
+
+// run 写协程, close 之后或写入失败时返回
+func (w *writer) run() {
+	defer close(w.done)
+	var out bytes.Buffer
+	var items []queued
+	var closing bool
+	var timer *time.Timer
+	for {
+		items, closing = w.take(items[:0], 0)
+		if len(items) == 0 {
+			if closing {
+				w.fail(errWriterClosed)
+				return
+			}
+			<-w.wake
+			continue
+		}
+
+		// 只有PUBLISH且不足一次写入时等待更多报文, 控制报文立即写出
+		size := queuedBytes(items)
+		if w.delay > 0 && size < w.batch && !closing && items[0].packetType == packets.PUBLISH {
+			if timer == nil {
+				timer = time.NewTimer(w.delay)
+			} else {
+				timer.Reset(w.delay)
+			}
+		wait:
+			for size < w.batch {
+				select {
+				case <-w.wake:
+					n := len(items)
+					items, closing = w.take(items, size)
+					size = queuedBytes(items)
+					if closing || len(items) > n && items[n].packetType != packets.PUBLISH {
+						break wait
+					}
+				case <-timer.C:
+					break wait
+				}
+			}
+			timer.Stop()
+		}
+
+		data := items[0].buf.Bytes()
+		if len(items) > 1 {
+			out.Reset()
+			for _, q := range items {
+				out.Write(q.buf.Bytes())
+			}
+			data = out.Bytes()
+		}
+		if w.timeout > 0 {
+			w.nc.SetWriteDeadline(time.Now().Add(w.timeout))
+		}
+		_, err := w.nc.Write(data)
+		for _, q := range items {
+			if err == nil {
+				w.stats.Sent(q.packetType, q.buf.Len())
+			}
+			packets.ReleaseBuffer(q.buf)
+		}
+		if out.Cap() > w.batch*2 {
+			out = bytes.Buffer{}
+		}
+		if err != nil {
+			w.nc.Close()
+			w.fail(err)
+			return
+		}
+
+		w.mu.Lock()
+		resume := w.blocked && w.bulkBytes < w.limit
+		if resume {
+			w.blocked = false
+		}
+		w.mu.Unlock()
+		if resume && w.resume != nil {
+			w.resume()
+		}
+	}
+}
+
+// take 取出排队的报文追加到 items, 控制报文优先, 合计超过一次写入的字节数时停止
+// size 为 items 中已有的字节数, 同时返回是否已调用 close
+func (w *writer) take(items []queued, size int) ([]queued, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for ; n < len(w.control) && size < w.batch; n++ {
+		items = append(items, w.control[n])
+		size += w.control[n].buf.Len()
+	}
+	w.control = shift(w.control, n)
+	n = 0
+	for ; n < len(w.bulk) && size < w.batch; n++ {
+		items = append(items, w.bulk[n])
+		size += w.bulk[n].buf.Len()
+		w.bulkBytes -= w.bulk[n].buf.Len()
+	}
+	w.bulk = shift(w.bulk, n)
+	return items, w.closing
+}
+
+// fail 记录错误并丢弃排队的报文, 之后的 write 返回该错误
+func (w *writer) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+	for _, q := range w.control {
+		packets.ReleaseBuffer(q.buf)
+	}
+	for _, q := range w.bulk {
+		packets.ReleaseBuffer(q.buf)
+	}
+	w.control, w.bulk, w.bulkBytes = nil, nil, 0
+}
+
+// shift 移除队列前 n 个报文, 队列为空时复用底层数组
+func shift(q []queued, n int) []queued {
+	clear(q[:n])
+	if n == len(q) {
+		return q[:0]
+	}
+	return q[n:]
+}
+
+// queuedBytes 报文的总字节数
+func queuedBytes(items []queued) int {
+	size := 0
+	for _, q := range items {
+		size += q.buf.Len()
+	}
+	return size
+}
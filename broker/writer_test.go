@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/stats"
+)
+
+// countingConn 统计写入次数
+type countingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// testWriter 新建写到管道的写协程, run 需要由调用方启动
+func testWriter(opts Options, resume func()) (*writer, *countingConn, net.Conn) {
+	client, server := newPipe()
+	nc := &countingConn{Conn: server}
+	if opts.WriteBuffer == 0 {
+		opts.WriteBuffer = DefaultWriteBuffer
+	}
+	if opts.WriteQueue == 0 {
+		opts.WriteQueue = DefaultWriteQueue
+	}
+	return newWriter(nc, opts, stats.New(), resume), nc, client
+}
+
+func TestWriterCoalesce(t *testing.T) {
+	w, nc, client := testWriter(Options{}, nil)
+	for i := 0; i < 100; i++ {
+		w.write(message("bulk", 0, false, "x"))
+	}
+	w.write(packets.NewControlPacket(packets.PINGRESP))
+	go w.run()
+	w.close()
+
+	if n := nc.writes.Load(); n != 1 {
+		t.Errorf("101 queued packets written in %d writes", n)
+	}
+	// 控制报文排在之前排队的PUBLISH前面
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i <= 100; i++ {
+		pk, err := packets.ReadPacket(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packetType := packets.HeaderOf(pk).PacketType; (i == 0) != (packetType == packets.PINGRESP) {
+			t.Fatalf("packet %d is %s", i, packets.PacketNames[packetType])
+		}
+	}
+	if err := w.write(packets.NewControlPacket(packets.PINGRESP)); err != errWriterClosed {
+		t.Errorf("write after close returned %v", err)
+	}
+}
+
+func TestWriterDelay(t *testing.T) {
+	w, nc, client := testWriter(Options{WriteDelay: 50 * time.Millisecond}, nil)
+	go w.run()
+	defer w.close()
+	for i := 0; i < 10; i++ {
+		w.write(message("bulk", 0, false, "x"))
+		time.Sleep(time.Millisecond)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 10; i++ {
+		if _, err := packets.ReadPacket(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := nc.writes.Load(); n > 2 {
+		t.Errorf("10 packets within the write delay written in %d writes", n)
+	}
+
+	// 控制报文不等待
+	start := time.Now()
+	w.write(packets.NewControlPacket(packets.PINGRESP))
+	if _, err := packets.ReadPacket(client); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Errorf("PINGRESP waited %s", d)
+	}
+}
+
+func TestWriterBackpressure(t *testing.T) {
+	resumed := make(chan struct{}, 1)
+	w, _, client := testWriter(Options{WriteQueue: 100}, func() { resumed <- struct{}{} })
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = w.write(message("bulk", 0, false, "0123456789abcdef0123456789"))
+	}
+	if err != errBackpressure || !w.full() {
+		t.Fatalf("write to a full queue returned %v", err)
+	}
+	// QoS 1消息由调用方检查 full, 不会被拒绝
+	if err = w.write(message("bulk", 1, false, "x")); err != nil {
+		t.Fatalf("QoS 1 write returned %v", err)
+	}
+
+	go w.run()
+	defer w.close()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("resume was not called after the queue was written")
+	}
+	if w.full() {
+		t.Error("queue still full after it was written")
+	}
+	client.Close()
+}
+
+func TestWriterTimeout(t *testing.T) {
+	// net.Pipe 没有缓冲, 对端不读取时写入阻塞到超时
+	client, server := net.Pipe()
+	defer client.Close()
+	w := newWriter(server, Options{WriteBuffer: DefaultWriteBuffer, WriteQueue: DefaultWriteQueue, WriteTimeout: 20 * time.Millisecond}, stats.New(), nil)
+	go w.run()
+	w.write(packets.NewControlPacket(packets.PINGRESP))
+
+	deadline := time.Now().Add(time.Second)
+	for w.write(packets.NewControlPacket(packets.PINGRESP)) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("write did not time out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	w.close()
+	// 超时后连接被关闭
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open after the write timeout")
+	}
+}
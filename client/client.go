@@ -0,0 +1,721 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/stats"
+)
+
+// 客户端错误
+var (
+	ErrClosed        = errors.New("client closed")
+	ErrNoPacketID    = errors.New("no packet identifier available")
+	ErrUnexpectedAck = errors.New("unexpected acknowledgement packet")
+)
+
+// ConnackError 服务端拒绝连接
+type ConnackError struct {
+	ReturnCode byte
+}
+
+// Error ...
+func (e *ConnackError) Error() string {
+	return fmt.Sprintf("connection refused, return code %d", e.ReturnCode)
+}
+
+// Handler 收到消息时调用, 在读协程中执行, 返回后才会确认QoS 1和QoS 2消息(设置了 ManualAck 时由调用方确认)
+// Handler 中不能同步等待 Publish 等需要确认的操作, 否则会阻塞读协程
+type Handler func(c *Client, pk *packets.PublishPacket)
+
+// StreamHandler 流式处理有效负载较大的消息, pk.Payload 为空, 有效负载从 payload 读取, 例如直接写入文件
+// 与 Handler 一样在读协程中执行, 返回时没有读完的有效负载被丢弃
+type StreamHandler func(c *Client, pk *packets.PublishPacket, payload io.Reader)
+
+// Options 客户端选项
+type Options struct {
+	ClientID      string
+	Username      string
+	Password      []byte
+	CleanSession  bool
+	KeepAlive     uint16 // 保持连接的秒数, 0表示不发送心跳
+	ProtocolLevel byte   // 协议级别, 为0时使用4(3.1.1)
+
+	WillTopic   string
+	WillMessage []byte
+	WillQos     byte
+	WillRetain  bool
+
+	ConnectTimeout time.Duration // 等待CONNACK的时间, 为0时不超时
+	OnMessage      Handler       // 收到PUBLISH时调用, 主题匹配了 Handle 注册的过滤器时不调用
+
+	// ManualAck 为true时QoS 1和QoS 2消息不在处理函数返回后自动确认, 由调用方按收到的顺序调用 Ack,
+	// 例如消息转发到其他服务端并被确认之后. 未确认的消息在持久会话重连后由服务端重发
+	ManualAck bool
+
+	// OnStream 不为nil时, 有效负载超过 StreamThreshold 字节的消息交给它处理, 有效负载不读入内存,
+	// 这些消息不经过 Handle 注册的处理函数和 OnMessage
+	OnStream        StreamHandler
+	StreamThreshold int
+
+	// Stats 记录收发的报文, CONNACK返回码, 收发的消息负载大小, 等待确认的发布数和发布完成的延迟,
+	// 为nil时新建. 多个客户端可以共用, 每次连接计入客户端总数, 因此总数与在线数之差为断开(重连)的次数
+	Stats *stats.Stats
+}
+
+// Client MQTT客户端, 可并发使用
+type Client struct {
+	opts           Options
+	conn           net.Conn
+	r              *reader               // 统计读取的字节数
+	sr             *packets.StreamReader // 设置了 OnStream 时用于读取报文
+	sessionPresent bool
+	stats          *stats.Stats
+
+	wmu sync.Mutex // 写锁
+
+	mu       sync.Mutex
+	nextID   uint16
+	pending  map[uint16]chan packets.ControlPacket // 等待确认的报文
+	received map[uint16]bool                       // 已收到, 等待PUBREL的QoS 2消息 -> 是否已发送PUBREC
+	routes   []*route
+	pong     chan struct{}
+
+	done chan struct{}
+	err  error
+}
+
+// route Handle 注册的消息处理函数
+type route struct {
+	filter  string
+	handler Handler
+}
+
+// Dial 连接服务端并完成CONNECT握手
+func Dial(network string, address string, opts Options) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return Connect(conn, opts)
+}
+
+// Connect 在已建立的连接上完成CONNECT握手, 失败时关闭连接
+func Connect(conn net.Conn, opts Options) (*Client, error) {
+	if opts.Stats == nil {
+		opts.Stats = stats.New()
+	}
+	c := &Client{
+		opts:     opts,
+		conn:     conn,
+		r:        &reader{Reader: conn},
+		stats:    opts.Stats,
+		pending:  make(map[uint16]chan packets.ControlPacket),
+		received: make(map[uint16]bool),
+		pong:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if opts.OnStream != nil {
+		c.sr = packets.NewStreamReader(c.r)
+	}
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.stats.ClientConnected()
+	go c.readLoop()
+	if opts.KeepAlive > 0 {
+		go c.keepAlive(time.Duration(opts.KeepAlive) * time.Second)
+	}
+	return c, nil
+}
+
+// Stats 统计信息
+func (c *Client) Stats() *stats.Stats {
+	return c.stats
+}
+
+// SessionPresent 服务端是否保留了之前的会话
+func (c *Client) SessionPresent() bool {
+	return c.sessionPresent
+}
+
+// Done 连接关闭时关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err 连接关闭的原因
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Publish 发布消息, QoS 1和QoS 2时等待确认完成
+// 报文标识符由客户端分配; Dup 为true且 PacketID 不为0时沿用原来的报文标识符, 用于重发未完成的消息,
+// 服务端据此识别重复的QoS 2消息
+func (c *Client) Publish(ctx context.Context, pk *packets.PublishPacket) error {
+	c.stats.Payload(len(pk.Payload))
+	return c.publish(ctx, pk, c.write)
+}
+
+// PublishStream 发布消息, 有效负载从 payload 读取 size 字节, 不读入内存, 忽略 pk.Payload
+// payload 不足 size 字节时连接已写出不完整的报文, 客户端关闭并返回 io.ErrUnexpectedEOF
+// 其他与 Publish 相同, 重发时需要重新提供有效负载
+func (c *Client) PublishStream(ctx context.Context, pk *packets.PublishPacket, payload io.Reader, size int) error {
+	c.stats.Payload(size)
+	return c.publish(ctx, pk, func(packets.ControlPacket) error {
+		return c.writeStream(pk, payload, size)
+	})
+}
+
+// publish 用 write 写出PUBLISH报文, QoS 1和QoS 2时等待确认完成
+func (c *Client) publish(ctx context.Context, pk *packets.PublishPacket, write func(pk packets.ControlPacket) error) error {
+	start := time.Now()
+	if pk.Qos == 0 {
+		err := write(pk)
+		if err == nil {
+			c.stats.Delivered(time.Since(start))
+		}
+		return err
+	}
+	var reuse uint16
+	if pk.Dup {
+		reuse = pk.PacketID
+	}
+	id, ack, err := c.register(reuse)
+	if err != nil {
+		return err
+	}
+	defer c.unregister(id)
+	c.stats.AddInflight(1)
+	defer c.stats.AddInflight(-1)
+	pk.PacketID = id
+	if err = write(pk); err != nil {
+		return err
+	}
+
+	reply, err := c.wait(ctx, ack)
+	if err != nil {
+		return err
+	}
+	if pk.Qos == 1 {
+		if _, ok := reply.(*packets.PubackPacket); !ok {
+			return ErrUnexpectedAck
+		}
+		c.stats.Delivered(time.Since(start))
+		return nil
+	}
+	if _, ok := reply.(*packets.PubrecPacket); !ok {
+		return ErrUnexpectedAck
+	}
+	rel := packets.NewControlPacket(packets.PUBREL).(*packets.PubrelPacket)
+	rel.PacketID = id
+	if err = c.write(rel); err != nil {
+		return err
+	}
+	reply, err = c.wait(ctx, ack)
+	if err != nil {
+		return err
+	}
+	if _, ok := reply.(*packets.PubcompPacket); !ok {
+		return ErrUnexpectedAck
+	}
+	c.stats.Delivered(time.Since(start))
+	return nil
+}
+
+// Subscribe 订阅主题, 返回SUBACK中的返回码
+func (c *Client) Subscribe(ctx context.Context, topics []string, qoss []byte) ([]byte, error) {
+	if len(topics) != len(qoss) {
+		return nil, fmt.Errorf("%d topics but %d qos values", len(topics), len(qoss))
+	}
+	id, ack, err := c.register(0)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	pk := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+	pk.PacketID = id
+	pk.Topics = topics
+	pk.Qoss = qoss
+	if err = c.write(pk); err != nil {
+		return nil, err
+	}
+	reply, err := c.wait(ctx, ack)
+	if err != nil {
+		return nil, err
+	}
+	suback, ok := reply.(*packets.SubackPacket)
+	if !ok {
+		return nil, ErrUnexpectedAck
+	}
+	return suback.ReturnCodes, nil
+}
+
+// Unsubscribe 取消订阅
+func (c *Client) Unsubscribe(ctx context.Context, topics ...string) error {
+	id, ack, err := c.register(0)
+	if err != nil {
+		return err
+	}
+	defer c.unregister(id)
+
+	pk := packets.NewControlPacket(packets.UNSUBSCRIBE).(*packets.UnsubscribePacket)
+	pk.PacketID = id
+	pk.Topics = topics
+	if err = c.write(pk); err != nil {
+		return err
+	}
+	reply, err := c.wait(ctx, ack)
+	if err != nil {
+		return err
+	}
+	if _, ok := reply.(*packets.UnsubackPacket); !ok {
+		return ErrUnexpectedAck
+	}
+	return nil
+}
+
+// Handle 注册主题过滤器的消息处理函数, 返回注销的函数
+// 收到的消息交给所有匹配的处理函数, 没有匹配时交给 Options.OnMessage
+// Handle 只在客户端内部分发消息, 需要另外调用 Subscribe 订阅
+func (c *Client) Handle(filter string, h Handler) (remove func()) {
+	r := &route{filter: filter, handler: h}
+	c.mu.Lock()
+	c.routes = append(c.routes, r)
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, other := range c.routes {
+			if other == r {
+				c.routes = append(c.routes[:i:i], c.routes[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Disconnect 发送DISCONNECT并关闭连接
+func (c *Client) Disconnect() error {
+	err := c.write(packets.NewControlPacket(packets.DISCONNECT))
+	c.close(ErrClosed)
+	return err
+}
+
+// Close 不发送DISCONNECT直接关闭连接, 服务端会发布遗嘱
+func (c *Client) Close() error {
+	c.close(ErrClosed)
+	return nil
+}
+
+// handshake 发送CONNECT并等待CONNACK
+func (c *Client) handshake() error {
+	pk := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	pk.ProtocolName = "MQTT"
+	pk.ProtocolLevel = c.opts.ProtocolLevel
+	if pk.ProtocolLevel == 0 {
+		pk.ProtocolLevel = 4
+	}
+	pk.ClientIdentifier = c.opts.ClientID
+	pk.CleanSession = c.opts.CleanSession
+	pk.KeepAlive = c.opts.KeepAlive
+	if c.opts.Username != "" {
+		pk.UsernameFlag = true
+		pk.Username = c.opts.Username
+	}
+	if c.opts.Password != nil {
+		pk.PasswordFlag = true
+		pk.Password = c.opts.Password
+	}
+	if c.opts.WillTopic != "" {
+		pk.WillFlag = true
+		pk.WillTopic = c.opts.WillTopic
+		pk.WillMessage = c.opts.WillMessage
+		pk.WillQos = c.opts.WillQos
+		pk.WillRetain = c.opts.WillRetain
+	}
+
+	if c.opts.ConnectTimeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.opts.ConnectTimeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if err := c.send(pk); err != nil {
+		return err
+	}
+	reply, _, err := c.read()
+	if err != nil {
+		return err
+	}
+	connack, ok := reply.(*packets.ConnackPacket)
+	if !ok {
+		return fmt.Errorf("expected CONNACK, got %s", reply)
+	}
+	c.stats.Connack(connack.ReturnCode)
+	if connack.ReturnCode != packets.Accepted {
+		return &ConnackError{ReturnCode: connack.ReturnCode}
+	}
+	c.sessionPresent = connack.SessionPresent
+	return nil
+}
+
+// readLoop 读取并分发报文
+func (c *Client) readLoop() {
+	for {
+		before := c.r.n
+		pk, payload, err := c.read()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		if payload != nil {
+			err = c.receiveStream(pk.(*packets.PublishPacket), payload, before)
+		} else {
+			err = c.dispatch(pk)
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// dispatch 处理收到的报文
+func (c *Client) dispatch(pk packets.ControlPacket) error {
+	switch p := pk.(type) {
+	case *packets.PublishPacket:
+		c.stats.Payload(len(p.Payload))
+		return c.receive(p, c.deliver)
+	case *packets.PubrelPacket:
+		c.mu.Lock()
+		delete(c.received, p.PacketID)
+		c.mu.Unlock()
+		comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+		comp.PacketID = p.PacketID
+		return c.write(comp)
+	case *packets.PubackPacket:
+		c.ack(p.PacketID, p)
+	case *packets.PubrecPacket:
+		c.ack(p.PacketID, p)
+	case *packets.PubcompPacket:
+		c.ack(p.PacketID, p)
+	case *packets.SubackPacket:
+		c.ack(p.PacketID, p)
+	case *packets.UnsubackPacket:
+		c.ack(p.PacketID, p)
+	case *packets.PingrespPacket:
+		select {
+		case c.pong <- struct{}{}:
+		default:
+		}
+	default:
+		return fmt.Errorf("unexpected packet from server: %s", pk)
+	}
+	return nil
+}
+
+// receiveStream 处理有效负载交给 OnStream 的PUBLISH报文, 有效负载读完后统计
+func (c *Client) receiveStream(pk *packets.PublishPacket, payload *packets.PayloadReader, before int) error {
+	c.stats.Payload(payload.Len())
+	var derr error
+	err := c.receive(pk, func(pk *packets.PublishPacket) {
+		c.opts.OnStream(c, pk, payload)
+		// 有效负载读完之后才确认
+		derr = payload.Discard()
+	})
+	if err == nil {
+		err = derr
+	}
+	if derr = payload.Discard(); err == nil {
+		err = derr
+	}
+	c.stats.Received(packets.PUBLISH, c.r.n-before)
+	return err
+}
+
+// receive 处理收到的PUBLISH报文, 用 deliver 投递给处理函数
+func (c *Client) receive(pk *packets.PublishPacket, deliver func(pk *packets.PublishPacket)) error {
+	switch pk.Qos {
+	case 0:
+		deliver(pk)
+	case 1:
+		deliver(pk)
+		if c.opts.ManualAck {
+			return nil
+		}
+		return c.Ack(pk)
+	case 2:
+		// 收到PUBREL之前重发的消息不再投递, 已确认过时再次发送PUBREC
+		// 设置了 ManualAck 时还未确认的消息再次投递
+		c.mu.Lock()
+		acked := c.received[pk.PacketID]
+		c.received[pk.PacketID] = acked
+		c.mu.Unlock()
+		if !acked {
+			deliver(pk)
+		}
+		if c.opts.ManualAck && !acked {
+			return nil
+		}
+		return c.Ack(pk)
+	default:
+		return fmt.Errorf("invalid QoS %d in PUBLISH", pk.Qos)
+	}
+	return nil
+}
+
+// Ack 确认收到的QoS 1或QoS 2消息, 发送PUBACK或PUBREC, QoS 0消息不需要确认
+// 只在设置了 ManualAck 时需要调用
+func (c *Client) Ack(pk *packets.PublishPacket) error {
+	switch pk.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+		ack.PacketID = pk.PacketID
+		return c.write(ack)
+	case 2:
+		c.mu.Lock()
+		c.received[pk.PacketID] = true
+		c.mu.Unlock()
+		rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+		rec.PacketID = pk.PacketID
+		return c.write(rec)
+	}
+	return nil
+}
+
+// deliver 调用消息处理函数
+func (c *Client) deliver(pk *packets.PublishPacket) {
+	// 注销时复制切片, 这里可以不持有锁遍历
+	c.mu.Lock()
+	routes := c.routes
+	c.mu.Unlock()
+	matched := false
+	for _, r := range routes {
+		if packets.MatchTopic(r.filter, pk.TopicName) {
+			r.handler(c, pk)
+			matched = true
+		}
+	}
+	if !matched && c.opts.OnMessage != nil {
+		c.opts.OnMessage(c, pk)
+	}
+}
+
+// keepAlive 定时发送PINGREQ, 超时未收到PINGRESP时关闭连接
+func (c *Client) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	waiting := false
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.pong:
+			waiting = false
+		case <-ticker.C:
+			if waiting {
+				c.close(errors.New("keepalive timeout"))
+				return
+			}
+			if err := c.write(packets.NewControlPacket(packets.PINGREQ)); err != nil {
+				c.close(err)
+				return
+			}
+			waiting = true
+		}
+	}
+}
+
+// write 写入报文
+func (c *Client) write(pk packets.ControlPacket) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	err := c.send(pk)
+	if err != nil {
+		go c.close(err)
+	}
+	return err
+}
+
+// writeStream 写入有效负载从 payload 读取的PUBLISH报文, 写入失败时连接不能继续使用
+func (c *Client) writeStream(pk *packets.PublishPacket, payload io.Reader, size int) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	w := &writer{Writer: c.conn}
+	err := pk.WriteStream(w, payload, size)
+	if err != nil {
+		go c.close(err)
+		return err
+	}
+	c.stats.Sent(packets.PUBLISH, w.n)
+	return nil
+}
+
+// send 编码并写出报文, 调用者需持有写锁或在握手中调用
+func (c *Client) send(pk packets.ControlPacket) error {
+	buf := packets.AcquireBuffer()
+	defer packets.ReleaseBuffer(buf)
+	pk.Write(buf)
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	c.stats.Sent(packets.HeaderOf(pk).PacketType, buf.Len())
+	return nil
+}
+
+// read 读取报文并统计, 只在握手和读协程中调用
+// 有效负载交给 OnStream 时返回有效负载的读取器, 报文由调用方读完有效负载后统计
+func (c *Client) read() (packets.ControlPacket, *packets.PayloadReader, error) {
+	before := c.r.n
+	if c.sr == nil {
+		pk, err := packets.ReadPacket(c.r)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.stats.Received(packets.HeaderOf(pk).PacketType, c.r.n-before)
+		return pk, nil, nil
+	}
+
+	pk, payload, err := c.sr.ReadPacket()
+	if err != nil {
+		return nil, nil, err
+	}
+	if payload != nil && payload.Len() > c.opts.StreamThreshold {
+		return pk, payload, nil
+	}
+	if payload != nil {
+		p := pk.(*packets.PublishPacket)
+		p.Payload = make([]byte, payload.Len())
+		if _, err = io.ReadFull(payload, p.Payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.stats.Received(packets.HeaderOf(pk).PacketType, c.r.n-before)
+	return pk, nil, nil
+}
+
+// reader 统计读取的字节数
+type reader struct {
+	io.Reader
+	n int
+}
+
+// Read 读取并累加字节数
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+// writer 统计写出的字节数
+type writer struct {
+	io.Writer
+	n int
+}
+
+// Write 写出并累加字节数
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += n
+	return n, err
+}
+
+// register 分配报文标识符并登记等待确认, reuse 不为0时使用该标识符
+func (c *Client) register(reuse uint16) (uint16, chan packets.ControlPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return 0, nil, c.err
+	default:
+	}
+	if reuse != 0 {
+		if _, ok := c.pending[reuse]; ok {
+			return 0, nil, fmt.Errorf("packet identifier %d is in use", reuse)
+		}
+		ch := make(chan packets.ControlPacket, 1)
+		c.pending[reuse] = ch
+		return reuse, ch, nil
+	}
+	for i := 0; i < 65535; i++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, ok := c.pending[c.nextID]; !ok {
+			ch := make(chan packets.ControlPacket, 1)
+			c.pending[c.nextID] = ch
+			return c.nextID, ch, nil
+		}
+	}
+	return 0, nil, ErrNoPacketID
+}
+
+// unregister 释放报文标识符
+func (c *Client) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// ack 把确认报文交给等待者
+func (c *Client) ack(id uint16, pk packets.ControlPacket) {
+	c.mu.Lock()
+	ch, ok := c.pending[id]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case ch <- pk:
+		default:
+		}
+	}
+}
+
+// wait 等待确认报文
+func (c *Client) wait(ctx context.Context, ack chan packets.ControlPacket) (packets.ControlPacket, error) {
+	select {
+	case pk := <-ack:
+		return pk, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// close 关闭连接并记录原因
+func (c *Client) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+	c.stats.ClientDisconnected()
+}
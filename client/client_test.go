@@ -0,0 +1,212 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/internal/testbroker"
+	"github.com/boxungo/mqtt/packets"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	b, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got := make(chan *packets.PublishPacket, 3)
+	c, err := Dial("tcp", b.Addr(), Options{
+		ClientID:     "test",
+		CleanSession: true,
+		KeepAlive:    1,
+		OnMessage: func(c *Client, pk *packets.PublishPacket) {
+			got <- pk
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial returned error: %s", err)
+	}
+	defer c.Disconnect()
+
+	codes, err := c.Subscribe(ctx, []string{"a/+", "a/#/b"}, []byte{2, 0})
+	if err != nil || !bytes.Equal(codes, []byte{2, 0x80}) {
+		t.Fatalf("Subscribe returned (%v, %v), should be ([2 128], nil)", codes, err)
+	}
+	for qos := byte(0); qos <= 2; qos++ {
+		pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		pk.Qos = qos
+		pk.TopicName = "a/b"
+		pk.Payload = []byte{qos}
+		if err = c.Publish(ctx, pk); err != nil {
+			t.Fatalf("Publish at QoS %d returned error: %s", qos, err)
+		}
+		select {
+		case in := <-got:
+			if in.Qos != qos || !bytes.Equal(in.Payload, []byte{qos}) {
+				t.Errorf("received %s, should be QoS %d", in, qos)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message at QoS %d was not received", qos)
+		}
+	}
+	snap := c.Stats().Snapshot()
+	if snap.PacketsSent[packets.PUBLISH] != 3 || snap.PacketsReceived[packets.PUBLISH] != 3 || snap.PacketsReceived[packets.CONNACK] != 1 {
+		t.Errorf("stats counted %d PUBLISH sent, %d received", snap.PacketsSent[packets.PUBLISH], snap.PacketsReceived[packets.PUBLISH])
+	}
+	if snap.BytesSent[packets.CONNECT] == 0 || snap.Inflight != 0 || snap.ClientsConnected != 1 {
+		t.Errorf("stats snapshot is %+v", snap)
+	}
+	if err = c.Unsubscribe(ctx, "a/+"); err != nil {
+		t.Errorf("Unsubscribe returned error: %s", err)
+	}
+
+	// 保持连接
+	time.Sleep(2500 * time.Millisecond)
+	if err = c.Err(); err != nil {
+		t.Errorf("client closed during keepalive: %s", err)
+	}
+}
+
+func TestConnackError(t *testing.T) {
+	b, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	_, err = Dial("tcp", b.Addr(), Options{CleanSession: false})
+	var ce *ConnackError
+	if !errors.As(err, &ce) || ce.ReturnCode != packets.ErrRefusedIDRejected {
+		t.Errorf("Dial returned %v, should be refused with %d", err, packets.ErrRefusedIDRejected)
+	}
+}
+
+func TestPublishDupReusesID(t *testing.T) {
+	b, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got := make(chan *packets.PublishPacket, 1)
+	c, err := Dial("tcp", b.Addr(), Options{
+		CleanSession: true,
+		OnMessage: func(c *Client, pk *packets.PublishPacket) {
+			got <- pk
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial returned error: %s", err)
+	}
+	defer c.Disconnect()
+	if _, err = c.Subscribe(ctx, []string{"a"}, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重发的消息沿用原来的报文标识符
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.Qos = 1
+	pk.TopicName = "a"
+	pk.Dup = true
+	pk.PacketID = 42
+	if err = c.Publish(ctx, pk); err != nil {
+		t.Fatalf("Publish returned error: %s", err)
+	}
+	select {
+	case in := <-got:
+		if in.PacketID != 42 {
+			t.Errorf("resent message has packet identifier %d, should be 42", in.PacketID)
+		}
+	case <-ctx.Done():
+		t.Fatal("message was not received")
+	}
+}
+
+func TestStream(t *testing.T) {
+	b, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got := make(chan []byte, 3)
+	c, err := Dial("tcp", b.Addr(), Options{
+		CleanSession: true,
+		OnMessage: func(c *Client, pk *packets.PublishPacket) {
+			got <- pk.Payload
+		},
+		OnStream: func(c *Client, pk *packets.PublishPacket, payload io.Reader) {
+			// 只读一半, 剩下的由客户端丢弃
+			half := make([]byte, 64*1024)
+			io.ReadFull(payload, half)
+			got <- half
+		},
+		StreamThreshold: 1024,
+	})
+	if err != nil {
+		t.Fatalf("Dial returned error: %s", err)
+	}
+	defer c.Disconnect()
+	if _, err = c.Subscribe(ctx, []string{"firmware"}, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	image := bytes.Repeat([]byte("0123456789abcdef"), 8*1024)
+	for qos := byte(0); qos <= 2; qos++ {
+		pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		pk.Qos = qos
+		pk.TopicName = "firmware"
+		if err = c.PublishStream(ctx, pk, bytes.NewReader(image), len(image)); err != nil {
+			t.Fatalf("PublishStream at QoS %d returned error: %s", qos, err)
+		}
+		select {
+		case in := <-got:
+			if !bytes.Equal(in, image[:len(in)]) || len(in) != 64*1024 {
+				t.Errorf("streamed payload at QoS %d differs", qos)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message at QoS %d was not received", qos)
+		}
+	}
+
+	// 不超过 StreamThreshold 的消息照常读入内存
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName = "firmware"
+	pk.Payload = []byte("small")
+	if err = c.Publish(ctx, pk); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case in := <-got:
+		if string(in) != "small" {
+			t.Errorf("received %q, should be small", in)
+		}
+	case <-ctx.Done():
+		t.Fatal("small message was not received")
+	}
+	snap := c.Stats().Snapshot()
+	if snap.PacketsReceived[packets.PUBLISH] != 4 || snap.BytesReceived[packets.PUBLISH] != snap.BytesSent[packets.PUBLISH] {
+		t.Errorf("stats received %d PUBLISH with %d bytes, sent %d bytes", snap.PacketsReceived[packets.PUBLISH], snap.BytesReceived[packets.PUBLISH], snap.BytesSent[packets.PUBLISH])
+	}
+
+	// 有效负载不足时关闭客户端
+	if err = c.PublishStream(ctx, pk, bytes.NewReader(image[:10]), len(image)); err != io.ErrUnexpectedEOF {
+		t.Errorf("short payload returned %v, should be %v", err, io.ErrUnexpectedEOF)
+	}
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Error("client was not closed after a short payload")
+	}
+}
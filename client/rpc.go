@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// 基于发布订阅的请求/响应
+// MQTT 5在PUBLISH属性中携带 Response Topic 和 Correlation Data,
+// packets 只实现了3.1.1, 这里用JSON信封携带同样的字段:
+// 请求方订阅自己的回复主题, 请求的信封中带上回复主题和关联数据,
+// 响应方把结果发布到回复主题, 回复的信封中原样带回关联数据
+
+// ReplySuffix 默认回复主题的后缀, 默认回复主题为 {ClientID}/reply
+const ReplySuffix = "/reply"
+
+// DefaultConcurrency 响应方默认同时处理的请求数上限
+const DefaultConcurrency = 64
+
+// ErrNoReply 请求超时前没有收到回复, 可能没有响应方订阅请求的主题或响应方繁忙
+var ErrNoReply = errors.New("rpc: no reply")
+
+// Envelope 请求和回复的JSON信封, 有效负载以base64编码
+type Envelope struct {
+	ResponseTopic   string `json:"response_topic,omitempty"`
+	CorrelationData []byte `json:"correlation_data,omitempty"`
+	Payload         []byte `json:"payload,omitempty"`
+	Error           string `json:"error,omitempty"` // 响应方处理失败的原因, 只出现在回复中
+}
+
+// RemoteError 响应方返回的错误
+type RemoteError struct {
+	Message string
+}
+
+// Error ...
+func (e *RemoteError) Error() string {
+	return "rpc: " + e.Message
+}
+
+// Requester 请求方, 可并发使用
+type Requester struct {
+	c          *Client
+	replyTopic string
+	qos        byte
+	prefix     [8]byte // 区分客户端重连前后的请求
+	remove     func()
+
+	mu      sync.Mutex
+	next    uint64
+	pending map[string]chan *Envelope
+}
+
+// NewRequester 订阅回复主题并新建请求方
+// replyTopic 为空时使用 {ClientID}/reply, 客户端标识符为空(由服务端分配)时必须指定, 同一个回复主题只能有一个请求方
+// qos 为发布请求的QoS和订阅回复主题的QoS
+// 回复主题上的消息由请求方处理, 不再交给 Options.OnMessage
+func NewRequester(ctx context.Context, c *Client, replyTopic string, qos byte) (*Requester, error) {
+	if replyTopic == "" {
+		if c.opts.ClientID == "" {
+			return nil, errors.New("rpc: reply topic is required without a client identifier")
+		}
+		replyTopic = c.opts.ClientID + ReplySuffix
+	}
+	if !packets.ValidTopicName(replyTopic) {
+		return nil, fmt.Errorf("rpc: invalid reply topic %q", replyTopic)
+	}
+	r := &Requester{c: c, replyTopic: replyTopic, qos: qos, pending: make(map[string]chan *Envelope)}
+	rand.Read(r.prefix[:])
+	r.remove = c.Handle(replyTopic, r.reply)
+	codes, err := c.Subscribe(ctx, []string{replyTopic}, []byte{qos})
+	if err == nil && codes[0] > 2 {
+		err = fmt.Errorf("rpc: subscription to %s refused", replyTopic)
+	}
+	if err != nil {
+		r.remove()
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReplyTopic 回复主题
+func (r *Requester) ReplyTopic() string {
+	return r.replyTopic
+}
+
+// Request 发布请求并等待回复
+// ctx 超时返回同时包装了 ErrNoReply 和 context.DeadlineExceeded 的错误, 响应方返回错误时返回 *RemoteError
+// 与 Publish 一样不能在消息处理函数中调用
+func (r *Requester) Request(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	correlation := make([]byte, 16)
+	copy(correlation, r.prefix[:])
+	ch := make(chan *Envelope, 1)
+	r.mu.Lock()
+	r.next++
+	binary.BigEndian.PutUint64(correlation[8:], r.next)
+	r.pending[string(correlation)] = ch
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, string(correlation))
+		r.mu.Unlock()
+	}()
+
+	data, err := json.Marshal(&Envelope{ResponseTopic: r.replyTopic, CorrelationData: correlation, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName = topic
+	pk.Qos = r.qos
+	pk.Payload = data
+	if err = r.c.Publish(ctx, pk); err != nil {
+		return nil, err
+	}
+
+	select {
+	case env := <-ch:
+		if env.Error != "" {
+			return nil, &RemoteError{Message: env.Error}
+		}
+		return env.Payload, nil
+	case <-r.c.done:
+		return nil, r.c.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%w: %w", ErrNoReply, ctx.Err())
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Close 取消订阅回复主题, 正在等待的请求会等到各自的 ctx 结束
+func (r *Requester) Close(ctx context.Context) error {
+	r.remove()
+	return r.c.Unsubscribe(ctx, r.replyTopic)
+}
+
+// reply 在读协程中把回复交给等待的请求, 无法解析或已超时的回复丢弃
+func (r *Requester) reply(c *Client, pk *packets.PublishPacket) {
+	var env Envelope
+	if json.Unmarshal(pk.Payload, &env) != nil {
+		return
+	}
+	r.mu.Lock()
+	ch, ok := r.pending[string(env.CorrelationData)]
+	r.mu.Unlock()
+	if ok {
+		select {
+		case ch <- &env:
+		default:
+		}
+	}
+}
+
+// RequestHandler 处理一个请求, 返回的数据或错误发布给请求方
+// ctx 在 Responder 关闭或连接断开时取消
+type RequestHandler func(ctx context.Context, topic string, payload []byte) ([]byte, error)
+
+// Responder 响应方, 处理订阅的主题上收到的请求
+type Responder struct {
+	c       *Client
+	filter  string
+	qos     byte
+	handler RequestHandler
+	remove  func()
+	ctx     context.Context
+	cancel  context.CancelFunc
+	slots   chan struct{} // 正在处理的请求
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Serve 订阅 filter 并用 h 处理收到的请求, qos 为订阅和发布回复的QoS
+// 每个请求在单独的协程中处理, 处理函数中可以发布消息和发出请求
+// limit 为同时处理的请求数上限, 不大于0时使用 DefaultConcurrency, 超过上限时丢弃请求, 请求方超时后返回 ErrNoReply
+// filter 匹配的消息由响应方处理, 不再交给 Options.OnMessage
+func Serve(ctx context.Context, c *Client, filter string, qos byte, limit int, h RequestHandler) (*Responder, error) {
+	if limit <= 0 {
+		limit = DefaultConcurrency
+	}
+	s := &Responder{c: c, filter: filter, qos: qos, handler: h, slots: make(chan struct{}, limit)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.done:
+			s.cancel()
+		case <-s.ctx.Done():
+		}
+	}()
+	s.remove = c.Handle(filter, s.receive)
+	codes, err := c.Subscribe(ctx, []string{filter}, []byte{qos})
+	if err == nil && codes[0] > 2 {
+		err = fmt.Errorf("rpc: subscription to %s refused", filter)
+	}
+	if err != nil {
+		s.remove()
+		s.cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close 取消订阅, 取消正在处理的请求的 ctx 并等待处理结束
+func (s *Responder) Close(ctx context.Context) error {
+	s.remove()
+	err := s.c.Unsubscribe(ctx, s.filter)
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return err
+}
+
+// receive 在读协程中收到请求, 启动处理协程
+// 不能在读协程中等待空闲: 处理函数发布回复时需要读协程接收确认
+func (s *Responder) receive(c *Client, pk *packets.PublishPacket) {
+	var env Envelope
+	if json.Unmarshal(pk.Payload, &env) != nil {
+		return
+	}
+	topic := pk.TopicName
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.slots }()
+		payload, err := s.handler(s.ctx, topic, env.Payload)
+		if env.ResponseTopic == "" || !packets.ValidTopicName(env.ResponseTopic) {
+			return
+		}
+		out := Envelope{CorrelationData: env.CorrelationData, Payload: payload}
+		if err != nil {
+			out = Envelope{CorrelationData: env.CorrelationData, Error: err.Error()}
+		}
+		data, err := json.Marshal(&out)
+		if err != nil {
+			return
+		}
+		reply := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		reply.TopicName = env.ResponseTopic
+		reply.Qos = s.qos
+		reply.Payload = data
+		s.c.Publish(s.ctx, reply)
+	}()
+}
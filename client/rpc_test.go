@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/internal/testbroker"
+	"github.com/boxungo/mqtt/packets"
+)
+
+func TestRequestResponse(t *testing.T) {
+	b, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	other := make(chan *packets.PublishPacket, 10)
+	device, err := Dial("tcp", b.Addr(), Options{ClientID: "device", CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	caller, err := Dial("tcp", b.Addr(), Options{ClientID: "caller", CleanSession: true, OnMessage: func(c *Client, pk *packets.PublishPacket) { other <- pk }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	s, err := Serve(ctx, device, "devices/device/rpc/+", 1, 0, func(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+		if strings.HasSuffix(topic, "/fail") {
+			return nil, errors.New("firmware busy")
+		}
+		return append([]byte(topic+":"), payload...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRequester(ctx, caller, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ReplyTopic() != "caller/reply" {
+		t.Errorf("ReplyTopic() = %q", r.ReplyTopic())
+	}
+
+	// 并发的请求各自收到自己的回复
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := fmt.Sprint(i)
+			reply, err := r.Request(ctx, "devices/device/rpc/echo", []byte(payload))
+			if want := "devices/device/rpc/echo:" + payload; err != nil || string(reply) != want {
+				t.Errorf("Request returned %q, %v, should be %q", reply, err, want)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var remote *RemoteError
+	if _, err = r.Request(ctx, "devices/device/rpc/fail", nil); !errors.As(err, &remote) || remote.Message != "firmware busy" {
+		t.Errorf("failed request returned %v", err)
+	}
+
+	// 没有响应方时超时
+	short, stop := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer stop()
+	if _, err = r.Request(short, "devices/other/rpc/echo", nil); !errors.Is(err, ErrNoReply) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("request without a responder returned %v", err)
+	}
+	if err = s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	short, stop = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer stop()
+	if _, err = r.Request(short, "devices/device/rpc/echo", nil); !errors.Is(err, ErrNoReply) {
+		t.Errorf("request after the responder closed returned %v", err)
+	}
+	if err = r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// 回复主题的消息交给了 Requester, 不会到达 OnMessage
+	select {
+	case pk := <-other:
+		t.Errorf("OnMessage received %s", pk)
+	default:
+	}
+}
+
+func TestResponderLimit(t *testing.T) {
+	b, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	device, err := Dial("tcp", b.Addr(), Options{ClientID: "device", CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	caller, err := Dial("tcp", b.Addr(), Options{CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	if _, err = NewRequester(ctx, caller, "", 1); err == nil {
+		t.Error("NewRequester without a client identifier or reply topic should fail")
+	}
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s, err := Serve(ctx, device, "rpc/+", 1, 1, func(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+		if topic == "rpc/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		return payload, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+	r, err := NewRequester(ctx, caller, "caller/reply", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 达到上限时丢弃请求, 处理结束后恢复
+	slow := make(chan error, 1)
+	go func() {
+		_, err := r.Request(ctx, "rpc/slow", nil)
+		slow <- err
+	}()
+	<-started
+	short, stop := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer stop()
+	if _, err = r.Request(short, "rpc/fast", nil); !errors.Is(err, ErrNoReply) {
+		t.Errorf("request over the limit returned %v", err)
+	}
+	close(release)
+	if err = <-slow; err != nil {
+		t.Errorf("slow request returned %v", err)
+	}
+	if reply, err := r.Request(ctx, "rpc/fast", []byte("ok")); err != nil || string(reply) != "ok" {
+		t.Errorf("request after the limit cleared returned %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,457 @@
+// Package cluster 集群节点间的订阅交换和消息转发
+// 节点之间全连接, 节点协议复用MQTT报文: 每条节点消息是主题为 $cluster/{kind} 的PUBLISH报文
+// 共享订阅由收到发布的节点在有成员的节点中轮流选择一个, 被选中的节点再在本地选择成员
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// 节点消息类型
+const (
+	kindHello       = "$cluster/hello"       // 负载为节点ID
+	kindSubscribe   = "$cluster/subscribe"   // 负载为主题过滤器
+	kindUnsubscribe = "$cluster/unsubscribe" // 负载为主题过滤器
+	kindPublish     = "$cluster/publish"     // 负载为本节点负责投递的共享订阅和编码后的PUBLISH报文
+	kindRetain      = "$cluster/retain"      // 负载为编码后的保留消息
+	kindTakeover    = "$cluster/takeover"    // 负载为客户端标识符
+)
+
+// DefaultHandshakeTimeout 默认的交换节点ID的超时时间
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// 节点错误
+var (
+	ErrDuplicateNode = errors.New("duplicate cluster node")
+	ErrClosed        = errors.New("cluster node closed")
+)
+
+// Node 集群节点, 可并发使用
+type Node struct {
+	ID               string
+	HandshakeTimeout time.Duration                                    // 交换节点ID的超时时间, 为0时使用 DefaultHandshakeTimeout
+	OnPublish        func(pk *packets.PublishPacket, shared []string) // 收到其他节点转发的消息, 只投递给本地订阅者和 shared 中的共享订阅
+	OnRetain         func(pk *packets.PublishPacket)                  // 收到其他节点复制的保留消息
+	OnTakeover       func(clientID string)                            // 客户端在其他节点上连接, 应断开本地的同名客户端
+
+	mu      sync.Mutex
+	subs    map[string]int    // 本地主题过滤器的引用计数
+	shared  map[string]uint64 // 共享订阅在节点间的轮询计数
+	peers   map[string]*peer
+	joining map[net.Conn]bool // 正在交换节点ID的连接, 关闭节点时断开
+	closed  bool
+}
+
+// peer 对端节点
+type peer struct {
+	id        string
+	conn      net.Conn
+	initiator string // 发起连接的节点ID
+	wmu       sync.Mutex
+	subs      map[string]bool // 对端的主题过滤器
+}
+
+// NewNode 新建集群节点
+func NewNode(id string) *Node {
+	return &Node{
+		ID:      id,
+		subs:    make(map[string]int),
+		shared:  make(map[string]uint64),
+		peers:   make(map[string]*peer),
+		joining: make(map[net.Conn]bool),
+	}
+}
+
+// Serve 接受其他节点的连接, 直到监听关闭
+func (n *Node) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go n.Accept(conn)
+	}
+}
+
+// Join 通过本节点发起的连接加入对端节点, 交换节点ID和订阅表后在后台处理节点消息
+func (n *Node) Join(conn net.Conn) error {
+	return n.join(conn, true)
+}
+
+// Accept 通过对端发起的连接加入对端节点, 与 Join 相同
+func (n *Node) Accept(conn net.Conn) error {
+	return n.join(conn, false)
+}
+
+// join 交换节点ID后登记对端
+// 两个节点同时互相连接时, 两端都保留由ID较小的节点发起的连接, 另一个连接返回 ErrDuplicateNode
+func (n *Node) join(conn net.Conn, dialed bool) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	n.joining[conn] = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.joining, conn)
+		n.mu.Unlock()
+	}()
+
+	// 对端接受了连接但不发送节点ID时不能一直等待
+	timeout := n.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	errc := make(chan error, 1)
+	go func() { errc <- send(conn, new(sync.Mutex), kindHello, []byte(n.ID)) }()
+	pk, err := packets.ReadPacket(conn)
+	if err == nil {
+		err = <-errc
+	}
+	if err != nil {
+		conn.Close()
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.closed {
+			return ErrClosed
+		}
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	hello, ok := pk.(*packets.PublishPacket)
+	if !ok || hello.TopicName != kindHello {
+		conn.Close()
+		return fmt.Errorf("expected cluster hello, got %s", pk)
+	}
+
+	p := &peer{id: string(hello.Payload), conn: conn, initiator: string(hello.Payload), subs: make(map[string]bool)}
+	if dialed {
+		p.initiator = n.ID
+	}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	old := n.peers[p.id]
+	if p.id == n.ID || old != nil && !p.preferred(old, n.ID) {
+		n.mu.Unlock()
+		conn.Close()
+		return ErrDuplicateNode
+	}
+	n.peers[p.id] = p
+	filters := n.filters()
+	n.mu.Unlock()
+	if old != nil {
+		old.conn.Close()
+	}
+
+	go n.serve(p)
+	for _, filter := range filters {
+		if err = p.send(kindSubscribe, []byte(filter)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Peers 已连接的对端节点ID
+func (n *Node) Peers() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ids := make([]string, 0, len(n.peers))
+	for id := range n.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Subscribe 本地新增订阅, 过滤器首次出现时通知其他节点
+func (n *Node) Subscribe(filter string) {
+	n.mu.Lock()
+	n.subs[filter]++
+	first := n.subs[filter] == 1
+	peers := n.peerList()
+	n.mu.Unlock()
+	if first {
+		broadcast(peers, kindSubscribe, []byte(filter))
+	}
+}
+
+// Unsubscribe 本地取消订阅, 过滤器不再被引用时通知其他节点
+func (n *Node) Unsubscribe(filter string) {
+	n.mu.Lock()
+	if n.subs[filter] == 0 {
+		n.mu.Unlock()
+		return
+	}
+	n.subs[filter]--
+	last := n.subs[filter] == 0
+	if last {
+		delete(n.subs, filter)
+	}
+	peers := n.peerList()
+	n.mu.Unlock()
+	if last {
+		broadcast(peers, kindUnsubscribe, []byte(filter))
+	}
+}
+
+// Publish 把本地收到的消息转发给有匹配订阅的节点, 返回转发的节点数和由本节点投递的共享订阅
+// 每个匹配的共享订阅在有成员的节点中只选择一个, 本地的订阅者只应收到 local 中的共享订阅
+func (n *Node) Publish(pk *packets.PublishPacket) (forwarded int, local []string) {
+	n.mu.Lock()
+	targets := make(map[*peer][]string) // 有匹配订阅的对端 -> 由该对端投递的共享订阅
+	groups := make(map[string][]*peer)  // 匹配的共享订阅 -> 有成员的节点, nil表示本节点
+	for filter := range n.subs {
+		if _, _, ok := packets.ParseSharedFilter(filter); ok && packets.MatchTopic(filter, pk.TopicName) {
+			groups[filter] = append(groups[filter], nil)
+		}
+	}
+	for _, p := range n.peers {
+		for filter := range p.subs {
+			if !packets.MatchTopic(filter, pk.TopicName) {
+				continue
+			}
+			if _, _, ok := packets.ParseSharedFilter(filter); ok {
+				groups[filter] = append(groups[filter], p)
+			} else if _, ok := targets[p]; !ok {
+				targets[p] = nil
+			}
+		}
+	}
+	for filter, nodes := range groups {
+		sort.Slice(nodes, func(i, j int) bool { return nodeID(nodes[i], n.ID) < nodeID(nodes[j], n.ID) })
+		i := n.shared[filter]
+		n.shared[filter] = i + 1
+		if p := nodes[i%uint64(len(nodes))]; p != nil {
+			targets[p] = append(targets[p], filter)
+		} else {
+			local = append(local, filter)
+		}
+	}
+	n.mu.Unlock()
+
+	for p, shared := range targets {
+		p.send(kindPublish, encodePublish(pk, shared))
+	}
+	return len(targets), local
+}
+
+// nodeID 共享订阅成员所在节点的ID, nil表示本节点
+func nodeID(p *peer, self string) string {
+	if p == nil {
+		return self
+	}
+	return p.id
+}
+
+// Retain 把保留消息复制到所有节点, 空负载表示删除
+func (n *Node) Retain(pk *packets.PublishPacket) {
+	n.mu.Lock()
+	peers := n.peerList()
+	n.mu.Unlock()
+	broadcast(peers, kindRetain, encode(pk))
+}
+
+// Connected 客户端连接到本节点, 通知其他节点断开同名客户端
+func (n *Node) Connected(clientID string) {
+	n.mu.Lock()
+	peers := n.peerList()
+	n.mu.Unlock()
+	broadcast(peers, kindTakeover, []byte(clientID))
+}
+
+// Close 断开所有对端节点和正在交换节点ID的连接, 之后不再接受新的连接
+func (n *Node) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	for conn := range n.joining {
+		conn.Close()
+	}
+	for _, p := range n.peers {
+		p.conn.Close()
+	}
+}
+
+// serve 处理对端节点的消息, 连接断开时移除对端
+func (n *Node) serve(p *peer) {
+	defer func() {
+		n.mu.Lock()
+		if n.peers[p.id] == p {
+			delete(n.peers, p.id)
+		}
+		n.mu.Unlock()
+		p.conn.Close()
+	}()
+	for {
+		pk, err := packets.ReadPacket(p.conn)
+		if err != nil {
+			return
+		}
+		msg, ok := pk.(*packets.PublishPacket)
+		if !ok {
+			return
+		}
+		if err = n.handle(p, msg); err != nil {
+			return
+		}
+	}
+}
+
+// handle 处理一条节点消息
+func (n *Node) handle(p *peer, msg *packets.PublishPacket) error {
+	switch msg.TopicName {
+	case kindSubscribe:
+		n.mu.Lock()
+		p.subs[string(msg.Payload)] = true
+		n.mu.Unlock()
+	case kindUnsubscribe:
+		n.mu.Lock()
+		delete(p.subs, string(msg.Payload))
+		n.mu.Unlock()
+	case kindPublish:
+		pk, shared, err := decodePublish(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if n.OnPublish != nil {
+			n.OnPublish(pk, shared)
+		}
+	case kindRetain:
+		pk, err := decode(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if n.OnRetain != nil {
+			n.OnRetain(pk)
+		}
+	case kindTakeover:
+		if n.OnTakeover != nil {
+			n.OnTakeover(string(msg.Payload))
+		}
+	default:
+		return fmt.Errorf("unknown cluster message %s", msg.TopicName)
+	}
+	return nil
+}
+
+// filters 本地主题过滤器, 调用者需持有锁
+func (n *Node) filters() []string {
+	filters := make([]string, 0, len(n.subs))
+	for filter := range n.subs {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// peerList 对端节点列表, 调用者需持有锁
+func (n *Node) peerList() []*peer {
+	peers := make([]*peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// preferred 与同一对端的已有连接相比是否应保留本连接, self 为本节点ID
+// 保留由ID较小的节点发起的连接, 发起方相同时保留已有的连接
+func (p *peer) preferred(old *peer, self string) bool {
+	lower := min(self, p.id)
+	return p.initiator == lower && old.initiator != lower
+}
+
+// send 向对端发送节点消息, 失败时关闭连接
+func (p *peer) send(kind string, payload []byte) error {
+	err := send(p.conn, &p.wmu, kind, payload)
+	if err != nil {
+		p.conn.Close()
+	}
+	return err
+}
+
+// broadcast 向多个对端发送节点消息
+func broadcast(peers []*peer, kind string, payload []byte) {
+	for _, p := range peers {
+		p.send(kind, payload)
+	}
+}
+
+// send 写入一条节点消息
+func send(conn net.Conn, wmu *sync.Mutex, kind string, payload []byte) error {
+	msg := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	msg.TopicName = kind
+	msg.Payload = payload
+	wmu.Lock()
+	defer wmu.Unlock()
+	return msg.Write(conn)
+}
+
+// encode 编码被转发的PUBLISH报文
+func encode(pk *packets.PublishPacket) []byte {
+	var buf bytes.Buffer
+	copied := *pk
+	copied.Write(&buf)
+	return buf.Bytes()
+}
+
+// encodePublish 编码转发的消息: 共享订阅的个数和每个共享订阅(都带2字节长度前缀), 然后是编码后的PUBLISH报文
+func encodePublish(pk *packets.PublishPacket, shared []string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(shared)))
+	for _, filter := range shared {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(filter)))
+		b = append(b, filter...)
+	}
+	return append(b, encode(pk)...)
+}
+
+// decodePublish 解码转发的消息
+func decodePublish(b []byte) (*packets.PublishPacket, []string, error) {
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("short forwarded message")
+	}
+	shared := make([]string, binary.BigEndian.Uint16(b))
+	b = b[2:]
+	for i := range shared {
+		if len(b) < 2 {
+			return nil, nil, fmt.Errorf("short forwarded message")
+		}
+		l := 2 + int(binary.BigEndian.Uint16(b))
+		if len(b) < l {
+			return nil, nil, fmt.Errorf("short forwarded message")
+		}
+		shared[i] = string(b[2:l])
+		b = b[l:]
+	}
+	pk, err := decode(b)
+	return pk, shared, err
+}
+
+// decode 解码被转发的PUBLISH报文
+func decode(b []byte) (*packets.PublishPacket, error) {
+	pk, err := packets.ReadPacket(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := pk.(*packets.PublishPacket)
+	if !ok {
+		return nil, fmt.Errorf("expected forwarded PUBLISH, got %s", pk)
+	}
+	return pub, nil
+}
@@ -0,0 +1,236 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// mesh 在进程内用net.Pipe把节点两两连接
+func mesh(t *testing.T, nodes ...*Node) {
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			a, b := net.Pipe()
+			errc := make(chan error, 1)
+			go func() { errc <- nodes[j].Accept(b) }()
+			if err := nodes[i].Join(a); err != nil {
+				t.Fatalf("Join returned error: %s", err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("Join returned error: %s", err)
+			}
+		}
+	}
+}
+
+// eventually 等待条件成立
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	received := make(chan string, 10)
+	retained := make(chan string, 10)
+	takeovers := make(chan string, 10)
+	nodes := []*Node{NewNode("a"), NewNode("b"), NewNode("c")}
+	for _, n := range nodes {
+		id := n.ID
+		n.OnPublish = func(pk *packets.PublishPacket, _ []string) { received <- id + ":" + pk.TopicName }
+		n.OnRetain = func(pk *packets.PublishPacket) { retained <- id + ":" + string(pk.Payload) }
+		n.OnTakeover = func(clientID string) { takeovers <- id + ":" + clientID }
+	}
+	nodes[1].Subscribe("sensors/+")
+	mesh(t, nodes...)
+	defer func() {
+		for _, n := range nodes {
+			n.Close()
+		}
+	}()
+	nodes[2].Subscribe("$share/g/sensors/#")
+
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.Qos = 1
+	pk.PacketID = 7
+	pk.TopicName = "sensors/temp"
+	pk.Payload = []byte("21")
+	eventually(t, "subscription exchange", func() bool {
+		n, _ := nodes[0].Publish(pk)
+		return n == 2
+	})
+	got := map[string]bool{<-received: true, <-received: true}
+	if !got["b:sensors/temp"] || !got["c:sensors/temp"] {
+		t.Errorf("forwarded to %v, should be b and c", got)
+	}
+
+	nodes[1].Unsubscribe("sensors/+")
+	nodes[2].Unsubscribe("$share/g/sensors/#")
+	eventually(t, "unsubscribe", func() bool {
+		n, _ := nodes[0].Publish(pk)
+		return n == 0
+	})
+
+	pk.Retain = true
+	nodes[0].Retain(pk)
+	if r := map[string]bool{<-retained: true, <-retained: true}; !r["b:21"] || !r["c:21"] {
+		t.Errorf("retained message replicated to %v", r)
+	}
+
+	nodes[2].Connected("dev1")
+	if r := map[string]bool{<-takeovers: true, <-takeovers: true}; !r["a:dev1"] || !r["b:dev1"] {
+		t.Errorf("takeover sent to %v", r)
+	}
+
+	a, b := net.Pipe()
+	go nodes[1].Accept(b)
+	if err := nodes[0].Join(a); err != ErrDuplicateNode {
+		t.Errorf("second Join returned %v, should be %v", err, ErrDuplicateNode)
+	}
+	// 已有的连接由ID较小的a发起, b发起的连接两端都拒绝
+	a, b = net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- nodes[0].Accept(b) }()
+	if err := nodes[1].Join(a); err != ErrDuplicateNode {
+		t.Errorf("Join from b returned %v, should be %v", err, ErrDuplicateNode)
+	}
+	if err := <-errc; err != ErrDuplicateNode {
+		t.Errorf("Accept from b returned %v, should be %v", err, ErrDuplicateNode)
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	received := make(chan string, 10)
+	nodes := []*Node{NewNode("a"), NewNode("b"), NewNode("c")}
+	for _, n := range nodes {
+		id := n.ID
+		n.OnPublish = func(pk *packets.PublishPacket, shared []string) {
+			for _, filter := range shared {
+				received <- id + ":" + filter
+			}
+		}
+	}
+	mesh(t, nodes...)
+	defer func() {
+		for _, n := range nodes {
+			n.Close()
+		}
+	}()
+	for _, n := range nodes {
+		n.Subscribe("$share/g/jobs/#")
+	}
+	nodes[1].Subscribe("jobs/+")
+
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName = "jobs/1"
+	eventually(t, "subscription exchange", func() bool {
+		nodes[0].mu.Lock()
+		defer nodes[0].mu.Unlock()
+		return len(nodes[0].peers["b"].subs) == 2 && len(nodes[0].peers["c"].subs) == 1
+	})
+
+	// 每条消息只由一个节点投递给共享订阅, 节点之间轮流选择
+	count := make(map[string]int)
+	for range 6 {
+		_, local := nodes[0].Publish(pk)
+		for _, filter := range local {
+			count["a:"+filter]++
+		}
+	}
+	for len(received) > 0 || count["a:$share/g/jobs/#"]+count["b:$share/g/jobs/#"]+count["c:$share/g/jobs/#"] < 6 {
+		select {
+		case got := <-received:
+			count[got]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("shared deliveries %v", count)
+		}
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if count[id+":$share/g/jobs/#"] != 2 {
+			t.Errorf("shared deliveries %v, should be 2 on every node", count)
+			break
+		}
+	}
+}
+
+func TestCrossDial(t *testing.T) {
+	received := make(chan string, 1)
+	x, y := NewNode("x"), NewNode("y")
+	y.OnPublish = func(pk *packets.PublishPacket, _ []string) { received <- pk.TopicName }
+	defer x.Close()
+	defer y.Close()
+	y.Subscribe("t")
+
+	// 两个节点同时互相连接
+	a1, b1 := net.Pipe()
+	a2, b2 := net.Pipe()
+	done := make(chan bool, 4)
+	for _, join := range []func(){
+		func() { x.Join(a1) },
+		func() { y.Accept(b1) },
+		func() { y.Join(a2) },
+		func() { x.Accept(b2) },
+	} {
+		go func() { join(); done <- true }()
+	}
+	for range 4 {
+		<-done
+	}
+
+	for _, n := range []*Node{x, y} {
+		n.mu.Lock()
+		p := n.peers[map[string]string{"x": "y", "y": "x"}[n.ID]]
+		n.mu.Unlock()
+		if p == nil || p.initiator != "x" {
+			t.Fatalf("node %s kept %+v, should keep the connection dialed by x", n.ID, p)
+		}
+	}
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName = "t"
+	eventually(t, "subscription exchange", func() bool {
+		n, _ := x.Publish(pk)
+		return n == 1
+	})
+	if got := <-received; got != "t" {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	n := NewNode("a")
+	n.HandshakeTimeout = 10 * time.Millisecond
+	a, _ := net.Pipe()
+	if err := n.Join(a); err == nil {
+		t.Fatal("Join with a silent peer returned nil")
+	}
+
+	// 关闭节点中断正在进行的握手
+	n.HandshakeTimeout = time.Minute
+	a, _ = net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- n.Join(a) }()
+	eventually(t, "handshake", func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return len(n.joining) == 1
+	})
+	n.Close()
+	select {
+	case err := <-errc:
+		if err != ErrClosed {
+			t.Errorf("Join returned %v, should be %v", err, ErrClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not abort the handshake")
+	}
+	a, _ = net.Pipe()
+	if err := n.Accept(a); err != ErrClosed {
+		t.Errorf("Accept after Close returned %v, should be %v", err, ErrClosed)
+	}
+}
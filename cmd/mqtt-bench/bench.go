@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/packets"
+)
+
+// minPayload 负载的最小长度, 前8个字节是发送时间
+const minPayload = 8
+
+// Dialer 以指定的客户端标识符连接服务端
+type Dialer func(clientID string, onMessage client.Handler) (*client.Client, error)
+
+// Config 压测参数
+type Config struct {
+	Publishers  int
+	Subscribers int
+	Qos         byte
+	PayloadSize int
+	Topic       string        // 发布的主题, %i 替换为发布者序号, %n 替换为消息序号
+	Filter      string        // 订阅者的主题过滤器
+	Rate        float64       // 每个发布者每秒发布的消息数, 0表示不限速
+	Count       int           // 每个发布者发布的消息数, 0表示直到 Duration 结束
+	Duration    time.Duration // 发布持续的时间, 0表示直到发完 Count
+	ConnectRate float64       // 每秒建立的连接数, 0表示不限速
+	Wait        time.Duration // 发布结束后等待消息送达的最长时间
+	IDPrefix    string        // 客户端标识符前缀
+}
+
+// Validate 检查参数
+func (c *Config) Validate() error {
+	switch {
+	case c.Publishers < 0 || c.Subscribers < 0:
+		return errors.New("client counts must not be negative")
+	case c.Publishers == 0 && c.Subscribers == 0:
+		return errors.New("at least one publisher or subscriber is needed")
+	case c.Qos > 2:
+		return fmt.Errorf("invalid QoS %d", c.Qos)
+	case c.PayloadSize < minPayload:
+		return fmt.Errorf("payload size must be at least %d bytes to carry the send time", minPayload)
+	case c.Rate < 0 || c.ConnectRate < 0:
+		return errors.New("rates must not be negative")
+	case c.Count < 0:
+		return errors.New("message count must not be negative")
+	case c.Count == 0 && c.Duration <= 0:
+		return errors.New("either a message count or a duration is needed")
+	case !packets.ValidTopicName(strings.NewReplacer("%i", "0", "%n", "0").Replace(c.Topic)):
+		return fmt.Errorf("invalid topic pattern %q", c.Topic)
+	case !packets.ValidTopicFilter(c.Filter):
+		return fmt.Errorf("invalid topic filter %q", c.Filter)
+	}
+	return nil
+}
+
+// topic 第 i 个发布者的第 n 条消息的主题
+func (c *Config) topic(i int, n int) string {
+	return strings.NewReplacer("%i", strconv.Itoa(i), "%n", strconv.Itoa(n)).Replace(c.Topic)
+}
+
+// bench 一次压测的运行状态
+type bench struct {
+	cfg  Config
+	dial Dialer
+
+	mu         sync.Mutex
+	connects   []time.Duration
+	publishes  []time.Duration // QoS 1/2 等待确认的时间
+	latencies  []time.Duration // 端到端延迟
+	errs       Errors
+	firstError string
+
+	published atomic.Int64
+	expected  atomic.Int64
+	received  atomic.Int64
+	bytes     atomic.Int64
+	stopping  atomic.Bool // 压测结束后的断开不计为错误
+}
+
+// Run 执行压测, ctx 取消时提前停止发布并汇总已有的结果
+func Run(ctx context.Context, cfg Config, dial Dialer) (*Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	b := &bench{cfg: cfg, dial: dial}
+	r := &Report{Config: cfg, Start: time.Now()}
+
+	// 先连接订阅者, 保证发布开始时订阅已经生效
+	start := time.Now()
+	subs := b.connectAll(ctx, "sub", cfg.Subscribers, b.onMessage)
+	pubs := b.connectAll(ctx, "pub", cfg.Publishers, nil)
+	r.ConnectTime = time.Since(start)
+	defer func() {
+		b.stopping.Store(true)
+		for _, c := range append(subs, pubs...) {
+			c.Disconnect()
+		}
+	}()
+
+	var subscribed []*client.Client
+	for _, c := range subs {
+		codes, err := c.Subscribe(ctx, []string{cfg.Filter}, []byte{cfg.Qos})
+		if err == nil && codes[0] == hooks.SubackFailure {
+			err = errors.New("subscription rejected")
+		}
+		if err != nil {
+			b.fail(&b.errs.Subscribe, err)
+			continue
+		}
+		subscribed = append(subscribed, c)
+	}
+
+	start = time.Now()
+	var wg sync.WaitGroup
+	for i, c := range pubs {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			b.publish(ctx, i, c, len(subscribed))
+		}(i, c)
+	}
+	wg.Wait()
+	r.PublishTime = time.Since(start)
+
+	// 等待在途的消息
+	deadline := time.Now().Add(cfg.Wait)
+	for b.received.Load() < b.expected.Load() && time.Now().Before(deadline) && ctx.Err() == nil {
+		sleep(ctx, 10*time.Millisecond)
+	}
+	r.ReceiveTime = time.Since(start)
+	b.collect(r)
+	return r, nil
+}
+
+// connectAll 建立 n 个连接, 失败的连接计入错误
+func (b *bench) connectAll(ctx context.Context, role string, n int, onMessage client.Handler) []*client.Client {
+	var interval time.Duration
+	if b.cfg.ConnectRate > 0 {
+		interval = time.Duration(float64(time.Second) / b.cfg.ConnectRate)
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var clients []*client.Client
+	next := time.Now()
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		if interval > 0 {
+			sleep(ctx, time.Until(next))
+			next = next.Add(interval)
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			start := time.Now()
+			c, err := b.dial(id, onMessage)
+			elapsed := time.Since(start)
+			if err != nil {
+				b.fail(&b.errs.Connect, err)
+				return
+			}
+			go b.watch(c)
+			b.mu.Lock()
+			b.connects = append(b.connects, elapsed)
+			b.mu.Unlock()
+			mu.Lock()
+			clients = append(clients, c)
+			mu.Unlock()
+		}(fmt.Sprintf("%s%s-%d", b.cfg.IDPrefix, role, i))
+	}
+	wg.Wait()
+	return clients
+}
+
+// watch 记录压测过程中意外断开的连接
+func (b *bench) watch(c *client.Client) {
+	<-c.Done()
+	if !b.stopping.Load() {
+		b.fail(&b.errs.Disconnect, c.Err())
+	}
+}
+
+// publish 一个发布者按速率发布消息
+func (b *bench) publish(ctx context.Context, i int, c *client.Client, subscribers int) {
+	var interval time.Duration
+	if b.cfg.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / b.cfg.Rate)
+	}
+	var deadline time.Time
+	if b.cfg.Duration > 0 {
+		deadline = time.Now().Add(b.cfg.Duration)
+	}
+	start := time.Now()
+	for n := 0; b.cfg.Count == 0 || n < b.cfg.Count; n++ {
+		if ctx.Err() != nil || (!deadline.IsZero() && time.Now().After(deadline)) {
+			return
+		}
+		if interval > 0 {
+			// 按计划时间发送, 某条消息发送较慢时后面的消息会追赶
+			sleep(ctx, time.Until(start.Add(time.Duration(n)*interval)))
+		}
+		pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		pk.TopicName = b.cfg.topic(i, n)
+		pk.Qos = b.cfg.Qos
+		pk.Payload = make([]byte, b.cfg.PayloadSize)
+		if packets.MatchTopic(b.cfg.Filter, pk.TopicName) {
+			b.expected.Add(int64(subscribers))
+		}
+		sent := time.Now()
+		binary.BigEndian.PutUint64(pk.Payload, uint64(sent.UnixNano()))
+		if err := c.Publish(ctx, pk); err != nil {
+			if ctx.Err() == nil {
+				b.fail(&b.errs.Publish, err)
+			}
+			if packets.MatchTopic(b.cfg.Filter, pk.TopicName) {
+				b.expected.Add(-int64(subscribers))
+			}
+			continue
+		}
+		b.published.Add(1)
+		if b.cfg.Qos > 0 {
+			elapsed := time.Since(sent)
+			b.mu.Lock()
+			b.publishes = append(b.publishes, elapsed)
+			b.mu.Unlock()
+		}
+	}
+}
+
+// onMessage 订阅者收到消息时记录端到端延迟
+func (b *bench) onMessage(c *client.Client, pk *packets.PublishPacket) {
+	if len(pk.Payload) < minPayload {
+		return
+	}
+	latency := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(pk.Payload))))
+	b.mu.Lock()
+	b.latencies = append(b.latencies, latency)
+	b.mu.Unlock()
+	b.bytes.Add(int64(len(pk.Payload)))
+	b.received.Add(1)
+}
+
+// fail 记录一个错误
+func (b *bench) fail(counter *int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	*counter++
+	if b.firstError == "" && err != nil {
+		b.firstError = err.Error()
+	}
+}
+
+// sleep 等待 d 或 ctx 取消
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
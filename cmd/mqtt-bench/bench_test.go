@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/client"
+)
+
+func TestRun(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	dial := func(clientID string, onMessage client.Handler) (*client.Client, error) {
+		return client.Connect(b.Pipe(), client.Options{ClientID: clientID, CleanSession: true, OnMessage: onMessage})
+	}
+	cfg := Config{
+		Publishers:  3,
+		Subscribers: 2,
+		Qos:         2,
+		PayloadSize: 32,
+		Topic:       "bench/%i/%n",
+		Filter:      "bench/+/+",
+		Count:       50,
+		Wait:        5 * time.Second,
+		IDPrefix:    "test-",
+	}
+	r, err := Run(context.Background(), cfg, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Connections != 5 || r.Published != 150 || r.Expected != 300 || r.Received != 300 {
+		t.Errorf("%d connections, %d published, %d of %d received", r.Connections, r.Published, r.Received, r.Expected)
+	}
+	if r.Latency.Count != 300 || r.Latency.P50 > r.Latency.P99 || r.Latency.P99 > r.Latency.Max || r.PublishLatency.Count != 150 {
+		t.Errorf("latency %+v, publish latency %+v", r.Latency, r.PublishLatency)
+	}
+	if r.Errors != (Errors{}) {
+		t.Errorf("errors %+v", r.Errors)
+	}
+
+	var buf bytes.Buffer
+	if err = r.WriteCSV(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != 2 || len(rows[1]) != len(csvHeader) {
+		t.Errorf("CSV %v %v", rows, err)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	if fields["received"] != 300.0 || fields["qos"] != 2.0 {
+		t.Errorf("JSON %s", data)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	var samples []time.Duration
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	l := newLatency(samples)
+	if l.Min != 1 || l.P50 != 50 || l.P90 != 90 || l.P99 != 99 || l.Max != 100 || l.Mean != 50.5 {
+		t.Errorf("%+v", l)
+	}
+	if l = newLatency(nil); l.Count != 0 || l.String() != "n/a" {
+		t.Errorf("%+v", l)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{Publishers: 1, PayloadSize: 8, Topic: "a/%i", Filter: "a/#", Count: 1}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range []func(*Config){
+		func(c *Config) { c.Publishers = 0 },
+		func(c *Config) { c.Qos = 3 },
+		func(c *Config) { c.PayloadSize = 7 },
+		func(c *Config) { c.Count = 0 },
+		func(c *Config) { c.Topic = "a/+" },
+		func(c *Config) { c.Filter = "a/#/b" },
+	} {
+		c := valid
+		change(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v was accepted", c)
+		}
+	}
+}
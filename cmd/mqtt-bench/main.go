@@ -0,0 +1,137 @@
+// mqtt-bench MQTT服务端压测工具
+//
+// 用法:
+//
+//	mqtt-bench -h broker -pub 50 -sub 10 -q 1 -n 1000
+//	mqtt-bench -embedded -pub 10 -sub 10 -rate 100 -d 30s -format json
+//	mqtt-bench -h broker -t 'devices/%i/data' -filter 'devices/+/data' -format csv -o results.csv
+//
+// 每个订阅者订阅 -filter, 每个发布者向 -t 发布消息, 主题中的 %i 替换为发布者序号, %n 替换为消息序号
+// 负载的前8个字节是发送时间, 订阅者据此计算端到端延迟, 因此压测工具需要同时运行发布者和订阅者
+// -embedded 在进程内启动服务端, 通过内存管道连接, 用于测量服务端本身的开销
+// CSV格式输出到已有文件时追加一行, 方便比较多次压测的结果
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/internal/cmdutil"
+)
+
+const name = "mqtt-bench"
+
+func main() {
+	var conn cmdutil.ConnFlags
+	var cfg Config
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	conn.Register(fs, name+"-")
+	fs.Lookup("i").Usage = "client ID prefix, followed by pub-N or sub-N"
+	embedded := fs.Bool("embedded", false, "benchmark an in-process broker instead of -h and -p")
+	fs.IntVar(&cfg.Publishers, "pub", 10, "number of publishers")
+	fs.IntVar(&cfg.Subscribers, "sub", 10, "number of subscribers")
+	qos := fs.Int("q", 0, "QoS of publications and subscriptions")
+	fs.IntVar(&cfg.PayloadSize, "s", 64, "payload size in bytes, at least 8")
+	fs.StringVar(&cfg.Topic, "t", "bench/%i", "topic pattern, %i is the publisher number and %n the message number")
+	fs.StringVar(&cfg.Filter, "filter", "bench/#", "topic filter of the subscribers")
+	fs.Float64Var(&cfg.Rate, "rate", 0, "messages per second per publisher, 0 for as fast as possible")
+	fs.IntVar(&cfg.Count, "n", 1000, "messages per publisher, 0 to publish until -d elapses")
+	fs.DurationVar(&cfg.Duration, "d", 0, "stop publishing after this long")
+	fs.Float64Var(&cfg.ConnectRate, "connect-rate", 0, "new connections per second, 0 for as fast as possible")
+	fs.DurationVar(&cfg.Wait, "wait", 5*time.Second, "time to wait for in-flight messages after publishing")
+	format := fs.String("format", "text", "report format: text, json or csv")
+	output := fs.String("o", "", "write the report to this file, CSV reports are appended")
+	fs.Parse(os.Args[1:])
+
+	if *qos < 0 || *qos > 2 {
+		cmdutil.Fatal(name, fmt.Errorf("invalid QoS %d", *qos))
+	}
+	cfg.Qos = byte(*qos)
+	if conn.ClientID == "" {
+		conn.ClientID = name + "-" + strconv.Itoa(os.Getpid()) + "-"
+	}
+	cfg.IDPrefix = conn.ClientID
+	if err := conn.Validate(); err != nil {
+		cmdutil.Fatal(name, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		cmdutil.Fatal(name, err)
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		cmdutil.Fatal(name, fmt.Errorf("unknown format %q", *format))
+	}
+
+	target := conn.Address()
+	dial := func(clientID string, onMessage client.Handler) (*client.Client, error) {
+		f := conn
+		f.ClientID = clientID
+		return f.Dial(onMessage)
+	}
+	if *embedded {
+		b := broker.New(broker.Options{})
+		defer b.Close()
+		target = "embedded"
+		dial = func(clientID string, onMessage client.Handler) (*client.Client, error) {
+			f := conn
+			f.ClientID = clientID
+			return client.Connect(b.Pipe(), f.Options(onMessage))
+		}
+	}
+
+	// 中断时停止发布并输出已有的结果
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r, err := Run(ctx, cfg, dial)
+	if err != nil {
+		cmdutil.Fatal(name, err)
+	}
+	r.Target = target
+	if err = write(r, *format, *output); err != nil {
+		cmdutil.Fatal(name, err)
+	}
+	if r.Connections == 0 {
+		cmdutil.Fatal(name, errors.New("no client could connect: "+r.Errors.First))
+	}
+}
+
+// write 按格式输出报告
+func write(r *Report, format string, path string) error {
+	var w io.Writer = os.Stdout
+	header := true
+	if path != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if format == "csv" {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(path, flags, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			header = false
+		}
+		w = f
+	}
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		return r.WriteCSV(w, header)
+	}
+	r.WriteText(w)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Errors 各阶段的错误数
+type Errors struct {
+	Connect    int    `json:"connect"`
+	Subscribe  int    `json:"subscribe"`
+	Publish    int    `json:"publish"`
+	Disconnect int    `json:"disconnect"` // 压测过程中意外断开的连接
+	First      string `json:"first,omitempty"`
+}
+
+// Latency 延迟分布, 单位为毫秒
+type Latency struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// newLatency 计算延迟分布, 会对 samples 排序
+func newLatency(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	// 最近秩法
+	percentile := func(p float64) float64 {
+		i := int(p*float64(len(samples))+0.999999) - 1
+		if i < 0 {
+			i = 0
+		}
+		return ms(samples[i])
+	}
+	return Latency{
+		Count: len(samples),
+		Min:   ms(samples[0]),
+		Mean:  ms(sum / time.Duration(len(samples))),
+		P50:   percentile(0.50),
+		P90:   percentile(0.90),
+		P95:   percentile(0.95),
+		P99:   percentile(0.99),
+		Max:   ms(samples[len(samples)-1]),
+	}
+}
+
+// ms 转换为毫秒
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Report 压测结果
+type Report struct {
+	Config      Config        `json:"-"`
+	Target      string        `json:"target"`
+	Start       time.Time     `json:"start"`
+	ConnectTime time.Duration `json:"-"`
+	PublishTime time.Duration `json:"-"`
+	ReceiveTime time.Duration `json:"-"` // 从开始发布到收到最后一条消息或等待超时
+
+	Connections    int     `json:"connections"`
+	ConnectRate    float64 `json:"connect_rate"` // 每秒建立的连接数
+	ConnectLatency Latency `json:"connect_latency"`
+
+	Published      int64   `json:"published"`
+	PublishRate    float64 `json:"publish_rate"` // 每秒发布的消息数
+	PublishLatency Latency `json:"publish_latency"`
+
+	Expected     int64   `json:"expected"`
+	Received     int64   `json:"received"`
+	ReceiveRate  float64 `json:"receive_rate"`  // 每秒收到的消息数
+	ReceiveBytes float64 `json:"receive_bytes"` // 每秒收到的负载字节数
+	Latency      Latency `json:"latency"`       // 端到端延迟
+
+	Errors Errors `json:"errors"`
+}
+
+// collect 汇总运行结果
+func (b *bench) collect(r *Report) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.Connections = len(b.connects)
+	r.ConnectRate = rate(float64(r.Connections), r.ConnectTime)
+	r.ConnectLatency = newLatency(b.connects)
+	r.Published = b.published.Load()
+	r.PublishRate = rate(float64(r.Published), r.PublishTime)
+	r.PublishLatency = newLatency(b.publishes)
+	r.Expected = b.expected.Load()
+	r.Received = b.received.Load()
+	r.ReceiveRate = rate(float64(r.Received), r.ReceiveTime)
+	r.ReceiveBytes = rate(float64(b.bytes.Load()), r.ReceiveTime)
+	r.Latency = newLatency(b.latencies)
+	r.Errors = b.errs
+	r.Errors.First = b.firstError
+}
+
+// rate 每秒的数量
+func rate(n float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return n / d.Seconds()
+}
+
+// MarshalJSON 附带压测参数
+func (r *Report) MarshalJSON() ([]byte, error) {
+	type report Report
+	return json.Marshal(struct {
+		Publishers  int     `json:"publishers"`
+		Subscribers int     `json:"subscribers"`
+		Qos         byte    `json:"qos"`
+		PayloadSize int     `json:"payload_size"`
+		Topic       string  `json:"topic"`
+		Filter      string  `json:"filter"`
+		Rate        float64 `json:"rate"`
+		ConnectTime float64 `json:"connect_seconds"`
+		PublishTime float64 `json:"publish_seconds"`
+		*report
+	}{
+		r.Config.Publishers, r.Config.Subscribers, r.Config.Qos, r.Config.PayloadSize,
+		r.Config.Topic, r.Config.Filter, r.Config.Rate,
+		r.ConnectTime.Seconds(), r.PublishTime.Seconds(),
+		(*report)(r),
+	})
+}
+
+// csvHeader CSV的列
+var csvHeader = []string{
+	"target", "start", "publishers", "subscribers", "qos", "payload_size", "rate",
+	"connections", "connect_rate", "connect_p50_ms", "connect_p99_ms",
+	"published", "publish_rate", "publish_p50_ms", "publish_p99_ms",
+	"expected", "received", "receive_rate", "receive_bytes",
+	"latency_min_ms", "latency_mean_ms", "latency_p50_ms", "latency_p90_ms", "latency_p95_ms", "latency_p99_ms", "latency_max_ms",
+	"connect_errors", "subscribe_errors", "publish_errors", "disconnects",
+}
+
+// csvRow 报告对应的CSV行
+func (r *Report) csvRow() []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	return []string{
+		r.Target, r.Start.Format(time.RFC3339), i(int64(r.Config.Publishers)), i(int64(r.Config.Subscribers)), i(int64(r.Config.Qos)), i(int64(r.Config.PayloadSize)), f(r.Config.Rate),
+		i(int64(r.Connections)), f(r.ConnectRate), f(r.ConnectLatency.P50), f(r.ConnectLatency.P99),
+		i(r.Published), f(r.PublishRate), f(r.PublishLatency.P50), f(r.PublishLatency.P99),
+		i(r.Expected), i(r.Received), f(r.ReceiveRate), f(r.ReceiveBytes),
+		f(r.Latency.Min), f(r.Latency.Mean), f(r.Latency.P50), f(r.Latency.P90), f(r.Latency.P95), f(r.Latency.P99), f(r.Latency.Max),
+		i(int64(r.Errors.Connect)), i(int64(r.Errors.Subscribe)), i(int64(r.Errors.Publish)), i(int64(r.Errors.Disconnect)),
+	}
+}
+
+// WriteCSV 输出CSV, header 为true时先输出列名, 多次压测的结果可以追加到同一个文件
+func (r *Report) WriteCSV(w io.Writer, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		cw.Write(csvHeader)
+	}
+	cw.Write(r.csvRow())
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteText 输出便于阅读的结果
+func (r *Report) WriteText(w io.Writer) {
+	c := r.Config
+	fmt.Fprintf(w, "target:      %s\n", r.Target)
+	fmt.Fprintf(w, "clients:     %d publishers, %d subscribers, QoS %d, %d byte payloads\n", c.Publishers, c.Subscribers, c.Qos, c.PayloadSize)
+	fmt.Fprintf(w, "connections: %d in %s, %.1f/s, latency %s\n", r.Connections, r.ConnectTime.Round(time.Millisecond), r.ConnectRate, r.ConnectLatency)
+	fmt.Fprintf(w, "published:   %d in %s, %.1f msg/s", r.Published, r.PublishTime.Round(time.Millisecond), r.PublishRate)
+	if c.Qos > 0 {
+		fmt.Fprintf(w, ", acknowledged in %s", r.PublishLatency)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "received:    %d of %d, %.1f msg/s, %.1f KiB/s\n", r.Received, r.Expected, r.ReceiveRate, r.ReceiveBytes/1024)
+	fmt.Fprintf(w, "latency:     %s\n", r.Latency)
+	e := r.Errors
+	fmt.Fprintf(w, "errors:      %d connect, %d subscribe, %d publish, %d disconnects\n", e.Connect, e.Subscribe, e.Publish, e.Disconnect)
+	if e.First != "" {
+		fmt.Fprintf(w, "first error: %s\n", e.First)
+	}
+}
+
+// String ...
+func (l Latency) String() string {
+	if l.Count == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("min %.3fms mean %.3fms p50 %.3fms p90 %.3fms p95 %.3fms p99 %.3fms max %.3fms", l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+}
@@ -0,0 +1,102 @@
+// mqtt-conformance 检查服务端是否符合MQTT 3.1.1规范
+//
+// 用法:
+//
+//	mqtt-conformance -h broker -p 1883
+//	mqtt-conformance -h broker -u user -P secret -run 'MQTT-3\.8' -v
+//	mqtt-conformance -embedded -json
+//
+// 每条规范性陈述输出一行结果, 有检查失败时退出状态为1
+// -run 为正则表达式, 只运行一致性编号匹配的检查
+// 检查会在服务端上建立持久会话和保留消息, 使用的客户端标识符和主题都以 -prefix 开头, 结束前会清除
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/conformance"
+	"github.com/boxungo/mqtt/internal/cmdutil"
+)
+
+const name = "mqtt-conformance"
+
+func main() {
+	var conn cmdutil.ConnFlags
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	conn.Register(fs, name+"-")
+	embedded := fs.Bool("embedded", false, "check the in-process broker instead of -h and -p")
+	run := fs.String("run", "", "only run checks whose conformance ID matches this regular expression")
+	prefix := fs.String("prefix", "conformance", "prefix of the client IDs and topics used by the checks")
+	timeout := fs.Duration("timeout", conformance.DefaultTimeout, "time to wait for a response or a disconnect")
+	quiet := fs.Duration("quiet", conformance.DefaultQuiet, "time to wait when checking that nothing is sent")
+	asJSON := fs.Bool("json", false, "write the results as JSON")
+	verbose := fs.Bool("v", false, "print the normative statement of each check")
+	fs.Parse(os.Args[1:])
+
+	opts := conformance.Options{
+		Dial:     conn.DialConn,
+		Username: conn.Username,
+		Prefix:   *prefix,
+		Timeout:  *timeout,
+		Quiet:    *quiet,
+	}
+	if conn.Password != "" {
+		opts.Password = []byte(conn.Password)
+	}
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			cmdutil.Fatal(name, err)
+		}
+		opts.Filter = re.MatchString
+	}
+	target := conn.Address()
+	if *embedded {
+		b := broker.New(broker.Options{})
+		defer b.Close()
+		target = "embedded"
+		opts.Dial = func() (net.Conn, error) { return b.Pipe(), nil }
+	}
+
+	results := conformance.Run(opts)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			cmdutil.Fatal(name, err)
+		}
+	} else {
+		fmt.Printf("%s: MQTT 3.1.1 conformance, MQTT 5 is not covered\n", target)
+		write(os.Stdout, results, *verbose)
+	}
+	for _, r := range results {
+		if r.Status == conformance.Fail {
+			os.Exit(1)
+		}
+	}
+}
+
+// write 以文本格式输出结果
+func write(w io.Writer, results []conformance.Result, verbose bool) {
+	counts := make(map[conformance.Status]int)
+	for _, r := range results {
+		counts[r.Status]++
+		fmt.Fprintf(w, "%-4s  %-14s %s", r.Status, r.ID, r.Elapsed.Round(time.Millisecond))
+		if r.Detail != "" {
+			fmt.Fprintf(w, "  %s", r.Detail)
+		}
+		fmt.Fprintln(w)
+		if verbose {
+			fmt.Fprintf(w, "      %s\n", r.Statement)
+		}
+	}
+	fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", counts[conformance.Pass], counts[conformance.Fail], counts[conformance.Skip])
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/conformance"
+)
+
+func TestWrite(t *testing.T) {
+	results := []conformance.Result{
+		{ID: "MQTT-3.1.0-1", Statement: "first packet", Status: conformance.Pass, Elapsed: time.Millisecond},
+		{ID: "MQTT-3.1.0-2", Statement: "second CONNECT", Status: conformance.Fail, Detail: "connection still open"},
+		{ID: "MQTT-3.1.2-2", Statement: "protocol level", Status: conformance.Skip, Detail: "dial: refused"},
+	}
+	var buf bytes.Buffer
+	write(&buf, results, true)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("%d lines:\n%s", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[2], "fail  MQTT-3.1.0-2") || !strings.HasSuffix(lines[2], "connection still open") {
+		t.Errorf("line %q", lines[2])
+	}
+	if lines[3] != "      second CONNECT" {
+		t.Errorf("statement %q", lines[3])
+	}
+	if lines[6] != "1 passed, 1 failed, 1 skipped" {
+		t.Errorf("summary %q", lines[6])
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// returnCodes CONNECT Validate 和CONNACK的返回码名称
+var returnCodes = map[byte]string{
+	packets.Accepted:                        "accepted",
+	packets.ErrRefusedBadProtocolLevel:      "unacceptable protocol level",
+	packets.ErrRefusedIDRejected:            "identifier rejected",
+	packets.ErrRefusedServerUnavailable:     "server unavailable",
+	packets.ErrRefusedBadUsernameOrPassword: "bad user name or password",
+	packets.ErrRefusedNotAuthorised:         "not authorized",
+	packets.ErrProtocolViolation:            "protocol violation",
+}
+
+// fixedLengths 剩余长度固定的报文
+var fixedLengths = map[byte]int{
+	packets.CONNACK:    2,
+	packets.PUBACK:     2,
+	packets.PUBREC:     2,
+	packets.PUBREL:     2,
+	packets.PUBCOMP:    2,
+	packets.UNSUBACK:   2,
+	packets.PINGREQ:    0,
+	packets.PINGRESP:   0,
+	packets.DISCONNECT: 0,
+}
+
+// finding 检查发现的问题, offset 为相对报文起始的字节偏移, 为-1表示无法定位
+type finding struct {
+	offset int
+	msg    string
+}
+
+// decoder 逐个解码字节流中的报文并输出
+type decoder struct {
+	w       io.Writer
+	preview int // 负载预览的字节数
+}
+
+// countingReader 记录已读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// decode 解码整个字节流, 全部成功时返回true
+func (d *decoder) decode(data []byte) bool {
+	ok := true
+	for off, i := 0, 1; off < len(data); i++ {
+		cr := &countingReader{r: bytes.NewReader(data[off:])}
+		pk, err := packets.ReadPacket(cr)
+		if err != nil {
+			at, stage := locate(data[off:])
+			fmt.Fprintf(d.w, "#%d at offset %d: decoding failed: %v\n", i, off, err)
+			fmt.Fprintf(d.w, "  error in %s at offset %d (byte %d of the packet)\n", stage, off+at, at)
+			d.context(data, off+at)
+			return false
+		}
+		raw := data[off : off+cr.n]
+		d.print(i, off, pk, raw)
+		findings := check(pk, raw)
+		for _, f := range findings {
+			if f.offset >= 0 {
+				fmt.Fprintf(d.w, "  ! offset %d: %s\n", off+f.offset, f.msg)
+			} else {
+				fmt.Fprintf(d.w, "  ! %s\n", f.msg)
+			}
+		}
+		if len(findings) > 0 {
+			ok = false
+		}
+		off += cr.n
+	}
+	return ok
+}
+
+// print 输出一个报文的固定头部和各个字段
+func (d *decoder) print(i int, off int, pk packets.ControlPacket, raw []byte) {
+	fh := packets.HeaderOf(pk)
+	_, lenBytes, _ := remainingLength(raw)
+	fmt.Fprintf(d.w, "#%d at offset %d: %s (%d bytes)\n", i, off, packets.PacketNames[fh.PacketType], len(raw))
+	fmt.Fprintf(d.w, "  fixed header: 0x%02x = %04b %04b\n", raw[0], raw[0]>>4, raw[0]&0x0f)
+	fmt.Fprintf(d.w, "    type:   %d (%s)\n", fh.PacketType, packets.PacketNames[fh.PacketType])
+	fmt.Fprintf(d.w, "    dup:    %t\n", fh.Dup)
+	fmt.Fprintf(d.w, "    qos:    %d\n", fh.Qos)
+	fmt.Fprintf(d.w, "    retain: %t\n", fh.Retain)
+	fmt.Fprintf(d.w, "  remaining length: %d (%d byte encoding: % x)\n", fh.RemainingLength, lenBytes, raw[1:1+lenBytes])
+
+	v := reflect.ValueOf(pk).Elem()
+	t := v.Type()
+	for j := 0; j < t.NumField(); j++ {
+		field := t.Field(j)
+		if field.Anonymous {
+			continue
+		}
+		fmt.Fprintf(d.w, "  %s: %s\n", field.Name, d.format(field.Name, v.Field(j)))
+	}
+}
+
+// format 格式化一个字段的值
+func (d *decoder) format(name string, v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return fmt.Sprintf("%q", v.String())
+	case reflect.Uint8:
+		if name == "ReturnCode" {
+			return fmt.Sprintf("0x%02x (%s)", v.Uint(), returnCodes[byte(v.Uint())])
+		}
+		return fmt.Sprintf("%d (0x%02x)", v.Uint(), v.Uint())
+	case reflect.Slice:
+		if b, ok := v.Interface().([]byte); ok {
+			switch name {
+			case "Payload", "WillMessage", "Password":
+				return preview(b, d.preview)
+			}
+			return fmt.Sprintf("% x", b)
+		}
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// context 输出出错位置前后的字节, 并用^标出出错的字节
+func (d *decoder) context(data []byte, at int) {
+	start := at - 8
+	if start < 0 {
+		start = 0
+	}
+	end := at + 8
+	if end > len(data) {
+		end = len(data)
+	}
+	fmt.Fprintf(d.w, "  %6d: % x\n", start, data[start:end])
+	marker := strings.Repeat("   ", at-start)
+	if at >= len(data) {
+		fmt.Fprintf(d.w, "          %s^ end of input\n", marker)
+		return
+	}
+	fmt.Fprintf(d.w, "          %s^^\n", marker)
+}
+
+// preview 负载预览, 可打印的UTF-8文本加引号输出, 否则输出十六进制
+func preview(b []byte, max int) string {
+	shown, more := b, ""
+	if max >= 0 && len(b) > max {
+		shown, more = b[:max], fmt.Sprintf(" ... (%d more)", len(b)-max)
+	}
+	if printable(shown) {
+		return fmt.Sprintf("%d bytes %q%s", len(b), shown, more)
+	}
+	return fmt.Sprintf("%d bytes % x%s", len(b), shown, more)
+}
+
+// printable 是否为可打印的UTF-8文本
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// remainingLength 解码剩余长度, 返回值, 编码的字节数和错误
+func remainingLength(raw []byte) (int, int, error) {
+	value, multiplier := 0, 1
+	for i := 1; i < len(raw); i++ {
+		value += int(raw[i]&0x7f) * multiplier
+		if raw[i]&0x80 == 0 {
+			return value, i, nil
+		}
+		if i == 4 {
+			return 0, i, fmt.Errorf("remaining length longer than 4 bytes")
+		}
+		multiplier *= 128
+	}
+	return 0, len(raw) - 1, io.ErrUnexpectedEOF
+}
+
+// locate 重新按步骤解码失败的报文, 返回出错的字节偏移和所在部分
+func locate(raw []byte) (int, string) {
+	if len(raw) == 0 {
+		return 0, "fixed header"
+	}
+	if t := raw[0] >> 4; t < packets.CONNECT || t > packets.DISCONNECT {
+		return 0, "fixed header (packet type)"
+	}
+	rl, n, err := remainingLength(raw)
+	if err != nil {
+		return 1 + n, "remaining length"
+	}
+	start := 1 + n
+	if len(raw)-start < rl {
+		return len(raw), fmt.Sprintf("body (remaining length is %d, only %d bytes available)", rl, len(raw)-start)
+	}
+
+	fh := packets.FixedHeader{
+		PacketType:      raw[0] >> 4,
+		Dup:             raw[0]&0x08 != 0,
+		Qos:             raw[0] >> 1 & 0x03,
+		Retain:          raw[0]&0x01 != 0,
+		RemainingLength: rl,
+	}
+	pk, err := packets.NewControlPacketWithHeader(fh)
+	if err != nil {
+		return 0, "fixed header"
+	}
+	cr := &countingReader{r: bytes.NewReader(raw[start : start+rl])}
+	pk.Unpack(cr)
+	return start + cr.n, "body"
+}
+
+// check 检查协议规则, raw 为报文的原始字节
+func check(pk packets.ControlPacket, raw []byte) []finding {
+	var fs []finding
+	add := func(offset int, format string, args ...interface{}) {
+		fs = append(fs, finding{offset: offset, msg: fmt.Sprintf(format, args...)})
+	}
+	fh := packets.HeaderOf(pk)
+
+	flags := raw[0] & 0x0f
+	switch fh.PacketType {
+	case packets.PUBLISH:
+		if fh.Qos == 3 {
+			add(0, "QoS 3 is not allowed")
+		}
+		if fh.Dup && fh.Qos == 0 {
+			add(0, "DUP must be 0 for QoS 0 messages")
+		}
+	case packets.PUBREL, packets.SUBSCRIBE, packets.UNSUBSCRIBE:
+		if flags != 0x02 {
+			add(0, "reserved flags must be 0010, found %04b", flags)
+		}
+	default:
+		if flags != 0 {
+			add(0, "reserved flags must be 0000, found %04b", flags)
+		}
+	}
+	if _, n, _ := remainingLength(raw); n > len(encodedLength(fh.RemainingLength)) {
+		add(1, "remaining length is not encoded in the minimum number of bytes")
+	}
+	if want, ok := fixedLengths[fh.PacketType]; ok && fh.RemainingLength != want {
+		add(1, "remaining length of %s must be %d, found %d", packets.PacketNames[fh.PacketType], want, fh.RemainingLength)
+		return fs
+	}
+	body := len(raw) - fh.RemainingLength
+
+	switch p := pk.(type) {
+	case *packets.ConnectPacket:
+		if code := p.Validate(); code != packets.Accepted {
+			add(-1, "Validate: 0x%02x (%s)", code, returnCodes[code])
+		}
+		if p.WillQos == 3 {
+			add(-1, "will QoS 3 is not allowed")
+		}
+		if !p.WillFlag && (p.WillQos != 0 || p.WillRetain) {
+			add(-1, "will QoS and will retain must be 0 when the will flag is 0")
+		}
+		if p.WillFlag && !packets.ValidTopicName(p.WillTopic) {
+			add(-1, "invalid will topic %q", p.WillTopic)
+		}
+	case *packets.ConnackPacket:
+		if raw[body]&0xfe != 0 {
+			add(body, "reserved connect acknowledge flags must be 0")
+		}
+		if _, ok := returnCodes[p.ReturnCode]; !ok || p.ReturnCode == packets.ErrProtocolViolation {
+			add(body+1, "unknown return code 0x%02x", p.ReturnCode)
+		}
+	case *packets.PublishPacket:
+		if !packets.ValidTopicName(p.TopicName) {
+			add(-1, "invalid topic name %q", p.TopicName)
+		}
+		if p.Qos > 0 && p.PacketID == 0 {
+			add(-1, "packet identifier must not be 0")
+		}
+	case *packets.SubscribePacket:
+		if len(p.Topics) == 0 {
+			add(-1, "SUBSCRIBE must contain at least one topic filter")
+		}
+		for i, topic := range p.Topics {
+			if !packets.ValidTopicFilter(topic) {
+				add(-1, "invalid topic filter %q", topic)
+			}
+			if p.Qoss[i] > 2 {
+				add(-1, "requested QoS %d for %q, must be 0, 1 or 2", p.Qoss[i], topic)
+			}
+		}
+		if p.PacketID == 0 {
+			add(-1, "packet identifier must not be 0")
+		}
+	case *packets.SubackPacket:
+		for _, code := range p.ReturnCodes {
+			if code > 2 && code != 0x80 {
+				add(-1, "invalid return code 0x%02x", code)
+			}
+		}
+	case *packets.UnsubscribePacket:
+		if len(p.Topics) == 0 {
+			add(-1, "UNSUBSCRIBE must contain at least one topic filter")
+		}
+		for _, topic := range p.Topics {
+			if !packets.ValidTopicFilter(topic) {
+				add(-1, "invalid topic filter %q", topic)
+			}
+		}
+		if p.PacketID == 0 {
+			add(-1, "packet identifier must not be 0")
+		}
+	}
+
+	// 重新编码后与输入比较, 可以发现解码时被忽略的多余字节或不一致的长度
+	var buf bytes.Buffer
+	if err := pk.Write(&buf); err == nil && len(fs) == 0 && !bytes.Equal(buf.Bytes(), raw) {
+		enc := buf.Bytes()
+		i := 0
+		for i < len(enc) && i < len(raw) && enc[i] == raw[i] {
+			i++
+		}
+		switch {
+		case i == len(raw):
+			add(i, "re-encoding the packet adds %d bytes not present in the input: % x", len(enc)-i, enc[i:])
+		case i == len(enc):
+			add(i, "%d bytes were ignored by the decoder: %s", len(raw)-i, hex.EncodeToString(raw[i:]))
+		default:
+			add(i, "re-encoded packet differs from the input: input 0x%02x, encoded 0x%02x", raw[i], enc[i])
+		}
+	}
+	return fs
+}
+
+// encodedLength 剩余长度的最短编码
+func encodedLength(length int) []byte {
+	var b []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// mqtt-decode 解码并检查MQTT报文
+//
+// 用法:
+//
+//	echo '10 0c 00 04 4d 51 54 54 04 02 00 3c 00 00' | mqtt-decode
+//	mqtt-decode -in base64 dump.txt
+//	mqtt-decode -in binary stream.bin
+//
+// 输入可以是十六进制(允许空白, 逗号, 冒号和0x前缀), base64或原始二进制, 默认自动识别
+// 多个输入按顺序拼接成一个字节流, 依次用 packets.ReadPacket 解码
+// 对每个报文输出固定头部的各个位, 所有字段和负载预览, 以及 Validate 和协议规则的检查结果
+// 解码失败时指出出错的字节偏移并以状态1退出
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const name = "mqtt-decode"
+
+func main() {
+	in := flag.String("in", "auto", "input encoding: auto, hex, base64 or binary")
+	preview := flag.Int("preview", 64, "number of payload bytes to show")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [file ...]\n", name)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var raw []byte
+	if flag.NArg() == 0 {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fatal(err)
+		}
+		raw = data
+	}
+	for _, path := range flag.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fatal(err)
+		}
+		raw = append(raw, data...)
+	}
+	data, err := decodeInput(raw, *in)
+	if err != nil {
+		fatal(err)
+	}
+	d := &decoder{w: os.Stdout, preview: *preview}
+	if !d.decode(data) {
+		os.Exit(1)
+	}
+}
+
+// fatal 输出错误并退出
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	os.Exit(1)
+}
+
+// decodeInput 按编码把输入转换为字节流
+func decodeInput(raw []byte, encoding string) ([]byte, error) {
+	if encoding == "auto" {
+		encoding = detect(raw)
+	}
+	switch encoding {
+	case "binary":
+		return raw, nil
+	case "hex":
+		return decodeHex(raw)
+	case "base64":
+		text := strings.Join(strings.Fields(string(raw)), "")
+		if data, err := base64.StdEncoding.DecodeString(text); err == nil {
+			return data, nil
+		}
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 input: %v", err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown input encoding %q, expected auto, hex, base64 or binary", encoding)
+}
+
+// detect 识别输入编码, 同时满足十六进制和base64时按十六进制处理
+func detect(raw []byte) string {
+	text := string(bytes.TrimSpace(raw))
+	if text == "" {
+		return "binary"
+	}
+	if _, err := decodeHex(raw); err == nil {
+		return "hex"
+	}
+	isBase64 := true
+	for _, r := range text {
+		if !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("+/=", r) || unicode.IsSpace(r))) {
+			isBase64 = false
+			break
+		}
+	}
+	if isBase64 {
+		return "base64"
+	}
+	return "binary"
+}
+
+// decodeHex 解码十六进制文本, 忽略空白, 逗号, 冒号和0x前缀
+func decodeHex(raw []byte) ([]byte, error) {
+	text := strings.NewReplacer("0x", " ", "0X", " ", ",", " ", ":", " ").Replace(string(raw))
+	var digits strings.Builder
+	for _, field := range strings.Fields(text) {
+		// 单个十六进制位的字段视为省略了前导0, 如 "0 c" 中的 "c"
+		if len(field) == 1 {
+			digits.WriteByte('0')
+		}
+		digits.WriteString(field)
+	}
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex input: %v", err)
+	}
+	return data, nil
+}
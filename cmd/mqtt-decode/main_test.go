@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeInput(t *testing.T) {
+	want := []byte{0xc0, 0x00, 0xd0, 0x00}
+	for _, in := range []string{"c0 00 d0 00", "0xc0,0x00,0xd0,0x00\n", "c0:0:d0:0", "c000d000", "wADQAA==", "wADQAA"} {
+		data, err := decodeInput([]byte(in), "auto")
+		if err != nil || !bytes.Equal(data, want) {
+			t.Errorf("decodeInput(%q) returned (% x, %v)", in, data, err)
+		}
+	}
+	if data, _ := decodeInput([]byte{0xc0, 0x00}, "auto"); !bytes.Equal(data, []byte{0xc0, 0x00}) {
+		t.Errorf("binary input decoded as % x", data)
+	}
+	if _, err := decodeInput([]byte("zz"), "hex"); err == nil {
+		t.Errorf("invalid hex input returned no error")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		in   string
+		ok   bool
+		want []string
+	}{
+		{"30 0a 00 03 61 2f 62 68 65 6c 6c 6f", true, []string{"PUBLISH (12 bytes)", `TopicName: "a/b"`, `Payload: 5 bytes "hello"`}},
+		{"10 0c 00 04 4d 51 54 54 05 02 00 3c 00 00", false, []string{"ProtocolLevel: 5", "Validate: 0x01 (unacceptable protocol level)"}},
+		{"33 05 00 01 23 00 00", false, []string{"invalid topic name \"#\"", "packet identifier must not be 0"}},
+		{"c1 00", false, []string{"offset 0: reserved flags must be 0000, found 0001"}},
+		{"40 82 00 00 01", false, []string{"offset 1: remaining length is not encoded in the minimum number of bytes"}},
+		{"c0 00 30 ff ff ff ff 01", false, []string{"#2 at offset 2: decoding failed", "error in remaining length at offset 7"}},
+		{"30 05 00 05 61", false, []string{"remaining length is 5, only 3 bytes available) at offset 5", "^ end of input"}},
+		{"f0 00", false, []string{"error in fixed header (packet type) at offset 0"}},
+	}
+	for _, tt := range tests {
+		data, _ := decodeHex([]byte(tt.in))
+		var out bytes.Buffer
+		d := &decoder{w: &out, preview: 64}
+		if ok := d.decode(data); ok != tt.ok {
+			t.Errorf("decode(%s) returned %v\n%s", tt.in, ok, out.String())
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("decode(%s) output does not contain %q:\n%s", tt.in, s, out.String())
+			}
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	if s := preview([]byte("hello world"), 5); s != `11 bytes "hello" ... (6 more)` {
+		t.Errorf("preview returned %s", s)
+	}
+	if s := preview([]byte{0, 1, 2}, 64); s != "3 bytes 00 01 02" {
+		t.Errorf("preview returned %s", s)
+	}
+}
@@ -0,0 +1,246 @@
+// mqtt-pcap 从pcap或pcapng抓包文件中还原MQTT会话
+//
+// 用法:
+//
+//	mqtt-pcap capture.pcapng
+//	mqtt-pcap -ports 1883,11883 -v site1.pcap site2.pcap
+//	mqtt-pcap -json capture.pcap
+//
+// 默认输出每个连接的摘要: 客户端标识符, 用户名, CONNACK返回码, 订阅, 各类报文的数量,
+// 以及抓包结束时仍未完成的CONNECT, SUBSCRIBE, UNSUBSCRIBE和QoS 1/2交互
+// -v 同时按时间顺序列出每个报文
+// TLS加密的连接无法解码
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/pcap"
+)
+
+const name = "mqtt-pcap"
+
+func main() {
+	portList := flag.String("ports", strconv.Itoa(pcap.DefaultPort), "comma separated MQTT server ports")
+	verbose := flag.Bool("v", false, "list every packet")
+	asJSON := flag.Bool("json", false, "write the summaries as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] file ...\n", name)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ports, err := parsePorts(*portList)
+	if err != nil {
+		fatal(err)
+	}
+
+	status := 0
+	var reports []report
+	for _, path := range flag.Args() {
+		convs, err := assemble(path, ports)
+		if err != nil {
+			// 文件损坏时仍输出已经读到的部分
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", name, path, err)
+			status = 1
+		}
+		for _, c := range convs {
+			r := newReport(path, c)
+			if *asJSON {
+				reports = append(reports, r)
+				continue
+			}
+			r.write(os.Stdout, c, *verbose)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(reports); err != nil {
+			fatal(err)
+		}
+	}
+	os.Exit(status)
+}
+
+// fatal 输出错误并退出
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	os.Exit(1)
+}
+
+// parsePorts 解析端口列表
+func parsePorts(s string) ([]uint16, error) {
+	var ports []uint16
+	for _, f := range strings.Split(s, ",") {
+		p, err := strconv.ParseUint(strings.TrimSpace(f), 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid port %q", f)
+		}
+		ports = append(ports, uint16(p))
+	}
+	return ports, nil
+}
+
+// assemble 读取一个抓包文件
+func assemble(path string, ports []uint16) ([]*pcap.Conversation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return pcap.Assemble(f, ports...)
+}
+
+// report 一个会话的摘要
+type report struct {
+	File          string            `json:"file"`
+	Client        string            `json:"client"`
+	Server        string            `json:"server"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	Closed        bool              `json:"closed"`
+	ClientID      string            `json:"client_id"`
+	Username      string            `json:"username,omitempty"`
+	ReturnCode    *int              `json:"return_code"`
+	Subscriptions map[string]byte   `json:"subscriptions"`
+	Packets       map[string]int    `json:"packets"`
+	Published     map[string]uint64 `json:"published_bytes"`
+	Incomplete    []string          `json:"incomplete"`
+	Errors        []string          `json:"errors"`
+}
+
+// newReport 生成会话的摘要
+func newReport(path string, c *pcap.Conversation) report {
+	s := c.Summary()
+	r := report{
+		File:          path,
+		Client:        c.Client.String(),
+		Server:        c.Server.String(),
+		Start:         c.Start,
+		End:           c.End,
+		Closed:        c.Closed,
+		ClientID:      s.ClientID,
+		Username:      s.Username,
+		Subscriptions: s.Subscriptions,
+		Packets:       s.Counts,
+		Published:     s.Published,
+		Incomplete:    []string{},
+		Errors:        c.Errors,
+	}
+	if s.ReturnCode >= 0 {
+		r.ReturnCode = &s.ReturnCode
+	}
+	for _, p := range s.Incomplete {
+		r.Incomplete = append(r.Incomplete, p.String())
+	}
+	if r.Errors == nil {
+		r.Errors = []string{}
+	}
+	return r
+}
+
+// write 以文本格式输出摘要
+func (r report) write(w io.Writer, c *pcap.Conversation, verbose bool) {
+	state := "open at end of capture"
+	if r.Closed {
+		state = "closed"
+	}
+	fmt.Fprintf(w, "%s -> %s  %s - %s  %s\n", r.Client, r.Server, r.Start.Format(time.RFC3339Nano), r.End.Format("15:04:05.000000"), state)
+	fmt.Fprintf(w, "  client ID: %q", r.ClientID)
+	if r.Username != "" {
+		fmt.Fprintf(w, "  username: %q", r.Username)
+	}
+	if r.ReturnCode != nil {
+		fmt.Fprintf(w, "  connack: 0x%02x", *r.ReturnCode)
+	} else {
+		fmt.Fprintf(w, "  connack: none")
+	}
+	fmt.Fprintln(w)
+
+	if len(r.Subscriptions) > 0 {
+		fmt.Fprintf(w, "  subscriptions:\n")
+		for _, topic := range sortedKeys(r.Subscriptions) {
+			if code := r.Subscriptions[topic]; code == 0x80 {
+				fmt.Fprintf(w, "    %s (rejected)\n", topic)
+			} else {
+				fmt.Fprintf(w, "    %s (QoS %d)\n", topic, code)
+			}
+		}
+	}
+	var counts []string
+	for _, t := range sortedKeys(r.Packets) {
+		counts = append(counts, fmt.Sprintf("%s %d", t, r.Packets[t]))
+	}
+	fmt.Fprintf(w, "  packets: %s\n", strings.Join(counts, ", "))
+	if len(r.Incomplete) > 0 {
+		fmt.Fprintf(w, "  incomplete:\n")
+		for _, s := range r.Incomplete {
+			fmt.Fprintf(w, "    %s\n", s)
+		}
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "  error: %s\n", e)
+	}
+	if verbose {
+		for _, m := range c.Messages {
+			arrow := "C->S"
+			if !m.FromClient {
+				arrow = "S->C"
+			}
+			fmt.Fprintf(w, "    %s %s %s\n", m.Timestamp.Format("15:04:05.000000"), arrow, describe(m.Packet))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// describe 报文的简短描述, 负载只输出长度
+func describe(pk packets.ControlPacket) string {
+	switch p := pk.(type) {
+	case *packets.ConnectPacket:
+		return fmt.Sprintf("CONNECT client ID %q clean %t keep alive %d", p.ClientIdentifier, p.CleanSession, p.KeepAlive)
+	case *packets.ConnackPacket:
+		return fmt.Sprintf("CONNACK session present %t return code 0x%02x", p.SessionPresent, p.ReturnCode)
+	case *packets.PublishPacket:
+		return fmt.Sprintf("PUBLISH %q QoS %d retain %t dup %t id %d, %d bytes", p.TopicName, p.Qos, p.Retain, p.Dup, p.PacketID, len(p.Payload))
+	case *packets.PubackPacket:
+		return fmt.Sprintf("PUBACK id %d", p.PacketID)
+	case *packets.PubrecPacket:
+		return fmt.Sprintf("PUBREC id %d", p.PacketID)
+	case *packets.PubrelPacket:
+		return fmt.Sprintf("PUBREL id %d", p.PacketID)
+	case *packets.PubcompPacket:
+		return fmt.Sprintf("PUBCOMP id %d", p.PacketID)
+	case *packets.SubscribePacket:
+		return fmt.Sprintf("SUBSCRIBE id %d %q QoS %v", p.PacketID, p.Topics, p.Qoss)
+	case *packets.SubackPacket:
+		return fmt.Sprintf("SUBACK id %d return codes %v", p.PacketID, p.ReturnCodes)
+	case *packets.UnsubscribePacket:
+		return fmt.Sprintf("UNSUBSCRIBE id %d %q", p.PacketID, p.Topics)
+	case *packets.UnsubackPacket:
+		return fmt.Sprintf("UNSUBACK id %d", p.PacketID)
+	}
+	return packets.PacketNames[packets.HeaderOf(pk).PacketType]
+}
+
+// sortedKeys 排序后的键
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
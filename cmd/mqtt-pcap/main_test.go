@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("1883, 11883")
+	if err != nil || len(ports) != 2 || ports[0] != 1883 || ports[1] != 11883 {
+		t.Errorf("parsePorts returned (%v, %v)", ports, err)
+	}
+	for _, s := range []string{"", "0", "65536", "mqtt"} {
+		if _, err = parsePorts(s); err == nil {
+			t.Errorf("parsePorts(%q) returned no error", s)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName, pk.Qos, pk.PacketID, pk.Payload = "a/b", 1, 9, []byte("secret")
+	if s := describe(pk); s != `PUBLISH "a/b" QoS 1 retain false dup false id 9, 6 bytes` {
+		t.Errorf("describe returned %s", s)
+	}
+	if s := describe(packets.NewControlPacket(packets.PINGREQ)); s != "PINGREQ" {
+		t.Errorf("describe returned %s", s)
+	}
+}
@@ -0,0 +1,95 @@
+// mqtt-proxy 理解MQTT协议的TCP代理
+//
+// 用法:
+//
+//	mqtt-proxy -listen :1884 -upstream broker:1883 -v
+//	mqtt-proxy -upstream broker:1883 -topic home/=tenants/42/home/ -client-id-prefix t42-
+//	mqtt-proxy -upstream broker:1883 -latency 200ms -jitter 50ms -loss 0.1
+//
+// -topic 为 客户端前缀=服务端前缀, 可以重复, 按顺序使用第一个匹配的规则
+// -loss 丢弃PUBLISH时代理代替接收方完成QoS 1/2的确认
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/boxungo/mqtt/proxy"
+)
+
+const name = "mqtt-proxy"
+
+// topicRules 可重复的 -topic 参数
+type topicRules []proxy.TopicRule
+
+// String ...
+func (r *topicRules) String() string {
+	var s []string
+	for _, t := range *r {
+		s = append(s, t.Client+"="+t.Broker)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set ...
+func (r *topicRules) Set(v string) error {
+	client, broker, ok := strings.Cut(v, "=")
+	if !ok || client == "" {
+		return errors.New("should be client-prefix=broker-prefix")
+	}
+	*r = append(*r, proxy.TopicRule{Client: client, Broker: broker})
+	return nil
+}
+
+func main() {
+	var cfg proxy.Config
+	var topics topicRules
+	listen := flag.String("listen", ":1884", "address to accept clients on")
+	flag.StringVar(&cfg.Upstream, "upstream", "", "broker address")
+	flag.Var(&topics, "topic", "rewrite topics with client-prefix=broker-prefix, repeatable")
+	flag.StringVar(&cfg.Rules.ClientIDPrefix, "client-id-prefix", "", "prefix added to client identifiers")
+	flag.StringVar(&cfg.Rules.Username, "username", "", "username sent to the broker instead of the client's")
+	flag.StringVar(&cfg.Rules.Password, "password", "", "password sent with -username")
+	flag.DurationVar(&cfg.Faults.Latency, "latency", 0, "delay added to every packet")
+	flag.DurationVar(&cfg.Faults.Jitter, "jitter", 0, "random delay added on top of -latency")
+	flag.Float64Var(&cfg.Faults.Loss, "loss", 0, "probability of dropping a PUBLISH, 0 to 1")
+	verbose := flag.Bool("v", false, "log every packet")
+	flag.Parse()
+	if cfg.Upstream == "" {
+		fmt.Fprintf(os.Stderr, "%s: -upstream is required\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg.Rules.Topics = topics
+
+	logger := log.New(os.Stderr, name+": ", log.LstdFlags)
+	if *verbose {
+		cfg.Logger = logger
+	}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Printf("proxying %s to %s", l.Addr(), cfg.Upstream)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		p.Close()
+	}()
+	if err = p.Serve(l); err != nil && !errors.Is(err, proxy.ErrClosed) {
+		logger.Fatal(err)
+	}
+}
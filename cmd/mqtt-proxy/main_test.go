@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestTopicRules(t *testing.T) {
+	var r topicRules
+	for _, v := range []string{"home/=tenants/42/home/", "a=", "=b", "nothing"} {
+		r.Set(v)
+	}
+	if got := r.String(); got != "home/=tenants/42/home/,a=" {
+		t.Errorf("rules %q", got)
+	}
+}
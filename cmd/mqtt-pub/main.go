@@ -0,0 +1,168 @@
+// mqtt-pub 发布消息, 参数与mosquitto_pub兼容
+//
+// 用法:
+//
+//	mqtt-pub -t sensors/1 -m 21.5
+//	mqtt-pub -t firmware -q 1 -f image.bin
+//	tail -f app.log | mqtt-pub -t logs -l
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/internal/cmdutil"
+	"github.com/boxungo/mqtt/packets"
+)
+
+const name = "mqtt-pub"
+
+func main() {
+	var conn cmdutil.ConnFlags
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	conn.Register(fs, name+"-")
+	topic := fs.String("t", "", "topic to publish to")
+	qos := fs.Int("q", 0, "QoS of the messages")
+	retain := fs.Bool("r", false, "retain the messages")
+	message := fs.String("m", "", "send the argument as a single message")
+	file := fs.String("f", "", "send the content of a file as a single message")
+	stdin := fs.Bool("s", false, "send all of stdin as a single message")
+	lines := fs.Bool("l", false, "send each line of stdin as a separate message")
+	null := fs.Bool("n", false, "send an empty message")
+	repeat := fs.Int("repeat", 1, "number of times to send the message, not used with -l")
+	delay := fs.Duration("repeat-delay", 0, "delay between repeated messages")
+	fs.Parse(os.Args[1:])
+
+	sources := 0
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range []string{"m", "f", "s", "l", "n"} {
+		if set[s] {
+			sources++
+		}
+	}
+	switch {
+	case *topic == "":
+		cmdutil.Fatal(name, errors.New("a topic is required (-t)"))
+	case !packets.ValidTopicName(*topic):
+		cmdutil.Fatal(name, fmt.Errorf("invalid topic %q", *topic))
+	case *qos < 0 || *qos > 2:
+		cmdutil.Fatal(name, fmt.Errorf("invalid QoS %d", *qos))
+	case sources != 1:
+		cmdutil.Fatal(name, errors.New("exactly one of -m, -f, -s, -l or -n is required"))
+	case *repeat < 1:
+		cmdutil.Fatal(name, errors.New("-repeat must be at least 1"))
+	}
+	if err := conn.Validate(); err != nil {
+		cmdutil.Fatal(name, err)
+	}
+
+	c, err := conn.Dial(nil)
+	if err != nil {
+		cmdutil.Fatal(name, err)
+	}
+	p := &publisher{c: c, topic: *topic, qos: byte(*qos), retain: *retain}
+	switch {
+	case *lines:
+		err = p.lines(os.Stdin)
+	case set["f"]:
+		err = p.file(*file, *repeat, *delay)
+	default:
+		var payload []byte
+		switch {
+		case set["m"]:
+			payload = []byte(*message)
+		case *stdin:
+			payload, err = io.ReadAll(os.Stdin)
+		case *null:
+		}
+		for i := 0; i < *repeat && err == nil; i++ {
+			if i > 0 {
+				time.Sleep(*delay)
+			}
+			err = p.publish(payload)
+		}
+	}
+	if err != nil {
+		c.Close()
+		cmdutil.Fatal(name, err)
+	}
+	c.Disconnect()
+}
+
+// publisher 按固定的主题和QoS发布消息
+type publisher struct {
+	c      *client.Client
+	topic  string
+	qos    byte
+	retain bool
+}
+
+// publish 发布一条消息, QoS大于0时等待确认
+func (p *publisher) publish(payload []byte) error {
+	pk := p.packet()
+	pk.Payload = payload
+	return p.c.Publish(context.Background(), pk)
+}
+
+// file 发布 repeat 次文件的内容, 有效负载从文件流式读取, 不读入内存, 适合固件等大文件
+func (p *publisher) file(path string, repeat int, delay time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < repeat; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			if _, err = f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		if err = p.c.PublishStream(context.Background(), p.packet(), f, int(info.Size())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packet 新建发布用的PUBLISH报文
+func (p *publisher) packet() *packets.PublishPacket {
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName = p.topic
+	pk.Qos = p.qos
+	pk.Retain = p.retain
+	return pk
+}
+
+// lines 把每一行作为一条消息发布, 不包含换行符, 空行也会发布
+func (p *publisher) lines(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			if perr := p.publish(line); perr != nil {
+				return perr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/packets"
+)
+
+func TestLines(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	got := make(chan string, 10)
+	sub, err := client.Connect(b.Pipe(), client.Options{ClientID: "sub", CleanSession: true, OnMessage: func(c *client.Client, pk *packets.PublishPacket) {
+		got <- string(pk.Payload)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	sub.Subscribe(context.Background(), []string{"logs"}, []byte{1})
+
+	pub, err := client.Connect(b.Pipe(), client.Options{ClientID: "pub", CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	p := &publisher{c: pub, topic: "logs", qos: 1}
+	if err = p.lines(strings.NewReader("first\n\nlast")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "", "last"} {
+		select {
+		case line := <-got:
+			if line != want {
+				t.Errorf("received %q, should be %q", line, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("did not receive %q", want)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	got := make(chan string, 10)
+	sub, err := client.Connect(b.Pipe(), client.Options{ClientID: "sub", CleanSession: true, OnMessage: func(c *client.Client, pk *packets.PublishPacket) {
+		got <- string(pk.Payload)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	sub.Subscribe(context.Background(), []string{"firmware"}, []byte{1})
+
+	pub, err := client.Connect(b.Pipe(), client.Options{ClientID: "pub", CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	path := filepath.Join(t.TempDir(), "image.bin")
+	if err = os.WriteFile(path, []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := &publisher{c: pub, topic: "firmware", qos: 1}
+	if err = p.file(path, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case payload := <-got:
+			if payload != "image" {
+				t.Errorf("received %q, should be image", payload)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("file was not published twice")
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// mqtt-sub 订阅并输出消息, 参数与mosquitto_sub兼容
+//
+// 用法:
+//
+//	mqtt-sub -t 'sensors/#' -v
+//	mqtt-sub -t 'devices/+/status' -F json -C 1 -W 5
+//
+// 输出格式:
+//
+//	raw   负载原样输出, -v 时在前面加上主题和空格
+//	json  每行一个JSON对象, 包含 topic, qos, retain 和 payload(非UTF-8时为 payload_base64)
+//	hex   负载的十六进制, -v 时在前面加上主题和空格
+//
+// -W 超时退出时状态码为27, 与mosquitto_sub相同
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/internal/cmdutil"
+	"github.com/boxungo/mqtt/packets"
+)
+
+const name = "mqtt-sub"
+
+// exitTimeout -W 超时退出时的状态码
+const exitTimeout = 27
+
+// topicList 可重复的主题参数
+type topicList []string
+
+func (l *topicList) String() string { return strings.Join(*l, ",") }
+
+func (l *topicList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func main() {
+	var conn cmdutil.ConnFlags
+	var topics, excludes topicList
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	conn.Register(fs, name+"-")
+	fs.Var(&topics, "t", "topic filter to subscribe to, may be repeated")
+	fs.Var(&excludes, "T", "do not print messages whose topic matches this filter, may be repeated")
+	qos := fs.Int("q", 0, "QoS of the subscriptions")
+	format := fs.String("F", "raw", "output format: raw, json or hex")
+	verbose := fs.Bool("v", false, "print the topic before the payload (raw and hex formats)")
+	noRetained := fs.Bool("R", false, "do not print retained messages received after subscribing")
+	count := fs.Int("C", 0, "exit after printing this many messages")
+	var timeout cmdutil.Seconds
+	fs.Var(&timeout, "W", "exit with status 27 if -C messages were not received within this many seconds")
+	fs.Parse(os.Args[1:])
+
+	switch {
+	case len(topics) == 0:
+		cmdutil.Fatal(name, errors.New("at least one topic is required (-t)"))
+	case *qos < 0 || *qos > 2:
+		cmdutil.Fatal(name, fmt.Errorf("invalid QoS %d", *qos))
+	case *count < 0:
+		cmdutil.Fatal(name, errors.New("-C must not be negative"))
+	}
+	for _, t := range append(append([]string(nil), topics...), excludes...) {
+		if !packets.ValidTopicFilter(t) {
+			cmdutil.Fatal(name, fmt.Errorf("invalid topic filter %q", t))
+		}
+	}
+	if err := conn.Validate(); err != nil {
+		cmdutil.Fatal(name, err)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	p := &printer{w: out, format: *format, verbose: *verbose, excludes: excludes, noRetained: *noRetained, count: *count, done: make(chan struct{})}
+	if err := p.check(); err != nil {
+		cmdutil.Fatal(name, err)
+	}
+
+	c, err := conn.Dial(func(c *client.Client, pk *packets.PublishPacket) {
+		if err := p.print(pk); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			c.Close()
+		}
+	})
+	if err != nil {
+		cmdutil.Fatal(name, err)
+	}
+	qoss := make([]byte, len(topics))
+	for i := range qoss {
+		qoss[i] = byte(*qos)
+	}
+	codes, err := c.Subscribe(context.Background(), topics, qoss)
+	if err != nil {
+		c.Close()
+		cmdutil.Fatal(name, err)
+	}
+	for i, code := range codes {
+		if code == hooks.SubackFailure {
+			c.Close()
+			cmdutil.Fatal(name, fmt.Errorf("subscription to %q was rejected", topics[i]))
+		}
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(time.Duration(timeout))
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	status := 0
+	select {
+	case <-p.done:
+	case <-signals:
+	case <-expired:
+		status = exitTimeout
+	case <-c.Done():
+		err = c.Err()
+		status = 1
+	}
+	c.Disconnect()
+	p.flush()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	}
+	os.Exit(status)
+}
+
+// printer 按格式输出消息, 在客户端的读协程中调用
+type printer struct {
+	w          *bufio.Writer
+	format     string
+	verbose    bool
+	excludes   []string
+	noRetained bool
+	count      int // 输出这么多条消息后关闭 done, 为0时不限制
+
+	mu      sync.Mutex
+	printed int
+	done    chan struct{}
+}
+
+// check 检查输出格式
+func (p *printer) check() error {
+	switch p.format {
+	case "raw", "json", "hex":
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, expected raw, json or hex", p.format)
+}
+
+// print 输出一条消息
+func (p *printer) print(pk *packets.PublishPacket) error {
+	if p.noRetained && pk.Retain {
+		return nil
+	}
+	for _, filter := range p.excludes {
+		if packets.MatchTopic(filter, pk.TopicName) {
+			return nil
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.count > 0 && p.printed >= p.count {
+		return nil
+	}
+	if err := writeMessage(p.w, pk, p.format, p.verbose); err != nil {
+		return err
+	}
+	// 逐条刷新, 便于管道中的下游程序及时处理
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	p.printed++
+	if p.count > 0 && p.printed == p.count {
+		close(p.done)
+	}
+	return nil
+}
+
+// flush 刷新输出
+func (p *printer) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.w.Flush()
+}
+
+// message JSON格式的消息
+type message struct {
+	Topic         string `json:"topic"`
+	Qos           byte   `json:"qos"`
+	Retain        bool   `json:"retain"`
+	Payload       string `json:"payload,omitempty"`
+	PayloadBase64 string `json:"payload_base64,omitempty"`
+}
+
+// writeMessage 按格式写入一条消息, 以换行结束
+func writeMessage(w io.Writer, pk *packets.PublishPacket, format string, verbose bool) error {
+	var err error
+	switch format {
+	case "json":
+		m := message{Topic: pk.TopicName, Qos: pk.Qos, Retain: pk.Retain}
+		if utf8.Valid(pk.Payload) {
+			m.Payload = string(pk.Payload)
+		} else {
+			m.PayloadBase64 = base64.StdEncoding.EncodeToString(pk.Payload)
+		}
+		return json.NewEncoder(w).Encode(m)
+	case "hex":
+		if verbose {
+			_, err = fmt.Fprintf(w, "%s %s\n", pk.TopicName, hex.EncodeToString(pk.Payload))
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", hex.EncodeToString(pk.Payload))
+		}
+	default:
+		if verbose {
+			_, err = fmt.Fprintf(w, "%s %s\n", pk.TopicName, pk.Payload)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", pk.Payload)
+		}
+	}
+	return err
+}
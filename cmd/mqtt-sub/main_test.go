@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+func publish(topic string, retain bool, payload string) *packets.PublishPacket {
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName = topic
+	pk.Qos = 1
+	pk.Retain = retain
+	pk.Payload = []byte(payload)
+	return pk
+}
+
+func TestWriteMessage(t *testing.T) {
+	tests := []struct {
+		format  string
+		verbose bool
+		payload string
+		out     string
+	}{
+		{"raw", false, "21.5", "21.5\n"},
+		{"raw", true, "21.5", "a/b 21.5\n"},
+		{"hex", false, "\x00\xff", "00ff\n"},
+		{"hex", true, "hi", "a/b 6869\n"},
+		{"json", false, "on", `{"topic":"a/b","qos":1,"retain":true,"payload":"on"}` + "\n"},
+		{"json", false, "\xff", `{"topic":"a/b","qos":1,"retain":true,"payload_base64":"/w=="}` + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeMessage(&buf, publish("a/b", true, tt.payload), tt.format, tt.verbose); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.out {
+			t.Errorf("writeMessage(%s, %v, %q) wrote %q, should be %q", tt.format, tt.verbose, tt.payload, buf.String(), tt.out)
+		}
+	}
+}
+
+func TestPrinter(t *testing.T) {
+	var buf bytes.Buffer
+	p := &printer{w: bufio.NewWriter(&buf), format: "raw", excludes: []string{"a/debug/#"}, noRetained: true, count: 2, done: make(chan struct{})}
+	p.print(publish("a/x", true, "stale"))
+	p.print(publish("a/debug/1", false, "noise"))
+	p.print(publish("a/x", false, "1"))
+	select {
+	case <-p.done:
+		t.Fatalf("done closed after one message")
+	default:
+	}
+	p.print(publish("a/x", false, "2"))
+	p.print(publish("a/x", false, "3"))
+	<-p.done
+	if buf.String() != "1\n2\n" {
+		t.Errorf("printer wrote %q", buf.String())
+	}
+}
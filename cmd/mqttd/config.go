@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boxungo/mqtt/bridge"
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/packets"
+	"github.com/boxungo/mqtt/ratelimit"
+	"github.com/boxungo/mqtt/session"
+	"github.com/boxungo/mqtt/store"
+)
+
+// Config 配置文件, JSON格式
+type Config struct {
+	Listeners      []Listener    `json:"listeners"`
+	Auth           Auth          `json:"auth"`
+	ACLFile        string        `json:"acl_file"`
+	Persistence    *Persistence  `json:"persistence"`
+	Sessions       Sessions      `json:"sessions"`
+	Limits         Limits        `json:"limits"`
+	SysInterval    Duration      `json:"sys_interval"`
+	MetricsAddress string        `json:"metrics_address"`
+	Bridges        []BridgeEntry `json:"bridges"`
+	Cluster        *Cluster      `json:"cluster"`
+}
+
+// Listener 监听配置
+type Listener struct {
+	Type     string `json:"type"` // tcp, tls, unix, websocket
+	Address  string `json:"address"`
+	CertFile string `json:"cert_file"` // tls, 以及设置了证书的websocket
+	KeyFile  string `json:"key_file"`
+	Path     string `json:"path"` // websocket的路径, 默认为 /mqtt
+}
+
+// Auth 认证配置, 可重新加载
+type Auth struct {
+	Anonymous    bool              `json:"anonymous"`
+	Users        map[string]string `json:"users"`
+	PasswordFile string            `json:"password_file"`
+}
+
+// Persistence 持久化配置
+type Persistence struct {
+	Dir          string   `json:"dir"`
+	Sync         string   `json:"sync"` // always, interval, never
+	SyncInterval Duration `json:"sync_interval"`
+	CompactSize  int64    `json:"compact_size"`
+}
+
+// Sessions 会话配置
+type Sessions struct {
+	ClientIDPolicy string   `json:"client_id_policy"` // takeover, reject, allow_both
+	IDGenerator    string   `json:"id_generator"`     // uuid, counter, addr_hash
+	IDPrefix       string   `json:"id_prefix"`
+	SessionExpiry  Duration `json:"session_expiry"`
+	WillOnTakeover bool     `json:"will_on_takeover"`
+	SharedStrategy string   `json:"shared_strategy"` // round_robin, random, sticky_client, hash_topic
+}
+
+// Limits 限制配置
+type Limits struct {
+	MaxInflight   int         `json:"max_inflight"`
+	QueueMessages int         `json:"queue_messages"`
+	QueueBytes    int         `json:"queue_bytes"`
+	Overflow      string      `json:"overflow"` // drop_oldest, drop_newest, disconnect
+	MessageExpiry Duration    `json:"message_expiry"`
+	Rate          *RateLimits `json:"rate"`
+	WriteBuffer   int         `json:"write_buffer"`
+	WriteDelay    Duration    `json:"write_delay"`
+	WriteTimeout  Timeout     `json:"write_timeout"` // 负数表示不设置写超时
+	WriteQueue    int         `json:"write_queue"`
+}
+
+// RateLimits 限流配置
+type RateLimits struct {
+	Client   RateRule            `json:"client"`
+	Username RateRule            `json:"username"`
+	Topics   map[string]RateRule `json:"topics"`
+}
+
+// RateRule 限流规则
+type RateRule struct {
+	PacketsPerSecond float64 `json:"packets_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+	Burst            int     `json:"burst"`
+	Action           string  `json:"action"` // throttle, drop, disconnect
+}
+
+// Cluster 集群配置, 节点之间全连接
+type Cluster struct {
+	NodeID        string            `json:"node_id"`
+	Address       string            `json:"address"`        // 接受其他节点连接的地址, 节点协议没有认证, 只应在内网中监听
+	Peers         map[string]string `json:"peers"`          // 节点ID -> 地址, 未连接时定期重连
+	RetryInterval Duration          `json:"retry_interval"` // 重连间隔, 默认5秒
+}
+
+// BridgeEntry 桥接配置
+type BridgeEntry struct {
+	Name          string        `json:"name"`
+	Address       string        `json:"address"`
+	ClientID      string        `json:"client_id"`
+	LocalClientID string        `json:"local_client_id"`
+	Username      string        `json:"username"`
+	Password      string        `json:"password"`
+	KeepAlive     uint16        `json:"keep_alive"`
+	PlainProtocol bool          `json:"plain_protocol"`
+	RetryInterval Duration      `json:"retry_interval"`
+	Topics        []BridgeTopic `json:"topics"`
+}
+
+// BridgeTopic 桥接主题
+type BridgeTopic struct {
+	Pattern      string `json:"pattern"`
+	Direction    string `json:"direction"` // out, in, both
+	Qos          byte   `json:"qos"`
+	LocalPrefix  string `json:"local_prefix"`
+	RemotePrefix string `json:"remote_prefix"`
+}
+
+// Duration 时长, 配置文件中写作 "10s", "1h30m"
+type Duration time.Duration
+
+// UnmarshalJSON ...
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	v, s, err := parseDuration(data)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("duration %q is negative", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Timeout 可以为负数的时间间隔, 格式与 Duration 相同, 负数表示不启用
+type Timeout time.Duration
+
+// UnmarshalJSON ...
+func (t *Timeout) UnmarshalJSON(data []byte) error {
+	v, _, err := parseDuration(data)
+	if err != nil {
+		return err
+	}
+	*t = Timeout(v)
+	return nil
+}
+
+// parseDuration 解析JSON字符串形式的时间间隔
+func parseDuration(data []byte) (time.Duration, string, error) {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, "", fmt.Errorf("duration must be a string like \"10s\"")
+	}
+	v, err := time.ParseDuration(s)
+	return v, s, err
+}
+
+// LoadConfig 读取并验证配置文件, 错误信息以文件名开头
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		var se *syntaxError
+		if errors.As(err, &se) {
+			return nil, fmt.Errorf("%s:%s", path, err)
+		}
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig 解析并验证配置
+// 语法和类型错误的格式为 行:列: 信息, 验证错误的格式为 路径: 信息
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		var se *json.SyntaxError
+		var te *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &se):
+			return nil, newSyntaxError(data, se.Offset-1, se.Error())
+		case errors.As(err, &te):
+			return nil, newSyntaxError(data, te.Offset-1, fmt.Sprintf("%s: expected %s, found %s", te.Field, te.Type, te.Value))
+		case err == io.EOF:
+			return nil, errors.New("empty configuration")
+		}
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if dec.More() {
+		return nil, newSyntaxError(data, dec.InputOffset(), "unexpected data after the configuration object")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// syntaxError 带有行号和列号的解析错误
+type syntaxError struct {
+	line int
+	col  int
+	msg  string
+}
+
+func (e *syntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.line, e.col, e.msg)
+}
+
+// newSyntaxError 把出错字符的字节偏移转换为行号和列号, 均从1开始
+func newSyntaxError(data []byte, offset int64, msg string) error {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	return &syntaxError{
+		line: bytes.Count(before, []byte("\n")) + 1,
+		col:  int(offset) - bytes.LastIndexByte(before, '\n'),
+		msg:  msg,
+	}
+}
+
+// fieldError 带有配置路径的验证错误
+type fieldError struct {
+	path string
+	msg  string
+}
+
+func (e *fieldError) Error() string {
+	return e.path + ": " + e.msg
+}
+
+// errorf 新建验证错误
+func errorf(path string, format string, args ...interface{}) error {
+	return &fieldError{path: path, msg: fmt.Sprintf(format, args...)}
+}
+
+// validate 验证配置
+func (c *Config) validate() error {
+	if len(c.Listeners) == 0 {
+		return errorf("listeners", "at least one listener is required")
+	}
+	seen := make(map[string]int)
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		switch l.Type {
+		case "tcp", "unix", "websocket":
+		case "tls":
+			if l.CertFile == "" || l.KeyFile == "" {
+				return errorf(path, "tls listener needs cert_file and key_file")
+			}
+		case "":
+			return errorf(path+".type", "missing listener type")
+		default:
+			return errorf(path+".type", "unknown listener type %q, expected tcp, tls, unix or websocket", l.Type)
+		}
+		if l.Address == "" {
+			return errorf(path+".address", "missing address")
+		}
+		if (l.CertFile == "") != (l.KeyFile == "") {
+			return errorf(path, "cert_file and key_file must be set together")
+		}
+		if l.Path != "" && l.Type != "websocket" {
+			return errorf(path+".path", "path is only used by websocket listeners")
+		}
+		if j, ok := seen[l.Address]; ok {
+			return errorf(path+".address", "%s is already used by listeners[%d]", l.Address, j)
+		}
+		seen[l.Address] = i
+	}
+	if c.MetricsAddress != "" {
+		if j, ok := seen[c.MetricsAddress]; ok {
+			return errorf("metrics_address", "%s is already used by listeners[%d]", c.MetricsAddress, j)
+		}
+	}
+	if cl := c.Cluster; cl != nil {
+		if cl.NodeID == "" {
+			return errorf("cluster.node_id", "missing node ID")
+		}
+		if cl.Address == "" {
+			return errorf("cluster.address", "missing address")
+		}
+		if j, ok := seen[cl.Address]; ok {
+			return errorf("cluster.address", "%s is already used by listeners[%d]", cl.Address, j)
+		}
+		if cl.Address == c.MetricsAddress {
+			return errorf("cluster.address", "%s is already used by metrics_address", cl.Address)
+		}
+		for id, addr := range cl.Peers {
+			if id == cl.NodeID {
+				return errorf("cluster.peers", "peer %q has the node's own ID", id)
+			}
+			if addr == "" {
+				return errorf("cluster.peers."+id, "missing address")
+			}
+		}
+	}
+
+	if _, err := c.Auth.users(); err != nil {
+		return err
+	}
+	if c.ACLFile != "" {
+		f, err := os.Open(c.ACLFile)
+		if err != nil {
+			return errorf("acl_file", "%s", err)
+		}
+		err = broker.NewACL().Load(c.ACLFile, f)
+		f.Close()
+		if err != nil {
+			return errorf("acl_file", "%s", err)
+		}
+	}
+	if _, err := c.storeOptions(); err != nil {
+		return err
+	}
+	if _, err := c.policy(); err != nil {
+		return err
+	}
+	if _, err := c.idGenerator(); err != nil {
+		return err
+	}
+	if _, err := c.sharedStrategy(); err != nil {
+		return err
+	}
+	if _, err := c.limits(); err != nil {
+		return err
+	}
+	if _, err := c.limiter(); err != nil {
+		return err
+	}
+	if c.Limits.MaxInflight < 0 || c.Limits.MaxInflight > 65535 {
+		return errorf("limits.max_inflight", "must be between 0 and 65535")
+	}
+	if c.Limits.WriteBuffer < 0 {
+		return errorf("limits.write_buffer", "must not be negative")
+	}
+	if c.Limits.WriteDelay < 0 {
+		return errorf("limits.write_delay", "must not be negative")
+	}
+	if c.Limits.WriteQueue < 0 {
+		return errorf("limits.write_queue", "must not be negative")
+	}
+	if _, err := c.bridges(nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// users 合并配置中的用户和密码文件中的用户
+func (a *Auth) users() (map[string]string, error) {
+	users := make(map[string]string)
+	if a.PasswordFile != "" {
+		fromFile, err := broker.ReadPasswordFile(a.PasswordFile)
+		if err != nil {
+			return nil, errorf("auth.password_file", "%s", err)
+		}
+		for u, p := range fromFile {
+			users[u] = p
+		}
+	}
+	for u, p := range a.Users {
+		if u == "" {
+			return nil, errorf("auth.users", "empty username")
+		}
+		users[u] = p
+	}
+	if !a.Anonymous && len(users) == 0 {
+		return nil, errorf("auth", "anonymous access is disabled but no users are configured")
+	}
+	return users, nil
+}
+
+// storeOptions 持久化选项, 未配置持久化时返回nil
+func (c *Config) storeOptions() (*store.Options, error) {
+	p := c.Persistence
+	if p == nil {
+		return nil, nil
+	}
+	if p.Dir == "" {
+		return nil, errorf("persistence.dir", "missing directory")
+	}
+	opts := &store.Options{Dir: p.Dir, SyncInterval: time.Duration(p.SyncInterval), CompactSize: p.CompactSize}
+	switch p.Sync {
+	case "", "always":
+		opts.Sync = store.SyncAlways
+	case "interval":
+		opts.Sync = store.SyncInterval
+	case "never":
+		opts.Sync = store.SyncNever
+	default:
+		return nil, errorf("persistence.sync", "unknown sync policy %q, expected always, interval or never", p.Sync)
+	}
+	if p.SyncInterval != 0 && opts.Sync != store.SyncInterval {
+		return nil, errorf("persistence.sync_interval", "only used when sync is \"interval\"")
+	}
+	if p.CompactSize < 0 {
+		return nil, errorf("persistence.compact_size", "must not be negative")
+	}
+	return opts, nil
+}
+
+// policy 客户端标识符重复时的策略
+func (c *Config) policy() (session.Policy, error) {
+	switch c.Sessions.ClientIDPolicy {
+	case "", "takeover":
+		return session.Takeover, nil
+	case "reject":
+		return session.Reject, nil
+	case "allow_both":
+		return session.AllowBoth, nil
+	}
+	return 0, errorf("sessions.client_id_policy", "unknown policy %q, expected takeover, reject or allow_both", c.Sessions.ClientIDPolicy)
+}
+
+// sharedStrategy 共享订阅在组内选择成员的策略
+func (c *Config) sharedStrategy() (broker.SharedStrategy, error) {
+	switch c.Sessions.SharedStrategy {
+	case "", "round_robin":
+		return broker.RoundRobin, nil
+	case "random":
+		return broker.Random, nil
+	case "sticky_client":
+		return broker.StickyClient, nil
+	case "hash_topic":
+		return broker.HashTopic, nil
+	}
+	return 0, errorf("sessions.shared_strategy", "unknown strategy %q, expected round_robin, random, sticky_client or hash_topic", c.Sessions.SharedStrategy)
+}
+
+// idGenerator 空客户端标识符的生成方式
+func (c *Config) idGenerator() (session.IDGenerator, error) {
+	switch c.Sessions.IDGenerator {
+	case "", "uuid":
+		return session.UUID(c.Sessions.IDPrefix), nil
+	case "counter":
+		return session.Counter(c.Sessions.IDPrefix), nil
+	case "addr_hash":
+		return session.AddrHash(c.Sessions.IDPrefix), nil
+	}
+	return nil, errorf("sessions.id_generator", "unknown generator %q, expected uuid, counter or addr_hash", c.Sessions.IDGenerator)
+}
+
+// limits 离线队列限制
+func (c *Config) limits() (session.Limits, error) {
+	l := session.Limits{
+		MaxMessages:   c.Limits.QueueMessages,
+		MaxBytes:      c.Limits.QueueBytes,
+		MessageExpiry: time.Duration(c.Limits.MessageExpiry),
+	}
+	if l.MaxMessages < 0 {
+		return l, errorf("limits.queue_messages", "must not be negative")
+	}
+	if l.MaxBytes < 0 {
+		return l, errorf("limits.queue_bytes", "must not be negative")
+	}
+	switch c.Limits.Overflow {
+	case "", "drop_oldest":
+		l.Overflow = session.DropOldest
+	case "drop_newest":
+		l.Overflow = session.DropNewest
+	case "disconnect":
+		l.Overflow = session.Disconnect
+	default:
+		return l, errorf("limits.overflow", "unknown overflow policy %q, expected drop_oldest, drop_newest or disconnect", c.Limits.Overflow)
+	}
+	return l, nil
+}
+
+// limiter 限流器, 未配置限流时返回nil
+func (c *Config) limiter() (*ratelimit.Limiter, error) {
+	r := c.Limits.Rate
+	if r == nil {
+		return nil, nil
+	}
+	l := &ratelimit.Limiter{Topics: make(map[string]ratelimit.Rule)}
+	var err error
+	if l.Client, err = r.Client.rule("limits.rate.client"); err != nil {
+		return nil, err
+	}
+	if l.Username, err = r.Username.rule("limits.rate.username"); err != nil {
+		return nil, err
+	}
+	for prefix, rule := range r.Topics {
+		path := fmt.Sprintf("limits.rate.topics[%q]", prefix)
+		if prefix == "" {
+			return nil, errorf(path, "empty topic prefix")
+		}
+		if l.Topics[prefix], err = rule.rule(path); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// rule 转换限流规则
+func (r RateRule) rule(path string) (ratelimit.Rule, error) {
+	rule := ratelimit.Rule{PacketsPerSecond: r.PacketsPerSecond, BytesPerSecond: r.BytesPerSecond, Burst: r.Burst}
+	if r.PacketsPerSecond < 0 {
+		return rule, errorf(path+".packets_per_second", "must not be negative")
+	}
+	if r.BytesPerSecond < 0 {
+		return rule, errorf(path+".bytes_per_second", "must not be negative")
+	}
+	switch r.Action {
+	case "", "throttle":
+		rule.Action = ratelimit.Throttle
+	case "drop":
+		rule.Action = ratelimit.Drop
+	case "disconnect":
+		rule.Action = ratelimit.Disconnect
+	default:
+		return rule, errorf(path+".action", "unknown action %q, expected throttle, drop or disconnect", r.Action)
+	}
+	return rule, nil
+}
+
+// bridges 桥接配置, local 为连接本地服务端的方法
+func (c *Config) bridges(local func() (net.Conn, error)) ([]bridge.Config, error) {
+	var cfgs []bridge.Config
+	names := make(map[string]bool)
+	for i, e := range c.Bridges {
+		path := fmt.Sprintf("bridges[%d]", i)
+		if e.Name == "" {
+			return nil, errorf(path+".name", "missing name")
+		}
+		if names[e.Name] {
+			return nil, errorf(path+".name", "duplicate bridge name %q", e.Name)
+		}
+		names[e.Name] = true
+		if e.Address == "" {
+			return nil, errorf(path+".address", "missing address")
+		}
+		if len(e.Topics) == 0 {
+			return nil, errorf(path+".topics", "at least one topic is required")
+		}
+		remote := client.Options{
+			ClientID:  e.ClientID,
+			Username:  e.Username,
+			KeepAlive: e.KeepAlive,
+		}
+		if e.Password != "" {
+			// 非nil的空密码也会设置密码标志, 没有用户名时服务端按协议错误关闭连接
+			remote.Password = []byte(e.Password)
+		}
+		if remote.ClientID == "" {
+			remote.ClientID = e.Name
+		}
+		localID := e.LocalClientID
+		if localID == "" {
+			localID = "bridge-" + e.Name
+		}
+		cfg := bridge.Config{
+			Local:         bridge.Endpoint{Options: client.Options{ClientID: localID}, Dial: local},
+			Remote:        bridge.Endpoint{Address: e.Address, Options: remote},
+			PlainProtocol: e.PlainProtocol,
+			RetryInterval: time.Duration(e.RetryInterval),
+		}
+		for j, t := range e.Topics {
+			tpath := fmt.Sprintf("%s.topics[%d]", path, j)
+			topic := bridge.Topic{Pattern: t.Pattern, Qos: t.Qos, LocalPrefix: t.LocalPrefix, RemotePrefix: t.RemotePrefix}
+			switch t.Direction {
+			case "", "out":
+				topic.Direction = bridge.Out
+			case "in":
+				topic.Direction = bridge.In
+			case "both":
+				topic.Direction = bridge.Both
+			default:
+				return nil, errorf(tpath+".direction", "unknown direction %q, expected out, in or both", t.Direction)
+			}
+			if t.Qos > 2 {
+				return nil, errorf(tpath+".qos", "invalid QoS %d", t.Qos)
+			}
+			if !packets.ValidTopicFilter(t.LocalPrefix+t.Pattern) || !packets.ValidTopicFilter(t.RemotePrefix+t.Pattern) {
+				return nil, errorf(tpath+".pattern", "invalid topic filter %q", t.Pattern)
+			}
+			cfg.Topics = append(cfg.Topics, topic)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
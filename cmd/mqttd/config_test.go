@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/ratelimit"
+	"github.com/boxungo/mqtt/session"
+	"github.com/boxungo/mqtt/store"
+)
+
+func TestParseConfig(t *testing.T) {
+	dir := t.TempDir()
+	acl := filepath.Join(dir, "acl")
+	os.WriteFile(acl, []byte("topic read #\n"), 0600)
+	cfg, err := ParseConfig([]byte(`{
+	"listeners": [
+		{"type": "tcp", "address": ":1883"},
+		{"type": "websocket", "address": ":8080", "path": "/ws"}
+	],
+	"auth": {"users": {"alice": "secret"}},
+	"acl_file": "` + acl + `",
+	"persistence": {"dir": "` + dir + `", "sync": "interval", "sync_interval": "200ms"},
+	"sessions": {"client_id_policy": "reject", "session_expiry": "1h", "shared_strategy": "hash_topic"},
+	"limits": {
+		"queue_messages": 100,
+		"overflow": "drop_newest",
+		"write_timeout": "-1s",
+		"rate": {"client": {"packets_per_second": 10, "action": "drop"}, "topics": {"sensors/": {"bytes_per_second": 1024}}}
+	},
+	"bridges": [{"name": "cloud", "address": "example.com:1883", "topics": [{"pattern": "#", "direction": "both", "qos": 1}]}]
+}`))
+	if err != nil {
+		t.Fatalf("ParseConfig returned error: %s", err)
+	}
+	if time.Duration(cfg.Sessions.SessionExpiry) != time.Hour {
+		t.Errorf("session_expiry parsed as %v", time.Duration(cfg.Sessions.SessionExpiry))
+	}
+	if cfg.Limits.WriteTimeout >= 0 {
+		t.Errorf("write_timeout parsed as %v", time.Duration(cfg.Limits.WriteTimeout))
+	}
+	if s, _ := cfg.sharedStrategy(); s != broker.HashTopic {
+		t.Errorf("shared strategy parsed as %v", s)
+	}
+	if p, _ := cfg.policy(); p != session.Reject {
+		t.Errorf("policy parsed as %v", p)
+	}
+	if so, _ := cfg.storeOptions(); so.Sync != store.SyncInterval || so.SyncInterval != 200*time.Millisecond {
+		t.Errorf("persistence parsed as %+v", so)
+	}
+	l, _ := cfg.limiter()
+	if l.Client.Action != ratelimit.Drop || l.Topics["sensors/"].BytesPerSecond != 1024 {
+		t.Errorf("rate limits parsed as %+v", l)
+	}
+	bridges, _ := cfg.bridges(nil)
+	if len(bridges) != 1 || bridges[0].Remote.Options.ClientID != "cloud" || bridges[0].Local.Options.ClientID != "bridge-cloud" || bridges[0].Remote.Options.Password != nil {
+		t.Errorf("bridges parsed as %+v", bridges)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"{\n  \"listeners\": [\n    {\"type\": \"tcp\" \"address\": \":1883\"}\n  ]\n}", "3:20: invalid character"},
+		{"{\n  \"listeners\": [{\"type\": 1}]\n}", "2:26: listeners.0.type: expected string, found number"},
+		{`{"listener": []}`, `unknown field "listener"`},
+		{`{"listeners": []}`, "listeners: at least one listener is required"},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}, {"type": "udp", "address": ":1884"}]}`, `listeners[1].type: unknown listener type "udp"`},
+		{`{"listeners": [{"type": "tls", "address": ":8883"}]}`, "listeners[0]: tls listener needs cert_file and key_file"},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}, {"type": "websocket", "address": ":1883"}]}`, "listeners[1].address: :1883 is already used by listeners[0]"},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": false}}`, "auth: anonymous access is disabled"},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "persistence": {"dir": "x", "sync": "sometimes"}}`, `persistence.sync: unknown sync policy "sometimes"`},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "sessions": {"session_expiry": "-1h"}}`, `duration "-1h" is negative`},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "cluster": {"address": ":7946"}}`, "cluster.node_id: missing node ID"},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "cluster": {"node_id": "a", "address": ":1883"}}`, "cluster.address: :1883 is already used by listeners[0]"},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "cluster": {"node_id": "a", "address": ":7946", "peers": {"a": "x:7946"}}}`, `cluster.peers: peer "a" has the node's own ID`},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "sessions": {"session_expiry": "forever"}}`, `invalid duration "forever"`},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "limits": {"rate": {"topics": {"a/": {"action": "slow"}}}}}`, `limits.rate.topics["a/"].action: unknown action "slow"`},
+		{`{"listeners": [{"type": "tcp", "address": ":1883"}], "auth": {"anonymous": true}, "bridges": [{"name": "b", "address": "x:1883", "topics": [{"pattern": "a/#/b"}]}]}`, `bridges[0].topics[0].pattern: invalid topic filter "a/#/b"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfig([]byte(tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseConfig(%s) returned %v, should contain %q", tt.config, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+// mqttd MQTT 3.1.1服务端
+//
+// 用法:
+//
+//	mqttd -config mqttd.json
+//	mqttd -config mqttd.json -check
+//
+// 收到SIGHUP时重新加载配置中的 auth 和 acl_file, 其余配置需要重启生效
+// 收到SIGTERM或SIGINT时关闭监听, 断开客户端并同步持久化数据后退出
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/boxungo/mqtt/bridge"
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/cluster"
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/store"
+)
+
+func main() {
+	path := flag.String("config", "mqttd.json", "configuration file")
+	check := flag.Bool("check", false, "validate the configuration and exit")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "mqttd: ", log.LstdFlags)
+	cfg, err := LoadConfig(*path)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *check {
+		fmt.Println("configuration ok")
+		return
+	}
+	if err = run(*path, cfg, logger); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// server 运行中的服务端及其可重新加载的部分
+type server struct {
+	logger *log.Logger
+	broker *broker.Broker
+	store  *store.Store
+	auth   *broker.Auth
+	acl    *broker.ACL
+	node   *cluster.Node
+
+	listeners []net.Listener
+	https     []*http.Server
+}
+
+// run 按配置运行服务端, 直到收到退出信号
+func run(path string, cfg *Config, logger *log.Logger) error {
+	s, err := newServer(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err = s.listen(cfg, &wg); err != nil {
+		cancel()
+		s.close()
+		return err
+	}
+	s.runCluster(ctx, cfg, &wg)
+	if err = s.runBridges(ctx, cfg, &wg); err != nil {
+		cancel()
+		s.close()
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			s.reload(path)
+			continue
+		}
+		logger.Printf("received %s, shutting down", sig)
+		break
+	}
+	signal.Stop(signals)
+	cancel()
+	s.close()
+	wg.Wait()
+	return nil
+}
+
+// newServer 按配置新建服务端
+func newServer(cfg *Config, logger *log.Logger) (*server, error) {
+	s := &server{logger: logger}
+	opts := broker.Options{
+		SessionExpiry:  time.Duration(cfg.Sessions.SessionExpiry),
+		WillOnTakeover: cfg.Sessions.WillOnTakeover,
+		MaxInflight:    cfg.Limits.MaxInflight,
+		WriteBuffer:    cfg.Limits.WriteBuffer,
+		WriteDelay:     time.Duration(cfg.Limits.WriteDelay),
+		WriteTimeout:   time.Duration(cfg.Limits.WriteTimeout),
+		WriteQueue:     cfg.Limits.WriteQueue,
+		SysInterval:    time.Duration(cfg.SysInterval),
+		Hooks:          &hooks.Hooks{},
+		Logger:         logger,
+	}
+	// 配置已经验证过, 这里不会出错
+	opts.Policy, _ = cfg.policy()
+	opts.NewID, _ = cfg.idGenerator()
+	opts.SharedStrategy, _ = cfg.sharedStrategy()
+	opts.Limits, _ = cfg.limits()
+	opts.Limiter, _ = cfg.limiter()
+
+	users, err := cfg.Auth.users()
+	if err != nil {
+		return nil, err
+	}
+	s.auth = broker.NewAuth(cfg.Auth.Anonymous, users)
+	opts.Hooks.Add(s.auth)
+	if cfg.ACLFile != "" {
+		s.acl = broker.NewACL()
+		if err = loadACL(s.acl, cfg.ACLFile); err != nil {
+			return nil, err
+		}
+		opts.Hooks.Add(s.acl)
+	}
+
+	if so, _ := cfg.storeOptions(); so != nil {
+		if s.store, err = store.Open(*so); err != nil {
+			return nil, err
+		}
+		opts.Store = s.store
+	}
+	if cfg.Cluster != nil {
+		s.node = cluster.NewNode(cfg.Cluster.NodeID)
+		opts.Cluster = s.node
+	}
+	s.broker = broker.New(opts)
+	return s, nil
+}
+
+// listen 打开所有监听
+func (s *server) listen(cfg *Config, wg *sync.WaitGroup) error {
+	for i, lc := range cfg.Listeners {
+		l, err := listener(lc)
+		if err != nil {
+			return fmt.Errorf("listeners[%d]: %s", i, err)
+		}
+		s.listeners = append(s.listeners, l)
+		s.logger.Printf("listening on %s %s", lc.Type, l.Addr())
+
+		wg.Add(1)
+		if lc.Type == "websocket" {
+			mux := http.NewServeMux()
+			p := lc.Path
+			if p == "" {
+				p = "/mqtt"
+			}
+			mux.Handle(p, s.broker.WebSocketHandler())
+			srv := &http.Server{Handler: mux, ErrorLog: s.logger}
+			s.https = append(s.https, srv)
+			go func() {
+				defer wg.Done()
+				srv.Serve(l)
+			}()
+			continue
+		}
+		go func() {
+			defer wg.Done()
+			if err := s.broker.Serve(l); err != nil && !errors.Is(err, broker.ErrClosed) {
+				s.logger.Printf("listener %s: %v", l.Addr(), err)
+			}
+		}()
+	}
+
+	if cfg.Cluster != nil {
+		l, err := net.Listen("tcp", cfg.Cluster.Address)
+		if err != nil {
+			return fmt.Errorf("cluster.address: %s", err)
+		}
+		s.listeners = append(s.listeners, l)
+		s.logger.Printf("cluster node %s listening on %s", cfg.Cluster.NodeID, l.Addr())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.node.Serve(l)
+		}()
+	}
+
+	if cfg.MetricsAddress != "" {
+		l, err := net.Listen("tcp", cfg.MetricsAddress)
+		if err != nil {
+			return fmt.Errorf("metrics_address: %s", err)
+		}
+		s.logger.Printf("serving metrics on %s", l.Addr())
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.broker.Stats().Handler())
+		srv := &http.Server{Handler: mux, ErrorLog: s.logger}
+		s.https = append(s.https, srv)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Serve(l)
+		}()
+	}
+	return nil
+}
+
+// listener 按配置打开一个监听
+func listener(lc Listener) (net.Listener, error) {
+	network := "tcp"
+	if lc.Type == "unix" {
+		network = "unix"
+		// 删除上次运行遗留的套接字文件
+		if fi, err := os.Stat(lc.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(lc.Address)
+		}
+	}
+	l, err := net.Listen(network, lc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if lc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	}
+	return l, nil
+}
+
+// runCluster 连接配置中的其他节点, 连接断开后按重连间隔重连
+func (s *server) runCluster(ctx context.Context, cfg *Config, wg *sync.WaitGroup) {
+	if cfg.Cluster == nil {
+		return
+	}
+	interval := time.Duration(cfg.Cluster.RetryInterval)
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	for id, addr := range cfg.Cluster.Peers {
+		wg.Add(1)
+		go func(id, addr string) {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				if !slices.Contains(s.node.Peers(), id) {
+					var d net.Dialer
+					conn, err := d.DialContext(ctx, "tcp", addr)
+					if err == nil {
+						// 对端同时连接过来时, 两端只保留ID较小的节点发起的连接, 另一个返回 ErrDuplicateNode
+						err = s.node.Join(conn)
+					}
+					if err != nil && !errors.Is(err, cluster.ErrDuplicateNode) && ctx.Err() == nil {
+						s.logger.Printf("cluster peer %s at %s: %v", id, addr, err)
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(id, addr)
+	}
+}
+
+// runBridges 启动所有桥接, 本地一端通过进程内的可信连接接入服务端, 不受认证和ACL限制
+func (s *server) runBridges(ctx context.Context, cfg *Config, wg *sync.WaitGroup) error {
+	cfgs, err := cfg.bridges(func() (net.Conn, error) { return s.broker.TrustedPipe(), nil })
+	if err != nil {
+		return err
+	}
+	for i, bc := range cfgs {
+		bc.Logger = log.New(s.logger.Writer(), fmt.Sprintf("mqttd: bridge %s: ", cfg.Bridges[i].Name), log.LstdFlags)
+		b, err := bridge.New(bc)
+		if err != nil {
+			return fmt.Errorf("bridges[%d]: %s", i, err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Run(ctx)
+		}()
+	}
+	return nil
+}
+
+// reload 重新加载认证和ACL, 配置有误时保留原有设置
+func (s *server) reload(path string) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		s.logger.Printf("reload: %v, keeping the current configuration", err)
+		return
+	}
+	users, err := cfg.Auth.users()
+	if err != nil {
+		s.logger.Printf("reload: %v", err)
+		return
+	}
+	if s.acl != nil {
+		if cfg.ACLFile == "" {
+			s.logger.Printf("reload: acl_file cannot be removed without a restart")
+			return
+		}
+		if err = loadACL(s.acl, cfg.ACLFile); err != nil {
+			s.logger.Printf("reload: %v", err)
+			return
+		}
+	} else if cfg.ACLFile != "" {
+		s.logger.Printf("reload: acl_file cannot be added without a restart")
+	}
+	s.auth.Set(cfg.Auth.Anonymous, users)
+	s.logger.Printf("reloaded auth with %d users", len(users))
+}
+
+// close 关闭监听, 服务端和持久化存储
+func (s *server) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range s.https {
+		srv.Shutdown(ctx)
+	}
+	// 服务端关闭时会关闭它接受连接的监听, 之后再关闭的是未被使用的监听和集群节点的监听
+	s.broker.Close()
+	if s.node != nil {
+		s.node.Close()
+	}
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			s.logger.Printf("close store: %v", err)
+		}
+	}
+}
+
+// loadACL 从文件加载ACL
+func loadACL(acl *broker.ACL, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return acl.Load(path, f)
+}
@@ -0,0 +1,368 @@
+package conformance
+
+import (
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// Cases 所有检查, 按一致性编号排列
+func Cases() []Case {
+	return []Case{
+		{"MQTT-1.5.3-1", "A UTF-8 encoded string with ill-formed UTF-8 is a protocol violation and the Server MUST close the connection", func(t *T) {
+			c := t.Connect("c", true)
+			c.Send(Publish(t.Topic("bad\xff"), 0, false, "x"))
+			c.ExpectClosed("a PUBLISH with an ill-formed UTF-8 topic")
+		}},
+		{"MQTT-1.5.3-2", "A UTF-8 encoded string MUST NOT include the null character U+0000, the Server MUST close the connection", func(t *T) {
+			c := t.Connect("c", true)
+			c.Send(Publish(t.Topic("nul\x00"), 0, false, "x"))
+			c.ExpectClosed("a PUBLISH with U+0000 in the topic")
+		}},
+		{"MQTT-2.2.2-2", "If invalid flags are received, the receiver MUST close the Network Connection", func(t *T) {
+			c := t.Connect("c", true)
+			c.SendRaw([]byte{packets.PINGREQ<<4 | 0x01, 0})
+			c.ExpectClosed("a PINGREQ with flags 0001")
+		}},
+		{"MQTT-2.3.1-1", "SUBSCRIBE, UNSUBSCRIBE and PUBLISH (QoS > 0) Control Packets MUST contain a non-zero 16-bit Packet Identifier", func(t *T) {
+			c := t.Connect("c", true)
+			sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+			sub.Topics, sub.Qoss = []string{t.Topic("a")}, []byte{0}
+			c.Send(sub)
+			c.ExpectClosed("a SUBSCRIBE with packet identifier 0")
+		}},
+		{"MQTT-3.1.0-1", "After a Network Connection is established, the first Packet sent from the Client to the Server MUST be a CONNECT Packet", func(t *T) {
+			c := t.Dial()
+			c.Send(packets.NewControlPacket(packets.PINGREQ))
+			c.ExpectClosed("a PINGREQ before CONNECT")
+		}},
+		{"MQTT-3.1.0-2", "The Server MUST process a second CONNECT Packet sent from a Client as a protocol violation and disconnect the Client", func(t *T) {
+			c := t.Connect("c", true)
+			c.Send(t.ConnectPacket(t.ClientID("c"), true))
+			c.ExpectClosed("a second CONNECT")
+		}},
+		{"MQTT-3.1.2-2", "The Server MUST respond to an unsupported protocol level with CONNACK return code 0x01 and then disconnect the Client", func(t *T) {
+			c := t.Dial()
+			cp := t.ConnectPacket(t.ClientID("c"), true)
+			cp.ProtocolLevel = 6
+			c.Send(cp)
+			if ack := c.Expect(packets.CONNACK).(*packets.ConnackPacket); ack.ReturnCode != packets.ErrRefusedBadProtocolLevel {
+				t.Fatalf("CONNACK return code 0x%02x, expected 0x01", ack.ReturnCode)
+			}
+			c.ExpectClosed("refusing the connection")
+		}},
+		{"MQTT-3.1.2-3", "The Server MUST validate that the reserved flag in the CONNECT Control Packet is set to zero and disconnect the Client if it is not", func(t *T) {
+			c := t.Dial()
+			data := Encode(t.ConnectPacket(t.ClientID("c"), true))
+			data[connectFlags(data)] |= 0x01
+			c.SendRaw(data)
+			c.ExpectClosed("a CONNECT with the reserved flag set")
+		}},
+		{"MQTT-3.1.2-8", "The Will Message MUST be published when the Network Connection is subsequently closed unless it has been deleted on receipt of a DISCONNECT", func(t *T) {
+			sub := t.Connect("sub", true)
+			sub.Subscribe(t.Topic("will"), 0)
+			cp := t.ConnectPacket(t.ClientID("c"), true)
+			cp.WillFlag, cp.WillTopic, cp.WillMessage = true, t.Topic("will"), []byte("gone")
+			c := t.ConnectWith(cp)
+			c.Close()
+			sub.ExpectMessage(t.Topic("will"), "gone")
+		}},
+		{"MQTT-3.1.2-14", "If the Will Flag is set to 1, the value of Will QoS can be 0, 1 or 2, it MUST NOT be 3", func(t *T) {
+			c := t.Dial()
+			cp := t.ConnectPacket(t.ClientID("c"), true)
+			cp.WillFlag, cp.WillQos, cp.WillTopic, cp.WillMessage = true, 3, t.Topic("will"), []byte("x")
+			c.Send(cp)
+			c.ExpectClosed("a CONNECT with will QoS 3")
+		}},
+		{"MQTT-3.1.2-22", "If the User Name Flag is set to 0, the Password Flag MUST be set to 0", func(t *T) {
+			c := t.Dial()
+			cp := t.ConnectPacket(t.ClientID("c"), true)
+			cp.UsernameFlag, cp.Username = false, ""
+			cp.PasswordFlag, cp.Password = true, []byte("secret")
+			c.Send(cp)
+			c.ExpectClosed("a CONNECT with a password but no user name")
+		}},
+		{"MQTT-3.1.2-24", "If the Keep Alive value is non-zero and the Server does not receive a Control Packet within one and a half times the Keep Alive period, it MUST disconnect", func(t *T) {
+			cp := t.ConnectPacket(t.ClientID("c"), true)
+			cp.KeepAlive = 1
+			c := t.ConnectWith(cp)
+			c.ExpectClosedWithin(1500*time.Millisecond+t.opts.Timeout, "1.5 times a keep alive of 1 second")
+		}},
+		{"MQTT-3.1.3-8", "If the Client supplies a zero-byte ClientId with CleanSession set to 0, the Server MUST respond with CONNACK return code 0x02 and then close the Network Connection", func(t *T) {
+			c := t.Dial()
+			c.Send(t.ConnectPacket("", false))
+			if ack := c.Expect(packets.CONNACK).(*packets.ConnackPacket); ack.ReturnCode != packets.ErrRefusedIDRejected {
+				t.Fatalf("CONNACK return code 0x%02x, expected 0x02", ack.ReturnCode)
+			}
+			c.ExpectClosed("rejecting the client identifier")
+		}},
+		{"MQTT-3.1.4-2", "If the ClientId represents a Client already connected to the Server then the Server MUST disconnect the existing Client", func(t *T) {
+			old := t.Connect("c", true)
+			t.Connect("c", true)
+			old.ExpectClosed("another connection with the same client identifier")
+		}},
+		{"MQTT-3.2.2-1", "If the Server accepts a connection with CleanSession set to 1, it MUST set Session Present to 0 in the CONNACK", func(t *T) {
+			// 先留下一个持久会话, 确认清除会话的连接不会报告它
+			c := t.Connect("c", false)
+			c.Send(packets.NewControlPacket(packets.DISCONNECT))
+			c.ExpectClosed("DISCONNECT")
+			c = t.Dial()
+			c.Send(t.ConnectPacket(t.ClientID("c"), true))
+			if ack := c.Expect(packets.CONNACK).(*packets.ConnackPacket); ack.SessionPresent {
+				t.Fatalf("Session Present is 1")
+			}
+		}},
+		{"MQTT-3.2.2-2", "If the Server accepts a connection with CleanSession set to 0 and has stored Session state for the ClientId, it MUST set Session Present to 1", func(t *T) {
+			c := t.Connect("c", false)
+			c.Subscribe(t.Topic("a"), 1)
+			c.Send(packets.NewControlPacket(packets.DISCONNECT))
+			c.ExpectClosed("DISCONNECT")
+			c = t.Dial()
+			c.Send(t.ConnectPacket(t.ClientID("c"), false))
+			present := c.Expect(packets.CONNACK).(*packets.ConnackPacket).SessionPresent
+			c.Close()
+			// 清除留在服务端的会话
+			t.Connect("c", true)
+			if !present {
+				t.Fatalf("Session Present is 0")
+			}
+		}},
+		{"MQTT-3.2.2-4", "If a Server sends a CONNACK packet containing a non-zero return code it MUST set Session Present to 0", func(t *T) {
+			c := t.Dial()
+			c.Send(t.ConnectPacket("", false))
+			if ack := c.Expect(packets.CONNACK).(*packets.ConnackPacket); ack.ReturnCode == packets.Accepted {
+				t.Skipf("broker accepted an empty client identifier with CleanSession 0")
+			} else if ack.SessionPresent {
+				t.Fatalf("Session Present is 1 with return code 0x%02x", ack.ReturnCode)
+			}
+		}},
+		{"MQTT-3.3.1-4", "A PUBLISH Packet MUST NOT have both QoS bits set to 1, the Server MUST close the Network Connection", func(t *T) {
+			c := t.Connect("c", true)
+			pk := Publish(t.Topic("a"), 2, false, "x")
+			pk.PacketID = 1
+			data := Encode(pk)
+			data[0] |= 0x06
+			c.SendRaw(data)
+			c.ExpectClosed("a PUBLISH with QoS 3")
+		}},
+		{"MQTT-3.3.1-5", "If the RETAIN flag is set to 1, the Server MUST store the Application Message so it can be delivered to future subscribers", func(t *T) {
+			c := t.Connect("c", true)
+			c.Publish(t.Topic("r"), 1, true, "kept")
+			defer c.Send(Publish(t.Topic("r"), 0, true, "")) // 删除保留消息
+			sub := t.Connect("sub", true)
+			sub.Subscribe(t.Topic("r"), 1)
+			sub.ExpectMessage(t.Topic("r"), "kept")
+		}},
+		{"MQTT-3.3.1-8", "When sending a PUBLISH Packet to a Client the Server MUST set the RETAIN flag to 1 if a message is sent as a result of a new subscription", func(t *T) {
+			c := t.Connect("c", true)
+			c.Publish(t.Topic("r"), 1, true, "kept")
+			defer c.Send(Publish(t.Topic("r"), 0, true, "")) // 删除保留消息
+			sub := t.Connect("sub", true)
+			sub.Subscribe(t.Topic("r"), 1)
+			if pk := sub.ExpectMessage(t.Topic("r"), "kept"); !pk.Retain {
+				t.Fatalf("retained message delivered with RETAIN 0")
+			}
+		}},
+		{"MQTT-3.3.1-9", "The Server MUST set the RETAIN flag to 0 when a PUBLISH Packet is sent to a Client because it matches an established subscription", func(t *T) {
+			sub := t.Connect("sub", true)
+			sub.Subscribe(t.Topic("r"), 1)
+			c := t.Connect("c", true)
+			c.Publish(t.Topic("r"), 1, true, "live")
+			defer c.Send(Publish(t.Topic("r"), 0, true, "")) // 删除保留消息
+			if pk := sub.ExpectMessage(t.Topic("r"), "live"); pk.Retain {
+				t.Fatalf("message for an established subscription delivered with RETAIN 1")
+			}
+		}},
+		{"MQTT-3.3.1-10", "A PUBLISH Packet with RETAIN 1 and a zero byte payload MUST remove any existing retained message for the topic", func(t *T) {
+			c := t.Connect("c", true)
+			c.Publish(t.Topic("r"), 1, true, "kept")
+			c.Publish(t.Topic("r"), 1, true, "")
+			sub := t.Connect("sub", true)
+			sub.Subscribe(t.Topic("r"), 1)
+			sub.ExpectNothing("after the retained message was removed")
+		}},
+		{"MQTT-3.3.2-2", "The Topic Name in the PUBLISH Packet MUST NOT contain wildcard characters", func(t *T) {
+			c := t.Connect("c", true)
+			c.Send(Publish(t.Topic("+"), 0, false, "x"))
+			c.ExpectClosed("a PUBLISH to a topic with a wildcard")
+		}},
+		{"MQTT-3.3.5-1", "The Server MUST deliver the message to the Client respecting the maximum QoS of all the matching subscriptions", func(t *T) {
+			sub := t.Connect("sub", true)
+			sub.Subscribe(t.Topic("q"), 0)
+			c := t.Connect("c", true)
+			c.Publish(t.Topic("q"), 2, false, "x")
+			if pk := sub.ExpectMessage(t.Topic("q"), "x"); pk.Qos != 0 {
+				t.Fatalf("delivered with QoS %d to a QoS 0 subscription", pk.Qos)
+			}
+		}},
+		{"MQTT-3.6.1-1", "Bits 3,2,1 and 0 of the fixed header in the PUBREL Control Packet MUST be set to 0,0,1 and 0, otherwise the Server MUST close the connection", func(t *T) {
+			c := t.Connect("c", true)
+			c.SendRaw([]byte{packets.PUBREL << 4, 2, 0, 1})
+			c.ExpectClosed("a PUBREL with flags 0000")
+		}},
+		{"MQTT-3.8.1-1", "Bits 3,2,1 and 0 of the fixed header of the SUBSCRIBE Control Packet MUST be set to 0,0,1 and 0, otherwise the Server MUST close the connection", func(t *T) {
+			c := t.Connect("c", true)
+			sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+			sub.PacketID, sub.Topics, sub.Qoss = 1, []string{t.Topic("a")}, []byte{0}
+			data := Encode(sub)
+			data[0] &^= 0x0f
+			c.SendRaw(data)
+			c.ExpectClosed("a SUBSCRIBE with flags 0000")
+		}},
+		{"MQTT-3.8.3-3", "The payload of a SUBSCRIBE packet MUST contain at least one Topic Filter / QoS pair", func(t *T) {
+			c := t.Connect("c", true)
+			c.SendRaw([]byte{packets.SUBSCRIBE<<4 | 0x02, 2, 0, 1})
+			c.ExpectClosed("a SUBSCRIBE without topic filters")
+		}},
+		{"MQTT-3.8.3-4", "The Server MUST treat a SUBSCRIBE packet as malformed and close the connection if any requested QoS is 3 or reserved bits are set", func(t *T) {
+			c := t.Connect("c", true)
+			sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+			sub.PacketID, sub.Topics, sub.Qoss = 1, []string{t.Topic("a")}, []byte{3}
+			c.Send(sub)
+			c.ExpectClosed("a SUBSCRIBE requesting QoS 3")
+		}},
+		{"MQTT-3.8.4-1", "When the Server receives a SUBSCRIBE Packet from a Client, the Server MUST respond with a SUBACK Packet", func(t *T) {
+			c := t.Connect("c", true)
+			c.Subscribe(t.Topic("a"), 1)
+		}},
+		{"MQTT-3.8.4-2", "The SUBACK Packet MUST have the same Packet Identifier as the SUBSCRIBE Packet that it is acknowledging", func(t *T) {
+			c := t.Connect("c", true)
+			sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+			sub.PacketID, sub.Topics, sub.Qoss = 0x1234, []string{t.Topic("a")}, []byte{1}
+			c.Send(sub)
+			if ack := c.Expect(packets.SUBACK).(*packets.SubackPacket); ack.PacketID != sub.PacketID {
+				t.Fatalf("SUBACK packet identifier %d, expected %d", ack.PacketID, sub.PacketID)
+			}
+		}},
+		{"MQTT-3.8.4-5", "The SUBACK Packet sent by the Server MUST contain a return code for each Topic Filter/QoS pair", func(t *T) {
+			c := t.Connect("c", true)
+			sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+			sub.PacketID = 1
+			sub.Topics, sub.Qoss = []string{t.Topic("a"), t.Topic("b"), t.Topic("c")}, []byte{0, 1, 2}
+			c.Send(sub)
+			if ack := c.Expect(packets.SUBACK).(*packets.SubackPacket); len(ack.ReturnCodes) != 3 {
+				t.Fatalf("%d return codes for 3 topic filters", len(ack.ReturnCodes))
+			}
+		}},
+		{"MQTT-3.10.1-1", "Bits 3,2,1 and 0 of the fixed header of the UNSUBSCRIBE Control Packet MUST be set to 0,0,1 and 0, otherwise the Server MUST close the connection", func(t *T) {
+			c := t.Connect("c", true)
+			unsub := packets.NewControlPacket(packets.UNSUBSCRIBE).(*packets.UnsubscribePacket)
+			unsub.PacketID, unsub.Topics = 1, []string{t.Topic("a")}
+			data := Encode(unsub)
+			data[0] &^= 0x0f
+			c.SendRaw(data)
+			c.ExpectClosed("an UNSUBSCRIBE with flags 0000")
+		}},
+		{"MQTT-3.10.3-2", "The Payload of an UNSUBSCRIBE packet MUST contain at least one Topic Filter", func(t *T) {
+			c := t.Connect("c", true)
+			c.SendRaw([]byte{packets.UNSUBSCRIBE<<4 | 0x02, 2, 0, 1})
+			c.ExpectClosed("an UNSUBSCRIBE without topic filters")
+		}},
+		{"MQTT-3.10.4-4", "The Server MUST respond to an UNSUBSUBCRIBE request by sending an UNSUBACK packet with the same Packet Identifier", func(t *T) {
+			c := t.Connect("c", true)
+			c.Subscribe(t.Topic("a"), 0)
+			unsub := packets.NewControlPacket(packets.UNSUBSCRIBE).(*packets.UnsubscribePacket)
+			unsub.PacketID, unsub.Topics = 0x4321, []string{t.Topic("a")}
+			c.Send(unsub)
+			if ack := c.Expect(packets.UNSUBACK).(*packets.UnsubackPacket); ack.PacketID != unsub.PacketID {
+				t.Fatalf("UNSUBACK packet identifier %d, expected %d", ack.PacketID, unsub.PacketID)
+			}
+		}},
+		{"MQTT-3.10.4-5", "Even where no Topic Subscriptions are deleted, the Server MUST respond with an UNSUBACK", func(t *T) {
+			c := t.Connect("c", true)
+			unsub := packets.NewControlPacket(packets.UNSUBSCRIBE).(*packets.UnsubscribePacket)
+			unsub.PacketID, unsub.Topics = 7, []string{t.Topic("never")}
+			c.Send(unsub)
+			c.Expect(packets.UNSUBACK)
+		}},
+		{"MQTT-3.12.4-1", "The Server MUST send a PINGRESP Packet in response to a PINGREQ Packet", func(t *T) {
+			c := t.Connect("c", true)
+			c.Send(packets.NewControlPacket(packets.PINGREQ))
+			c.Expect(packets.PINGRESP)
+		}},
+		{"MQTT-3.14.1-1", "The Server MUST validate that reserved bits in the DISCONNECT fixed header are set to zero and disconnect the Client if they are not", func(t *T) {
+			c := t.Connect("c", true)
+			c.SendRaw([]byte{packets.DISCONNECT<<4 | 0x02, 0})
+			c.ExpectClosed("a DISCONNECT with flags 0010")
+		}},
+		{"MQTT-3.14.4-3", "On receipt of DISCONNECT the Server MUST discard any Will Message associated with the current connection without publishing it", func(t *T) {
+			sub := t.Connect("sub", true)
+			sub.Subscribe(t.Topic("will"), 0)
+			cp := t.ConnectPacket(t.ClientID("c"), true)
+			cp.WillFlag, cp.WillTopic, cp.WillMessage = true, t.Topic("will"), []byte("gone")
+			c := t.ConnectWith(cp)
+			c.Send(packets.NewControlPacket(packets.DISCONNECT))
+			c.ExpectClosed("DISCONNECT")
+			sub.ExpectNothing("after the client disconnected with DISCONNECT")
+		}},
+		{"MQTT-4.3.2-2", "In the QoS 1 delivery protocol, the Receiver MUST respond with a PUBACK Packet containing the Packet Identifier from the incoming PUBLISH", func(t *T) {
+			c := t.Connect("c", true)
+			pk := Publish(t.Topic("a"), 1, false, "x")
+			pk.PacketID = 0x0102
+			c.Send(pk)
+			if ack := c.Expect(packets.PUBACK).(*packets.PubackPacket); ack.PacketID != pk.PacketID {
+				t.Fatalf("PUBACK packet identifier %d, expected %d", ack.PacketID, pk.PacketID)
+			}
+		}},
+		{"MQTT-4.3.3-2", "In the QoS 2 delivery protocol, the Receiver MUST respond with a PUBREC containing the Packet Identifier from the incoming PUBLISH, and to a PUBREL with a PUBCOMP", func(t *T) {
+			c := t.Connect("c", true)
+			pk := Publish(t.Topic("a"), 2, false, "x")
+			pk.PacketID = 0x0203
+			c.Send(pk)
+			if rec := c.Expect(packets.PUBREC).(*packets.PubrecPacket); rec.PacketID != pk.PacketID {
+				t.Fatalf("PUBREC packet identifier %d, expected %d", rec.PacketID, pk.PacketID)
+			}
+			rel := packets.NewControlPacket(packets.PUBREL).(*packets.PubrelPacket)
+			rel.PacketID = pk.PacketID
+			c.Send(rel)
+			if comp := c.Expect(packets.PUBCOMP).(*packets.PubcompPacket); comp.PacketID != pk.PacketID {
+				t.Fatalf("PUBCOMP packet identifier %d, expected %d", comp.PacketID, pk.PacketID)
+			}
+		}},
+		{"MQTT-4.7.1-2", "The multi-level wildcard character MUST be the last character specified in the Topic Filter", func(t *T) {
+			c := t.Connect("c", true)
+			sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+			sub.PacketID, sub.Topics, sub.Qoss = 1, []string{t.Topic("#/a")}, []byte{0}
+			c.Send(sub)
+			expectRejected(c, "a SUBSCRIBE to an invalid topic filter")
+		}},
+		{"MQTT-4.7.3-1", "All Topic Names and Topic Filters MUST be at least one character long", func(t *T) {
+			c := t.Connect("c", true)
+			c.Send(Publish("", 0, false, "x"))
+			c.ExpectClosed("a PUBLISH with an empty topic")
+		}},
+		{"MQTT-4.8.0-1", "If the Server encounters a protocol violation, such as a malformed Remaining Length, it MUST close the Network Connection", func(t *T) {
+			c := t.Connect("c", true)
+			c.SendRaw([]byte{packets.PINGREQ << 4, 0xff, 0xff, 0xff, 0xff, 0x7f})
+			c.ExpectClosed("a Remaining Length encoded in five bytes")
+		}},
+	}
+}
+
+// connectFlags CONNECT报文中连接标志字节的位置
+func connectFlags(data []byte) int {
+	i := 1
+	for data[i]&0x80 != 0 {
+		i++
+	}
+	// 剩余长度之后是协议名(2字节长度和"MQTT")和协议级别
+	return i + 1 + 6 + 1
+}
+
+// expectRejected 无效的主题过滤器可以用SUBACK返回码0x80拒绝, 也可以关闭连接
+func expectRejected(c *Conn, reason string) {
+	pk, err := c.read(c.t.opts.Timeout)
+	switch {
+	case isTimeout(err):
+		c.t.Fatalf("neither SUBACK nor disconnect within %s after %s", c.t.opts.Timeout, reason)
+	case err != nil:
+		return
+	}
+	ack, ok := pk.(*packets.SubackPacket)
+	if !ok {
+		c.t.Fatalf("received %s after %s", name(pk), reason)
+	}
+	if len(ack.ReturnCodes) != 1 || ack.ReturnCodes[0] != 0x80 {
+		c.t.Fatalf("SUBACK return codes %v after %s, expected 0x80", ack.ReturnCodes, reason)
+	}
+}
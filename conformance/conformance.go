@@ -0,0 +1,342 @@
+// Package conformance 检查服务端是否符合MQTT 3.1.1规范
+// 每个检查对应规范附录B中的一条规范性陈述, 以一致性编号(如 MQTT-3.1.0-2)标识
+// 检查通过原始网络连接发送 packets 构造的报文, 包括故意构造的畸形报文, 并根据服务端的响应判断结果
+// packets 只实现了3.1.1, 因此MQTT 5的规范性陈述不在检查范围内
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// 默认的等待时间
+const (
+	DefaultTimeout = 2 * time.Second
+	DefaultQuiet   = 300 * time.Millisecond
+)
+
+// Status 检查结果
+type Status string
+
+// 检查结果
+const (
+	Pass Status = "pass"
+	Fail Status = "fail"
+	Skip Status = "skip" // 无法检查, 例如服务端拒绝了连接
+)
+
+// Options 检查参数
+type Options struct {
+	Dial     func() (net.Conn, error)
+	Username string // 不为空时每个CONNECT都带上用户名和密码
+	Password []byte
+	Prefix   string               // 客户端标识符和主题的前缀, 为空时使用 "conformance"
+	Timeout  time.Duration        // 等待服务端响应或关闭连接的时间, 为0时使用 DefaultTimeout
+	Quiet    time.Duration        // 确认服务端不发送报文时等待的时间, 为0时使用 DefaultQuiet
+	Filter   func(id string) bool // 不为空时只运行返回true的检查
+}
+
+// Result 一条规范性陈述的检查结果
+type Result struct {
+	ID        string        `json:"id"`
+	Statement string        `json:"statement"`
+	Status    Status        `json:"status"`
+	Detail    string        `json:"detail,omitempty"`
+	Elapsed   time.Duration `json:"elapsed_ns"`
+}
+
+// Case 一条检查
+type Case struct {
+	ID        string
+	Statement string
+	check     func(t *T)
+}
+
+// Run 依次运行所有检查
+func Run(opts Options) []Result {
+	if opts.Prefix == "" {
+		opts.Prefix = "conformance"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Quiet == 0 {
+		opts.Quiet = DefaultQuiet
+	}
+	var results []Result
+	for _, c := range Cases() {
+		if opts.Filter != nil && !opts.Filter(c.ID) {
+			continue
+		}
+		results = append(results, c.run(&opts))
+	}
+	return results
+}
+
+// run 运行一条检查, 检查函数在单独的协程中运行, Fatalf 和 Skipf 会结束该协程
+func (c Case) run(opts *Options) Result {
+	t := &T{opts: opts, id: c.ID, status: Pass}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.check(t)
+	}()
+	<-done
+	t.closeAll()
+	return Result{ID: c.ID, Statement: c.Statement, Status: t.status, Detail: t.detail, Elapsed: time.Since(start)}
+}
+
+// T 一条检查的运行状态
+type T struct {
+	opts   *Options
+	id     string
+	status Status
+	detail string
+
+	mu    sync.Mutex
+	conns []*Conn
+	seq   int
+}
+
+// Fatalf 检查失败
+func (t *T) Fatalf(format string, args ...interface{}) {
+	t.status, t.detail = Fail, fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+// Skipf 无法检查
+func (t *T) Skipf(format string, args ...interface{}) {
+	t.status, t.detail = Skip, fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+// ClientID 本条检查使用的客户端标识符
+func (t *T) ClientID(name string) string {
+	return t.opts.Prefix + "-" + t.id + "-" + name
+}
+
+// Topic 本条检查使用的主题, 避免与其他检查和服务端上的其他客户端相互影响
+func (t *T) Topic(name string) string {
+	return t.opts.Prefix + "/" + t.id + "/" + name
+}
+
+// Dial 建立网络连接, 不发送CONNECT
+func (t *T) Dial() *Conn {
+	nc, err := t.opts.Dial()
+	if err != nil {
+		t.Skipf("dial: %v", err)
+	}
+	c := &Conn{t: t, nc: nc}
+	t.mu.Lock()
+	t.conns = append(t.conns, c)
+	t.mu.Unlock()
+	return c
+}
+
+// ConnectPacket 新建3.1.1的CONNECT报文, 带上配置的凭据
+func (t *T) ConnectPacket(clientID string, clean bool) *packets.ConnectPacket {
+	cp := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolLevel = 4
+	cp.CleanSession = clean
+	cp.ClientIdentifier = clientID
+	if t.opts.Username != "" {
+		cp.UsernameFlag, cp.Username = true, t.opts.Username
+		cp.PasswordFlag, cp.Password = len(t.opts.Password) > 0, t.opts.Password
+	}
+	return cp
+}
+
+// Connect 建立连接并完成CONNECT, 服务端拒绝时跳过检查
+func (t *T) Connect(name string, clean bool) *Conn {
+	return t.ConnectWith(t.ConnectPacket(t.ClientID(name), clean))
+}
+
+// ConnectWith 发送指定的CONNECT, 服务端拒绝时跳过检查
+func (t *T) ConnectWith(cp *packets.ConnectPacket) *Conn {
+	c := t.Dial()
+	c.Send(cp)
+	ack := c.Expect(packets.CONNACK).(*packets.ConnackPacket)
+	if ack.ReturnCode != packets.Accepted {
+		t.Skipf("broker refused CONNECT %q with return code 0x%02x", cp.ClientIdentifier, ack.ReturnCode)
+	}
+	return c
+}
+
+// Subscribe 订阅并等待SUBACK
+func (c *Conn) Subscribe(filter string, qos byte) {
+	sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+	sub.PacketID = c.nextID()
+	sub.Topics, sub.Qoss = []string{filter}, []byte{qos}
+	c.Send(sub)
+	ack := c.Expect(packets.SUBACK).(*packets.SubackPacket)
+	if len(ack.ReturnCodes) != 1 || ack.ReturnCodes[0] > 2 {
+		c.t.Skipf("broker refused the subscription to %q: %v", filter, ack.ReturnCodes)
+	}
+}
+
+// Publish 发布消息并完成QoS交互
+func (c *Conn) Publish(topic string, qos byte, retain bool, payload string) {
+	pk := Publish(topic, qos, retain, payload)
+	if qos > 0 {
+		pk.PacketID = c.nextID()
+	}
+	c.Send(pk)
+	switch qos {
+	case 1:
+		c.Expect(packets.PUBACK)
+	case 2:
+		c.Expect(packets.PUBREC)
+		rel := packets.NewControlPacket(packets.PUBREL).(*packets.PubrelPacket)
+		rel.PacketID = pk.PacketID
+		c.Send(rel)
+		c.Expect(packets.PUBCOMP)
+	}
+}
+
+// Publish 新建PUBLISH报文
+func Publish(topic string, qos byte, retain bool, payload string) *packets.PublishPacket {
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.TopicName, pk.Qos, pk.Retain, pk.Payload = topic, qos, retain, []byte(payload)
+	return pk
+}
+
+// closeAll 关闭检查中建立的所有连接
+func (t *T) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.conns {
+		c.nc.Close()
+	}
+}
+
+// Conn 到服务端的原始连接
+type Conn struct {
+	t  *T
+	nc net.Conn
+	id uint16
+}
+
+// nextID 下一个报文标识符
+func (c *Conn) nextID() uint16 {
+	c.id++
+	return c.id
+}
+
+// Send 发送报文
+func (c *Conn) Send(pk packets.ControlPacket) {
+	c.SendRaw(Encode(pk))
+}
+
+// SendRaw 发送原始字节, 用于畸形报文
+// 服务端可能已经关闭连接, 写入错误留给之后的读取报告
+func (c *Conn) SendRaw(data []byte) {
+	c.nc.SetWriteDeadline(time.Now().Add(c.t.opts.Timeout))
+	c.nc.Write(data)
+}
+
+// Encode 编码报文
+func Encode(pk packets.ControlPacket) []byte {
+	var buf bytes.Buffer
+	pk.Write(&buf)
+	return buf.Bytes()
+}
+
+// read 在 d 内读取一个报文
+func (c *Conn) read(d time.Duration) (packets.ControlPacket, error) {
+	c.nc.SetReadDeadline(time.Now().Add(d))
+	return packets.ReadPacket(c.nc)
+}
+
+// Close 关闭网络连接, 不发送DISCONNECT
+func (c *Conn) Close() {
+	c.nc.Close()
+}
+
+// Expect 等待指定类型的报文
+func (c *Conn) Expect(packetType byte) packets.ControlPacket {
+	want := packets.PacketNames[packetType]
+	pk, err := c.read(c.t.opts.Timeout)
+	switch {
+	case isTimeout(err):
+		c.t.Fatalf("no %s within %s", want, c.t.opts.Timeout)
+	case err != nil:
+		c.t.Fatalf("connection closed while waiting for %s: %v", want, err)
+	case packets.HeaderOf(pk).PacketType != packetType:
+		c.t.Fatalf("received %s, expected %s", name(pk), want)
+	}
+	return pk
+}
+
+// ExpectClosed 等待服务端关闭连接, 期间收到任何报文都视为失败
+func (c *Conn) ExpectClosed(reason string) {
+	c.ExpectClosedWithin(c.t.opts.Timeout, reason)
+}
+
+// ExpectClosedWithin 在 d 内等待服务端关闭连接
+func (c *Conn) ExpectClosedWithin(d time.Duration, reason string) {
+	pk, err := c.read(d)
+	switch {
+	case err == nil:
+		c.t.Fatalf("broker sent %s instead of closing the connection after %s", name(pk), reason)
+	case isTimeout(err):
+		c.t.Fatalf("connection still open %s after %s", d, reason)
+	}
+}
+
+// ExpectNothing 确认服务端在一段时间内没有发送报文, 也没有关闭连接
+func (c *Conn) ExpectNothing(reason string) {
+	pk, err := c.read(c.t.opts.Quiet)
+	switch {
+	case err == nil:
+		c.t.Fatalf("broker sent %s %s", name(pk), reason)
+	case !isTimeout(err):
+		c.t.Fatalf("connection closed %s: %v", reason, err)
+	}
+}
+
+// ExpectMessage 等待一条PUBLISH并完成QoS交互
+func (c *Conn) ExpectMessage(topic string, payload string) *packets.PublishPacket {
+	pub := c.Expect(packets.PUBLISH).(*packets.PublishPacket)
+	if pub.TopicName != topic || string(pub.Payload) != payload {
+		c.t.Fatalf("received %q %q, expected %q %q", pub.TopicName, pub.Payload, topic, payload)
+	}
+	switch pub.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+		ack.PacketID = pub.PacketID
+		c.Send(ack)
+	case 2:
+		rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+		rec.PacketID = pub.PacketID
+		c.Send(rec)
+		c.Expect(packets.PUBREL)
+		comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+		comp.PacketID = pub.PacketID
+		c.Send(comp)
+	}
+	return pub
+}
+
+// isTimeout 是否为读超时
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// name 报文的简短描述
+func name(pk packets.ControlPacket) string {
+	n := packets.PacketNames[packets.HeaderOf(pk).PacketType]
+	if ack, ok := pk.(*packets.ConnackPacket); ok {
+		return fmt.Sprintf("%s with return code 0x%02x", n, ack.ReturnCode)
+	}
+	return n
+}
@@ -0,0 +1,50 @@
+package conformance
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/internal/testbroker"
+)
+
+func TestBroker(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	results := Run(Options{
+		Dial:    func() (net.Conn, error) { return b.Pipe(), nil },
+		Timeout: time.Second,
+	})
+	if len(results) != len(Cases()) {
+		t.Fatalf("%d results for %d cases", len(results), len(Cases()))
+	}
+	for _, r := range results {
+		if r.Status != Pass {
+			t.Errorf("%s %s: %s", r.ID, r.Status, r.Detail)
+		}
+	}
+}
+
+func TestReportsViolations(t *testing.T) {
+	// 测试用的服务端不检查报文的合法性
+	b, err := testbroker.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	results := Run(Options{
+		Dial:    func() (net.Conn, error) { return net.Dial("tcp", b.Addr()) },
+		Timeout: 200 * time.Millisecond,
+		Filter:  func(id string) bool { return id == "MQTT-3.8.1-1" || id == "MQTT-3.12.4-1" },
+	})
+	if len(results) != 2 {
+		t.Fatalf("%d results", len(results))
+	}
+	if r := results[0]; r.ID != "MQTT-3.8.1-1" || r.Status != Fail || r.Detail == "" {
+		t.Errorf("%+v", r)
+	}
+	if r := results[1]; r.ID != "MQTT-3.12.4-1" || r.Status != Pass {
+		t.Errorf("%+v", r)
+	}
+}
@@ -0,0 +1,248 @@
+// Package hooks 代理事件钩子
+// 认证, 访问控制, 消息改写和审计等扩展实现 Hook 接口, 由 Hooks 按注册顺序依次调用
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// SubackFailure SUBACK中表示订阅失败的返回码
+const SubackFailure = 0x80
+
+// ErrDropped 钩子丢弃了消息
+var ErrDropped = errors.New("message dropped by hook")
+
+// ReturnCode 带有MQTT返回码的错误, 钩子返回它以指定返回给客户端的返回码
+type ReturnCode byte
+
+// Error ...
+func (c ReturnCode) Error() string {
+	return fmt.Sprintf("return code 0x%02x", byte(c))
+}
+
+// Hook 代理事件钩子
+// OnPublish 和 OnDeliver 返回的报文会传给下一个钩子, 返回nil表示丢弃
+// OnSubscribe 和 OnUnsubscribe 的报文在返回后被复用, 钩子不能保留报文和它的切片字段
+type Hook interface {
+	ID() string
+	OnConnect(pk *packets.ConnectPacket) error
+	OnConnAck(clientID string, pk *packets.ConnackPacket)
+	OnSubscribe(clientID string, pk *packets.SubscribePacket) error
+	OnUnsubscribe(clientID string, pk *packets.UnsubscribePacket)
+	OnPublish(clientID string, pk *packets.PublishPacket) (*packets.PublishPacket, error)
+	OnDeliver(clientID string, pk *packets.PublishPacket) *packets.PublishPacket
+	OnDisconnect(clientID string, err error)
+	OnWill(clientID string, pk *packets.PublishPacket) *packets.PublishPacket
+	OnSessionExpired(clientID string)
+}
+
+// SessionHook 可选的会话回调, 钩子实现了该接口时调用
+// 不加入 Hook 是为了不影响已有的钩子实现
+type SessionHook interface {
+	// OnSessionStart 会话注册表接受连接之后调用, clientID 为最终的客户端标识符(服务端分配或加了后缀)
+	// trusted 为true时连接是服务端进程内的可信连接(如桥接), 没有经过 OnConnect 认证
+	OnSessionStart(clientID string, pk *packets.ConnectPacket, trusted bool)
+	// OnSessionEnd 清理会话(CleanSession)的连接断开后调用, 持久会话在过期时调用 OnSessionExpired
+	// 连接被同一客户端标识符的新连接接管时不调用
+	OnSessionEnd(clientID string)
+}
+
+// Base 空实现, 嵌入后只需实现关心的回调
+type Base struct{}
+
+// OnConnect ...
+func (Base) OnConnect(pk *packets.ConnectPacket) error { return nil }
+
+// OnConnAck ...
+func (Base) OnConnAck(clientID string, pk *packets.ConnackPacket) {}
+
+// OnSubscribe ...
+func (Base) OnSubscribe(clientID string, pk *packets.SubscribePacket) error { return nil }
+
+// OnUnsubscribe ...
+func (Base) OnUnsubscribe(clientID string, pk *packets.UnsubscribePacket) {}
+
+// OnPublish ...
+func (Base) OnPublish(clientID string, pk *packets.PublishPacket) (*packets.PublishPacket, error) {
+	return pk, nil
+}
+
+// OnDeliver ...
+func (Base) OnDeliver(clientID string, pk *packets.PublishPacket) *packets.PublishPacket { return pk }
+
+// OnDisconnect ...
+func (Base) OnDisconnect(clientID string, err error) {}
+
+// OnWill ...
+func (Base) OnWill(clientID string, pk *packets.PublishPacket) *packets.PublishPacket { return pk }
+
+// OnSessionExpired ...
+func (Base) OnSessionExpired(clientID string) {}
+
+// Hooks 按注册顺序调用的钩子列表, 可并发使用
+type Hooks struct {
+	mu    sync.RWMutex
+	hooks []Hook
+}
+
+// Add 注册钩子, ID重复时返回错误
+func (h *Hooks) Add(hook Hook) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, exist := range h.hooks {
+		if exist.ID() == hook.ID() {
+			return fmt.Errorf("hook %s already registered", hook.ID())
+		}
+	}
+	h.hooks = append(h.hooks, hook)
+	return nil
+}
+
+// Remove 移除钩子
+func (h *Hooks) Remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, hook := range h.hooks {
+		if hook.ID() == id {
+			h.hooks = append(h.hooks[:i:i], h.hooks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Len 已注册的钩子数量
+func (h *Hooks) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.hooks)
+}
+
+// list 当前钩子列表, Add 和 Remove 不会修改已返回的切片
+func (h *Hooks) list() []Hook {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.hooks
+}
+
+// OnConnect 依次调用钩子, 返回CONNACK返回码
+// 钩子返回 ReturnCode 时使用该返回码, 其他错误返回 ErrRefusedNotAuthorised
+func (h *Hooks) OnConnect(pk *packets.ConnectPacket) byte {
+	for _, hook := range h.list() {
+		if err := hook.OnConnect(pk); err != nil {
+			return codeOf(err, packets.ErrRefusedNotAuthorised)
+		}
+	}
+	return packets.Accepted
+}
+
+// OnConnAck 依次调用钩子
+func (h *Hooks) OnConnAck(clientID string, pk *packets.ConnackPacket) {
+	for _, hook := range h.list() {
+		hook.OnConnAck(clientID, pk)
+	}
+}
+
+// OnSubscribe 依次调用钩子, 返回每个主题的SUBACK返回码
+// 钩子可以修改 pk.Qoss 来降低授予的QoS, 返回错误时所有主题都订阅失败
+func (h *Hooks) OnSubscribe(clientID string, pk *packets.SubscribePacket) []byte {
+	codes := make([]byte, len(pk.Topics))
+	for _, hook := range h.list() {
+		if err := hook.OnSubscribe(clientID, pk); err != nil {
+			code := codeOf(err, SubackFailure)
+			for i := range codes {
+				codes[i] = code
+			}
+			return codes
+		}
+	}
+	copy(codes, pk.Qoss)
+	return codes
+}
+
+// OnUnsubscribe 依次调用钩子
+func (h *Hooks) OnUnsubscribe(clientID string, pk *packets.UnsubscribePacket) {
+	for _, hook := range h.list() {
+		hook.OnUnsubscribe(clientID, pk)
+	}
+}
+
+// OnPublish 依次调用钩子, 返回最终要路由的报文
+// 钩子丢弃报文时返回 ErrDropped
+func (h *Hooks) OnPublish(clientID string, pk *packets.PublishPacket) (*packets.PublishPacket, error) {
+	var err error
+	for _, hook := range h.list() {
+		pk, err = hook.OnPublish(clientID, pk)
+		if err != nil {
+			return nil, err
+		}
+		if pk == nil {
+			return nil, ErrDropped
+		}
+	}
+	return pk, nil
+}
+
+// OnDeliver 依次调用钩子, 返回nil表示不投递给该客户端
+func (h *Hooks) OnDeliver(clientID string, pk *packets.PublishPacket) *packets.PublishPacket {
+	for _, hook := range h.list() {
+		if pk = hook.OnDeliver(clientID, pk); pk == nil {
+			return nil
+		}
+	}
+	return pk
+}
+
+// OnDisconnect 依次调用钩子
+func (h *Hooks) OnDisconnect(clientID string, err error) {
+	for _, hook := range h.list() {
+		hook.OnDisconnect(clientID, err)
+	}
+}
+
+// OnWill 依次调用钩子, 返回nil表示不发布遗嘱
+func (h *Hooks) OnWill(clientID string, pk *packets.PublishPacket) *packets.PublishPacket {
+	for _, hook := range h.list() {
+		if pk = hook.OnWill(clientID, pk); pk == nil {
+			return nil
+		}
+	}
+	return pk
+}
+
+// OnSessionExpired 依次调用钩子
+func (h *Hooks) OnSessionExpired(clientID string) {
+	for _, hook := range h.list() {
+		hook.OnSessionExpired(clientID)
+	}
+}
+
+// OnSessionStart 依次调用实现了 SessionHook 的钩子
+func (h *Hooks) OnSessionStart(clientID string, pk *packets.ConnectPacket, trusted bool) {
+	for _, hook := range h.list() {
+		if sh, ok := hook.(SessionHook); ok {
+			sh.OnSessionStart(clientID, pk, trusted)
+		}
+	}
+}
+
+// OnSessionEnd 依次调用实现了 SessionHook 的钩子
+func (h *Hooks) OnSessionEnd(clientID string) {
+	for _, hook := range h.list() {
+		if sh, ok := hook.(SessionHook); ok {
+			sh.OnSessionEnd(clientID)
+		}
+	}
+}
+
+// codeOf 从错误中取出返回码
+func codeOf(err error, def byte) byte {
+	var code ReturnCode
+	if errors.As(err, &code) {
+		return byte(code)
+	}
+	return def
+}
@@ -0,0 +1,129 @@
+package hooks
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+type authHook struct {
+	Base
+}
+
+func (authHook) ID() string { return "auth" }
+
+func (authHook) OnConnect(pk *packets.ConnectPacket) error {
+	if pk.Username != "admin" {
+		return ReturnCode(packets.ErrRefusedBadUsernameOrPassword)
+	}
+	return nil
+}
+
+func (authHook) OnSubscribe(clientID string, pk *packets.SubscribePacket) error {
+	for i := range pk.Qoss {
+		if pk.Qoss[i] > 1 {
+			pk.Qoss[i] = 1
+		}
+	}
+	return nil
+}
+
+type rewriteHook struct {
+	Base
+	calls int
+}
+
+func (*rewriteHook) ID() string { return "rewrite" }
+
+func (h *rewriteHook) OnPublish(clientID string, pk *packets.PublishPacket) (*packets.PublishPacket, error) {
+	h.calls++
+	if pk.TopicName == "drop" {
+		return nil, nil
+	}
+	if pk.TopicName == "deny" {
+		return nil, errors.New("denied")
+	}
+	pk.Payload = bytes.ToUpper(pk.Payload)
+	return pk, nil
+}
+
+func TestHooks(t *testing.T) {
+	var h Hooks
+	rewrite := &rewriteHook{}
+	if err := h.Add(authHook{}); err != nil {
+		t.Fatalf("Add returned error: %s", err)
+	}
+	if err := h.Add(rewrite); err != nil {
+		t.Fatalf("Add returned error: %s", err)
+	}
+	if err := h.Add(authHook{}); err == nil {
+		t.Errorf("Add of duplicate hook should return error")
+	}
+
+	cp := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	if code := h.OnConnect(cp); code != packets.ErrRefusedBadUsernameOrPassword {
+		t.Errorf("OnConnect returned %d, should be %d", code, packets.ErrRefusedBadUsernameOrPassword)
+	}
+	cp.Username = "admin"
+	if code := h.OnConnect(cp); code != packets.Accepted {
+		t.Errorf("OnConnect returned %d, should be %d", code, packets.Accepted)
+	}
+
+	sp := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+	sp.Topics = []string{"a", "b"}
+	sp.Qoss = []byte{0, 2}
+	if codes := h.OnSubscribe("c1", sp); !bytes.Equal(codes, []byte{0, 1}) {
+		t.Errorf("OnSubscribe returned %v, should be [0 1]", codes)
+	}
+
+	pp := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pp.TopicName = "a"
+	pp.Payload = []byte("hello")
+	if pk, err := h.OnPublish("c1", pp); err != nil || string(pk.Payload) != "HELLO" {
+		t.Errorf("OnPublish did not rewrite payload: %v %v", pk, err)
+	}
+	pp.TopicName = "drop"
+	if _, err := h.OnPublish("c1", pp); err != ErrDropped {
+		t.Errorf("OnPublish returned %v, should be %v", err, ErrDropped)
+	}
+	pp.TopicName = "deny"
+	if _, err := h.OnPublish("c1", pp); err == nil || err == ErrDropped {
+		t.Errorf("OnPublish returned %v, should be hook error", err)
+	}
+
+	h.Remove("rewrite")
+	pp.TopicName = "a"
+	h.OnPublish("c1", pp)
+	if h.Len() != 1 || rewrite.calls != 3 {
+		t.Errorf("Removed hook was still called")
+	}
+}
+
+type sessionHook struct {
+	Base
+	started, ended []string
+}
+
+func (*sessionHook) ID() string { return "session" }
+
+func (h *sessionHook) OnSessionStart(clientID string, pk *packets.ConnectPacket, trusted bool) {
+	h.started = append(h.started, clientID)
+}
+
+func (h *sessionHook) OnSessionEnd(clientID string) {
+	h.ended = append(h.ended, clientID)
+}
+
+func TestSessionHook(t *testing.T) {
+	var h Hooks
+	s := &sessionHook{}
+	h.Add(authHook{})
+	h.Add(s)
+	h.OnSessionStart("a", packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket), false)
+	h.OnSessionEnd("a")
+	if len(s.started) != 1 || len(s.ended) != 1 {
+		t.Errorf("OnSessionStart called %d times, OnSessionEnd called %d times", len(s.started), len(s.ended))
+	}
+}
@@ -0,0 +1,192 @@
+// Package cmdutil 命令行工具共用的连接参数
+// 参数名与mosquitto_pub/mosquitto_sub保持一致, 方便替换
+package cmdutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/session"
+)
+
+// ConnFlags 连接参数
+type ConnFlags struct {
+	Host      string
+	Port      int
+	ClientID  string
+	IDPrefix  string
+	Username  string
+	Password  string
+	KeepAlive int
+	NoClean   bool
+	Timeout   time.Duration
+
+	WillTopic   string
+	WillPayload string
+	WillQos     int
+	WillRetain  bool
+
+	TLS      bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Insecure bool
+}
+
+// Register 在 fs 上注册连接参数, idPrefix 用于生成默认的客户端标识符
+func (f *ConnFlags) Register(fs *flag.FlagSet, idPrefix string) {
+	f.IDPrefix = idPrefix
+	fs.StringVar(&f.Host, "h", "localhost", "broker host")
+	fs.IntVar(&f.Port, "p", 0, "broker port (default 1883, 8883 with TLS)")
+	fs.StringVar(&f.ClientID, "i", "", "client ID (default "+idPrefix+" followed by a random UUID)")
+	fs.StringVar(&f.Username, "u", "", "username")
+	fs.StringVar(&f.Password, "P", "", "password")
+	fs.IntVar(&f.KeepAlive, "k", 60, "keep alive in seconds, 0 disables it")
+	fs.BoolVar(&f.NoClean, "c", false, "use a persistent session (clean session off), needs -i")
+	fs.DurationVar(&f.Timeout, "connect-timeout", 10*time.Second, "time to wait for the connection and CONNACK")
+
+	fs.StringVar(&f.WillTopic, "will-topic", "", "will topic")
+	fs.StringVar(&f.WillPayload, "will-payload", "", "will payload")
+	fs.IntVar(&f.WillQos, "will-qos", 0, "will QoS")
+	fs.BoolVar(&f.WillRetain, "will-retain", false, "retain the will message")
+
+	fs.BoolVar(&f.TLS, "tls", false, "connect with TLS")
+	fs.StringVar(&f.CAFile, "cafile", "", "CA certificates to verify the broker, implies -tls")
+	fs.StringVar(&f.CertFile, "cert", "", "client certificate, implies -tls")
+	fs.StringVar(&f.KeyFile, "key", "", "client private key")
+	fs.BoolVar(&f.Insecure, "insecure", false, "do not verify the broker certificate")
+}
+
+// Validate 检查参数组合
+func (f *ConnFlags) Validate() error {
+	if f.NoClean && f.ClientID == "" {
+		return errors.New("-c needs a client ID given with -i")
+	}
+	if f.WillQos < 0 || f.WillQos > 2 {
+		return fmt.Errorf("invalid will QoS %d", f.WillQos)
+	}
+	if f.WillTopic == "" && (f.WillPayload != "" || f.WillRetain) {
+		return errors.New("will payload and retain need -will-topic")
+	}
+	if f.KeepAlive < 0 || f.KeepAlive > 65535 {
+		return fmt.Errorf("invalid keep alive %d", f.KeepAlive)
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return errors.New("-cert and -key must be given together")
+	}
+	return nil
+}
+
+// Options 客户端选项
+func (f *ConnFlags) Options(onMessage client.Handler) client.Options {
+	opts := client.Options{
+		ClientID:       f.ClientID,
+		Username:       f.Username,
+		CleanSession:   !f.NoClean,
+		KeepAlive:      uint16(f.KeepAlive),
+		WillTopic:      f.WillTopic,
+		WillMessage:    []byte(f.WillPayload),
+		WillQos:        byte(f.WillQos),
+		WillRetain:     f.WillRetain,
+		ConnectTimeout: f.Timeout,
+		OnMessage:      onMessage,
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = session.UUID(f.IDPrefix)(nil)
+	}
+	if f.Password != "" {
+		opts.Password = []byte(f.Password)
+	}
+	return opts
+}
+
+// Dial 连接服务端
+func (f *ConnFlags) Dial(onMessage client.Handler) (*client.Client, error) {
+	conn, err := f.DialConn()
+	if err != nil {
+		return nil, err
+	}
+	return client.Connect(conn, f.Options(onMessage))
+}
+
+// DialConn 建立到服务端的网络连接, 不发送CONNECT
+func (f *ConnFlags) DialConn() (net.Conn, error) {
+	useTLS := f.TLS || f.CAFile != "" || f.CertFile != ""
+	dialer := &net.Dialer{Timeout: f.Timeout}
+	if !useTLS {
+		return dialer.Dial("tcp", f.Address())
+	}
+	cfg, err := f.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", f.Address(), cfg)
+}
+
+// Address 服务端地址, 没有指定端口时使用1883, TLS使用8883
+func (f *ConnFlags) Address() string {
+	port := f.Port
+	if port == 0 {
+		port = 1883
+		if f.TLS || f.CAFile != "" || f.CertFile != "" {
+			port = 8883
+		}
+	}
+	return net.JoinHostPort(f.Host, strconv.Itoa(port))
+}
+
+// tlsConfig TLS配置
+func (f *ConnFlags) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: f.Host, InsecureSkipVerify: f.Insecure}
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", f.CAFile)
+		}
+	}
+	if f.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Fatal 输出错误并以状态1退出
+func Fatal(name string, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	os.Exit(1)
+}
+
+// Seconds 时长参数, 与mosquitto一样接受秒数, 也接受 "500ms" 这样的时长
+type Seconds time.Duration
+
+func (s *Seconds) String() string { return time.Duration(*s).String() }
+
+func (s *Seconds) Set(v string) error {
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		*s = Seconds(n * float64(time.Second))
+	} else if d, err := time.ParseDuration(v); err == nil {
+		*s = Seconds(d)
+	} else {
+		return fmt.Errorf("expected seconds or a duration like 500ms")
+	}
+	if *s < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package testbroker 测试用的最小MQTT服务端
+// 只支持单连接会话, 不保存离线消息, 用于测试客户端, 桥接等组件
+package testbroker
+
+import (
+	"net"
+	"sync"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// Broker 测试服务端
+type Broker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	clients  map[*conn]bool
+	retained map[string]*packets.PublishPacket
+	connects []*packets.ConnectPacket
+	wg       sync.WaitGroup
+}
+
+// conn 一个客户端连接
+type conn struct {
+	net.Conn
+	bridge bool // 协议级别带有桥接标志, 不回送自己发布的消息
+	wmu    sync.Mutex
+	subs   map[string]byte
+}
+
+// Start 在随机端口上启动测试服务端
+func Start() (*Broker, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		listener: l,
+		clients:  make(map[*conn]bool),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// Addr 监听地址
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Connects 收到的CONNECT报文
+func (b *Broker) Connects() []*packets.ConnectPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*packets.ConnectPacket(nil), b.connects...)
+}
+
+// DropClients 断开所有客户端
+func (b *Broker) DropClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.Close()
+	}
+}
+
+// Close 关闭服务端和所有连接
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.DropClients()
+	b.wg.Wait()
+}
+
+// accept 接受连接
+func (b *Broker) accept() {
+	defer b.wg.Done()
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go b.serve(&conn{Conn: nc, subs: make(map[string]byte)})
+	}
+}
+
+// serve 处理一个连接
+func (b *Broker) serve(c *conn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		c.Close()
+	}()
+
+	pk, err := packets.ReadPacket(c)
+	if err != nil {
+		return
+	}
+	cp, ok := pk.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	c.bridge = cp.ProtocolLevel&packets.BridgeFlag != 0
+	b.mu.Lock()
+	b.connects = append(b.connects, cp)
+	b.clients[c] = true
+	b.mu.Unlock()
+	connack := packets.NewControlPacket(packets.CONNACK).(*packets.ConnackPacket)
+	connack.ReturnCode = cp.Validate()
+	c.write(connack)
+	if connack.ReturnCode != packets.Accepted {
+		return
+	}
+
+	for {
+		pk, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		switch p := pk.(type) {
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+				ack.PacketID = p.PacketID
+				c.write(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+				rec.PacketID = p.PacketID
+				c.write(rec)
+			}
+			b.route(c, p)
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+			comp.PacketID = p.PacketID
+			c.write(comp)
+		case *packets.SubscribePacket:
+			b.subscribe(c, p)
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, topic := range p.Topics {
+				delete(c.subs, topic)
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.UNSUBACK).(*packets.UnsubackPacket)
+			ack.PacketID = p.PacketID
+			c.write(ack)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.PINGRESP))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// subscribe 处理订阅并发送匹配的保留消息
+func (b *Broker) subscribe(c *conn, p *packets.SubscribePacket) {
+	ack := packets.NewControlPacket(packets.SUBACK).(*packets.SubackPacket)
+	ack.PacketID = p.PacketID
+	var retained []*packets.PublishPacket
+	b.mu.Lock()
+	for i, topic := range p.Topics {
+		if !packets.ValidTopicFilter(topic) || p.Qoss[i] > 2 {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+			continue
+		}
+		c.subs[topic] = p.Qoss[i]
+		ack.ReturnCodes = append(ack.ReturnCodes, p.Qoss[i])
+		for name, pk := range b.retained {
+			if packets.MatchTopic(topic, name) {
+				copied := *pk
+				retained = append(retained, &copied)
+			}
+		}
+	}
+	b.mu.Unlock()
+	c.write(ack)
+	for _, pk := range retained {
+		c.write(pk)
+	}
+}
+
+// route 把消息投递给匹配的订阅者
+func (b *Broker) route(from *conn, p *packets.PublishPacket) {
+	b.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p
+		}
+	}
+	var targets []*conn
+	var qoss []byte
+	for c := range b.clients {
+		if c == from && c.bridge {
+			continue
+		}
+		matched := false
+		var qos byte
+		for filter, q := range c.subs {
+			if packets.MatchTopic(filter, p.TopicName) {
+				if !matched || q > qos {
+					qos = q
+				}
+				matched = true
+			}
+		}
+		if matched {
+			targets = append(targets, c)
+			qoss = append(qoss, qos)
+		}
+	}
+	b.mu.Unlock()
+
+	for i, c := range targets {
+		out := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		out.TopicName = p.TopicName
+		out.Payload = p.Payload
+		out.Qos = p.Qos
+		if qoss[i] < out.Qos {
+			out.Qos = qoss[i]
+		}
+		out.PacketID = p.PacketID
+		if out.PacketID == 0 {
+			out.PacketID = 1
+		}
+		c.write(out)
+	}
+}
+
+// write 写入报文
+func (c *conn) write(pk packets.ControlPacket) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	pk.Write(c)
+}
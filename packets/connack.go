@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // ConnackPacket 连接确认包
@@ -51,3 +52,23 @@ func (p *ConnackPacket) Unpack(r io.Reader) error {
 	}
 	return nil
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *ConnackPacket) Reset() {
+	*p = ConnackPacket{FixedHeader: FixedHeader{PacketType: CONNACK}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *ConnackPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *ConnackPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *ConnackPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, CONNACK)
+}
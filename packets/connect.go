@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 //连接错误码
@@ -18,6 +19,9 @@ const (
 	ErrProtocolViolation            = 0xFF // 协议错误,保留位不为0 或 协议名错误 或 客户端标识|用户名|密码长度超出65535
 )
 
+// BridgeFlag 协议级别的最高位, 桥接连接用它告知服务端不要回送自己发布的消息
+const BridgeFlag = 0x80
+
 // ConnectPacket 连接包
 type ConnectPacket struct {
 	FixedHeader
@@ -44,7 +48,12 @@ type ConnectPacket struct {
 func (p *ConnectPacket) String() string {
 	str := fmt.Sprintf("%s", p.FixedHeader)
 	str += " "
-	str += fmt.Sprintf("protocolversion: %d protocolname: %s cleansession: %t willflag: %t WillQos: %d WillRetain: %t Usernameflag: %t Passwordflag: %t keepalive: %d clientId: %s willtopic: %s willmessage: %s Username: %s Password: %s", p.ProtocolLevel, p.ProtocolName, p.CleanSession, p.WillFlag, p.WillQos, p.WillRetain, p.UsernameFlag, p.PasswordFlag, p.KeepAlive, p.ClientIdentifier, p.WillTopic, p.WillMessage, p.Username, p.Password)
+	// 密码不输出, 遗嘱消息按 LogFormat 截断
+	password := ""
+	if p.PasswordFlag || len(p.Password) > 0 {
+		password = redacted
+	}
+	str += fmt.Sprintf("protocolversion: %d protocolname: %s cleansession: %t willflag: %t WillQos: %d WillRetain: %t Usernameflag: %t Passwordflag: %t keepalive: %d clientId: %s willtopic: %s willmessage: %s Username: %s Password: %s", p.ProtocolLevel, p.ProtocolName, p.CleanSession, p.WillFlag, p.WillQos, p.WillRetain, p.UsernameFlag, p.PasswordFlag, p.KeepAlive, p.ClientIdentifier, p.WillTopic, LogFormat.bytesString(p.WillMessage), p.Username, password)
 	return str
 }
 
@@ -58,7 +67,7 @@ func (p *ConnectPacket) Write(w io.Writer) error {
 
 	body.Write(encodeString(p.ProtocolName))
 	body.WriteByte(p.ProtocolLevel)
-	body.WriteByte(boolToByte(p.CleanSession)<<1 | boolToByte(p.WillFlag)<<2 | p.WillQos<<3 | boolToByte(p.WillRetain)<<5 | boolToByte(p.PasswordFlag)<<6 | boolToByte(p.UsernameFlag)<<7)
+	body.WriteByte(p.Reserved&1 | boolToByte(p.CleanSession)<<1 | boolToByte(p.WillFlag)<<2 | p.WillQos<<3 | boolToByte(p.WillRetain)<<5 | boolToByte(p.PasswordFlag)<<6 | boolToByte(p.UsernameFlag)<<7)
 	body.Write(encodeUint16(p.KeepAlive))
 	body.Write(encodeString(p.ClientIdentifier))
 	if p.WillFlag {
@@ -138,16 +147,20 @@ func (p *ConnectPacket) Unpack(r io.Reader) error {
 // Validate 验证
 func (p *ConnectPacket) Validate() byte {
 	if p.PasswordFlag && !p.UsernameFlag {
-		return ErrRefusedBadUsernameOrPassword
+		return ErrProtocolViolation
 	}
 	if p.Reserved != 0 {
 		return ErrProtocolViolation
 	}
+	// 遗嘱QoS不能为3, 没有遗嘱时遗嘱QoS和遗嘱保留必须为0
+	if p.WillQos > 2 || !p.WillFlag && (p.WillQos != 0 || p.WillRetain) {
+		return ErrProtocolViolation
+	}
 	if p.ProtocolName != "MQTT" {
 		return ErrProtocolViolation
 	}
-	// >= 3.1.1
-	if p.ProtocolLevel != 0x04 {
+	// >= 3.1.1, 允许桥接标志
+	if p.ProtocolLevel&^BridgeFlag != 0x04 {
 		return ErrRefusedBadProtocolLevel
 	}
 
@@ -160,3 +173,23 @@ func (p *ConnectPacket) Validate() byte {
 
 	return Accepted
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *ConnectPacket) Reset() {
+	*p = ConnectPacket{FixedHeader: FixedHeader{PacketType: CONNECT}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *ConnectPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *ConnectPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *ConnectPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, CONNECT)
+}
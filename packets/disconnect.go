@@ -3,6 +3,7 @@ package packets
 import (
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // DisconnectPacket 客户端断开连接包
@@ -19,6 +20,7 @@ func (p *DisconnectPacket) String() string {
 // Write 写入
 func (p *DisconnectPacket) Write(w io.Writer) error {
 	var err error
+	p.FixedHeader.RemainingLength = 0
 	packet := p.FixedHeader.pack()
 	_, err = packet.WriteTo(w)
 
@@ -29,3 +31,23 @@ func (p *DisconnectPacket) Write(w io.Writer) error {
 func (p *DisconnectPacket) Unpack(r io.Reader) error {
 	return nil
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *DisconnectPacket) Reset() {
+	*p = DisconnectPacket{FixedHeader: FixedHeader{PacketType: DISCONNECT}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *DisconnectPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *DisconnectPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *DisconnectPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, DISCONNECT)
+}
@@ -0,0 +1,419 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 报文的日志和JSON格式
+// 字段名使用小写加下划线, 例如 {"type":"PUBLISH","qos":1,"topic":"a/b","packet_id":1,"payload":"aGk=","payload_encoding":"base64"}
+// 字节字段(有效负载, 遗嘱消息, 密码)按 Format 编码, 不是文本时带上 <字段>_encoding, 截断时带上 <字段>_size 记录原始长度
+// 密码默认以 [redacted] 代替, 解码时得到设置了密码标志但密码为空的CONNECT
+
+// redacted 隐藏的密码
+const redacted = "[redacted]"
+
+// PayloadEncoding 字节字段的编码方式
+type PayloadEncoding int
+
+// 字节字段的编码方式
+const (
+	PayloadAuto   PayloadEncoding = iota // 可打印的UTF-8文本原样输出, 否则使用十六进制
+	PayloadText                          // 原样输出, 无效的UTF-8在JSON中会被替换
+	PayloadHex                           // 十六进制
+	PayloadBase64                        // 标准base64
+)
+
+var encodingNames = map[PayloadEncoding]string{
+	PayloadAuto:   "auto",
+	PayloadText:   "text",
+	PayloadHex:    "hex",
+	PayloadBase64: "base64",
+}
+
+func (e PayloadEncoding) String() string {
+	if name, ok := encodingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("PayloadEncoding(%d)", int(e))
+}
+
+// Format 报文在日志和JSON中的格式
+type Format struct {
+	Payload      PayloadEncoding // 字节字段的编码方式
+	MaxPayload   int             // 字节字段最多输出的字节数, 0表示不截断
+	ShowPassword bool            // 输出密码, 默认隐藏
+}
+
+// LogFormat 报文 LogValue 使用的格式, 隐藏密码, 有效负载最多输出64字节
+var LogFormat = Format{Payload: PayloadAuto, MaxPayload: 64}
+
+// JSONFormat 报文 MarshalJSON 使用的格式, 隐藏密码, 有效负载以base64完整保存
+var JSONFormat = Format{Payload: PayloadBase64}
+
+// LogValue 报文的 slog 值, 每个字段是组中的一个属性
+func (f Format) LogValue(pk ControlPacket) slog.Value {
+	return slog.GroupValue(f.attrs(pk)...)
+}
+
+// Marshal 把报文编码成JSON对象, 字段顺序与 LogValue 相同
+func (f Format) Marshal(pk ControlPacket) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, a := range f.attrs(pk) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(a.Key)
+		value, err := json.Marshal(a.Value.Any())
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// attrs 报文的字段, 按输出顺序排列
+func (f Format) attrs(pk ControlPacket) []slog.Attr {
+	fh := HeaderOf(pk)
+	attrs := []slog.Attr{slog.String("type", PacketNames[fh.PacketType])}
+	switch p := pk.(type) {
+	case *ConnectPacket:
+		attrs = append(attrs,
+			slog.String("protocol_name", p.ProtocolName),
+			slog.Int("protocol_level", int(p.ProtocolLevel)),
+			slog.Bool("clean_session", p.CleanSession),
+			slog.Int("keep_alive", int(p.KeepAlive)),
+			slog.String("client_id", p.ClientIdentifier))
+		if p.WillFlag {
+			attrs = append(attrs,
+				slog.String("will_topic", p.WillTopic),
+				slog.Int("will_qos", int(p.WillQos)),
+				slog.Bool("will_retain", p.WillRetain))
+			attrs = f.bytesAttrs(attrs, "will_message", p.WillMessage)
+		}
+		if p.UsernameFlag {
+			attrs = append(attrs, slog.String("username", p.Username))
+		}
+		if p.PasswordFlag && f.ShowPassword {
+			attrs = f.bytesAttrs(attrs, "password", p.Password)
+		} else if p.PasswordFlag {
+			attrs = append(attrs, slog.String("password", redacted))
+		}
+		if p.Reserved != 0 {
+			attrs = append(attrs, slog.Int("reserved", int(p.Reserved)))
+		}
+	case *ConnackPacket:
+		attrs = append(attrs, slog.Bool("session_present", p.SessionPresent), slog.Int("return_code", int(p.ReturnCode)))
+	case *PublishPacket:
+		attrs = append(attrs, slog.Bool("dup", fh.Dup), slog.Int("qos", int(fh.Qos)), slog.Bool("retain", fh.Retain), slog.String("topic", p.TopicName))
+		if fh.Qos > 0 {
+			attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)))
+		}
+		attrs = f.bytesAttrs(attrs, "payload", p.Payload)
+	case *PubackPacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)))
+	case *PubrecPacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)))
+	case *PubrelPacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)))
+	case *PubcompPacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)))
+	case *SubscribePacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)), slog.Any("topics", p.Topics), slog.Any("qoss", ints(p.Qoss)))
+	case *SubackPacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)), slog.Any("return_codes", ints(p.ReturnCodes)))
+	case *UnsubscribePacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)), slog.Any("topics", p.Topics))
+	case *UnsubackPacket:
+		attrs = append(attrs, slog.Int("packet_id", int(p.PacketID)))
+	}
+	return attrs
+}
+
+// bytesAttrs 按格式编码字节字段
+func (f Format) bytesAttrs(attrs []slog.Attr, key string, b []byte) []slog.Attr {
+	size := len(b)
+	if f.MaxPayload > 0 && len(b) > f.MaxPayload {
+		n := f.MaxPayload
+		// 文本在字符边界截断, UTF-8字符最多4字节
+		for i := 0; i < 3 && n > 0 && (f.Payload == PayloadAuto || f.Payload == PayloadText) && !utf8.RuneStart(b[n]); i++ {
+			n--
+		}
+		b = b[:n]
+	}
+	enc := f.Payload
+	if enc == PayloadAuto {
+		enc = PayloadText
+		if !printable(b) {
+			enc = PayloadHex
+		}
+	}
+	switch enc {
+	case PayloadHex:
+		attrs = append(attrs, slog.String(key, hex.EncodeToString(b)), slog.String(key+"_encoding", "hex"))
+	case PayloadBase64:
+		attrs = append(attrs, slog.String(key, base64.StdEncoding.EncodeToString(b)), slog.String(key+"_encoding", "base64"))
+	default:
+		attrs = append(attrs, slog.String(key, string(b)))
+	}
+	if len(b) < size {
+		attrs = append(attrs, slog.Int(key+"_size", size))
+	}
+	return attrs
+}
+
+// bytesString 按格式输出字节字段, 用于 String
+func (f Format) bytesString(b []byte) string {
+	attrs := f.bytesAttrs(nil, "", b)
+	str := attrs[0].Value.String()
+	for _, a := range attrs[1:] {
+		str += fmt.Sprintf(" %s: %s", a.Key[1:], a.Value)
+	}
+	return str
+}
+
+// printable 是否为可打印的UTF-8文本
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ints 把字节切片转成整数切片, 避免JSON把 []byte 编码成base64
+func ints(b []byte) []int {
+	v := make([]int, len(b))
+	for i, c := range b {
+		v[i] = int(c)
+	}
+	return v
+}
+
+// jsonPacket 所有报文类型的JSON字段
+type jsonPacket struct {
+	Type string `json:"type"`
+
+	ProtocolName        string  `json:"protocol_name"`
+	ProtocolLevel       byte    `json:"protocol_level"`
+	CleanSession        bool    `json:"clean_session"`
+	KeepAlive           uint16  `json:"keep_alive"`
+	ClientID            string  `json:"client_id"`
+	WillTopic           *string `json:"will_topic"`
+	WillQos             byte    `json:"will_qos"`
+	WillRetain          bool    `json:"will_retain"`
+	WillMessage         *string `json:"will_message"`
+	WillMessageEncoding string  `json:"will_message_encoding"`
+	WillMessageSize     *int    `json:"will_message_size"`
+	Username            *string `json:"username"`
+	Password            *string `json:"password"`
+	PasswordEncoding    string  `json:"password_encoding"`
+	PasswordSize        *int    `json:"password_size"`
+	Reserved            byte    `json:"reserved"`
+
+	SessionPresent bool `json:"session_present"`
+	ReturnCode     byte `json:"return_code"`
+
+	Dup             bool    `json:"dup"`
+	Qos             byte    `json:"qos"`
+	Retain          bool    `json:"retain"`
+	Topic           string  `json:"topic"`
+	PacketID        uint16  `json:"packet_id"`
+	Payload         *string `json:"payload"`
+	PayloadEncoding string  `json:"payload_encoding"`
+	PayloadSize     *int    `json:"payload_size"`
+
+	Topics      []string `json:"topics"`
+	Qoss        []int    `json:"qoss"`
+	ReturnCodes []int    `json:"return_codes"`
+}
+
+// DecodeJSON 根据 type 字段解码任意类型的报文
+func DecodeJSON(data []byte) (ControlPacket, error) {
+	var d jsonPacket
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	for packetType, name := range PacketNames {
+		if name == d.Type {
+			pk := NewControlPacket(packetType)
+			return pk, d.fill(pk)
+		}
+	}
+	return nil, fmt.Errorf("unsupported packet type %q", d.Type)
+}
+
+// unmarshalJSON 把JSON解码到指定类型的报文中
+func unmarshalJSON(data []byte, pk ControlPacket, packetType byte) error {
+	var d jsonPacket
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	if d.Type != PacketNames[packetType] {
+		return fmt.Errorf("cannot unmarshal %q into a %s packet", d.Type, PacketNames[packetType])
+	}
+	return d.fill(pk)
+}
+
+// fill 用解码的字段填充报文, 固定头部的标志位使用报文类型的默认值, PUBLISH除外
+func (d *jsonPacket) fill(pk ControlPacket) error {
+	fh := HeaderOf(NewControlPacket(typeOf(pk)))
+	var err error
+	switch p := pk.(type) {
+	case *ConnectPacket:
+		*p = ConnectPacket{
+			FixedHeader:      fh,
+			ProtocolName:     d.ProtocolName,
+			ProtocolLevel:    d.ProtocolLevel,
+			CleanSession:     d.CleanSession,
+			KeepAlive:        d.KeepAlive,
+			ClientIdentifier: d.ClientID,
+			Reserved:         d.Reserved,
+		}
+		if d.WillTopic != nil {
+			p.WillFlag, p.WillTopic, p.WillQos, p.WillRetain = true, *d.WillTopic, d.WillQos, d.WillRetain
+			if p.WillMessage, err = decodeField("will_message", d.WillMessage, d.WillMessageEncoding, d.WillMessageSize); err != nil {
+				return err
+			}
+		}
+		if d.Username != nil {
+			p.UsernameFlag, p.Username = true, *d.Username
+		}
+		if d.Password != nil {
+			p.PasswordFlag = true
+			if *d.Password != redacted || d.PasswordEncoding != "" {
+				if p.Password, err = decodeField("password", d.Password, d.PasswordEncoding, d.PasswordSize); err != nil {
+					return err
+				}
+			}
+		}
+	case *ConnackPacket:
+		*p = ConnackPacket{FixedHeader: fh, SessionPresent: d.SessionPresent, ReturnCode: d.ReturnCode}
+	case *PublishPacket:
+		fh.Dup, fh.Qos, fh.Retain = d.Dup, d.Qos, d.Retain
+		*p = PublishPacket{FixedHeader: fh, TopicName: d.Topic, PacketID: d.PacketID}
+		if p.Payload, err = decodeField("payload", d.Payload, d.PayloadEncoding, d.PayloadSize); err != nil {
+			return err
+		}
+	case *PubackPacket:
+		*p = PubackPacket{FixedHeader: fh, PacketID: d.PacketID}
+	case *PubrecPacket:
+		*p = PubrecPacket{FixedHeader: fh, PacketID: d.PacketID}
+	case *PubrelPacket:
+		*p = PubrelPacket{FixedHeader: fh, PacketID: d.PacketID}
+	case *PubcompPacket:
+		*p = PubcompPacket{FixedHeader: fh, PacketID: d.PacketID}
+	case *SubscribePacket:
+		if len(d.Topics) != len(d.Qoss) {
+			return fmt.Errorf("SUBSCRIBE has %d topics and %d QoS values", len(d.Topics), len(d.Qoss))
+		}
+		*p = SubscribePacket{FixedHeader: fh, PacketID: d.PacketID, Topics: d.Topics}
+		if p.Qoss, err = byteSlice("qoss", d.Qoss); err != nil {
+			return err
+		}
+	case *SubackPacket:
+		*p = SubackPacket{FixedHeader: fh, PacketID: d.PacketID}
+		if p.ReturnCodes, err = byteSlice("return_codes", d.ReturnCodes); err != nil {
+			return err
+		}
+	case *UnsubscribePacket:
+		*p = UnsubscribePacket{FixedHeader: fh, PacketID: d.PacketID, Topics: d.Topics}
+	case *UnsubackPacket:
+		*p = UnsubackPacket{FixedHeader: fh, PacketID: d.PacketID}
+	case *PingreqPacket:
+		p.FixedHeader = fh
+	case *PingrespPacket:
+		p.FixedHeader = fh
+	case *DisconnectPacket:
+		p.FixedHeader = fh
+	}
+	return nil
+}
+
+// byteSlice 把整数切片转回字节切片
+func byteSlice(key string, v []int) ([]byte, error) {
+	b := make([]byte, len(v))
+	for i, n := range v {
+		if n < 0 || n > 255 {
+			return nil, fmt.Errorf("%s: %d is not a byte", key, n)
+		}
+		b[i] = byte(n)
+	}
+	return b, nil
+}
+
+// typeOf 报文结构体对应的类型, 零值报文的固定头部中还没有类型
+func typeOf(pk ControlPacket) byte {
+	switch pk.(type) {
+	case *ConnectPacket:
+		return CONNECT
+	case *ConnackPacket:
+		return CONNACK
+	case *PublishPacket:
+		return PUBLISH
+	case *PubackPacket:
+		return PUBACK
+	case *PubrecPacket:
+		return PUBREC
+	case *PubrelPacket:
+		return PUBREL
+	case *PubcompPacket:
+		return PUBCOMP
+	case *SubscribePacket:
+		return SUBSCRIBE
+	case *SubackPacket:
+		return SUBACK
+	case *UnsubscribePacket:
+		return UNSUBSCRIBE
+	case *UnsubackPacket:
+		return UNSUBACK
+	case *PingreqPacket:
+		return PINGREQ
+	case *PingrespPacket:
+		return PINGRESP
+	case *DisconnectPacket:
+		return DISCONNECT
+	}
+	return 0
+}
+
+// decodeField 解码字节字段, 截断过的字段无法还原, 返回错误
+func decodeField(key string, value *string, encoding string, size *int) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	var b []byte
+	var err error
+	switch encoding {
+	case "", "text":
+		b = []byte(*value)
+	case "hex":
+		b, err = hex.DecodeString(*value)
+	case "base64":
+		b, err = base64.StdEncoding.DecodeString(*value)
+	default:
+		return nil, fmt.Errorf("%s: unknown encoding %q", key, encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	if size != nil && *size != len(b) {
+		return nil, fmt.Errorf("%s was truncated to %d of %d bytes", key, len(b), *size)
+	}
+	return b, nil
+}
@@ -0,0 +1,128 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, enc := range []PayloadEncoding{PayloadAuto, PayloadHex, PayloadBase64} {
+		f := Format{Payload: enc, ShowPassword: true}
+		for packetType := byte(CONNECT); packetType <= DISCONNECT; packetType++ {
+			for i := 0; i < 50; i++ {
+				pk := randPacket(r, packetType)
+				data, err := f.Marshal(pk)
+				if err != nil {
+					t.Fatalf("%s: Marshal(%v): %v", enc, pk, err)
+				}
+				read, err := DecodeJSON(data)
+				if err != nil {
+					t.Fatalf("%s: DecodeJSON(%s): %v", enc, data, err)
+				}
+				if diff := diffFields(pk, read); len(diff) > 0 {
+					t.Fatalf("%s: DecodeJSON(%s) differs:\n  %s", enc, data, strings.Join(diff, "\n  "))
+				}
+				// 各报文类型的 UnmarshalJSON
+				typed := reflect.New(reflect.TypeOf(pk).Elem()).Interface().(ControlPacket)
+				if err := json.Unmarshal(data, typed); err != nil {
+					t.Fatalf("%s: json.Unmarshal(%s) into %T: %v", enc, data, typed, err)
+				}
+				if diff := diffFields(pk, typed); len(diff) > 0 {
+					t.Fatalf("%s: json.Unmarshal(%s) differs:\n  %s", enc, data, strings.Join(diff, "\n  "))
+				}
+			}
+		}
+	}
+}
+
+func TestJSONRedaction(t *testing.T) {
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName, cp.ProtocolLevel, cp.ClientIdentifier = "MQTT", 4, "device-1"
+	cp.UsernameFlag, cp.Username = true, "device"
+	cp.PasswordFlag, cp.Password = true, []byte("s3cret")
+	data, err := json.Marshal(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("s3cret")) || !bytes.Contains(data, []byte(`"password":"[redacted]"`)) {
+		t.Errorf("password not redacted: %s", data)
+	}
+	var read ConnectPacket
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if !read.PasswordFlag || read.Password != nil || read.Username != "device" {
+		t.Errorf("decoded %+v", read)
+	}
+	if strings.Contains(cp.String(), "s3cret") {
+		t.Errorf("String() contains the password: %s", cp)
+	}
+
+	var pub PublishPacket
+	if err := json.Unmarshal(data, &pub); err == nil {
+		t.Errorf("CONNECT JSON was decoded into a PUBLISH")
+	}
+}
+
+func TestJSONTruncated(t *testing.T) {
+	pk := NewControlPacket(PUBLISH).(*PublishPacket)
+	pk.TopicName, pk.Payload = "a/b", []byte("hello world")
+	data, err := Format{Payload: PayloadText, MaxPayload: 5}.Marshal(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"type":"PUBLISH","dup":false,"qos":0,"retain":false,"topic":"a/b","payload":"hello","payload_size":11}` {
+		t.Errorf("Marshal returned %s", data)
+	}
+	if _, err := DecodeJSON(data); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("DecodeJSON of a truncated payload returned %v", err)
+	}
+}
+
+func TestLogValue(t *testing.T) {
+	pub := NewControlPacket(PUBLISH).(*PublishPacket)
+	pub.TopicName, pub.Qos, pub.PacketID = "firmware/image", 1, 7
+	pub.Payload = bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 1000)
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName, cp.ProtocolLevel, cp.ClientIdentifier = "MQTT", 4, "device-1"
+	cp.UsernameFlag, cp.Username, cp.PasswordFlag, cp.Password = true, "device", true, []byte("s3cret")
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Info("received", "packet", pub)
+	var entry struct {
+		Packet map[string]interface{} `json:"packet"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	p := entry.Packet
+	if p["type"] != "PUBLISH" || p["packet_id"] != 7.0 || p["payload_encoding"] != "hex" || p["payload_size"] != 4000.0 || len(p["payload"].(string)) != 128 {
+		t.Errorf("logged %v", p)
+	}
+
+	buf.Reset()
+	logger = slog.New(slog.NewTextHandler(&buf, nil))
+	logger.Info("connect", "packet", cp)
+	if out := buf.String(); strings.Contains(out, "s3cret") || !strings.Contains(out, "packet.password=[redacted]") || !strings.Contains(out, "packet.client_id=device-1") {
+		t.Errorf("logged %s", out)
+	}
+	if s := pub.String(); len(s) > 300 {
+		t.Errorf("String() of a 4000 byte payload is %d bytes", len(s))
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	f := Format{Payload: PayloadAuto, MaxPayload: 4}
+	attrs := f.bytesAttrs(nil, "payload", []byte("中文"))
+	// 4字节在第二个字符中间, 截断到第一个字符
+	if attrs[0].Value.String() != "中" || attrs[1].Key != "payload_size" {
+		t.Errorf("attrs %v", attrs)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 )
 
 // CONNECT 客户端请求连接服务端
@@ -70,6 +71,28 @@ func (fh FixedHeader) String() string {
 	return fmt.Sprintf("%s: dup: %t qos: %d retain: %t rLength: %d", PacketNames[fh.PacketType], fh.Dup, fh.Qos, fh.Retain, fh.RemainingLength)
 }
 
+// Header 返回固定头部, 各报文通过嵌入 FixedHeader 实现
+func (fh FixedHeader) Header() FixedHeader {
+	return fh
+}
+
+// setHeader 设置固定头部, 用于解码时设置池中取出的报文
+func (fh *FixedHeader) setHeader(h FixedHeader) {
+	*fh = h
+}
+
+// ValidFlags 标志位是否符合报文类型的规定
+// PUBREL, SUBSCRIBE 和 UNSUBSCRIBE 必须为0010, PUBLISH 的QoS不能为3, 其他报文必须为0000
+func (fh FixedHeader) ValidFlags() bool {
+	switch fh.PacketType {
+	case PUBLISH:
+		return fh.Qos < 3
+	case PUBREL, SUBSCRIBE, UNSUBSCRIBE:
+		return !fh.Dup && fh.Qos == 1 && !fh.Retain
+	}
+	return !fh.Dup && fh.Qos == 0 && !fh.Retain
+}
+
 // pack 打包固定头部
 func (fh *FixedHeader) pack() bytes.Buffer {
 	var header bytes.Buffer
@@ -79,21 +102,21 @@ func (fh *FixedHeader) pack() bytes.Buffer {
 }
 
 // unpack 打开固定头部
+// 第一个字节之前结束返回 io.EOF, 之后结束返回 io.ErrUnexpectedEOF
 func (fh *FixedHeader) unpack(r io.Reader) error {
-	b := make([]byte, 1)
-	_, err := r.Read(b)
+	b, err := decodeByte(r)
 	if err != nil {
 		return err
 	}
 
-	fh.PacketType = b[0] >> 4
-	fh.Dup = (b[0]>>3)&0x01 > 0
-	fh.Qos = (b[0] >> 1) & 0x03
-	fh.Retain = b[0]&0x01 > 0
+	fh.PacketType = b >> 4
+	fh.Dup = (b>>3)&0x01 > 0
+	fh.Qos = (b >> 1) & 0x03
+	fh.Retain = b&0x01 > 0
 
 	fh.RemainingLength, err = decodeRemainingLength(r)
 
-	return err
+	return unexpectedEOF(err)
 }
 
 // ControlPacket 控制报文接口
@@ -103,38 +126,101 @@ type ControlPacket interface {
 	String() string
 }
 
+// headerPacket 嵌入了 FixedHeader 的报文, 本包的报文类型都是
+type headerPacket interface {
+	Header() FixedHeader
+}
+
+// HeaderOf 返回报文的固定头部, 没有嵌入 FixedHeader 的 ControlPacket 实现返回零值
+func HeaderOf(pk ControlPacket) FixedHeader {
+	if h, ok := pk.(headerPacket); ok {
+		return h.Header()
+	}
+	return FixedHeader{}
+}
+
 // ReadPacket 读包
 func ReadPacket(r io.Reader) (ControlPacket, error) {
+	return readPacket(r, false)
+}
+
+// readPacket 读包, pooled 为true时报文从池中取出
+func readPacket(r io.Reader, pooled bool) (ControlPacket, error) {
 	var fh FixedHeader
 
 	err := fh.unpack(r)
 	if err != nil {
 		return nil, err
 	}
+	return readPacketBody(r, fh, pooled)
+}
 
-	packet, err := NewControlPacketWithHeader(fh)
-	if err != nil {
+// readPacketBody 读取固定头部之后的报文内容
+func readPacketBody(r io.Reader, fh FixedHeader, pooled bool) (ControlPacket, error) {
+	var packet ControlPacket
+	var err error
+	if pooled {
+		packet = AcquirePacket(fh.PacketType)
+	}
+	if packet != nil {
+		packet.(interface{ setHeader(FixedHeader) }).setHeader(fh)
+	} else if packet, err = NewControlPacketWithHeader(fh); err != nil {
 		return nil, err
 	}
 
-	// 验证数据是否正常
-	if fh.RemainingLength > 0 {
-		packetBytes := make([]byte, fh.RemainingLength)
-		n, err := io.ReadFull(r, packetBytes)
-		if err != nil {
-			return nil, err
-		}
-		if n != fh.RemainingLength {
-			return nil, fmt.Errorf("Failed to read expected data")
+	// 读取缓冲区来自池, 各报文的 Unpack 会复制需要保留的数据
+	// 剩余长度为0时也要解包, 缺少必需字段的报文(如空的PUBLISH)返回错误
+	buf := AcquireBuffer()
+	defer ReleaseBuffer(buf)
+	if fh.RemainingLength <= bodyChunk {
+		buf.Grow(fh.RemainingLength)
+	}
+	body, err := readBody(buf.AvailableBuffer(), r, fh.RemainingLength)
+	if err == nil {
+		buf.Write(body)
+		err = unexpectedEOF(packet.Unpack(buf))
+	}
+	if err != nil {
+		if pooled {
+			ReleasePacket(packet)
 		}
+		return nil, err
+	}
+
+	return packet, nil
+}
 
-		err = packet.Unpack(bytes.NewBuffer(packetBytes))
+// bodyChunk 剩余长度超过该值时随读取的数据逐步分配内存
+// 剩余长度最大为256MB, 一次分配会让几个字节的伪造报文占用大量内存
+const bodyChunk = 64 * 1024
+
+// readBody 读取 n 字节追加到 dst 后返回, dst 的容量足够时不分配内存
+func readBody(dst []byte, r io.Reader, n int) ([]byte, error) {
+	// 数据已经全部在内存中(如解包时的 bytes.Buffer)时可以一次分配
+	if l, ok := r.(interface{ Len() int }); n <= bodyChunk || ok && l.Len() >= n || cap(dst)-len(dst) >= n {
+		dst = slices.Grow(dst, n)
+		_, err := io.ReadFull(r, dst[len(dst):len(dst)+n])
+		return dst[:len(dst)+n], unexpectedEOF(err)
+	}
+	for n > 0 {
+		chunk := min(n, bodyChunk)
+		dst = slices.Grow(dst, chunk)
+		m, err := io.ReadFull(r, dst[len(dst):len(dst)+chunk])
+		dst = dst[:len(dst)+m]
 		if err != nil {
-			return nil, err
+			return dst, unexpectedEOF(err)
 		}
+		n -= chunk
 	}
+	return dst, nil
+}
 
-	return packet, nil
+// unexpectedEOF 报文读到一半结束时返回 io.ErrUnexpectedEOF, 与报文之间的正常结束区分
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 // NewControlPacket 新建控制报文
@@ -212,10 +298,13 @@ func byteToBool(b byte) bool {
 	}
 }
 
-// decodeByte 从Reader读取一个字节
+// decodeByte 从Reader读取一个字节, r 实现了 io.ByteReader 时不分配内存
 func decodeByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
 	num := make([]byte, 1)
-	_, err := r.Read(num)
+	_, err := io.ReadFull(r, num)
 	if err != nil {
 		return 0, err
 	}
@@ -239,8 +328,11 @@ func decodeBytes(r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	// 再根据长度读取内容
+	if buf, ok := r.(*bytes.Buffer); ok && buf.Len() < int(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
 	value := make([]byte, length)
-	_, err = r.Read(value)
+	_, err = io.ReadFull(r, value)
 	if err != nil {
 		return nil, err
 	}
@@ -256,8 +348,19 @@ func encodeUint16(value uint16) []byte {
 
 // decodeUint16 从Reader读出uint16的数字
 func decodeUint16(r io.Reader) (uint16, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		hi, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		lo, err := br.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		return uint16(hi)<<8 | uint16(lo), nil
+	}
 	bytes := make([]byte, 2)
-	_, err := r.Read(bytes)
+	_, err := io.ReadFull(r, bytes)
 	if err != nil {
 		return 0, err
 	}
@@ -272,6 +375,17 @@ func encodeString(value string) []byte {
 // decodeString 从Reader读出字符串内容
 // 字符串的编码规则是: 前两字节为字符串长度
 func decodeString(r io.Reader) (string, error) {
+	// 解包时 r 为 bytes.Buffer, 直接转换成字符串, 少一次分配
+	if buf, ok := r.(*bytes.Buffer); ok {
+		length, err := decodeUint16(r)
+		if err != nil {
+			return "", err
+		}
+		if buf.Len() < int(length) {
+			return "", io.ErrUnexpectedEOF
+		}
+		return string(buf.Next(int(length))), nil
+	}
 	value, err := decodeBytes(r)
 	return string(value), err
 }
@@ -299,16 +413,14 @@ func encodeRemainingLength(length int) []byte {
 
 // decodeRemainingLength 解码剩余长度
 func decodeRemainingLength(r io.Reader) (int, error) {
-	b := make([]byte, 1)
 	multiplier := 1
 	value := 0
 	for {
-		_, err := io.ReadFull(r, b)
+		digit, err := decodeByte(r)
 		if err != nil {
 			return 0, err
 		}
 
-		digit := b[0]
 		value += int(digit&127) * multiplier
 		multiplier *= 128
 		if (digit & 128) == 0 {
@@ -125,3 +125,61 @@ func TestDecodeRemainingLength(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/#", "sport", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"+/+", "/finance", true},
+		{"+", "/finance", false},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/monitor/Clients", "$SYS/monitor/Clients", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$share/group/sport/+", "sport/tennis", true},
+		{"$share/group/sport/+", "sport/tennis/player1", false},
+	}
+	for _, c := range cases {
+		if res := MatchTopic(c.filter, c.topic); res != c.match {
+			t.Errorf("MatchTopic(%q, %q) returned %t, should be %t", c.filter, c.topic, res, c.match)
+		}
+	}
+}
+
+func TestParseSharedFilter(t *testing.T) {
+	group, filter, ok := ParseSharedFilter("$share/workers/jobs/#")
+	if !ok || group != "workers" || filter != "jobs/#" {
+		t.Errorf("ParseSharedFilter did not return (workers, jobs/#, true) but (%s, %s, %t)", group, filter, ok)
+	}
+	for _, topic := range []string{"jobs/#", "$share/workers", "$share//jobs", "$share/wor+kers/jobs", "$share/workers/"} {
+		if _, _, ok := ParseSharedFilter(topic); ok {
+			t.Errorf("ParseSharedFilter(%q) should not be a shared subscription", topic)
+		}
+	}
+
+	valid := map[string]bool{
+		"sport/tennis/#":        true,
+		"sport/tennis#":         false,
+		"sport/tennis/#/rank":   false,
+		"sport/+/player1":       true,
+		"sport+":                false,
+		"":                      false,
+		"$share/workers/jobs/+": true,
+		"$share/workers":        false,
+	}
+	for filter, res := range valid {
+		if ValidTopicFilter(filter) != res {
+			t.Errorf("ValidTopicFilter(%q) should return %t", filter, res)
+		}
+	}
+	if ValidTopicName("sport/+") || !ValidTopicName("sport/tennis") {
+		t.Errorf("ValidTopicName did not reject wildcards")
+	}
+}
@@ -3,6 +3,7 @@ package packets
 import (
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // PingrespPacket 心跳响应包
@@ -19,6 +20,7 @@ func (p *PingrespPacket) String() string {
 // Write 写入
 func (p *PingrespPacket) Write(w io.Writer) error {
 	var err error
+	p.FixedHeader.RemainingLength = 0
 	packet := p.FixedHeader.pack()
 	_, err = packet.WriteTo(w)
 
@@ -29,3 +31,23 @@ func (p *PingrespPacket) Write(w io.Writer) error {
 func (p *PingrespPacket) Unpack(r io.Reader) error {
 	return nil
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *PingrespPacket) Reset() {
+	*p = PingrespPacket{FixedHeader: FixedHeader{PacketType: PINGRESP}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *PingrespPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *PingrespPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *PingrespPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, PINGRESP)
+}
@@ -0,0 +1,79 @@
+package packets
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// 报文和缓冲区的对象池
+// ReadPacket 的读取缓冲区总是来自池, 报文结构体和有效负载需要调用方通过 ReadPacketPooled 和 ReleasePacket 显式复用
+//
+// 切片字段的所有权:
+// ReleasePacket 之后报文归池所有, 调用方不能再使用报文, 也不能再使用从报文取出的切片(Payload, Topics 等)
+// 这些切片的底层数组会在下一次 ReadPacketPooled 时被覆盖, 需要在释放之后保留的数据要先复制
+// 调用方赋给池中报文的切片同样会被复用和覆盖
+// 例如服务端把同一个有效负载投递给多个订阅者时, 所有投递完成之前不能释放收到的报文
+
+// maxPooled 容量超过该值的缓冲区和有效负载不放回池中, 避免偶尔的大报文长期占用内存
+const maxPooled = 64 * 1024
+
+// packetPools 每种报文类型一个池
+var packetPools [DISCONNECT + 1]sync.Pool
+
+// pooledTypes 每个池中报文的具体类型, 其他 ControlPacket 实现不放回池中
+var pooledTypes [DISCONNECT + 1]reflect.Type
+
+// bufferPool 字节缓冲区池
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func init() {
+	for i := CONNECT; i <= DISCONNECT; i++ {
+		packetType := byte(i)
+		packetPools[i].New = func() interface{} { return NewControlPacket(packetType) }
+		pooledTypes[i] = reflect.TypeOf(NewControlPacket(packetType))
+	}
+}
+
+// AcquirePacket 从池中取出 packetType 类型的报文, 字段与 NewControlPacket 相同, 类型无效时返回nil
+func AcquirePacket(packetType byte) ControlPacket {
+	if packetType < CONNECT || packetType > DISCONNECT {
+		return nil
+	}
+	return packetPools[packetType].Get().(ControlPacket)
+}
+
+// ReleasePacket 清空报文并放回池中, 之后不能再使用报文和它的切片字段
+// 不是本包报文类型的 ControlPacket 实现被忽略
+func ReleasePacket(pk ControlPacket) {
+	packetType := HeaderOf(pk).PacketType
+	if packetType < CONNECT || packetType > DISCONNECT || reflect.TypeOf(pk) != pooledTypes[packetType] {
+		return
+	}
+	pk.(interface{ Reset() }).Reset()
+	if p, ok := pk.(*PublishPacket); ok && cap(p.Payload) > maxPooled {
+		p.Payload = nil
+	}
+	packetPools[packetType].Put(pk)
+}
+
+// ReadPacketPooled 与 ReadPacket 相同, 但报文从池中取出, 有效负载复用报文上次使用时的内存
+// 用完后调用 ReleasePacket, 见上面关于所有权的说明
+func ReadPacketPooled(r io.Reader) (ControlPacket, error) {
+	return readPacket(r, true)
+}
+
+// AcquireBuffer 从池中取出一个空的缓冲区
+func AcquireBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// ReleaseBuffer 清空缓冲区并放回池中, 之后不能再使用缓冲区和 Bytes() 返回的切片
+func ReleaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooled {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,160 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for packetType := byte(CONNECT); packetType <= DISCONNECT; packetType++ {
+		pk := randPacket(r, packetType)
+		pk.Write(io.Discard)
+		pk.(interface{ Reset() }).Reset()
+		if diff := diffFields(NewControlPacket(packetType), pk); len(diff) > 0 {
+			t.Errorf("Reset %s:\n  %s", PacketNames[packetType], strings.Join(diff, "\n  "))
+		}
+	}
+}
+
+func TestReadPacketPooled(t *testing.T) {
+	// 反复从池中取出同一批报文, 上一次解码留下的字段不能影响下一次
+	r := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		pk := randPacket(r, byte(CONNECT+r.Intn(DISCONNECT)))
+		buf.Reset()
+		pk.Write(&buf)
+		read, err := ReadPacketPooled(&buf)
+		if err != nil {
+			t.Fatalf("ReadPacketPooled(%v): %v", pk, err)
+		}
+		if diff := diffFields(pk, read); len(diff) > 0 {
+			t.Fatalf("pooled %s differs:\n  %s", PacketNames[HeaderOf(pk).PacketType], strings.Join(diff, "\n  "))
+		}
+		ReleasePacket(read)
+	}
+	if _, err := ReadPacketPooled(bytes.NewReader([]byte{0x30, 0x05, 0x00})); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated packet returned %v", err)
+	}
+	if AcquirePacket(0) != nil || AcquirePacket(15) != nil {
+		t.Errorf("AcquirePacket returned a packet for an invalid type")
+	}
+}
+
+// externalPacket 包外的 ControlPacket 实现, 没有 Header 方法
+type externalPacket struct{}
+
+func (externalPacket) Write(io.Writer) error  { return nil }
+func (externalPacket) Unpack(io.Reader) error { return nil }
+func (externalPacket) String() string         { return "external" }
+
+func TestExternalPacket(t *testing.T) {
+	var pk ControlPacket = externalPacket{}
+	if fh := HeaderOf(pk); fh != (FixedHeader{}) {
+		t.Errorf("HeaderOf(external) = %v", fh)
+	}
+	// 不是本包的报文类型, 不能放进池中
+	ReleasePacket(pk)
+	pub := &struct{ PublishPacket }{}
+	pub.PacketType = PUBLISH
+	ReleasePacket(pub)
+	for i := 0; i < 10; i++ {
+		if _, ok := AcquirePacket(PUBLISH).(*PublishPacket); !ok {
+			t.Fatal("AcquirePacket(PUBLISH) returned a foreign type")
+		}
+	}
+}
+
+func TestReleaseBuffer(t *testing.T) {
+	buf := AcquireBuffer()
+	buf.WriteString("data")
+	ReleaseBuffer(buf)
+	if buf = AcquireBuffer(); buf.Len() != 0 {
+		t.Errorf("acquired buffer contains %q", buf.Bytes())
+	}
+	ReleaseBuffer(buf)
+}
+
+// benchmarkPublish 编码后的PUBLISH报文流
+func benchmarkPublish(n, size int) []byte {
+	pk := NewControlPacket(PUBLISH).(*PublishPacket)
+	pk.TopicName, pk.Qos, pk.PacketID = "sensors/42/temperature", 1, 1
+	pk.Payload = bytes.Repeat([]byte{'x'}, size)
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		pk.Write(&buf)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	for _, size := range []int{64, 1024, 16 * 1024} {
+		data := benchmarkPublish(1000, size)
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data) / 1000))
+			r := bytes.NewReader(data)
+			for i := 0; i < b.N; i++ {
+				if r.Len() == 0 {
+					r.Reset(data)
+				}
+				if _, err := ReadPacket(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadPacketPooled(b *testing.B) {
+	for _, size := range []int{64, 1024, 16 * 1024} {
+		data := benchmarkPublish(1000, size)
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data) / 1000))
+			r := bytes.NewReader(data)
+			for i := 0; i < b.N; i++ {
+				if r.Len() == 0 {
+					r.Reset(data)
+				}
+				pk, err := ReadPacketPooled(r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ReleasePacket(pk)
+			}
+		})
+	}
+}
+
+func BenchmarkReadPacketPooledParallel(b *testing.B) {
+	data := benchmarkPublish(1000, 1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data) / 1000))
+	b.RunParallel(func(pb *testing.PB) {
+		r := bytes.NewReader(data)
+		for pb.Next() {
+			if r.Len() == 0 {
+				r.Reset(data)
+			}
+			pk, err := ReadPacketPooled(r)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ReleasePacket(pk)
+		}
+	})
+}
+
+// byteSize 子基准测试的名称
+func byteSize(n int) string {
+	if n >= 1024 {
+		return fmt.Sprintf("%dKB", n/1024)
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // PubackPacket 发布消息确认包
@@ -41,3 +42,23 @@ func (p *PubackPacket) Unpack(r io.Reader) error {
 	p.PacketID, err = decodeUint16(r)
 	return err
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *PubackPacket) Reset() {
+	*p = PubackPacket{FixedHeader: FixedHeader{PacketType: PUBACK}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *PubackPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *PubackPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *PubackPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, PUBACK)
+}
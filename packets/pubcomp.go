@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // PubcompPacket 发布完成包
@@ -41,3 +42,23 @@ func (p *PubcompPacket) Unpack(r io.Reader) error {
 	p.PacketID, err = decodeUint16(r)
 	return err
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *PubcompPacket) Reset() {
+	*p = PubcompPacket{FixedHeader: FixedHeader{PacketType: PUBCOMP}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *PubcompPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *PubcompPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *PubcompPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, PUBCOMP)
+}
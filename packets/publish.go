@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // PublishPacket 发布消息包
@@ -20,7 +21,7 @@ func (p *PublishPacket) String() string {
 	str += " "
 	str += fmt.Sprintf("topicName: %s PacketID: %d", p.TopicName, p.PacketID)
 	str += " "
-	str += fmt.Sprintf("payload: %s", string(p.Payload))
+	str += fmt.Sprintf("payload: %s", LogFormat.bytesString(p.Payload))
 	return str
 }
 
@@ -44,27 +45,56 @@ func (p *PublishPacket) Write(w io.Writer) error {
 
 // Unpack 解包
 func (p *PublishPacket) Unpack(r io.Reader) error {
+	payloadLength, err := p.unpackHeader(r)
+	if err != nil {
+		return err
+	}
+	// 复用池中报文原有的有效负载内存
+	p.Payload, err = readBody(p.Payload[:0], r, payloadLength)
+
+	return err
+}
+
+// unpackHeader 解包可变头部, 返回有效负载的长度
+func (p *PublishPacket) unpackHeader(r io.Reader) (int, error) {
 	var payloadLength = p.FixedHeader.RemainingLength
 	var err error
 
 	p.TopicName, err = decodeString(r)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if p.Qos > 0 {
 		p.PacketID, err = decodeUint16(r)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		payloadLength -= len(p.TopicName) + 4
 	} else {
 		payloadLength -= len(p.TopicName) + 2
 	}
 	if payloadLength < 0 {
-		return fmt.Errorf("Error unpacking publish, payload length < 0")
+		return 0, fmt.Errorf("Error unpacking publish, payload length < 0")
 	}
-	p.Payload = make([]byte, payloadLength)
-	_, err = r.Read(p.Payload)
+	return payloadLength, nil
+}
 
-	return err
+// Reset 恢复为 NewControlPacket 返回的状态, 保留切片的容量供下一次解码复用
+func (p *PublishPacket) Reset() {
+	*p = PublishPacket{FixedHeader: FixedHeader{PacketType: PUBLISH}, Payload: p.Payload[:0]}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *PublishPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *PublishPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *PublishPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, PUBLISH)
 }
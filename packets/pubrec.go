@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // PubrecPacket 发布收到确认包
@@ -41,3 +42,23 @@ func (p *PubrecPacket) Unpack(r io.Reader) error {
 	p.PacketID, err = decodeUint16(r)
 	return err
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *PubrecPacket) Reset() {
+	*p = PubrecPacket{FixedHeader: FixedHeader{PacketType: PUBREC}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *PubrecPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *PubrecPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *PubrecPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, PUBREC)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // PubrelPacket 发布释放包
@@ -41,3 +42,23 @@ func (p *PubrelPacket) Unpack(r io.Reader) error {
 	p.PacketID, err = decodeUint16(r)
 	return err
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *PubrelPacket) Reset() {
+	*p = PubrelPacket{FixedHeader: FixedHeader{PacketType: PUBREL, Qos: 1}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *PubrelPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *PubrelPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *PubrelPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, PUBREL)
+}
@@ -0,0 +1,239 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// 随机字符串使用的字符, 包括多字节的UTF-8字符
+var runes = []rune("abcxyz019-_. äöü中文テスト€\U0001F600")
+
+// randString 随机字符串, 长度为 0 到 max 个字符
+func randString(r *rand.Rand, max int) string {
+	var sb strings.Builder
+	for i := r.Intn(max + 1); i > 0; i-- {
+		sb.WriteRune(runes[r.Intn(len(runes))])
+	}
+	return sb.String()
+}
+
+// randBytes 随机字节, 长度为 0 到 max
+func randBytes(r *rand.Rand, max int) []byte {
+	b := make([]byte, r.Intn(max+1))
+	r.Read(b)
+	return b
+}
+
+// randPayload 随机有效负载, 偶尔超过 bodyChunk 以覆盖逐步分配的读取路径
+func randPayload(r *rand.Rand) []byte {
+	if r.Intn(50) == 0 {
+		return randBytes(r, 2*bodyChunk)
+	}
+	return randBytes(r, 256)
+}
+
+// randTopic 随机主题名, 不含通配符
+func randTopic(r *rand.Rand) string {
+	levels := make([]string, 1+r.Intn(4))
+	for i := range levels {
+		levels[i] = randString(r, 8)
+	}
+	if topic := strings.Join(levels, "/"); topic != "" {
+		return topic
+	}
+	return "t"
+}
+
+// randFilter 随机主题过滤器, 可能包含 + 和 #
+func randFilter(r *rand.Rand) string {
+	levels := strings.Split(randTopic(r), "/")
+	for i := range levels {
+		if r.Intn(4) == 0 {
+			levels[i] = "+"
+		}
+	}
+	if r.Intn(4) == 0 {
+		levels = append(levels, "#")
+	}
+	return strings.Join(levels, "/")
+}
+
+// randID 非0的报文标识符
+func randID(r *rand.Rand) uint16 {
+	return uint16(1 + r.Intn(65535))
+}
+
+// randPacket 生成 packetType 类型的随机合法报文
+func randPacket(r *rand.Rand, packetType byte) ControlPacket {
+	pk := NewControlPacket(packetType)
+	switch p := pk.(type) {
+	case *ConnectPacket:
+		p.ProtocolName, p.ProtocolLevel = "MQTT", 4
+		if r.Intn(4) == 0 {
+			p.ProtocolLevel |= BridgeFlag
+		}
+		p.CleanSession = r.Intn(2) == 0
+		p.KeepAlive = uint16(r.Intn(65536))
+		p.ClientIdentifier = randString(r, 23)
+		if p.ClientIdentifier == "" {
+			p.CleanSession = true
+		}
+		if p.WillFlag = r.Intn(2) == 0; p.WillFlag {
+			p.WillTopic, p.WillMessage = randTopic(r), randBytes(r, 256)
+			p.WillQos, p.WillRetain = byte(r.Intn(3)), r.Intn(2) == 0
+		}
+		if p.UsernameFlag = r.Intn(2) == 0; p.UsernameFlag {
+			p.Username = randString(r, 16)
+			if p.PasswordFlag = r.Intn(2) == 0; p.PasswordFlag {
+				p.Password = randBytes(r, 64)
+			}
+		}
+	case *ConnackPacket:
+		p.ReturnCode = byte(r.Intn(6))
+		p.SessionPresent = p.ReturnCode == Accepted && r.Intn(2) == 0
+	case *PublishPacket:
+		p.Qos, p.Retain = byte(r.Intn(3)), r.Intn(2) == 0
+		p.TopicName, p.Payload = randTopic(r), randPayload(r)
+		if p.Qos > 0 {
+			p.Dup, p.PacketID = r.Intn(2) == 0, randID(r)
+		}
+	case *PubackPacket:
+		p.PacketID = randID(r)
+	case *PubrecPacket:
+		p.PacketID = randID(r)
+	case *PubrelPacket:
+		p.PacketID = randID(r)
+	case *PubcompPacket:
+		p.PacketID = randID(r)
+	case *SubscribePacket:
+		p.PacketID = randID(r)
+		for i := r.Intn(5); i >= 0; i-- {
+			p.Topics = append(p.Topics, randFilter(r))
+			p.Qoss = append(p.Qoss, byte(r.Intn(3)))
+		}
+	case *SubackPacket:
+		p.PacketID = randID(r)
+		for i := r.Intn(5); i >= 0; i-- {
+			p.ReturnCodes = append(p.ReturnCodes, []byte{0, 1, 2, 0x80}[r.Intn(4)])
+		}
+	case *UnsubscribePacket:
+		p.PacketID = randID(r)
+		for i := r.Intn(5); i >= 0; i-- {
+			p.Topics = append(p.Topics, randFilter(r))
+		}
+	case *UnsubackPacket:
+		p.PacketID = randID(r)
+	}
+	return pk
+}
+
+// diffFields 逐个字段比较两个报文, 返回不同的字段名, 空切片与nil视为相同
+func diffFields(a, b ControlPacket) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	if va.Type() != vb.Type() {
+		return []string{fmt.Sprintf("type %s != %s", va.Type(), vb.Type())}
+	}
+	var diff []string
+	for i := 0; i < va.NumField(); i++ {
+		fa, fb := va.Field(i), vb.Field(i)
+		if fa.Kind() == reflect.Slice && fa.Len() == 0 && fb.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			diff = append(diff, fmt.Sprintf("%s: %v != %v", va.Type().Field(i).Name, fa.Interface(), fb.Interface()))
+		}
+	}
+	return diff
+}
+
+// roundTrip 编码 pk 后重新解码, 解码结果的每个字段都必须与 pk 相同, 且正好读完编码的字节
+func roundTrip(pk ControlPacket) error {
+	var buf bytes.Buffer
+	if err := pk.Write(&buf); err != nil {
+		return fmt.Errorf("Write: %v", err)
+	}
+	encoded := append([]byte(nil), buf.Bytes()[:min(buf.Len(), 64)]...)
+	read, err := ReadPacket(&buf)
+	if err != nil {
+		return fmt.Errorf("ReadPacket(% x): %v", encoded, err)
+	}
+	if buf.Len() != 0 {
+		return fmt.Errorf("ReadPacket(% x) left %d bytes", encoded, buf.Len())
+	}
+	if diff := diffFields(pk, read); len(diff) > 0 {
+		return fmt.Errorf("decoded %s differs from the original:\n  %s", PacketNames[HeaderOf(pk).PacketType], strings.Join(diff, "\n  "))
+	}
+	return nil
+}
+
+func TestRoundTripProperty(t *testing.T) {
+	for packetType := byte(CONNECT); packetType <= DISCONNECT; packetType++ {
+		packetType := packetType
+		t.Run(PacketNames[packetType], func(t *testing.T) {
+			property := func(seed int64) bool {
+				pk := randPacket(rand.New(rand.NewSource(seed)), packetType)
+				if !HeaderOf(pk).ValidFlags() {
+					t.Errorf("seed %d: generated %s has invalid flags", seed, PacketNames[packetType])
+					return false
+				}
+				if cp, ok := pk.(*ConnectPacket); ok && cp.Validate() != Accepted {
+					t.Errorf("seed %d: generated CONNECT is invalid: 0x%02x", seed, cp.Validate())
+					return false
+				}
+				if err := roundTrip(pk); err != nil {
+					t.Errorf("seed %d: %v", seed, err)
+					return false
+				}
+				return true
+			}
+			if err := quick.Check(property, &quick.Config{MaxCount: 300}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestReadPacketMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated fixed header":      {0x30},
+		"remaining length too long":   {0x30, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"truncated body":              {0x30, 0x05, 0x00, 0x05, 'a'},
+		"huge remaining length":       {0x30, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x01, 'a'},
+		"empty PUBLISH":               {0x30, 0x00},
+		"short topic":                 {0x30, 0x03, 0x00, 0x05, 'a'},
+		"QoS 1 PUBLISH without ID":    {0x32, 0x03, 0x00, 0x01, 'a'},
+		"PUBACK with one byte":        {0x40, 0x01, 0x00},
+		"SUBSCRIBE without QoS":       {0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'},
+		"CONNECT with short password": {0x10, 0x0f, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xc2, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		"unknown packet type":         {0xf0, 0x00},
+	}
+	for name, data := range cases {
+		if pk, err := ReadPacket(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: ReadPacket(% x) returned %v", name, data, pk)
+		}
+	}
+	if _, err := ReadPacket(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("ReadPacket of empty input returned %v, should be io.EOF", err)
+	}
+	if _, err := ReadPacket(bytes.NewReader([]byte{0x30, 0x05, 0x00})); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadPacket of a truncated packet returned %v, should be io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestUnsubscribeTopics(t *testing.T) {
+	// 每个主题过滤器之后没有QoS字节, 4个过滤器都要解码, 空过滤器也要保留给服务端判断
+	data := []byte{0xa2, 0x0f, 0x00, 0x07, 0x00, 0x01, 'a', 0x00, 0x01, 'b', 0x00, 0x00, 0x00, 0x01, 'c', 0x00, 0x00}
+	pk, err := ReadPacket(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := pk.(*UnsubscribePacket).Topics; !reflect.DeepEqual(topics, []string{"a", "b", "", "c", ""}) {
+		t.Errorf("UNSUBSCRIBE topics %q", topics)
+	}
+}
@@ -0,0 +1,113 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 流式读写PUBLISH报文, 有效负载不在内存中缓存, 用于固件等大文件
+// 剩余长度最大为256MB, 减去主题和报文标识符之后就是有效负载的上限
+
+// MaxRemainingLength 剩余长度的最大值
+const MaxRemainingLength = 268435455
+
+// ErrPayloadNotConsumed 上一个报文的有效负载没有读完
+var ErrPayloadNotConsumed = errors.New("packets: previous payload not consumed")
+
+// WriteStream 写入PUBLISH报文, 有效负载从 payload 读取 size 字节, 忽略 p.Payload
+// payload 不足 size 字节时返回 io.ErrUnexpectedEOF, 此时已写出的报文不完整, 连接不能继续使用
+func (p *PublishPacket) WriteStream(w io.Writer, payload io.Reader, size int) error {
+	header := encodeString(p.TopicName)
+	if p.Qos > 0 {
+		header = append(header, encodeUint16(p.PacketID)...)
+	}
+	if size < 0 || size > MaxRemainingLength-len(header) {
+		return fmt.Errorf("packets: payload size %d out of range", size)
+	}
+	p.FixedHeader.RemainingLength = len(header) + size
+	packet := p.FixedHeader.pack()
+	packet.Write(header)
+	if _, err := packet.WriteTo(w); err != nil {
+		return err
+	}
+
+	n, err := io.CopyN(w, payload, int64(size))
+	if err == io.EOF && n < int64(size) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// PayloadReader 流式读取的有效负载, 最多读出剩余的有效负载字节数
+type PayloadReader struct {
+	r io.Reader
+	n int
+}
+
+// Read 读取有效负载, 读完之后返回 io.EOF, 连接提前结束返回 io.ErrUnexpectedEOF
+func (pr *PayloadReader) Read(b []byte) (int, error) {
+	if pr.n <= 0 {
+		return 0, io.EOF
+	}
+	if len(b) > pr.n {
+		b = b[:pr.n]
+	}
+	n, err := pr.r.Read(b)
+	pr.n -= n
+	if err == io.EOF && pr.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Len 还没有读取的有效负载字节数
+func (pr *PayloadReader) Len() int {
+	return pr.n
+}
+
+// Discard 丢弃剩余的有效负载, 之后才能读取下一个报文
+func (pr *PayloadReader) Discard() error {
+	_, err := io.Copy(io.Discard, pr)
+	return err
+}
+
+// StreamReader 从连接中依次读取报文, PUBLISH的有效负载以 PayloadReader 的形式返回
+type StreamReader struct {
+	r       io.Reader
+	payload *PayloadReader
+}
+
+// NewStreamReader 新建 StreamReader
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{r: r}
+}
+
+// ReadPacket 读取下一个报文
+// 报文是PUBLISH时 Payload 为空, 有效负载由返回的 PayloadReader 读取,
+// 必须读完或调用 Discard 之后才能读取下一个报文, 否则返回 ErrPayloadNotConsumed
+// 其他报文与 ReadPacket 相同, 返回的 PayloadReader 为nil
+func (s *StreamReader) ReadPacket() (ControlPacket, *PayloadReader, error) {
+	if s.payload != nil && s.payload.n > 0 {
+		return nil, nil, ErrPayloadNotConsumed
+	}
+	s.payload = nil
+
+	var fh FixedHeader
+	if err := fh.unpack(s.r); err != nil {
+		return nil, nil, err
+	}
+	if fh.PacketType != PUBLISH {
+		packet, err := readPacketBody(s.r, fh, false)
+		return packet, nil, err
+	}
+
+	// 可变头部不能超出剩余长度, 否则会读到下一个报文
+	p := &PublishPacket{FixedHeader: fh}
+	payloadLength, err := p.unpackHeader(io.LimitReader(s.r, int64(fh.RemainingLength)))
+	if err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	s.payload = &PayloadReader{r: s.r, n: payloadLength}
+	return p, s.payload, nil
+}
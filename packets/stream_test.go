@@ -0,0 +1,102 @@
+package packets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	const size = 8 << 20
+	payload := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	var buf bytes.Buffer
+	pub := NewControlPacket(PUBLISH).(*PublishPacket)
+	pub.TopicName, pub.Qos, pub.PacketID = "firmware/image", 1, 9
+	if err := pub.WriteStream(&buf, bytes.NewReader(payload), size); err != nil {
+		t.Fatal(err)
+	}
+	NewControlPacket(PINGREQ).Write(&buf)
+	data := buf.Bytes()
+
+	// 与 ReadPacket 读出的报文一致
+	pk, err := ReadPacket(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read := pk.(*PublishPacket); read.PacketID != 9 || !bytes.Equal(read.Payload, payload) {
+		t.Fatalf("ReadPacket returned %v", pk)
+	}
+
+	s := NewStreamReader(bytes.NewReader(data))
+	pk, pr, err := s.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read := pk.(*PublishPacket); read.TopicName != "firmware/image" || read.PacketID != 9 || read.Payload != nil || pr.Len() != size {
+		t.Fatalf("StreamReader returned %v, %d payload bytes", pk, pr.Len())
+	}
+	if _, _, err := s.ReadPacket(); err != ErrPayloadNotConsumed {
+		t.Fatalf("ReadPacket before the payload was read returned %v", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, pr); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(payload); !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Fatal("streamed payload differs")
+	}
+	if pk, pr, err = s.ReadPacket(); err != nil || HeaderOf(pk).PacketType != PINGREQ || pr != nil {
+		t.Fatalf("ReadPacket after the payload returned %v, %v, %v", pk, pr, err)
+	}
+}
+
+func TestStreamDiscard(t *testing.T) {
+	var buf bytes.Buffer
+	pub := NewControlPacket(PUBLISH).(*PublishPacket)
+	pub.TopicName = "a"
+	pub.WriteStream(&buf, strings.NewReader("skipped"), 7)
+	NewControlPacket(PINGRESP).Write(&buf)
+
+	s := NewStreamReader(&buf)
+	_, pr, err := s.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if pk, _, err := s.ReadPacket(); err != nil || HeaderOf(pk).PacketType != PINGRESP {
+		t.Fatalf("ReadPacket after Discard returned %v, %v", pk, err)
+	}
+}
+
+func TestStreamShort(t *testing.T) {
+	pub := NewControlPacket(PUBLISH).(*PublishPacket)
+	pub.TopicName = "a"
+	if err := pub.WriteStream(io.Discard, strings.NewReader("short"), 10); err != io.ErrUnexpectedEOF {
+		t.Errorf("WriteStream of a short reader returned %v", err)
+	}
+	if err := pub.WriteStream(io.Discard, strings.NewReader(""), MaxRemainingLength); err == nil {
+		t.Errorf("WriteStream accepted a payload over the remaining length limit")
+	}
+
+	// 连接在有效负载中间断开
+	var buf bytes.Buffer
+	pub.WriteStream(&buf, strings.NewReader("0123456789"), 10)
+	_, pr, err := NewStreamReader(bytes.NewReader(buf.Bytes()[:buf.Len()-4])).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(pr); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading a truncated payload returned %v", err)
+	}
+	// 主题长度超出剩余长度
+	if _, _, err := NewStreamReader(bytes.NewReader([]byte{0x30, 0x03, 0x00, 0x05, 'a', 'b', 'c', 'd', 'e'})).ReadPacket(); err != io.ErrUnexpectedEOF {
+		t.Errorf("topic beyond the remaining length returned %v", err)
+	}
+}
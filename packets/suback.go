@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // SubackPacket 客户端订阅确认包
@@ -54,3 +55,23 @@ func (p *SubackPacket) Unpack(r io.Reader) error {
 
 	return nil
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态
+func (p *SubackPacket) Reset() {
+	*p = SubackPacket{FixedHeader: FixedHeader{PacketType: SUBACK}}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *SubackPacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *SubackPacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *SubackPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, SUBACK)
+}
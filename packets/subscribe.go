@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // SubscribePacket 客户端订阅包
@@ -65,3 +66,24 @@ func (p *SubscribePacket) Unpack(r io.Reader) error {
 
 	return nil
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态, 保留切片的容量供下一次解码复用
+func (p *SubscribePacket) Reset() {
+	clear(p.Topics)
+	*p = SubscribePacket{FixedHeader: FixedHeader{PacketType: SUBSCRIBE, Qos: 1}, Topics: p.Topics[:0], Qoss: p.Qoss[:0]}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *SubscribePacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *SubscribePacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *SubscribePacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, SUBSCRIBE)
+}
@@ -0,0 +1,101 @@
+package packets
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// SharePrefix 共享订阅前缀, 格式为 $share/{ShareName}/{filter}
+const SharePrefix = "$share/"
+
+// ParseSharedFilter 解析共享订阅主题过滤器
+// 非共享订阅时 ok 为 false, 返回原主题过滤器
+func ParseSharedFilter(topic string) (group string, filter string, ok bool) {
+	if !strings.HasPrefix(topic, SharePrefix) {
+		return "", topic, false
+	}
+	rest := topic[len(SharePrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 {
+		return "", topic, false
+	}
+	group, filter = rest[:i], rest[i+1:]
+	// 共享名不能包含 / + #
+	if strings.ContainsAny(group, "+#") {
+		return "", topic, false
+	}
+	return group, filter, true
+}
+
+// ValidTopicName 验证PUBLISH报文的主题名
+// 主题名不能为空, 不能包含通配符和空字符
+func ValidTopicName(topic string) bool {
+	if !validTopic(topic) {
+		return false
+	}
+	return !strings.ContainsAny(topic, "+#")
+}
+
+// ValidTopicFilter 验证SUBSCRIBE报文的主题过滤器
+// 支持共享订阅 $share/{ShareName}/{filter}
+func ValidTopicFilter(filter string) bool {
+	if strings.HasPrefix(filter, SharePrefix) {
+		var ok bool
+		if _, filter, ok = ParseSharedFilter(filter); !ok {
+			return false
+		}
+	}
+	if !validTopic(filter) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		// 通配符必须占据整个层级
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		// 多层通配符必须是最后一个层级
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchTopic 判断主题过滤器是否匹配主题名
+// 共享订阅按其实际的主题过滤器匹配
+// 以通配符开头的过滤器不匹配以$开头的主题名
+func MatchTopic(filter string, topic string) bool {
+	if _, f, ok := ParseSharedFilter(filter); ok {
+		filter = f
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, level := range fl {
+		if level == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if level != "+" && level != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// validTopic 主题的通用规则: 非空, UTF-8编码, 不含空字符, 长度不超过65535
+func validTopic(topic string) bool {
+	if len(topic) == 0 || len(topic) > 65535 {
+		return false
+	}
+	if !utf8.ValidString(topic) {
+		return false
+	}
+	return !strings.ContainsRune(topic, 0)
+}
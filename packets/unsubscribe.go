@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 )
 
 // UnsubscribePacket 客户端取消订阅包
@@ -52,12 +53,30 @@ func (p *UnsubscribePacket) Unpack(r io.Reader) error {
 		if err != nil {
 			return err
 		}
-		if topic != "" {
-			p.Topics = append(p.Topics, topic)
-		}
-
-		payloadLength -= 2 + len(topic) + 1
+		p.Topics = append(p.Topics, topic)
+		payloadLength -= 2 + len(topic)
 	}
 
 	return nil
 }
+
+// Reset 恢复为 NewControlPacket 返回的状态, 保留切片的容量供下一次解码复用
+func (p *UnsubscribePacket) Reset() {
+	clear(p.Topics)
+	*p = UnsubscribePacket{FixedHeader: FixedHeader{PacketType: UNSUBSCRIBE, Qos: 1}, Topics: p.Topics[:0]}
+}
+
+// LogValue 日志中的报文, 格式见 LogFormat
+func (p *UnsubscribePacket) LogValue() slog.Value {
+	return LogFormat.LogValue(p)
+}
+
+// MarshalJSON 编码成JSON, 格式见 JSONFormat
+func (p *UnsubscribePacket) MarshalJSON() ([]byte, error) {
+	return JSONFormat.Marshal(p)
+}
+
+// UnmarshalJSON 从JSON解码
+func (p *UnsubscribePacket) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, p, UNSUBSCRIBE)
+}
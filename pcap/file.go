@@ -0,0 +1,334 @@
+// Package pcap 读取pcap和pcapng抓包文件, 重组TCP流并解码其中的MQTT报文
+// 纯Go实现, 不依赖libpcap
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// LinkType 链路层类型, 取值与libpcap的LINKTYPE_*相同
+type LinkType uint32
+
+// 支持的链路层类型
+const (
+	LinkNull     LinkType = 0   // BSD loopback
+	LinkEthernet LinkType = 1   // 以太网
+	LinkRaw      LinkType = 101 // 原始IP
+	LinkLoop     LinkType = 108 // OpenBSD loopback
+	LinkLinuxSLL LinkType = 113 // Linux cooked capture
+	LinkIPv4     LinkType = 228
+	LinkIPv6     LinkType = 229
+	LinkSLL2     LinkType = 276 // Linux cooked capture v2
+)
+
+// 文件格式的魔数
+const (
+	magicMicro   = 0xa1b2c3d4
+	magicNano    = 0xa1b23c4d
+	magicNG      = 0x0a0d0d0a // pcapng的Section Header Block类型
+	byteOrderNG  = 0x1a2b3c4d
+	maxBlockSize = 64 << 20
+)
+
+// pcapng的块类型
+const (
+	blockInterface    = 0x00000001
+	blockPacket       = 0x00000002 // 已废弃的Packet Block
+	blockSimple       = 0x00000003
+	blockEnhanced     = 0x00000006
+	optEndOfOpt       = 0
+	optIfTsResolution = 9
+	optIfTsOffset     = 14
+)
+
+// ErrFormat 不是pcap或pcapng文件
+var ErrFormat = errors.New("pcap: unknown file format")
+
+// Packet 抓到的一个数据帧
+type Packet struct {
+	Timestamp time.Time
+	LinkType  LinkType
+	Data      []byte // 抓到的字节, 可能因snaplen被截断
+	Length    int    // 数据帧的原始长度
+}
+
+// Truncated 数据帧是否被截断
+func (p *Packet) Truncated() bool {
+	return len(p.Data) < p.Length
+}
+
+// iface pcapng的接口描述
+type iface struct {
+	linkType LinkType
+	snapLen  uint32
+	units    float64 // 每秒的时间戳单位数
+	offset   int64   // 时间戳的秒偏移
+}
+
+// Reader 读取pcap或pcapng文件
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	// pcap
+	linkType LinkType
+	nano     bool
+
+	// pcapng
+	ifaces []iface
+}
+
+// NewReader 读取文件头, 自动识别pcap和pcapng格式及字节序
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	head, err := br.Peek(4)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	rd := &Reader{r: br}
+	switch {
+	case binary.LittleEndian.Uint32(head) == magicNG:
+		rd.ng = true
+		if err = rd.readSection(); err != nil {
+			return nil, err
+		}
+		return rd, nil
+	case binary.LittleEndian.Uint32(head) == magicMicro, binary.LittleEndian.Uint32(head) == magicNano:
+		rd.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(head) == magicMicro, binary.BigEndian.Uint32(head) == magicNano:
+		rd.order = binary.BigEndian
+	default:
+		return nil, ErrFormat
+	}
+
+	var hdr [24]byte
+	if _, err = io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("pcap: reading file header: %w", err)
+	}
+	rd.nano = rd.order.Uint32(hdr[0:]) == magicNano
+	rd.linkType = LinkType(rd.order.Uint32(hdr[20:]) & 0x0fffffff)
+	return rd, nil
+}
+
+// Next 读取下一个数据帧, 文件结束时返回 io.EOF
+func (r *Reader) Next() (*Packet, error) {
+	if r.ng {
+		return r.nextNG()
+	}
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("pcap: truncated record header")
+		}
+		return nil, err
+	}
+	sec := r.order.Uint32(hdr[0:])
+	frac := r.order.Uint32(hdr[4:])
+	capLen := r.order.Uint32(hdr[8:])
+	origLen := r.order.Uint32(hdr[12:])
+	if capLen > maxBlockSize {
+		return nil, fmt.Errorf("pcap: record length %d too large", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, fmt.Errorf("pcap: truncated record: %w", err)
+	}
+	nsec := int64(frac) * 1000
+	if r.nano {
+		nsec = int64(frac)
+	}
+	return &Packet{
+		Timestamp: time.Unix(int64(sec), nsec),
+		LinkType:  r.linkType,
+		Data:      data,
+		Length:    int(origLen),
+	}, nil
+}
+
+// readSection 读取pcapng的Section Header Block, 确定该段的字节序
+func (r *Reader) readSection() error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return fmt.Errorf("pcapng: reading section header: %w", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[8:]) == byteOrderNG:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[8:]) == byteOrderNG:
+		r.order = binary.BigEndian
+	default:
+		return ErrFormat
+	}
+	length := r.order.Uint32(hdr[4:])
+	if length < 28 || length%4 != 0 || length > maxBlockSize {
+		return fmt.Errorf("pcapng: invalid section header length %d", length)
+	}
+	if _, err := r.r.Discard(int(length) - 12); err != nil {
+		return fmt.Errorf("pcapng: reading section header: %w", err)
+	}
+	// 新的段重新编号接口
+	r.ifaces = r.ifaces[:0]
+	return nil
+}
+
+// nextNG 读取下一个包含数据帧的pcapng块, 跳过其他块
+func (r *Reader) nextNG() (*Packet, error) {
+	for {
+		head, err := r.r.Peek(8)
+		if err != nil {
+			if err == io.EOF && len(head) == 0 {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("pcapng: truncated block header")
+		}
+		if binary.LittleEndian.Uint32(head) == magicNG {
+			if err = r.readSection(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		typ := r.order.Uint32(head)
+		length := r.order.Uint32(head[4:])
+		if length < 12 || length%4 != 0 || length > maxBlockSize {
+			return nil, fmt.Errorf("pcapng: invalid block length %d", length)
+		}
+		block := make([]byte, length)
+		if _, err = io.ReadFull(r.r, block); err != nil {
+			return nil, fmt.Errorf("pcapng: truncated block: %w", err)
+		}
+		body := block[8 : length-4]
+
+		switch typ {
+		case blockInterface:
+			if err = r.readInterface(body); err != nil {
+				return nil, err
+			}
+		case blockEnhanced:
+			return r.enhanced(body)
+		case blockSimple:
+			return r.simple(body)
+		case blockPacket:
+			return r.obsolete(body)
+		}
+	}
+}
+
+// readInterface 读取Interface Description Block
+func (r *Reader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("pcapng: short interface description block")
+	}
+	ifc := iface{
+		linkType: LinkType(r.order.Uint16(body[0:])),
+		snapLen:  r.order.Uint32(body[4:]),
+		units:    1e6,
+	}
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code := r.order.Uint16(opts[0:])
+		n := int(r.order.Uint16(opts[2:]))
+		if code == optEndOfOpt || 4+n > len(opts) {
+			break
+		}
+		value := opts[4 : 4+n]
+		switch {
+		case code == optIfTsResolution && n >= 1:
+			if value[0]&0x80 != 0 {
+				ifc.units = math.Pow(2, float64(value[0]&0x7f))
+			} else {
+				ifc.units = math.Pow(10, float64(value[0]))
+			}
+		case code == optIfTsOffset && n >= 8:
+			ifc.offset = int64(r.order.Uint64(value))
+		}
+		opts = opts[4+(n+3)&^3:]
+	}
+	r.ifaces = append(r.ifaces, ifc)
+	return nil
+}
+
+// timestamp 把接口的时间戳单位转换为时间
+func (r *Reader) timestamp(ifc iface, high uint32, low uint32) time.Time {
+	ts := uint64(high)<<32 | uint64(low)
+	units := uint64(ifc.units)
+	sec := ts / units
+	nsec := float64(ts%units) * 1e9 / ifc.units
+	return time.Unix(int64(sec)+ifc.offset, int64(nsec))
+}
+
+// iface 按编号查找接口
+func (r *Reader) iface(id uint32) (iface, error) {
+	if int(id) >= len(r.ifaces) {
+		return iface{}, fmt.Errorf("pcapng: packet refers to unknown interface %d", id)
+	}
+	return r.ifaces[id], nil
+}
+
+// enhanced 解析Enhanced Packet Block
+func (r *Reader) enhanced(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("pcapng: short enhanced packet block")
+	}
+	ifc, err := r.iface(r.order.Uint32(body[0:]))
+	if err != nil {
+		return nil, err
+	}
+	capLen := r.order.Uint32(body[12:])
+	if int(capLen) > len(body)-20 {
+		return nil, fmt.Errorf("pcapng: captured length %d exceeds block", capLen)
+	}
+	return &Packet{
+		Timestamp: r.timestamp(ifc, r.order.Uint32(body[4:]), r.order.Uint32(body[8:])),
+		LinkType:  ifc.linkType,
+		Data:      body[20 : 20+capLen],
+		Length:    int(r.order.Uint32(body[16:])),
+	}, nil
+}
+
+// simple 解析Simple Packet Block, 没有时间戳, 属于第一个接口
+func (r *Reader) simple(body []byte) (*Packet, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("pcapng: short simple packet block")
+	}
+	ifc, err := r.iface(0)
+	if err != nil {
+		return nil, err
+	}
+	length := r.order.Uint32(body[0:])
+	data := body[4:]
+	if uint32(len(data)) > length {
+		data = data[:length]
+	}
+	if ifc.snapLen > 0 && uint32(len(data)) > ifc.snapLen {
+		data = data[:ifc.snapLen]
+	}
+	return &Packet{LinkType: ifc.linkType, Data: data, Length: int(length)}, nil
+}
+
+// obsolete 解析已废弃的Packet Block
+func (r *Reader) obsolete(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("pcapng: short packet block")
+	}
+	ifc, err := r.iface(uint32(r.order.Uint16(body[0:])))
+	if err != nil {
+		return nil, err
+	}
+	capLen := r.order.Uint32(body[12:])
+	if int(capLen) > len(body)-20 {
+		return nil, fmt.Errorf("pcapng: captured length %d exceeds block", capLen)
+	}
+	return &Packet{
+		Timestamp: r.timestamp(ifc, r.order.Uint32(body[4:]), r.order.Uint32(body[8:])),
+		LinkType:  ifc.linkType,
+		Data:      body[20 : 20+capLen],
+		Length:    int(r.order.Uint32(body[16:])),
+	}, nil
+}
@@ -0,0 +1,154 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// TCP标志位
+const (
+	FlagFIN = 0x01
+	FlagSYN = 0x02
+	FlagRST = 0x04
+	FlagACK = 0x10
+)
+
+// Segment TCP报文段
+type Segment struct {
+	Timestamp time.Time
+	Src       netip.AddrPort
+	Dst       netip.AddrPort
+	Seq       uint32
+	Flags     byte
+	Payload   []byte
+}
+
+// DecodeTCP 从数据帧中解析TCP报文段
+// 不是TCP, 是IP分片或者数据不完整时返回false
+func DecodeTCP(p *Packet) (*Segment, bool) {
+	data := p.Data
+	var ethertype uint16
+	switch p.LinkType {
+	case LinkEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		ethertype = binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// 802.1Q和802.1ad标签
+		for (ethertype == 0x8100 || ethertype == 0x88a8) && len(data) >= 4 {
+			ethertype = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+	case LinkLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		ethertype = binary.BigEndian.Uint16(data[14:])
+		data = data[16:]
+	case LinkSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		ethertype = binary.BigEndian.Uint16(data[0:])
+		data = data[20:]
+	case LinkNull, LinkLoop:
+		// 地址族的字节序取决于抓包的主机, 直接按IP版本判断
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case LinkRaw, LinkIPv4, LinkIPv6:
+	default:
+		return nil, false
+	}
+	if ethertype == 0 && len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			ethertype = 0x0800
+		case 6:
+			ethertype = 0x86dd
+		}
+	}
+
+	seg := &Segment{Timestamp: p.Timestamp}
+	var src, dst netip.Addr
+	var ok bool
+	switch ethertype {
+	case 0x0800:
+		src, dst, data, ok = decodeIPv4(data)
+	case 0x86dd:
+		src, dst, data, ok = decodeIPv6(data)
+	}
+	if !ok || len(data) < 20 {
+		return nil, false
+	}
+
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil, false
+	}
+	seg.Src = netip.AddrPortFrom(src, binary.BigEndian.Uint16(data[0:]))
+	seg.Dst = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(data[2:]))
+	seg.Seq = binary.BigEndian.Uint32(data[4:])
+	seg.Flags = data[13]
+	seg.Payload = data[offset:]
+	return seg, true
+}
+
+// decodeIPv4 解析IPv4头部, 返回TCP部分
+func decodeIPv4(data []byte) (netip.Addr, netip.Addr, []byte, bool) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return netip.Addr{}, netip.Addr{}, nil, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(data[2:]))
+	if ihl < 20 || total < ihl || len(data) < ihl {
+		return netip.Addr{}, netip.Addr{}, nil, false
+	}
+	// 分片需要IP层重组, 不支持
+	if frag := binary.BigEndian.Uint16(data[6:]); frag&0x3fff != 0 {
+		return netip.Addr{}, netip.Addr{}, nil, false
+	}
+	if data[9] != 6 {
+		return netip.Addr{}, netip.Addr{}, nil, false
+	}
+	src := netip.AddrFrom4([4]byte(data[12:16]))
+	dst := netip.AddrFrom4([4]byte(data[16:20]))
+	// 去掉以太网的填充字节, TSO抓包时总长度可能为0
+	if total != 0 && total < len(data) {
+		data = data[:total]
+	}
+	return src, dst, data[ihl:], true
+}
+
+// decodeIPv6 解析IPv6头部和扩展头部, 返回TCP部分
+func decodeIPv6(data []byte) (netip.Addr, netip.Addr, []byte, bool) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return netip.Addr{}, netip.Addr{}, nil, false
+	}
+	next := data[6]
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	src := netip.AddrFrom16([16]byte(data[8:24]))
+	dst := netip.AddrFrom16([16]byte(data[24:40]))
+	data = data[40:]
+	if length != 0 && length < len(data) {
+		data = data[:length]
+	}
+	for {
+		switch next {
+		case 6:
+			return src, dst, data, true
+		case 0, 43, 60: // 逐跳选项, 路由, 目的选项
+			if len(data) < 8 || len(data) < (int(data[1])+1)*8 {
+				return netip.Addr{}, netip.Addr{}, nil, false
+			}
+			next = data[0]
+			data = data[(int(data[1])+1)*8:]
+		default:
+			// 包括分片头部(44)
+			return netip.Addr{}, netip.Addr{}, nil, false
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+var (
+	client = netip.MustParseAddrPort("10.0.0.2:50000")
+	server = netip.MustParseAddrPort("10.0.0.1:1883")
+	epoch  = time.Unix(1700000000, 0)
+)
+
+// frame 构造以太网/IPv4/TCP数据帧
+func frame(src, dst netip.AddrPort, seq uint32, flags byte, payload []byte) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 12))
+	b.Write([]byte{0x08, 0x00})
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(payload)))
+	ip[8], ip[9] = 64, 6
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(ip[12:], s[:])
+	copy(ip[16:], d[:])
+	b.Write(ip)
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	b.Write(tcp)
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// frame6 构造原始IPv6/TCP数据帧
+func frame6(src, dst netip.AddrPort, seq uint32, flags byte, payload []byte) []byte {
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(20+len(payload)))
+	ip[6], ip[7] = 6, 64
+	s, d := src.Addr().As16(), dst.Addr().As16()
+	copy(ip[8:], s[:])
+	copy(ip[24:], d[:])
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return append(append(ip, tcp...), payload...)
+}
+
+// encode 编码报文
+func encode(pks ...packets.ControlPacket) []byte {
+	var b bytes.Buffer
+	for _, pk := range pks {
+		pk.Write(&b)
+	}
+	return b.Bytes()
+}
+
+// pcapFile 构造pcap文件
+func pcapFile(frames [][]byte) []byte {
+	var b bytes.Buffer
+	hdr := []uint32{magicMicro, 0x00040002, 0, 0, 65535, uint32(LinkEthernet)}
+	for _, v := range hdr {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	for i, f := range frames {
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(epoch.Unix()), uint32(i * 1000), uint32(len(f)), uint32(len(f))})
+		b.Write(f)
+	}
+	return b.Bytes()
+}
+
+// pcapngFile 构造大端序的pcapng文件, 时间戳单位为纳秒
+func pcapngFile(linkType LinkType, frames [][]byte) []byte {
+	var b bytes.Buffer
+	block := func(typ uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		n := uint32(12 + len(body))
+		binary.Write(&b, binary.BigEndian, typ)
+		binary.Write(&b, binary.BigEndian, n)
+		b.Write(body)
+		binary.Write(&b, binary.BigEndian, n)
+	}
+	shb := binary.BigEndian.AppendUint32(nil, byteOrderNG)
+	shb = append(shb, 0, 1, 0, 0)
+	shb = binary.BigEndian.AppendUint64(shb, ^uint64(0))
+	block(magicNG, shb)
+	idb := binary.BigEndian.AppendUint16(nil, uint16(linkType))
+	idb = append(idb, 0, 0, 0, 0, 0xff, 0xff)
+	idb = append(idb, 0, optIfTsResolution, 0, 1, 9, 0, 0, 0, 0, 0, 0, 0)
+	block(blockInterface, idb)
+	for i, f := range frames {
+		ts := uint64(epoch.UnixNano()) + uint64(i)
+		epb := binary.BigEndian.AppendUint32(nil, 0)
+		epb = binary.BigEndian.AppendUint32(epb, uint32(ts>>32))
+		epb = binary.BigEndian.AppendUint32(epb, uint32(ts))
+		epb = binary.BigEndian.AppendUint32(epb, uint32(len(f)))
+		epb = binary.BigEndian.AppendUint32(epb, uint32(len(f)))
+		block(blockEnhanced, append(epb, f...))
+	}
+	return b.Bytes()
+}
+
+func TestAssemble(t *testing.T) {
+	connect := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolLevel, connect.ClientIdentifier = "MQTT", 4, "dev1"
+	connect.UsernameFlag, connect.Username = true, "alice"
+	connack := packets.NewControlPacket(packets.CONNACK)
+	sub := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+	sub.PacketID, sub.Topics, sub.Qoss = 1, []string{"cmd/#", "bad/#"}, []byte{1, 1}
+	suback := packets.NewControlPacket(packets.SUBACK).(*packets.SubackPacket)
+	suback.PacketID, suback.ReturnCodes = 1, []byte{1, 0x80}
+	pub := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.PacketID, pub.Payload = "cmd/reboot", 1, 7, []byte("now")
+	pub2 := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pub2.TopicName, pub2.Qos, pub2.PacketID, pub2.Payload = "status", 2, 3, []byte("up")
+	pubrec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+	pubrec.PacketID = 3
+
+	c1 := encode(connect)
+	c2 := encode(sub, pub2)
+	s1 := encode(connack)
+	s2 := encode(suback, pub, pubrec)
+	frames := [][]byte{
+		frame(client, server, 100, FlagSYN, nil),
+		frame(server, client, 500, FlagSYN|FlagACK, nil),
+		// CONNECT分成两段, 第二段先到
+		frame(client, server, 105, FlagACK, c1[4:]),
+		frame(client, server, 101, FlagACK, c1[:4]),
+		frame(server, client, 501, FlagACK, s1),
+		frame(client, server, uint32(101+len(c1)), FlagACK, c2),
+		// 重传
+		frame(client, server, uint32(101+len(c1)), FlagACK, c2),
+		frame(server, client, uint32(501+len(s1)), FlagACK, s2),
+		// 其他端口的流量被忽略
+		frame(client, netip.MustParseAddrPort("10.0.0.1:80"), 1, FlagACK, []byte("GET /")),
+	}
+
+	for name, file := range map[string][]byte{"pcap": pcapFile(frames), "pcapng": pcapngFile(LinkEthernet, frames)} {
+		convs, err := Assemble(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("%s: Assemble returned error: %s", name, err)
+		}
+		if len(convs) != 1 {
+			t.Fatalf("%s: found %d conversations", name, len(convs))
+		}
+		c := convs[0]
+		if c.Client != client || c.Server != server || len(c.Errors) != 0 {
+			t.Errorf("%s: conversation %s -> %s, errors %v", name, c.Client, c.Server, c.Errors)
+		}
+		if len(c.Messages) != 7 {
+			t.Fatalf("%s: decoded %d messages, should be 7", name, len(c.Messages))
+		}
+		if !c.Messages[0].FromClient || c.Messages[1].FromClient {
+			t.Errorf("%s: wrong message directions", name)
+		}
+
+		s := c.Summary()
+		if s.ClientID != "dev1" || s.Username != "alice" || s.ReturnCode != 0 {
+			t.Errorf("%s: summary %+v", name, s)
+		}
+		if len(s.Subscriptions) != 2 || s.Subscriptions["cmd/#"] != 1 || s.Subscriptions["bad/#"] != 0x80 {
+			t.Errorf("%s: subscriptions %v", name, s.Subscriptions)
+		}
+		if len(s.Incomplete) != 2 ||
+			s.Incomplete[0].Waiting != "PUBREL" || !s.Incomplete[0].FromClient || s.Incomplete[0].PacketID != 3 ||
+			s.Incomplete[1].Waiting != "PUBACK" || s.Incomplete[1].FromClient || s.Incomplete[1].PacketID != 7 {
+			t.Errorf("%s: incomplete %v", name, s.Incomplete)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	ping := encode(packets.NewControlPacket(packets.PINGREQ))
+	frames := [][]byte{
+		// 抓包开始时连接已建立
+		frame6(client, server, 1000, FlagACK, ping),
+		// 缺失序号1002-1003的数据
+		frame6(client, server, 1004, FlagACK, ping),
+		frame6(server, client, 9, FlagACK, []byte{0xd0, 0x00, 0x30}),
+		frame6(server, client, 12, FlagFIN|FlagACK, nil),
+	}
+	convs, err := Assemble(bytes.NewReader(pcapngFile(LinkRaw, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 1 {
+		t.Fatalf("found %d conversations", len(convs))
+	}
+	c := convs[0]
+	if len(c.Messages) != 2 || !c.Closed {
+		t.Errorf("decoded %d messages, closed %v", len(c.Messages), c.Closed)
+	}
+	if want := epoch.Add(2 * time.Nanosecond); !c.Messages[1].Timestamp.Equal(want) {
+		t.Errorf("timestamp %v, should be %v", c.Messages[1].Timestamp, want)
+	}
+	want := []string{
+		"client: 2 bytes missing before sequence 1004, stopped decoding",
+		"server: capture ends inside a packet, 1 bytes left",
+	}
+	if len(c.Errors) != 2 || c.Errors[0] != want[0] || c.Errors[1] != want[1] {
+		t.Errorf("errors %q, should be %q", c.Errors, want)
+	}
+}
+
+func TestNewReaderFormat(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture"))); err != ErrFormat {
+		t.Errorf("NewReader returned %v, should be ErrFormat", err)
+	}
+}
@@ -0,0 +1,310 @@
+package pcap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// DefaultPort MQTT的默认端口
+const DefaultPort = 1883
+
+// maxPending 每个方向最多缓存的乱序报文段数, 超过后认为中间的数据丢失
+const maxPending = 1024
+
+// Message 从TCP流中解码出的MQTT报文
+type Message struct {
+	Timestamp  time.Time // 报文最后一个字节所在报文段的时间
+	FromClient bool
+	Packet     packets.ControlPacket
+}
+
+// Conversation 一个TCP连接上的MQTT会话
+type Conversation struct {
+	Client   netip.AddrPort
+	Server   netip.AddrPort
+	Start    time.Time
+	End      time.Time
+	Messages []Message
+	Errors   []string // 重组和解码错误, 出错的方向不再继续解码
+	Closed   bool     // 是否看到了FIN或RST
+
+	client halfStream // 客户端发出的数据
+	server halfStream
+}
+
+// halfStream 一个方向的TCP数据
+type halfStream struct {
+	started bool
+	next    uint32            // 下一个期望的序号
+	pending map[uint32]*chunk // 乱序到达的报文段
+	buf     []byte            // 尚未组成完整报文的数据
+	broken  bool
+}
+
+// chunk 乱序到达的数据
+type chunk struct {
+	timestamp time.Time
+	data      []byte
+}
+
+// key 连接的标识
+type key struct {
+	client netip.AddrPort
+	server netip.AddrPort
+}
+
+// Assembler 把TCP报文段重组为MQTT会话
+type Assembler struct {
+	ports map[uint16]bool
+	conns map[key]*Conversation
+	all   []*Conversation
+}
+
+// NewAssembler 新建重组器, ports 为服务端的MQTT端口, 为空时使用 DefaultPort
+func NewAssembler(ports ...uint16) *Assembler {
+	if len(ports) == 0 {
+		ports = []uint16{DefaultPort}
+	}
+	a := &Assembler{ports: make(map[uint16]bool), conns: make(map[key]*Conversation)}
+	for _, p := range ports {
+		a.ports[p] = true
+	}
+	return a
+}
+
+// Add 添加一个报文段, 不属于MQTT端口的报文段被忽略
+func (a *Assembler) Add(seg *Segment) {
+	var k key
+	var fromClient bool
+	switch {
+	case a.ports[seg.Dst.Port()]:
+		k, fromClient = key{client: seg.Src, server: seg.Dst}, true
+	case a.ports[seg.Src.Port()]:
+		k = key{client: seg.Dst, server: seg.Src}
+	default:
+		return
+	}
+
+	c := a.conns[k]
+	// 端口复用: 已关闭的连接上出现新的SYN
+	if c == nil || (c.Closed && seg.Flags&FlagSYN != 0 && seg.Flags&FlagACK == 0) {
+		c = &Conversation{Client: k.client, Server: k.server, Start: seg.Timestamp}
+		a.conns[k] = c
+		a.all = append(a.all, c)
+	}
+	c.End = seg.Timestamp
+	if seg.Flags&(FlagFIN|FlagRST) != 0 {
+		c.Closed = true
+	}
+	if fromClient {
+		c.client.add(c, seg, true)
+	} else {
+		c.server.add(c, seg, false)
+	}
+}
+
+// Conversations 返回按开始时间排序的所有会话, 并报告未能补齐的数据
+func (a *Assembler) Conversations() []*Conversation {
+	for _, c := range a.all {
+		c.client.flush(c, true)
+		c.server.flush(c, false)
+	}
+	sort.SliceStable(a.all, func(i, j int) bool { return a.all[i].Start.Before(a.all[j].Start) })
+	return a.all
+}
+
+// add 按序号处理一个报文段
+func (h *halfStream) add(c *Conversation, seg *Segment, fromClient bool) {
+	seq := seg.Seq
+	if seg.Flags&FlagSYN != 0 {
+		h.started = true
+		h.next = seq + 1
+		seq++
+	}
+	if !h.started {
+		// 抓包开始时连接已建立, 从第一个报文段开始
+		h.started = true
+		h.next = seq
+	}
+	data := seg.Payload
+	if len(data) == 0 || h.broken {
+		return
+	}
+
+	diff := int32(seq - h.next)
+	if diff < 0 {
+		// 重传或重叠, 去掉已经收到的部分
+		if int(-diff) >= len(data) {
+			return
+		}
+		data = data[-diff:]
+		diff = 0
+	}
+	if diff > 0 {
+		if h.pending == nil {
+			h.pending = make(map[uint32]*chunk)
+		}
+		if old, ok := h.pending[seq]; !ok || len(old.data) < len(data) {
+			h.pending[seq] = &chunk{timestamp: seg.Timestamp, data: data}
+		}
+		if len(h.pending) > maxPending {
+			h.skip(c, fromClient)
+		}
+		return
+	}
+	h.append(c, seg.Timestamp, data, fromClient)
+}
+
+// append 追加按序到达的数据, 然后处理可以接上的乱序数据
+func (h *halfStream) append(c *Conversation, ts time.Time, data []byte, fromClient bool) {
+	h.next += uint32(len(data))
+	h.buf = append(h.buf, data...)
+	h.decode(c, ts, fromClient)
+	for len(h.pending) > 0 && !h.broken {
+		progressed := false
+		for seq, ch := range h.pending {
+			diff := int32(seq - h.next)
+			if diff > 0 {
+				continue
+			}
+			delete(h.pending, seq)
+			if int(-diff) < len(ch.data) {
+				h.next += uint32(len(ch.data) + int(diff))
+				h.buf = append(h.buf, ch.data[-diff:]...)
+				h.decode(c, ch.timestamp, fromClient)
+			}
+			progressed = true
+			break
+		}
+		if !progressed {
+			return
+		}
+	}
+}
+
+// skip 数据缺失, 之后的字节无法对齐到报文边界, 停止解码该方向
+func (h *halfStream) skip(c *Conversation, fromClient bool) {
+	first := true
+	var lowest uint32
+	for seq := range h.pending {
+		if first || int32(seq-lowest) < 0 {
+			lowest, first = seq, false
+		}
+	}
+	c.Errors = append(c.Errors, fmt.Sprintf("%s: %d bytes missing before sequence %d, stopped decoding", direction(fromClient), lowest-h.next, lowest))
+	h.broken = true
+	h.pending = nil
+	h.buf = nil
+}
+
+// flush 抓包结束时报告缺失的数据和不完整的报文
+func (h *halfStream) flush(c *Conversation, fromClient bool) {
+	if h.broken {
+		return
+	}
+	if len(h.pending) > 0 {
+		h.skip(c, fromClient)
+		return
+	}
+	if len(h.buf) > 0 {
+		c.Errors = append(c.Errors, fmt.Sprintf("%s: capture ends inside a packet, %d bytes left", direction(fromClient), len(h.buf)))
+		h.buf = nil
+	}
+}
+
+// decode 从缓冲的数据中解码完整的报文
+func (h *halfStream) decode(c *Conversation, ts time.Time, fromClient bool) {
+	for len(h.buf) >= 2 {
+		length, n, ok := remainingLength(h.buf)
+		if !ok {
+			if n < 4 {
+				return // 剩余长度还不完整
+			}
+			h.fail(c, fromClient, "malformed remaining length")
+			return
+		}
+		total := 1 + n + length
+		if len(h.buf) < total {
+			return
+		}
+		pk, err := packets.ReadPacket(bytes.NewReader(h.buf[:total]))
+		if err != nil {
+			h.fail(c, fromClient, err.Error())
+			return
+		}
+		c.Messages = append(c.Messages, Message{Timestamp: ts, FromClient: fromClient, Packet: pk})
+		h.buf = h.buf[total:]
+	}
+	if len(h.buf) == 0 {
+		h.buf = nil
+	}
+}
+
+// fail 记录解码错误并停止解码该方向
+func (h *halfStream) fail(c *Conversation, fromClient bool, msg string) {
+	c.Errors = append(c.Errors, fmt.Sprintf("%s: decoding packet %d: %s, stopped decoding", direction(fromClient), count(c, fromClient)+1, msg))
+	h.broken = true
+	h.buf = nil
+	h.pending = nil
+}
+
+// remainingLength 解码剩余长度, 返回值和编码的字节数, 数据不完整或格式错误时 ok 为false
+func remainingLength(buf []byte) (length int, n int, ok bool) {
+	multiplier := 1
+	for n = 1; n < len(buf) && n <= 4; n++ {
+		length += int(buf[n]&0x7f) * multiplier
+		if buf[n]&0x80 == 0 {
+			return length, n, true
+		}
+		multiplier *= 128
+	}
+	return 0, n - 1, false
+}
+
+// count 一个方向已经解码的报文数
+func count(c *Conversation, fromClient bool) int {
+	n := 0
+	for _, m := range c.Messages {
+		if m.FromClient == fromClient {
+			n++
+		}
+	}
+	return n
+}
+
+// direction 方向的名称
+func direction(fromClient bool) string {
+	if fromClient {
+		return "client"
+	}
+	return "server"
+}
+
+// Assemble 读取整个抓包文件, 返回其中的MQTT会话
+// 不是TCP的数据帧和IP分片被忽略
+func Assemble(r io.Reader, ports ...uint16) ([]*Conversation, error) {
+	rd, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	a := NewAssembler(ports...)
+	for {
+		p, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return a.Conversations(), err
+		}
+		if seg, ok := DecodeTCP(p); ok {
+			a.Add(seg)
+		}
+	}
+	return a.Conversations(), nil
+}
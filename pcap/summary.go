@@ -0,0 +1,145 @@
+package pcap
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// Summary 会话摘要
+type Summary struct {
+	ClientID      string
+	Username      string
+	ReturnCode    int               // CONNACK的返回码, 没有CONNACK时为-1
+	Subscriptions map[string]byte   // 主题过滤器 -> 服务端授予的QoS, 0x80表示被拒绝
+	Incomplete    []Pending         // 抓包结束时仍未完成的交互
+	Counts        map[string]int    // 报文类型 -> 数量
+	Published     map[string]uint64 // 主题 -> 负载字节数
+}
+
+// Pending 未完成的交互
+type Pending struct {
+	Timestamp  time.Time // 发起交互的时间
+	FromClient bool      // 发起交互的一方
+	Waiting    string    // 等待的报文类型
+	PacketID   uint16
+	Detail     string
+}
+
+// String ...
+func (p Pending) String() string {
+	return fmt.Sprintf("%s %s %s, no %s", p.Timestamp.Format("15:04:05.000000"), direction(p.FromClient), p.Detail, p.Waiting)
+}
+
+// flow 交互的标识, 发起方和报文标识符
+type flow struct {
+	fromClient bool
+	id         uint16
+}
+
+// Summary 根据解码出的报文生成会话摘要
+func (c *Conversation) Summary() Summary {
+	s := Summary{
+		ReturnCode:    -1,
+		Subscriptions: make(map[string]byte),
+		Counts:        make(map[string]int),
+		Published:     make(map[string]uint64),
+	}
+	pending := make(map[flow]*Pending)
+	subscribes := make(map[uint16]*packets.SubscribePacket)
+	unsubscribes := make(map[uint16]*packets.UnsubscribePacket)
+	var connect *Pending
+
+	start := func(m Message, fromClient bool, id uint16, waiting string, detail string) {
+		pending[flow{fromClient, id}] = &Pending{Timestamp: m.Timestamp, FromClient: fromClient, Waiting: waiting, PacketID: id, Detail: detail}
+	}
+	// done 结束对端发起的交互
+	done := func(m Message, id uint16, waiting string) {
+		f := flow{!m.FromClient, id}
+		if p, ok := pending[f]; ok && p.Waiting == waiting {
+			delete(pending, f)
+		}
+	}
+
+	for _, m := range c.Messages {
+		s.Counts[packets.PacketNames[packets.HeaderOf(m.Packet).PacketType]]++
+		switch p := m.Packet.(type) {
+		case *packets.ConnectPacket:
+			s.ClientID, s.Username = p.ClientIdentifier, p.Username
+			connect = &Pending{Timestamp: m.Timestamp, FromClient: true, Waiting: "CONNACK", Detail: fmt.Sprintf("CONNECT %q", p.ClientIdentifier)}
+		case *packets.ConnackPacket:
+			s.ReturnCode = int(p.ReturnCode)
+			connect = nil
+		case *packets.PublishPacket:
+			s.Published[p.TopicName] += uint64(len(p.Payload))
+			detail := fmt.Sprintf("PUBLISH %q QoS %d id %d", p.TopicName, p.Qos, p.PacketID)
+			switch p.Qos {
+			case 1:
+				start(m, m.FromClient, p.PacketID, "PUBACK", detail)
+			case 2:
+				start(m, m.FromClient, p.PacketID, "PUBREC", detail)
+			}
+		case *packets.PubackPacket:
+			done(m, p.PacketID, "PUBACK")
+		case *packets.PubrecPacket:
+			f := flow{!m.FromClient, p.PacketID}
+			if old, ok := pending[f]; ok && old.Waiting == "PUBREC" {
+				old.Waiting = "PUBREL"
+			}
+		case *packets.PubrelPacket:
+			// PUBREL由发起方发送, 之后等待接收方的PUBCOMP
+			f := flow{m.FromClient, p.PacketID}
+			if old, ok := pending[f]; ok && old.Waiting == "PUBREL" {
+				old.Waiting = "PUBCOMP"
+			} else {
+				start(m, m.FromClient, p.PacketID, "PUBCOMP", fmt.Sprintf("PUBREL id %d", p.PacketID))
+			}
+		case *packets.PubcompPacket:
+			done(m, p.PacketID, "PUBCOMP")
+		case *packets.SubscribePacket:
+			subscribes[p.PacketID] = p
+			start(m, true, p.PacketID, "SUBACK", fmt.Sprintf("SUBSCRIBE %q id %d", p.Topics, p.PacketID))
+		case *packets.SubackPacket:
+			if sub, ok := subscribes[p.PacketID]; ok {
+				for i, topic := range sub.Topics {
+					if i < len(p.ReturnCodes) {
+						s.Subscriptions[topic] = p.ReturnCodes[i]
+					}
+				}
+				delete(subscribes, p.PacketID)
+			}
+			done(m, p.PacketID, "SUBACK")
+		case *packets.UnsubscribePacket:
+			unsubscribes[p.PacketID] = p
+			start(m, true, p.PacketID, "UNSUBACK", fmt.Sprintf("UNSUBSCRIBE %q id %d", p.Topics, p.PacketID))
+		case *packets.UnsubackPacket:
+			if unsub, ok := unsubscribes[p.PacketID]; ok {
+				for _, topic := range unsub.Topics {
+					delete(s.Subscriptions, topic)
+				}
+				delete(unsubscribes, p.PacketID)
+			}
+			done(m, p.PacketID, "UNSUBACK")
+		}
+	}
+
+	if connect != nil {
+		s.Incomplete = append(s.Incomplete, *connect)
+	}
+	for _, p := range pending {
+		s.Incomplete = append(s.Incomplete, *p)
+	}
+	sort.Slice(s.Incomplete, func(i, j int) bool {
+		a, b := s.Incomplete[i], s.Incomplete[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.FromClient != b.FromClient {
+			return a.FromClient
+		}
+		return a.PacketID < b.PacketID
+	})
+	return s
+}
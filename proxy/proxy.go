@@ -0,0 +1,427 @@
+// Package proxy 理解MQTT协议的TCP代理
+// 代理逐个解码两个方向的报文, 记录日志, 按规则改写主题, 客户端标识符和凭据后重新编码转发
+// 还可以注入延迟和丢包用于测试, 丢弃QoS 1/2消息时代理代替对端完成确认, 发送方的QoS交互保持完整
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// ErrClosed 代理已关闭
+var ErrClosed = errors.New("proxy closed")
+
+// Direction 报文方向
+type Direction int
+
+// 报文方向
+const (
+	ClientToBroker Direction = iota
+	BrokerToClient
+)
+
+// String ...
+func (d Direction) String() string {
+	if d == ClientToBroker {
+		return "C->B"
+	}
+	return "B->C"
+}
+
+// Faults 注入的故障, 对两个方向都生效
+type Faults struct {
+	Latency time.Duration // 每个报文的固定延迟
+	Jitter  time.Duration // 在 Latency 上增加的随机延迟, 报文顺序保持不变
+	Loss    float64       // 丢弃PUBLISH报文的概率, 0到1
+}
+
+// Config 代理配置
+type Config struct {
+	Upstream string                   // 服务端地址
+	Dial     func() (net.Conn, error) // 不为空时用于连接服务端, 代替 Upstream
+	Rules    Rules
+	Faults   Faults
+
+	// Filter 在规则改写之后调用, 可以修改报文, 返回nil时丢弃报文
+	// 丢弃QoS 1/2的PUBLISH时发送方会一直等待确认, 需要保持交互完整时应使用 Faults.Loss
+	Filter func(clientID string, dir Direction, pk packets.ControlPacket) packets.ControlPacket
+
+	Logger *log.Logger // 为nil时不记录报文
+}
+
+// Proxy MQTT代理
+type Proxy struct {
+	cfg Config
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	sessions  map[*session]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New 新建代理
+func New(cfg Config) (*Proxy, error) {
+	if cfg.Dial == nil {
+		if cfg.Upstream == "" {
+			return nil, errors.New("proxy needs an upstream address")
+		}
+		addr := cfg.Upstream
+		cfg.Dial = func() (net.Conn, error) { return net.Dial("tcp", addr) }
+	}
+	if cfg.Faults.Loss < 0 || cfg.Faults.Loss > 1 {
+		return nil, fmt.Errorf("loss %v must be between 0 and 1", cfg.Faults.Loss)
+	}
+	for _, t := range cfg.Rules.Topics {
+		if t.Client == t.Broker {
+			return nil, fmt.Errorf("topic rule %q maps to itself", t.Client)
+		}
+	}
+	return &Proxy{cfg: cfg, listeners: make(map[net.Listener]bool), sessions: make(map[*session]bool)}, nil
+}
+
+// Serve 接受客户端连接, 直到监听或代理关闭
+func (p *Proxy) Serve(l net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.listeners[l] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.listeners, l)
+		p.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn 连接服务端并在两端之间转发报文, 直到任意一端断开
+func (p *Proxy) ServeConn(client net.Conn) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		client.Close()
+		return
+	}
+	p.wg.Add(1)
+	p.mu.Unlock()
+	defer p.wg.Done()
+
+	broker, err := p.cfg.Dial()
+	if err != nil {
+		p.logf("%s: dial upstream: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+	s := newSession(p, client, broker)
+	p.mu.Lock()
+	p.sessions[s] = true
+	p.mu.Unlock()
+	s.run()
+	p.mu.Lock()
+	delete(p.sessions, s)
+	p.mu.Unlock()
+}
+
+// Close 关闭所有监听和连接
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	for s := range p.sessions {
+		s.close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return nil
+}
+
+// logf 输出日志
+func (p *Proxy) logf(format string, args ...interface{}) {
+	if p.cfg.Logger != nil {
+		p.cfg.Logger.Printf(format, args...)
+	}
+}
+
+// session 一对客户端和服务端连接
+type session struct {
+	p      *Proxy
+	client *link
+	broker *link
+
+	mu       sync.Mutex
+	clientID string
+	dropped  [2]map[uint16]bool // 每个方向上被丢弃的QoS 2消息, 等待发送方的PUBREL
+	once     sync.Once
+	done     chan struct{}
+}
+
+// link 一端的连接, 写入经过按注入的延迟排队
+type link struct {
+	conn  net.Conn
+	queue chan delayed
+	eof   chan struct{} // 对端已断开, 发送完排队的报文后关闭会话
+	last  time.Time     // 上一个报文的发送时间, 保证延迟后顺序不变
+}
+
+// delayed 等待发送的报文
+type delayed struct {
+	at time.Time
+	pk packets.ControlPacket
+}
+
+// newSession 新建会话
+func newSession(p *Proxy, client net.Conn, broker net.Conn) *session {
+	return &session{
+		p:       p,
+		client:  &link{conn: client, queue: make(chan delayed, 256), eof: make(chan struct{})},
+		broker:  &link{conn: broker, queue: make(chan delayed, 256), eof: make(chan struct{})},
+		dropped: [2]map[uint16]bool{make(map[uint16]bool), make(map[uint16]bool)},
+		done:    make(chan struct{}),
+	}
+}
+
+// run 转发两个方向的报文, 返回时两端都已关闭
+func (s *session) run() {
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() { defer wg.Done(); s.pump(ClientToBroker) }()
+	go func() { defer wg.Done(); s.pump(BrokerToClient) }()
+	go func() { defer wg.Done(); s.writer(s.broker) }()
+	go func() { defer wg.Done(); s.writer(s.client) }()
+	wg.Wait()
+}
+
+// close 关闭两端
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.client.conn.Close()
+		s.broker.conn.Close()
+	})
+}
+
+// id 日志中的连接标识
+func (s *session) id() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clientID != "" {
+		return s.clientID
+	}
+	return s.client.conn.RemoteAddr().String()
+}
+
+// pump 读取一个方向的报文, 改写后发送给对端
+// 读取失败时通知对端的写入协程, 例如拒绝连接的CONNACK仍会转发给客户端
+func (s *session) pump(dir Direction) {
+	from, to := s.client, s.broker
+	if dir == BrokerToClient {
+		from, to = s.broker, s.client
+	}
+	defer close(to.eof)
+	first := true
+	for {
+		pk, err := packets.ReadPacket(from.conn)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				s.p.logf("%s %s: %v", s.id(), dir, err)
+			}
+			return
+		}
+		if first && dir == ClientToBroker {
+			connect, ok := pk.(*packets.ConnectPacket)
+			if !ok {
+				s.p.logf("%s: first packet is %s, not CONNECT", s.id(), packets.PacketNames[packets.HeaderOf(pk).PacketType])
+				return
+			}
+			s.mu.Lock()
+			s.clientID = connect.ClientIdentifier
+			s.mu.Unlock()
+		}
+		first = false
+
+		if s.swallow(dir, from, pk) {
+			continue
+		}
+		s.p.cfg.Rules.rewrite(pk, dir == ClientToBroker)
+		if f := s.p.cfg.Filter; f != nil {
+			if pk = f(s.id(), dir, pk); pk == nil {
+				continue
+			}
+		}
+		if s.lose(dir, from, pk) {
+			continue
+		}
+		s.p.logf("%s %s %s", s.id(), dir, describe(pk))
+		if !s.send(to, pk) {
+			return
+		}
+	}
+}
+
+// swallow 处理已被代理丢弃的QoS 2消息的PUBREL, 代替接收方回复PUBCOMP
+func (s *session) swallow(dir Direction, from *link, pk packets.ControlPacket) bool {
+	rel, ok := pk.(*packets.PubrelPacket)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	dropped := s.dropped[dir][rel.PacketID]
+	delete(s.dropped[dir], rel.PacketID)
+	s.mu.Unlock()
+	if !dropped {
+		return false
+	}
+	comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+	comp.PacketID = rel.PacketID
+	s.p.logf("%s %s PUBREL id %d for a dropped message, answered by the proxy", s.id(), dir, rel.PacketID)
+	s.send(from, comp)
+	return true
+}
+
+// lose 按丢包率丢弃PUBLISH, QoS 1/2消息由代理代替接收方确认
+func (s *session) lose(dir Direction, from *link, pk packets.ControlPacket) bool {
+	pub, ok := pk.(*packets.PublishPacket)
+	if !ok || s.p.cfg.Faults.Loss == 0 || rand.Float64() >= s.p.cfg.Faults.Loss {
+		return false
+	}
+	s.p.logf("%s %s dropped %s", s.id(), dir, describe(pk))
+	switch pub.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+		ack.PacketID = pub.PacketID
+		s.send(from, ack)
+	case 2:
+		s.mu.Lock()
+		s.dropped[dir][pub.PacketID] = true
+		s.mu.Unlock()
+		rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+		rec.PacketID = pub.PacketID
+		s.send(from, rec)
+	}
+	return true
+}
+
+// send 按注入的延迟排队发送报文, 会话结束时返回false
+func (s *session) send(to *link, pk packets.ControlPacket) bool {
+	f := s.p.cfg.Faults
+	at := time.Now()
+	if f.Latency > 0 || f.Jitter > 0 {
+		at = at.Add(f.Latency)
+		if f.Jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(f.Jitter))))
+		}
+	}
+	select {
+	case to.queue <- delayed{at: at, pk: pk}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// writer 按时间顺序写出一端的报文
+func (s *session) writer(to *link) {
+	defer s.close()
+	for {
+		select {
+		case <-s.done:
+			return
+		case d := <-to.queue:
+			if !s.write(to, d) {
+				return
+			}
+		case <-to.eof:
+			for {
+				select {
+				case d := <-to.queue:
+					if !s.write(to, d) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write 等到发送时间后写出报文, 会话结束或写入失败时返回false
+func (s *session) write(to *link, d delayed) bool {
+	if d.at.Before(to.last) {
+		d.at = to.last
+	}
+	to.last = d.at
+	if wait := time.Until(d.at); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return false
+		}
+	}
+	return d.pk.Write(to.conn) == nil
+}
+
+// describe 报文的简短描述, 不包含负载和密码
+func describe(pk packets.ControlPacket) string {
+	switch p := pk.(type) {
+	case *packets.ConnectPacket:
+		return fmt.Sprintf("CONNECT client ID %q username %q clean %t keep alive %d", p.ClientIdentifier, p.Username, p.CleanSession, p.KeepAlive)
+	case *packets.ConnackPacket:
+		return fmt.Sprintf("CONNACK session present %t return code 0x%02x", p.SessionPresent, p.ReturnCode)
+	case *packets.PublishPacket:
+		return fmt.Sprintf("PUBLISH %q QoS %d retain %t dup %t id %d, %d bytes", p.TopicName, p.Qos, p.Retain, p.Dup, p.PacketID, len(p.Payload))
+	case *packets.PubackPacket:
+		return fmt.Sprintf("PUBACK id %d", p.PacketID)
+	case *packets.PubrecPacket:
+		return fmt.Sprintf("PUBREC id %d", p.PacketID)
+	case *packets.PubrelPacket:
+		return fmt.Sprintf("PUBREL id %d", p.PacketID)
+	case *packets.PubcompPacket:
+		return fmt.Sprintf("PUBCOMP id %d", p.PacketID)
+	case *packets.SubscribePacket:
+		return fmt.Sprintf("SUBSCRIBE id %d %q QoS %v", p.PacketID, p.Topics, p.Qoss)
+	case *packets.SubackPacket:
+		return fmt.Sprintf("SUBACK id %d return codes %v", p.PacketID, p.ReturnCodes)
+	case *packets.UnsubscribePacket:
+		return fmt.Sprintf("UNSUBSCRIBE id %d %q", p.PacketID, p.Topics)
+	case *packets.UnsubackPacket:
+		return fmt.Sprintf("UNSUBACK id %d", p.PacketID)
+	}
+	return packets.PacketNames[packets.HeaderOf(pk).PacketType]
+}
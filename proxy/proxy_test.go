@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/broker"
+	"github.com/boxungo/mqtt/client"
+	"github.com/boxungo/mqtt/hooks"
+	"github.com/boxungo/mqtt/packets"
+)
+
+// connect 通过代理连接服务端
+func connect(t *testing.T, p *Proxy, opts client.Options) (*client.Client, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	go p.ServeConn(c2)
+	return client.Connect(c1, opts)
+}
+
+// receive 等待一条消息
+func receive(t *testing.T, ch chan *packets.PublishPacket) *packets.PublishPacket {
+	t.Helper()
+	select {
+	case pk := <-ch:
+		return pk
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	p, err := New(Config{
+		Dial: func() (net.Conn, error) { return b.Pipe(), nil },
+		Rules: Rules{
+			Topics:         []TopicRule{{Client: "home/", Broker: "tenants/42/home/"}},
+			ClientIDPrefix: "t42-",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// 直接连接服务端的订阅者看到的是改写后的主题
+	direct := make(chan *packets.PublishPacket, 10)
+	d, err := client.Connect(b.Pipe(), client.Options{ClientID: "direct", CleanSession: true, OnMessage: func(c *client.Client, pk *packets.PublishPacket) { direct <- pk }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err = d.Subscribe(context.Background(), []string{"tenants/42/#"}, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	proxied := make(chan *packets.PublishPacket, 10)
+	c, err := connect(t, p, client.Options{ClientID: "sensor", CleanSession: true, OnMessage: func(c *client.Client, pk *packets.PublishPacket) { proxied <- pk }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Subscribe(context.Background(), []string{"home/+/cmd"}, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.Payload = "home/kitchen/temp", 1, []byte("21")
+	if err = c.Publish(context.Background(), pub); err != nil {
+		t.Fatal(err)
+	}
+	if pk := receive(t, direct); pk.TopicName != "tenants/42/home/kitchen/temp" {
+		t.Errorf("broker saw topic %q", pk.TopicName)
+	}
+
+	cmd := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	cmd.TopicName, cmd.Qos, cmd.Payload = "tenants/42/home/kitchen/cmd", 1, []byte("off")
+	if err = d.Publish(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, direct)
+	if pk := receive(t, proxied); pk.TopicName != "home/kitchen/cmd" || string(pk.Payload) != "off" {
+		t.Errorf("client received %q %q", pk.TopicName, pk.Payload)
+	}
+
+	// 客户端标识符加上了前缀, 同名的直连客户端不会接管代理的连接
+	if b.Stats().Snapshot().ClientsConnected != 2 {
+		t.Errorf("%d clients connected, should be 2", b.Stats().Snapshot().ClientsConnected)
+	}
+	if _, err = client.Connect(b.Pipe(), client.Options{ClientID: "t42-sensor", CleanSession: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Error("proxied client sensor was not taken over by t42-sensor")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	var h hooks.Hooks
+	h.Add(broker.NewAuth(false, map[string]string{"proxy": "secret"}))
+	b := broker.New(broker.Options{Hooks: &h})
+	defer b.Close()
+
+	for _, tc := range []struct {
+		password string
+		code     byte
+	}{
+		{"secret", packets.Accepted},
+		{"wrong", packets.ErrRefusedBadUsernameOrPassword},
+	} {
+		p, err := New(Config{
+			Dial:  func() (net.Conn, error) { return b.Pipe(), nil },
+			Rules: Rules{Username: "proxy", Password: tc.password},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 客户端不带凭据, 由代理填入
+		c, err := connect(t, p, client.Options{ClientID: "anon", CleanSession: true})
+		var ce *client.ConnackError
+		switch {
+		case err == nil:
+			c.Close()
+			if tc.code != packets.Accepted {
+				t.Errorf("password %q was accepted", tc.password)
+			}
+		case !errors.As(err, &ce) || ce.ReturnCode != tc.code:
+			t.Errorf("connecting with password %q returned %v", tc.password, err)
+		}
+		p.Close()
+	}
+}
+
+func TestLoss(t *testing.T) {
+	b := broker.New(broker.Options{})
+	defer b.Close()
+	p, err := New(Config{
+		Dial:   func() (net.Conn, error) { return b.Pipe(), nil },
+		Faults: Faults{Loss: 1, Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	direct := make(chan *packets.PublishPacket, 10)
+	d, err := client.Connect(b.Pipe(), client.Options{ClientID: "direct", CleanSession: true, OnMessage: func(c *client.Client, pk *packets.PublishPacket) { direct <- pk }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.Subscribe(context.Background(), []string{"#"}, []byte{2})
+
+	c, err := connect(t, p, client.Options{ClientID: "lossy", CleanSession: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 消息被丢弃, 但发送方的QoS交互照常完成
+	for qos := byte(0); qos <= 2; qos++ {
+		pub := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		pub.TopicName, pub.Qos, pub.Payload = "lost", qos, []byte("x")
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err = c.Publish(ctx, pub)
+		cancel()
+		if err != nil {
+			t.Fatalf("QoS %d publish: %v", qos, err)
+		}
+	}
+	// 非PUBLISH报文不受影响
+	if _, err = c.Subscribe(context.Background(), []string{"a"}, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pk := <-direct:
+		t.Errorf("broker delivered %q", pk.TopicName)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("a proxy without upstream was accepted")
+	}
+	if _, err := New(Config{Upstream: "localhost:1883", Faults: Faults{Loss: 1.5}}); err == nil {
+		t.Error("loss 1.5 was accepted")
+	}
+}
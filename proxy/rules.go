@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// TopicRule 主题前缀映射, 客户端一侧的 Client 前缀对应服务端一侧的 Broker 前缀
+// 客户端发布和订阅时把 Client 替换为 Broker, 服务端投递时反向替换
+type TopicRule struct {
+	Client string
+	Broker string
+}
+
+// Rules 改写规则
+type Rules struct {
+	Topics []TopicRule // 按顺序使用第一个匹配的规则, 没有匹配时主题不变
+
+	ClientIDPrefix string            // 为非空的客户端标识符加上前缀
+	ClientIDs      map[string]string // 客户端标识符的替换表, 优先于 ClientIDPrefix
+
+	// Username 不为空时替换CONNECT中的用户名和密码, 用于代理统一使用服务端分配的凭据
+	Username string
+	Password string
+}
+
+// toBroker 把客户端一侧的主题映射到服务端一侧
+func (r *Rules) toBroker(topic string) string {
+	if group, filter, ok := packets.ParseSharedFilter(topic); ok {
+		return packets.SharePrefix + group + "/" + r.toBroker(filter)
+	}
+	for _, t := range r.Topics {
+		if strings.HasPrefix(topic, t.Client) {
+			return t.Broker + topic[len(t.Client):]
+		}
+	}
+	return topic
+}
+
+// toClient 把服务端一侧的主题映射到客户端一侧
+func (r *Rules) toClient(topic string) string {
+	for _, t := range r.Topics {
+		if strings.HasPrefix(topic, t.Broker) {
+			return t.Client + topic[len(t.Broker):]
+		}
+	}
+	return topic
+}
+
+// clientID 改写客户端标识符
+func (r *Rules) clientID(id string) string {
+	if mapped, ok := r.ClientIDs[id]; ok {
+		return mapped
+	}
+	if id == "" {
+		return id
+	}
+	return r.ClientIDPrefix + id
+}
+
+// rewrite 改写报文, fromClient 表示报文由客户端发出
+// 只改变主题, 客户端标识符和凭据, 报文标识符保持不变, 因此QoS交互不受影响
+func (r *Rules) rewrite(pk packets.ControlPacket, fromClient bool) {
+	switch p := pk.(type) {
+	case *packets.ConnectPacket:
+		p.ClientIdentifier = r.clientID(p.ClientIdentifier)
+		if p.WillFlag {
+			p.WillTopic = r.toBroker(p.WillTopic)
+		}
+		if r.Username != "" {
+			p.UsernameFlag, p.Username = true, r.Username
+			p.PasswordFlag, p.Password = r.Password != "", []byte(r.Password)
+		}
+	case *packets.PublishPacket:
+		if fromClient {
+			p.TopicName = r.toBroker(p.TopicName)
+		} else {
+			p.TopicName = r.toClient(p.TopicName)
+		}
+	case *packets.SubscribePacket:
+		for i, topic := range p.Topics {
+			p.Topics[i] = r.toBroker(topic)
+		}
+	case *packets.UnsubscribePacket:
+		for i, topic := range p.Topics {
+			p.Topics[i] = r.toBroker(topic)
+		}
+	}
+}
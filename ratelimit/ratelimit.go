@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action 超出限制时的动作
+type Action int
+
+// 超出限制时的动作
+const (
+	Throttle   Action = iota // 放行, 但延迟读取该客户端的下一个报文
+	Drop                     // 丢弃报文
+	Disconnect               // 断开客户端
+)
+
+// Rule 限流规则, 速率为0表示不限制
+type Rule struct {
+	PacketsPerSecond float64
+	BytesPerSecond   float64
+	Burst            int // 桶容量的秒数, 不大于0时为1秒
+	Action           Action
+}
+
+// Result 限流结果
+type Result struct {
+	Allowed bool          // 是否放行该报文
+	Action  Action        // 不放行或需要延迟时的动作
+	Delay   time.Duration // Throttle时读取下一个报文前需要等待的时间
+}
+
+// Limiter 按客户端, 用户名和主题前缀限流, 可并发使用
+type Limiter struct {
+	Client   Rule
+	Username Rule
+	Topics   map[string]Rule // 主题前缀 -> 规则, 使用最长匹配的前缀
+
+	mu      sync.Mutex
+	buckets map[string]*buckets
+}
+
+// buckets 一个限流对象的报文桶和字节桶
+type buckets struct {
+	packets *Bucket
+	bytes   *Bucket
+}
+
+// Check 检查一个报文是否超出限制, topic 为空表示非PUBLISH报文, size 为报文字节数
+func (l *Limiter) Check(clientID string, username string, topic string, size int, now time.Time) Result {
+	res := Result{Allowed: true}
+	res = l.apply(res, "c/"+clientID, l.Client, size, now)
+	if username != "" {
+		res = l.apply(res, "u/"+username, l.Username, size, now)
+	}
+	if topic != "" {
+		if prefix, rule, ok := l.topicRule(topic); ok {
+			res = l.apply(res, "t/"+prefix, rule, size, now)
+		}
+	}
+	return res
+}
+
+// Forget 释放客户端的令牌桶, 应在客户端断开时调用
+func (l *Limiter) Forget(clientID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, "c/"+clientID)
+}
+
+// apply 按规则检查并合并结果
+func (l *Limiter) apply(res Result, key string, rule Rule, size int, now time.Time) Result {
+	if rule.PacketsPerSecond <= 0 && rule.BytesPerSecond <= 0 {
+		return res
+	}
+	b := l.get(key, rule)
+	if rule.Action == Throttle {
+		var delay time.Duration
+		if b.packets != nil {
+			delay = b.packets.ReserveN(now, 1)
+		}
+		if b.bytes != nil {
+			if d := b.bytes.ReserveN(now, size); d > delay {
+				delay = d
+			}
+		}
+		if delay > res.Delay {
+			res.Delay = delay
+		}
+		return res
+	}
+
+	if (b.packets == nil || b.packets.AllowN(now, 1)) && (b.bytes == nil || b.bytes.AllowN(now, size)) {
+		return res
+	}
+	res.Allowed = false
+	if rule.Action > res.Action {
+		res.Action = rule.Action
+	}
+	return res
+}
+
+// get 获取或新建令牌桶
+func (l *Limiter) get(key string, rule Rule) *buckets {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*buckets)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		burst := rule.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		b = &buckets{}
+		if rule.PacketsPerSecond > 0 {
+			b.packets = NewBucket(rule.PacketsPerSecond, int(rule.PacketsPerSecond)*burst)
+		}
+		if rule.BytesPerSecond > 0 {
+			b.bytes = NewBucket(rule.BytesPerSecond, int(rule.BytesPerSecond)*burst)
+		}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// topicRule 查找最长匹配的主题前缀规则
+func (l *Limiter) topicRule(topic string) (string, Rule, bool) {
+	var prefix string
+	var rule Rule
+	var found bool
+	for p, r := range l.Topics {
+		if strings.HasPrefix(topic, p) && (!found || len(p) > len(prefix)) {
+			prefix, rule, found = p, r, true
+		}
+	}
+	return prefix, rule, found
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 2)
+	if !b.AllowN(now, 1) || !b.AllowN(now, 1) || b.AllowN(now, 1) {
+		t.Errorf("Bucket did not enforce burst of 2")
+	}
+	if !b.AllowN(now.Add(100*time.Millisecond), 1) {
+		t.Errorf("Bucket did not refill after 100ms")
+	}
+	if d := b.ReserveN(now.Add(100*time.Millisecond), 5); d != 500*time.Millisecond {
+		t.Errorf("ReserveN returned %s, should be 500ms", d)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := &Limiter{
+		Client: Rule{PacketsPerSecond: 2, Action: Drop},
+		Topics: map[string]Rule{
+			"sensors/":     {BytesPerSecond: 100, Action: Throttle},
+			"sensors/bad/": {PacketsPerSecond: 1, Action: Disconnect},
+		},
+	}
+	if res := l.Check("c1", "", "", 2, now); !res.Allowed {
+		t.Errorf("first packet should be allowed")
+	}
+	if res := l.Check("c1", "", "sensors/temp", 150, now); !res.Allowed || res.Delay != 500*time.Millisecond {
+		t.Errorf("throttled packet returned %+v", res)
+	}
+	if res := l.Check("c1", "", "", 2, now); res.Allowed || res.Action != Drop {
+		t.Errorf("third packet returned %+v, should be dropped", res)
+	}
+	if res := l.Check("c2", "", "sensors/bad/x", 1, now); !res.Allowed {
+		t.Errorf("first packet on sensors/bad/ returned %+v", res)
+	}
+	if res := l.Check("c3", "", "sensors/bad/x", 1, now); res.Allowed || res.Action != Disconnect {
+		t.Errorf("second packet on sensors/bad/ returned %+v, should disconnect", res)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(2)
+	if !w.TryAcquire() || !w.TryAcquire() || w.TryAcquire() {
+		t.Errorf("Window did not enforce maximum of 2")
+	}
+	done := make(chan struct{})
+	go func() {
+		w.Acquire()
+		close(done)
+	}()
+	w.Release()
+	<-done
+	if w.Inflight() != 2 {
+		t.Errorf("Inflight is %d, should be 2", w.Inflight())
+	}
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import "sync"
+
+// Window 出站QoS 1和QoS 2消息的飞行窗口, 可并发使用
+// 3.1.1没有Receive Maximum, 窗口大小由服务端配置
+type Window struct {
+	max int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inflight int
+}
+
+// NewWindow 新建飞行窗口, max 不大于0时不限制
+func NewWindow(max int) *Window {
+	w := &Window{max: max}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// TryAcquire 窗口未满时占用一个位置并返回true
+func (w *Window) TryAcquire() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.max > 0 && w.inflight >= w.max {
+		return false
+	}
+	w.inflight++
+	return true
+}
+
+// Acquire 等待窗口有空位后占用一个位置
+func (w *Window) Acquire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.max > 0 && w.inflight >= w.max {
+		w.cond.Wait()
+	}
+	w.inflight++
+}
+
+// Release 收到PUBACK或PUBCOMP后释放一个位置
+func (w *Window) Release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inflight > 0 {
+		w.inflight--
+	}
+	w.cond.Signal()
+}
+
+// Inflight 飞行中的消息数
+func (w *Window) Inflight() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.inflight
+}
@@ -0,0 +1,54 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// IDGenerator 为空客户端标识符生成标识符, remote 为客户端地址, 未知时为nil
+type IDGenerator func(remote net.Addr) string
+
+// UUID 生成随机的UUID(版本4)作为客户端标识符
+func UUID(prefix string) IDGenerator {
+	return func(remote net.Addr) string {
+		var b [16]byte
+		rand.Read(b[:])
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%s%x-%x-%x-%x-%x", prefix, b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+}
+
+// Counter 生成前缀加递增序号的客户端标识符
+func Counter(prefix string) IDGenerator {
+	var n atomic.Uint64
+	return func(remote net.Addr) string {
+		return prefix + strconv.FormatUint(n.Add(1), 10)
+	}
+}
+
+// AddrHash 根据客户端地址的哈希生成客户端标识符, 同一地址得到相同的标识符
+// 地址未知时退化为 UUID
+func AddrHash(prefix string) IDGenerator {
+	fallback := UUID(prefix)
+	return func(remote net.Addr) string {
+		if remote == nil {
+			return fallback(remote)
+		}
+		sum := sha1.Sum([]byte(remote.Network() + "://" + remote.String()))
+		return prefix + hex.EncodeToString(sum[:8])
+	}
+}
+
+// remoteAddr 获取连接的远程地址
+func remoteAddr(conn interface{}) net.Addr {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
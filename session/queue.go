@@ -0,0 +1,211 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// ErrQueueFull 离线队列已满, 溢出策略为 Disconnect 时返回
+var ErrQueueFull = errors.New("session queue full")
+
+// Overflow 离线队列溢出策略
+type Overflow int
+
+// 溢出策略
+const (
+	DropOldest Overflow = iota // 丢弃最早的消息
+	DropNewest                 // 丢弃新到的消息
+	Disconnect                 // 丢弃新到的消息并返回 ErrQueueFull, 由调用者断开客户端
+)
+
+// Limits 离线队列限制, 值为0表示不限制
+type Limits struct {
+	MaxMessages   int           // 最大消息数
+	MaxBytes      int           // 最大负载字节数
+	Overflow      Overflow      // 溢出策略
+	MessageExpiry time.Duration // 消息过期时间
+}
+
+// Message 队列中的消息, 出队后未完成的消息带着原来的过期时间放回队列
+type Message struct {
+	Packet  *packets.PublishPacket
+	Expires time.Time // 过期时间, 零值表示不过期
+}
+
+// Queue 持久会话的离线消息队列, 可并发使用
+type Queue struct {
+	limits   Limits
+	onDrop   func(pk *packets.PublishPacket)      // 由注册表设置, 持有队列的锁时调用
+	released func(pk *packets.PublishPacket) bool // 由注册表设置, 已发送PUBREL的QoS 2消息不会过期
+
+	mu    sync.Mutex
+	msgs  []Message
+	bytes int
+}
+
+// NewQueue 新建离线消息队列
+func NewQueue(limits Limits) *Queue {
+	return &Queue{limits: limits}
+}
+
+// NewMessage 在 now 进入会话的消息, 按队列的限制设置过期时间
+func (q *Queue) NewMessage(pk *packets.PublishPacket, now time.Time) Message {
+	m := Message{Packet: pk}
+	if q.limits.MessageExpiry > 0 {
+		m.Expires = now.Add(q.limits.MessageExpiry)
+	}
+	return m
+}
+
+// Push 入队, 返回因超出限制而被丢弃的消息数
+func (q *Queue) Push(pk *packets.PublishPacket, now time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dropped := q.expire(now)
+	size := len(pk.Payload)
+	if q.limits.MaxBytes > 0 && size > q.limits.MaxBytes {
+		q.drop(pk)
+		return dropped + 1, q.overflow()
+	}
+	for q.full(size) {
+		if q.limits.Overflow != DropOldest {
+			q.drop(pk)
+			return dropped + 1, q.overflow()
+		}
+		q.drop(q.shift())
+		dropped++
+	}
+
+	q.msgs = append(q.msgs, q.NewMessage(pk, now))
+	q.bytes += size
+	return dropped, nil
+}
+
+// Requeue 把已出队但未完成的消息按顺序放回队列头部, 这些消息已被接受过, 不受数量和字节数限制
+// 消息保留原来的过期时间
+func (q *Queue) Requeue(msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, m := range msgs {
+		q.bytes += len(m.Packet.Payload)
+	}
+	q.msgs = append(append(make([]Message, 0, len(msgs)+len(q.msgs)), msgs...), q.msgs...)
+}
+
+// Pop 出队, 跳过已过期的消息
+func (q *Queue) Pop(now time.Time) (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire(now)
+	if len(q.msgs) == 0 {
+		return Message{}, false
+	}
+	m := q.msgs[0]
+	q.shift()
+	return m, true
+}
+
+// Remove 移除 match 返回true的消息并按入队顺序返回, 移除的消息不视为丢弃
+func (q *Queue) Remove(match func(pk *packets.PublishPacket) bool) []*packets.PublishPacket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var removed []*packets.PublishPacket
+	kept := q.msgs[:0]
+	for _, m := range q.msgs {
+		if match(m.Packet) {
+			q.bytes -= len(m.Packet.Payload)
+			removed = append(removed, m.Packet)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	for i := len(kept); i < len(q.msgs); i++ {
+		q.msgs[i] = Message{}
+	}
+	q.msgs = kept
+	return removed
+}
+
+// Expire 丢弃已过期的消息, 返回丢弃的数量
+func (q *Queue) Expire(now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.expire(now)
+}
+
+// Len 消息数
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.msgs)
+}
+
+// Bytes 负载字节数
+func (q *Queue) Bytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// full 加入size字节的消息后是否超出限制
+func (q *Queue) full(size int) bool {
+	if len(q.msgs) == 0 {
+		return false
+	}
+	if q.limits.MaxMessages > 0 && len(q.msgs)+1 > q.limits.MaxMessages {
+		return true
+	}
+	return q.limits.MaxBytes > 0 && q.bytes+size > q.limits.MaxBytes
+}
+
+// overflow 按溢出策略返回错误
+func (q *Queue) overflow() error {
+	if q.limits.Overflow == Disconnect {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// drop 通知消息被丢弃
+func (q *Queue) drop(pk *packets.PublishPacket) {
+	if q.onDrop != nil {
+		q.onDrop(pk)
+	}
+}
+
+// shift 移除最早的消息
+func (q *Queue) shift() *packets.PublishPacket {
+	pk := q.msgs[0].Packet
+	q.msgs[0] = Message{}
+	q.msgs = q.msgs[1:]
+	q.bytes -= len(pk.Payload)
+	return pk
+}
+
+// expire 丢弃已过期的消息
+// 已发送PUBREL的QoS 2消息已被客户端收到, 丢弃后客户端会一直等待PUBREL, 因此不会过期
+func (q *Queue) expire(now time.Time) int {
+	n := 0
+	kept := q.msgs[:0]
+	for _, m := range q.msgs {
+		if !m.Expires.IsZero() && !now.Before(m.Expires) && (q.released == nil || !q.released(m.Packet)) {
+			q.bytes -= len(m.Packet.Payload)
+			q.drop(m.Packet)
+			n++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	for i := len(kept); i < len(q.msgs); i++ {
+		q.msgs[i] = Message{}
+	}
+	q.msgs = kept
+	return n
+}
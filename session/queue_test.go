@@ -0,0 +1,151 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+func publish(payload string) *packets.PublishPacket {
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.Qos = 1
+	pk.TopicName = "a"
+	pk.Payload = []byte(payload)
+	return pk
+}
+
+func TestQueueOverflow(t *testing.T) {
+	now := time.Now()
+	q := NewQueue(Limits{MaxMessages: 2, Overflow: DropOldest})
+	q.Push(publish("1"), now)
+	q.Push(publish("2"), now)
+	if dropped, err := q.Push(publish("3"), now); dropped != 1 || err != nil {
+		t.Errorf("Push returned (%d, %v), should be (1, nil)", dropped, err)
+	}
+	if m, _ := q.Pop(now); string(m.Packet.Payload) != "2" {
+		t.Errorf("DropOldest kept %s, should be 2", m.Packet.Payload)
+	}
+
+	q = NewQueue(Limits{MaxBytes: 5, Overflow: DropNewest})
+	q.Push(publish("abc"), now)
+	if dropped, err := q.Push(publish("def"), now); dropped != 1 || err != nil || q.Len() != 1 {
+		t.Errorf("DropNewest returned (%d, %v) with %d messages", dropped, err, q.Len())
+	}
+
+	q = NewQueue(Limits{MaxMessages: 1, Overflow: Disconnect})
+	q.Push(publish("1"), now)
+	if _, err := q.Push(publish("2"), now); err != ErrQueueFull {
+		t.Errorf("Disconnect returned %v, should be %v", err, ErrQueueFull)
+	}
+}
+
+func TestQueueRequeue(t *testing.T) {
+	now := time.Now()
+	q := NewQueue(Limits{MaxMessages: 2})
+	q.Push(publish("3"), now)
+	q.Push(publish("4"), now)
+	q.Requeue([]Message{{Packet: publish("1")}, {Packet: publish("2")}})
+	var got []string
+	for {
+		m, ok := q.Pop(now)
+		if !ok {
+			break
+		}
+		got = append(got, string(m.Packet.Payload))
+	}
+	if strings.Join(got, ",") != "1,2,3,4" || q.Bytes() != 0 {
+		t.Errorf("popped %v with %d bytes left, should be [1 2 3 4]", got, q.Bytes())
+	}
+
+	// 放回的消息保留原来的过期时间
+	q = NewQueue(Limits{MessageExpiry: time.Minute})
+	q.Push(publish("1"), now)
+	m, _ := q.Pop(now.Add(30 * time.Second))
+	q.Requeue([]Message{m})
+	if _, ok := q.Pop(now.Add(time.Minute)); ok || q.Bytes() != 0 {
+		t.Errorf("requeued message did not expire a minute after it was queued")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	q := NewQueue(Limits{MessageExpiry: time.Minute})
+	q.Push(publish("old"), now)
+	q.Push(publish("new"), now.Add(30*time.Second))
+	if m, ok := q.Pop(now.Add(time.Minute)); !ok || string(m.Packet.Payload) != "new" || q.Bytes() != 0 {
+		t.Errorf("Pop did not skip the expired message")
+	}
+
+	r := &Registry{SessionExpiry: time.Hour}
+	c := &conn{}
+	s, _, _ := r.Connect(connect("dev", false), c)
+	r.Disconnect(s, c, true)
+	if expired := r.Expire(time.Now()); len(expired) != 0 {
+		t.Errorf("session expired too early")
+	}
+	if expired := r.Expire(time.Now().Add(time.Hour)); len(expired) != 1 || r.Len() != 0 {
+		t.Errorf("session was not purged after SessionExpiry")
+	}
+}
+
+func TestQueueOnDrop(t *testing.T) {
+	now := time.Now()
+	var dropped []string
+	r := &Registry{
+		Limits: Limits{MaxMessages: 1, Overflow: DropOldest, MessageExpiry: time.Minute},
+		OnDrop: func(s *Session, pk *packets.PublishPacket) { dropped = append(dropped, string(pk.Payload)) },
+	}
+	s, _, _ := r.Connect(connect("dev", false), &conn{})
+	s.Queue.Push(publish("1"), now)
+	s.Queue.Push(publish("2"), now)
+	s.Queue.Expire(now.Add(time.Minute))
+	if strings.Join(dropped, ",") != "1,2" {
+		t.Errorf("OnDrop called for %v, should be [1 2]", dropped)
+	}
+}
+
+func TestExpiryReleased(t *testing.T) {
+	now := time.Now()
+	r := &Registry{Limits: Limits{MessageExpiry: time.Minute}}
+	s, _, _ := r.Connect(connect("dev", false), &conn{})
+	for _, payload := range []string{"released", "queued"} {
+		pk := publish(payload)
+		pk.Qos = 2
+		pk.PacketID, _ = s.AllocateID()
+		if payload == "released" {
+			s.Release(pk.PacketID)
+		}
+		s.Queue.Push(pk, now)
+	}
+	// 已发送PUBREL的消息不会过期
+	if n := s.Queue.Expire(now.Add(time.Hour)); n != 1 {
+		t.Errorf("Expire dropped %d messages, should be 1", n)
+	}
+	if m, ok := s.Queue.Pop(now.Add(time.Hour)); !ok || string(m.Packet.Payload) != "released" {
+		t.Errorf("released message was not kept")
+	}
+}
+
+func TestPacketIDs(t *testing.T) {
+	s := &Session{}
+	s.ReserveID(1)
+	if id, ok := s.AllocateID(); id != 2 || !ok {
+		t.Errorf("AllocateID returned %d, %t after reserving 1", id, ok)
+	}
+	for i := 0; i < 65533; i++ {
+		s.AllocateID()
+	}
+	if _, ok := s.AllocateID(); ok {
+		t.Error("AllocateID succeeded with all identifiers in use")
+	}
+	s.Release(100)
+	if !s.Released(100) {
+		t.Error("Released returned false after Release")
+	}
+	s.FreeID(100)
+	if id, ok := s.AllocateID(); id != 100 || !ok || s.Released(100) {
+		t.Errorf("AllocateID returned %d, %t after freeing 100", id, ok)
+	}
+}
@@ -0,0 +1,353 @@
+package session
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// Policy 客户端标识符重复时的处理策略
+type Policy int
+
+// 处理策略
+const (
+	Takeover  Policy = iota // 断开已有的连接, 新连接接管会话(协议规定的行为)
+	Reject                  // 拒绝新连接, 返回 ErrRefusedIDRejected
+	AllowBoth               // 保留两个连接, 为新连接的客户端标识符加上后缀, 仅用于调试
+)
+
+// Session 客户端会话
+type Session struct {
+	ClientID      string
+	Assigned      bool // 客户端标识符是否由服务端分配
+	CleanSession  bool
+	Subscriptions map[string]byte        // 主题过滤器 -> QoS
+	Will          *packets.PublishPacket // 遗嘱消息, 没有遗嘱时为nil
+	Queue         *Queue                 // 离线消息队列
+
+	conn           io.Closer
+	disconnectedAt time.Time
+
+	// 出站报文标识符在消息进入会话时分配, 重发和重连后不变
+	idMu   sync.Mutex
+	nextID uint16
+	ids    map[uint16]bool // 使用中的标识符 -> QoS 2消息是否已发送PUBREL
+
+	// 客户端发布的QoS 2消息在收到PUBREL之前的报文标识符, 重连后用于识别重发的消息
+	recvMu   sync.Mutex
+	received map[uint16]bool
+}
+
+// Connected 会话当前是否有网络连接
+func (s *Session) Connected() bool {
+	return s.conn != nil
+}
+
+// AllocateID 为投递给会话的QoS 1或QoS 2消息分配报文标识符, 65535个标识符都在使用时返回false
+func (s *Session) AllocateID() (uint16, bool) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[uint16]bool)
+	}
+	if len(s.ids) == 65535 {
+		return 0, false
+	}
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		if _, used := s.ids[s.nextID]; !used {
+			s.ids[s.nextID] = false
+			return s.nextID, true
+		}
+	}
+}
+
+// ReserveID 标记报文标识符已被使用, 用于从持久化存储恢复的消息
+func (s *Session) ReserveID(id uint16) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[uint16]bool)
+	}
+	if _, used := s.ids[id]; !used {
+		s.ids[id] = false
+	}
+}
+
+// Release 记录已为QoS 2消息发送PUBREL, 重发时发送PUBREL而不是PUBLISH
+func (s *Session) Release(id uint16) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	if _, used := s.ids[id]; used {
+		s.ids[id] = true
+	}
+}
+
+// Released QoS 2消息是否已发送PUBREL
+func (s *Session) Released(id uint16) bool {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	return s.ids[id]
+}
+
+// FreeID 消息投递完成或被丢弃后释放报文标识符
+func (s *Session) FreeID(id uint16) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	delete(s.ids, id)
+}
+
+// Receive 记录收到客户端的QoS 2消息, 收到PUBREL之前重发的消息返回false
+func (s *Session) Receive(id uint16) bool {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	if s.received[id] {
+		return false
+	}
+	if s.received == nil {
+		s.received = make(map[uint16]bool)
+	}
+	s.received[id] = true
+	return true
+}
+
+// Complete 收到客户端的PUBREL, 返回该报文标识符是否在等待PUBREL
+func (s *Session) Complete(id uint16) bool {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	if !s.received[id] {
+		return false
+	}
+	delete(s.received, id)
+	return true
+}
+
+// Registry 会话注册表, 可并发使用
+type Registry struct {
+	Policy         Policy                                        // 客户端标识符重复时的处理策略
+	NewID          IDGenerator                                   // 为空客户端标识符生成标识符, 为nil时使用 UUID
+	Limits         Limits                                        // 持久会话离线队列的限制
+	SessionExpiry  time.Duration                                 // 持久会话断开后保留的时间, 0表示永久保留
+	WillOnTakeover bool                                          // 被接管的连接是否发布遗嘱
+	OnWill         func(s *Session, will *packets.PublishPacket) // 发布遗嘱消息
+	OnTakeover     func(s *Session)                              // 连接被接管时调用, 此时旧连接已关闭
+	OnDrop         func(s *Session, pk *packets.PublishPacket)   // 离线队列因溢出或过期丢弃消息时调用, 不能再访问该队列
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	assigned map[string]bool // AssignID 分配的, 还没有用于 Connect 的标识符
+}
+
+// Connect 为CONNECT报文关联会话, 返回会话, 会话是否已存在和CONNACK返回码
+// 调用前应先用 ConnectPacket.Validate 验证报文
+// 客户端标识符为空时由 NewID 分配, 通过 Session.ClientID 获取
+func (r *Registry) Connect(pk *packets.ConnectPacket, conn io.Closer) (*Session, bool, byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]*Session)
+	}
+
+	id := pk.ClientIdentifier
+	assigned := id == "" || r.assigned[id]
+	delete(r.assigned, id)
+	if id == "" {
+		id = r.assign(conn)
+	}
+	old := r.sessions[id]
+	if old != nil && old.Connected() {
+		switch r.Policy {
+		case Reject:
+			return nil, false, packets.ErrRefusedIDRejected
+		case AllowBoth:
+			id = r.suffixed(id)
+			old = nil
+		default:
+			r.takeover(old)
+		}
+	}
+
+	// 恢复的会话的 ClientID, Assigned 和 CleanSession 与新连接相同, 不再写入,
+	// 这三个字段创建后不变, 其他协程可以不加锁读取
+	var present bool
+	s := old
+	if s == nil || s.CleanSession || pk.CleanSession {
+		s = &Session{
+			ClientID:      id,
+			Assigned:      assigned,
+			CleanSession:  pk.CleanSession,
+			Subscriptions: make(map[string]byte),
+		}
+		r.newQueue(s)
+	} else {
+		present = true
+	}
+	s.Will = willPacket(pk)
+	s.conn = conn
+	r.sessions[id] = s
+
+	return s, present, packets.Accepted
+}
+
+// Disconnect 会话的连接断开
+// graceful 表示收到了DISCONNECT报文, 否则发布遗嘱
+// conn 不是会话的当前连接时(已被接管)不做任何处理
+func (r *Registry) Disconnect(s *Session, conn io.Closer, graceful bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.conn != conn {
+		return
+	}
+	s.conn = nil
+	s.disconnectedAt = time.Now()
+	if !graceful && s.Will != nil && r.OnWill != nil {
+		r.OnWill(s, s.Will)
+	}
+	s.Will = nil
+	if s.CleanSession && r.sessions[s.ClientID] == s {
+		delete(r.sessions, s.ClientID)
+	}
+}
+
+// Expire 清除断开时间超过 SessionExpiry 的持久会话, 并丢弃各会话中已过期的消息
+// 返回被清除的会话, 应由调用者周期性调用
+func (r *Registry) Expire(now time.Time) []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []*Session
+	for id, s := range r.sessions {
+		if r.SessionExpiry > 0 && !s.Connected() && now.Sub(s.disconnectedAt) >= r.SessionExpiry {
+			delete(r.sessions, id)
+			expired = append(expired, s)
+			continue
+		}
+		s.Queue.Expire(now)
+	}
+	return expired
+}
+
+// AssignID 为空客户端标识符分配一个未被使用的标识符
+// 用于在调用 Connect 之前就需要知道客户端标识符的场景, 如认证钩子
+// 之后以该标识符调用 Connect 时, 会话的 Assigned 为true
+func (r *Registry) AssignID(conn io.Closer) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.assign(conn)
+	if r.assigned == nil {
+		r.assigned = make(map[string]bool)
+	}
+	r.assigned[id] = true
+	return id
+}
+
+// ReleaseID 释放 AssignID 分配但没有用于 Connect 的标识符, 用于连接在 Connect 之前被拒绝时
+func (r *Registry) ReleaseID(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.assigned, id)
+}
+
+// Restore 恢复持久化的离线会话, 已存在同名会话时不做处理
+func (r *Registry) Restore(clientID string, subscriptions map[string]byte) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]*Session)
+	}
+	if s, ok := r.sessions[clientID]; ok {
+		return s
+	}
+	s := &Session{
+		ClientID:       clientID,
+		Subscriptions:  subscriptions,
+		disconnectedAt: time.Now(),
+	}
+	r.newQueue(s)
+	if s.Subscriptions == nil {
+		s.Subscriptions = make(map[string]byte)
+	}
+	r.sessions[clientID] = s
+	return s
+}
+
+// Get 获取会话
+func (r *Registry) Get(clientID string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[clientID]
+	return s, ok
+}
+
+// Len 会话数量
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// newQueue 为会话新建离线队列
+func (r *Registry) newQueue(s *Session) {
+	s.Queue = NewQueue(r.Limits)
+	s.Queue.released = func(pk *packets.PublishPacket) bool { return s.Released(pk.PacketID) }
+	if onDrop := r.OnDrop; onDrop != nil {
+		s.Queue.onDrop = func(pk *packets.PublishPacket) { onDrop(s, pk) }
+	}
+}
+
+// takeover 关闭已有连接, 按配置发布遗嘱
+func (r *Registry) takeover(s *Session) {
+	s.conn.Close()
+	s.conn = nil
+	if r.WillOnTakeover && s.Will != nil && r.OnWill != nil {
+		r.OnWill(s, s.Will)
+	}
+	s.Will = nil
+	if r.OnTakeover != nil {
+		r.OnTakeover(s)
+	}
+}
+
+// assign 为空客户端标识符分配未被使用的标识符
+func (r *Registry) assign(conn io.Closer) string {
+	newID := r.NewID
+	if newID == nil {
+		newID = UUID("")
+	}
+	id := newID(remoteAddr(conn))
+	if _, ok := r.sessions[id]; ok || r.assigned[id] {
+		return r.suffixed(id)
+	}
+	return id
+}
+
+// suffixed 为重复的客户端标识符生成未被使用的后缀标识符
+func (r *Registry) suffixed(id string) string {
+	for i := 1; ; i++ {
+		candidate := id + "-" + strconv.Itoa(i)
+		if r.assigned[candidate] {
+			continue
+		}
+		if s, ok := r.sessions[candidate]; !ok || !s.Connected() {
+			return candidate
+		}
+	}
+}
+
+// willPacket 根据CONNECT报文生成遗嘱消息
+func willPacket(pk *packets.ConnectPacket) *packets.PublishPacket {
+	if !pk.WillFlag {
+		return nil
+	}
+	will := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	will.Qos = pk.WillQos
+	will.Retain = pk.WillRetain
+	will.TopicName = pk.WillTopic
+	will.Payload = pk.WillMessage
+	return will
+}
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"net"
+	"testing"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+type conn struct {
+	closed bool
+}
+
+func (c *conn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func connect(id string, clean bool) *packets.ConnectPacket {
+	pk := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	pk.ClientIdentifier = id
+	pk.CleanSession = clean
+	pk.WillFlag = true
+	pk.WillTopic = "status/" + id
+	pk.WillMessage = []byte("offline")
+	return pk
+}
+
+func TestTakeover(t *testing.T) {
+	var wills []string
+	r := &Registry{
+		WillOnTakeover: true,
+		OnWill: func(s *Session, will *packets.PublishPacket) {
+			wills = append(wills, will.TopicName)
+		},
+	}
+	c1, c2 := &conn{}, &conn{}
+	s1, present, code := r.Connect(connect("dev", false), c1)
+	if code != packets.Accepted || present {
+		t.Fatalf("first Connect returned (%t, %d)", present, code)
+	}
+	s1.Subscriptions["a/b"] = 1
+
+	s2, present, code := r.Connect(connect("dev", false), c2)
+	if code != packets.Accepted || !present {
+		t.Fatalf("second Connect returned (%t, %d)", present, code)
+	}
+	if !c1.closed || c2.closed {
+		t.Errorf("old connection should be closed and new one kept open")
+	}
+	if s2 != s1 || s2.Subscriptions["a/b"] != 1 {
+		t.Errorf("session was not migrated to the new connection")
+	}
+	if len(wills) != 1 || wills[0] != "status/dev" {
+		t.Errorf("will was not published on takeover: %v", wills)
+	}
+
+	// 旧连接的清理不能影响新连接
+	r.Disconnect(s1, c1, false)
+	if !s2.Connected() || len(wills) != 1 {
+		t.Errorf("disconnect of the old connection affected the new one")
+	}
+	r.Disconnect(s2, c2, true)
+	if s2.Connected() || len(wills) != 1 || r.Len() != 1 {
+		t.Errorf("graceful disconnect should keep persistent session without will")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	r := &Registry{Policy: Reject}
+	r.Connect(connect("dev", true), &conn{})
+	if _, _, code := r.Connect(connect("dev", true), &conn{}); code != packets.ErrRefusedIDRejected {
+		t.Errorf("Reject policy returned %d, should be %d", code, packets.ErrRefusedIDRejected)
+	}
+
+	r = &Registry{Policy: AllowBoth}
+	c1 := &conn{}
+	r.Connect(connect("dev", true), c1)
+	s, _, code := r.Connect(connect("dev", true), &conn{})
+	if code != packets.Accepted || s.ClientID != "dev-1" || c1.closed {
+		t.Errorf("AllowBoth policy returned (%s, %d)", s.ClientID, code)
+	}
+	if s, _, _ = r.Connect(connect("dev", true), &conn{}); s.ClientID != "dev-2" {
+		t.Errorf("AllowBoth policy assigned %s, should be dev-2", s.ClientID)
+	}
+}
+
+type netConn struct {
+	conn
+	addr net.Addr
+}
+
+func (c *netConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestAssignedClientID(t *testing.T) {
+	r := &Registry{NewID: Counter("auto-")}
+	s, _, code := r.Connect(connect("", true), &conn{})
+	if code != packets.Accepted || s.ClientID != "auto-1" || !s.Assigned {
+		t.Errorf("Connect assigned (%s, %t, %d), should be (auto-1, true, 0)", s.ClientID, s.Assigned, code)
+	}
+	if s, _, _ = r.Connect(connect("", true), &conn{}); s.ClientID != "auto-2" {
+		t.Errorf("Connect assigned %s, should be auto-2", s.ClientID)
+	}
+
+	if id := UUID("")(nil); len(id) != 36 || id[14] != '4' {
+		t.Errorf("UUID generated %q", id)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	r = &Registry{NewID: AddrHash("h-")}
+	s1, _, _ := r.Connect(connect("", true), &netConn{addr: addr})
+	s2, _, _ := r.Connect(connect("", true), &netConn{addr: addr})
+	if s1.ClientID != AddrHash("h-")(addr) || s2.ClientID != s1.ClientID+"-1" {
+		t.Errorf("AddrHash assigned (%s, %s)", s1.ClientID, s2.ClientID)
+	}
+
+	// AssignID 分配后再 Connect, 会话标记为服务端分配
+	r = &Registry{NewID: AddrHash("h-")}
+	id1, id2 := r.AssignID(&netConn{addr: addr}), r.AssignID(&netConn{addr: addr})
+	if id1 == id2 {
+		t.Errorf("AssignID returned %s twice", id1)
+	}
+	if s, _, _ = r.Connect(connect(id1, true), &conn{}); !s.Assigned {
+		t.Errorf("session connected with an AssignID identifier is not Assigned")
+	}
+	r.ReleaseID(id2)
+	if s, _, _ = r.Connect(connect(id2, true), &conn{}); s.Assigned {
+		t.Errorf("session connected with a released identifier is Assigned")
+	}
+}
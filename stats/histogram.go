@@ -0,0 +1,69 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+)
+
+// PayloadBuckets 默认的消息负载大小分桶(字节)
+var PayloadBuckets = []float64{16, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// LatencyBuckets 默认的投递延迟分桶(秒)
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Histogram 直方图, 可并发使用
+// 计数和总和在同一把锁下更新, 快照中各桶的计数, 观测次数和总和总是一致的
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // 每个桶的计数, 最后一个为 +Inf
+	count  uint64
+	sum    float64
+}
+
+// HistogramSnapshot 直方图快照
+type HistogramSnapshot struct {
+	Buckets    []float64 // 升序的桶上限, 不含 +Inf
+	Cumulative []uint64  // 每个桶的累计计数
+	Count      uint64    // 观测次数, 即 +Inf 桶的累计计数
+	Sum        float64   // 观测值总和
+}
+
+// NewHistogram 按升序的桶上限新建直方图
+func NewHistogram(buckets []float64) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)+1),
+	}
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// Snapshot 直方图快照
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Buckets:    h.buckets,
+		Cumulative: make([]uint64, len(h.buckets)),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var total uint64
+	for i := range h.buckets {
+		total += h.counts[i]
+		snap.Cumulative[i] = total
+	}
+	snap.Count = h.count
+	snap.Sum = h.sum
+	return snap
+}
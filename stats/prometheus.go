@@ -0,0 +1,83 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// ContentType Prometheus文本格式的内容类型
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler 以Prometheus文本格式输出统计信息
+func (s *Stats) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		s.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus 以Prometheus文本格式写入统计信息
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	snap := s.Snapshot()
+
+	gauge(bw, "mqtt_uptime_seconds", "Seconds since the statistics were started.", snap.Uptime.Seconds())
+	gauge(bw, "mqtt_clients_connected", "Number of currently connected clients.", float64(snap.ClientsConnected))
+	gauge(bw, "mqtt_clients_total", "Number of connected clients plus persistent sessions.", float64(snap.ClientsTotal))
+	gauge(bw, "mqtt_subscriptions", "Number of active subscriptions.", float64(snap.Subscriptions))
+	gauge(bw, "mqtt_retained_messages", "Number of retained messages.", float64(snap.Retained))
+	gauge(bw, "mqtt_inflight_messages", "Number of QoS 1 and 2 messages in the inflight window.", float64(snap.Inflight))
+
+	perType(bw, "mqtt_packets_received_total", "Control packets received by type.", snap.PacketsReceived[:])
+	perType(bw, "mqtt_packets_sent_total", "Control packets sent by type.", snap.PacketsSent[:])
+	perType(bw, "mqtt_bytes_received_total", "Bytes received by packet type.", snap.BytesReceived[:])
+	perType(bw, "mqtt_bytes_sent_total", "Bytes sent by packet type.", snap.BytesSent[:])
+
+	fmt.Fprintf(bw, "# HELP mqtt_connack_total CONNACK packets by return code.\n# TYPE mqtt_connack_total counter\n")
+	for code := range s.connack {
+		if n := s.connack[code].Load(); n > 0 {
+			fmt.Fprintf(bw, "mqtt_connack_total{code=\"%d\"} %d\n", code, n)
+		}
+	}
+	fmt.Fprintf(bw, "# HELP mqtt_messages_dropped_total Messages dropped before delivery.\n# TYPE mqtt_messages_dropped_total counter\nmqtt_messages_dropped_total %d\n", s.dropped.Load())
+
+	histogram(bw, "mqtt_publish_payload_bytes", "Size of PUBLISH payloads.", s.payloadSize)
+	histogram(bw, "mqtt_delivery_latency_seconds", "Time from receiving a PUBLISH to completing its delivery.", s.latency)
+
+	return bw.Flush()
+}
+
+// gauge 写入一个无标签的gauge
+func gauge(w io.Writer, name string, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// perType 写入按报文类型区分的计数器
+func perType(w io.Writer, name string, help string, values []int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for t := packets.CONNECT; t <= packets.DISCONNECT; t++ {
+		fmt.Fprintf(w, "%s{type=\"%s\"} %d\n", name, strings.ToLower(packets.PacketNames[uint8(t)]), values[t])
+	}
+}
+
+// histogram 写入直方图
+func histogram(w io.Writer, name string, help string, h *Histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	snap := h.Snapshot()
+	for i, bound := range snap.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), snap.Cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, snap.Count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(snap.Sum), name, snap.Count)
+}
+
+// formatFloat 格式化浮点数
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,237 @@
+package stats
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// SysPrefix $SYS主题前缀
+const SysPrefix = "$SYS/broker/"
+
+// DefaultInterval 默认的$SYS发布间隔
+const DefaultInterval = 10 * time.Second
+
+// counter 报文计数
+type counter struct {
+	packets atomic.Int64
+	bytes   atomic.Int64
+}
+
+// Stats 代理统计信息, 可并发使用
+type Stats struct {
+	start    time.Time
+	received [packets.DISCONNECT + 1]counter
+	sent     [packets.DISCONNECT + 1]counter
+
+	clientsConnected atomic.Int64
+	clientsTotal     atomic.Int64
+	subscriptions    atomic.Int64
+	retained         atomic.Int64
+	inflight         atomic.Int64
+
+	connack     [256]atomic.Int64
+	dropped     atomic.Int64
+	payloadSize *Histogram
+	latency     *Histogram
+}
+
+// New 新建统计信息
+func New() *Stats {
+	return &Stats{
+		start:       time.Now(),
+		payloadSize: NewHistogram(PayloadBuckets),
+		latency:     NewHistogram(LatencyBuckets),
+	}
+}
+
+// Received 记录收到的报文及其字节数
+func (s *Stats) Received(packetType byte, size int) {
+	if packetType < packets.CONNECT || packetType > packets.DISCONNECT {
+		return
+	}
+	s.received[packetType].packets.Add(1)
+	s.received[packetType].bytes.Add(int64(size))
+}
+
+// Sent 记录发送的报文及其字节数
+func (s *Stats) Sent(packetType byte, size int) {
+	if packetType < packets.CONNECT || packetType > packets.DISCONNECT {
+		return
+	}
+	s.sent[packetType].packets.Add(1)
+	s.sent[packetType].bytes.Add(int64(size))
+}
+
+// ClientConnected 客户端连接
+func (s *Stats) ClientConnected() {
+	s.clientsConnected.Add(1)
+	s.clientsTotal.Add(1)
+}
+
+// ClientDisconnected 客户端断开连接
+// 持久会话仍计入客户端总数, 会话清除时调用 SessionRemoved
+func (s *Stats) ClientDisconnected() {
+	s.clientsConnected.Add(-1)
+}
+
+// SessionRestored 从持久化存储恢复了一个没有连接的会话, 计入客户端总数
+func (s *Stats) SessionRestored() {
+	s.clientsTotal.Add(1)
+}
+
+// SessionRemoved 会话被清除
+func (s *Stats) SessionRemoved() {
+	s.clientsTotal.Add(-1)
+}
+
+// SetSubscriptions 设置订阅数
+func (s *Stats) SetSubscriptions(n int64) { s.subscriptions.Store(n) }
+
+// SetRetained 设置保留消息数
+func (s *Stats) SetRetained(n int64) { s.retained.Store(n) }
+
+// SetInflight 设置飞行窗口中的消息数
+func (s *Stats) SetInflight(n int64) { s.inflight.Store(n) }
+
+// AddInflight 增减飞行窗口中的消息数, 用于多个客户端共用一个统计信息
+func (s *Stats) AddInflight(delta int64) { s.inflight.Add(delta) }
+
+// Connack 记录CONNACK返回码
+func (s *Stats) Connack(code byte) { s.connack[code].Add(1) }
+
+// Payload 记录PUBLISH消息负载大小
+func (s *Stats) Payload(size int) { s.payloadSize.Observe(float64(size)) }
+
+// Delivered 记录消息从收到到完成投递的延迟
+func (s *Stats) Delivered(latency time.Duration) { s.latency.Observe(latency.Seconds()) }
+
+// Dropped 记录被丢弃的消息
+func (s *Stats) Dropped() { s.dropped.Add(1) }
+
+// Snapshot 统计信息快照
+type Snapshot struct {
+	Uptime           time.Duration
+	ClientsConnected int64
+	ClientsTotal     int64
+	Subscriptions    int64
+	Retained         int64
+	Inflight         int64
+
+	// 按报文类型的计数, 下标为报文类型
+	PacketsReceived [packets.DISCONNECT + 1]int64
+	PacketsSent     [packets.DISCONNECT + 1]int64
+	BytesReceived   [packets.DISCONNECT + 1]int64
+	BytesSent       [packets.DISCONNECT + 1]int64
+}
+
+// Snapshot 获取统计信息快照
+func (s *Stats) Snapshot() Snapshot {
+	snap := Snapshot{
+		Uptime:           time.Since(s.start),
+		ClientsConnected: s.clientsConnected.Load(),
+		ClientsTotal:     s.clientsTotal.Load(),
+		Subscriptions:    s.subscriptions.Load(),
+		Retained:         s.retained.Load(),
+		Inflight:         s.inflight.Load(),
+	}
+	for t := packets.CONNECT; t <= packets.DISCONNECT; t++ {
+		snap.PacketsReceived[t] = s.received[t].packets.Load()
+		snap.PacketsSent[t] = s.sent[t].packets.Load()
+		snap.BytesReceived[t] = s.received[t].bytes.Load()
+		snap.BytesSent[t] = s.sent[t].bytes.Load()
+	}
+	return snap
+}
+
+// MessagesReceived 收到的报文总数
+func (snap *Snapshot) MessagesReceived() int64 { return sum(snap.PacketsReceived[:]) }
+
+// MessagesSent 发送的报文总数
+func (snap *Snapshot) MessagesSent() int64 { return sum(snap.PacketsSent[:]) }
+
+// TotalBytesReceived 收到的字节总数
+func (snap *Snapshot) TotalBytesReceived() int64 { return sum(snap.BytesReceived[:]) }
+
+// TotalBytesSent 发送的字节总数
+func (snap *Snapshot) TotalBytesSent() int64 { return sum(snap.BytesSent[:]) }
+
+// SysTopics 按Mosquitto兼容的$SYS布局生成主题及其值
+func (s *Stats) SysTopics() map[string]string {
+	snap := s.Snapshot()
+	topics := map[string]string{
+		SysPrefix + "uptime":                    strconv.FormatInt(int64(snap.Uptime/time.Second), 10) + " seconds",
+		SysPrefix + "clients/connected":         strconv.FormatInt(snap.ClientsConnected, 10),
+		SysPrefix + "clients/total":             strconv.FormatInt(snap.ClientsTotal, 10),
+		SysPrefix + "messages/received":         strconv.FormatInt(snap.MessagesReceived(), 10),
+		SysPrefix + "messages/sent":             strconv.FormatInt(snap.MessagesSent(), 10),
+		SysPrefix + "messages/inflight":         strconv.FormatInt(snap.Inflight, 10),
+		SysPrefix + "bytes/received":            strconv.FormatInt(snap.TotalBytesReceived(), 10),
+		SysPrefix + "bytes/sent":                strconv.FormatInt(snap.TotalBytesSent(), 10),
+		SysPrefix + "subscriptions/count":       strconv.FormatInt(snap.Subscriptions, 10),
+		SysPrefix + "retained messages/count":   strconv.FormatInt(snap.Retained, 10),
+		SysPrefix + "publish/messages/received": strconv.FormatInt(snap.PacketsReceived[packets.PUBLISH], 10),
+		SysPrefix + "publish/messages/sent":     strconv.FormatInt(snap.PacketsSent[packets.PUBLISH], 10),
+		SysPrefix + "publish/bytes/received":    strconv.FormatInt(snap.BytesReceived[packets.PUBLISH], 10),
+		SysPrefix + "publish/bytes/sent":        strconv.FormatInt(snap.BytesSent[packets.PUBLISH], 10),
+	}
+	for t := packets.CONNECT; t <= packets.DISCONNECT; t++ {
+		name := strings.ToLower(packets.PacketNames[uint8(t)])
+		topics[SysPrefix+"packets/received/"+name] = strconv.FormatInt(snap.PacketsReceived[t], 10)
+		topics[SysPrefix+"packets/sent/"+name] = strconv.FormatInt(snap.PacketsSent[t], 10)
+		topics[SysPrefix+"bytes/received/"+name] = strconv.FormatInt(snap.BytesReceived[t], 10)
+		topics[SysPrefix+"bytes/sent/"+name] = strconv.FormatInt(snap.BytesSent[t], 10)
+	}
+	return topics
+}
+
+// SysPackets 生成$SYS主题的保留消息
+func (s *Stats) SysPackets() []*packets.PublishPacket {
+	topics := s.SysTopics()
+	pks := make([]*packets.PublishPacket, 0, len(topics))
+	for topic, value := range topics {
+		pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+		pk.Retain = true
+		pk.TopicName = topic
+		pk.Payload = []byte(value)
+		pks = append(pks, pk)
+	}
+	return pks
+}
+
+// Publish 按间隔周期性地发布$SYS保留消息, 直到stop被关闭
+// interval 不大于0时使用 DefaultInterval
+func (s *Stats) Publish(stop <-chan struct{}, interval time.Duration, publish func(*packets.PublishPacket)) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, pk := range s.SysPackets() {
+			publish(pk)
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sum 求和
+func sum(values []int64) int64 {
+	var total int64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+func TestSysTopics(t *testing.T) {
+	s := New()
+	s.ClientConnected()
+	s.ClientConnected()
+	s.ClientDisconnected()
+	s.SessionRestored()
+	s.Received(packets.CONNECT, 20)
+	s.Received(packets.PUBLISH, 30)
+	s.Sent(packets.CONNACK, 4)
+	s.Received(0, 100)
+	s.SetSubscriptions(3)
+
+	topics := s.SysTopics()
+	expected := map[string]string{
+		"$SYS/broker/clients/connected":         "1",
+		"$SYS/broker/clients/total":             "3",
+		"$SYS/broker/messages/received":         "2",
+		"$SYS/broker/messages/sent":             "1",
+		"$SYS/broker/bytes/received":            "50",
+		"$SYS/broker/bytes/received/publish":    "30",
+		"$SYS/broker/packets/sent/connack":      "1",
+		"$SYS/broker/publish/messages/received": "1",
+		"$SYS/broker/subscriptions/count":       "3",
+	}
+	for topic, value := range expected {
+		if topics[topic] != value {
+			t.Errorf("%s is %q, should be %q", topic, topics[topic], value)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	s := New()
+	stop := make(chan struct{})
+	count := 0
+	s.Publish(stop, time.Millisecond, func(pk *packets.PublishPacket) {
+		if !pk.Retain {
+			t.Errorf("%s should be retained", pk.TopicName)
+		}
+		count++
+		if count == len(s.SysTopics()) {
+			close(stop)
+		}
+	})
+	if count != len(s.SysTopics()) {
+		t.Errorf("Publish sent %d packets, should be %d", count, len(s.SysTopics()))
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	s := New()
+	s.Received(packets.PUBLISH, 30)
+	s.Connack(packets.ErrRefusedNotAuthorised)
+	s.Payload(20)
+	s.Payload(5000)
+	s.Delivered(2 * time.Millisecond)
+	s.Dropped()
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type is %q, should be %q", ct, ContentType)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`mqtt_packets_received_total{type="publish"} 1`,
+		`mqtt_bytes_received_total{type="publish"} 30`,
+		`mqtt_connack_total{code="5"} 1`,
+		`mqtt_messages_dropped_total 1`,
+		`mqtt_publish_payload_bytes_bucket{le="16"} 0`,
+		`mqtt_publish_payload_bytes_bucket{le="64"} 1`,
+		`mqtt_publish_payload_bytes_bucket{le="16384"} 2`,
+		`mqtt_publish_payload_bytes_bucket{le="+Inf"} 2`,
+		`mqtt_publish_payload_bytes_sum 5020`,
+		`mqtt_delivery_latency_seconds_bucket{le="0.0025"} 1`,
+		`mqtt_delivery_latency_seconds_count 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Exposition does not contain %q", line)
+		}
+	}
+}
+
+func TestHistogramSnapshot(t *testing.T) {
+	h := NewHistogram([]float64{10, 100})
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			h.Observe(50)
+		}
+	}()
+	// 并发观测时快照中的 +Inf 桶, 有限桶和总和也必须一致
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		snap := h.Snapshot()
+		if snap.Cumulative[0] != 0 || snap.Cumulative[1] != snap.Count || snap.Sum != 50*float64(snap.Count) {
+			t.Fatalf("inconsistent snapshot %+v", snap)
+		}
+	}
+}
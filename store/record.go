@@ -0,0 +1,174 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// 记录类型
+const (
+	recSessionCreate = 1  // 创建会话: 客户端标识符, 清除会话标志
+	recSessionDelete = 2  // 删除会话: 客户端标识符
+	recSubscribe     = 3  // 订阅: 客户端标识符, 主题过滤器, QoS
+	recUnsubscribe   = 4  // 取消订阅: 客户端标识符, 主题过滤器
+	recEnqueue       = 5  // 待投递消息: 客户端标识符, PUBLISH报文
+	recRelease       = 6  // QoS 2消息已发送PUBREL: 客户端标识符, 报文标识符
+	recAck           = 7  // 消息投递完成: 客户端标识符, 报文标识符
+	recRetain        = 8  // 保留消息: PUBLISH报文, 负载为空表示删除
+	recReceive       = 9  // 收到客户端的QoS 2消息, 等待PUBREL: 客户端标识符, 报文标识符
+	recComplete      = 10 // 收到PUBREL: 客户端标识符, 报文标识符
+)
+
+// 记录头部: 4字节长度, 4字节CRC32, 8字节序号, 1字节类型
+const headerSize = 17
+
+// errTornRecord 记录不完整或校验失败, 通常是崩溃时写了一半
+var errTornRecord = errors.New("torn WAL record")
+
+// record 一条WAL记录
+type record struct {
+	seq      uint64
+	kind     byte
+	clientID string
+	topic    string
+	qos      byte
+	flag     bool
+	packetID uint16
+	packet   *packets.PublishPacket
+}
+
+// encode 编码记录
+func (r *record) encode() []byte {
+	var body bytes.Buffer
+	body.Write(encodeField([]byte(r.clientID)))
+	switch r.kind {
+	case recSessionCreate:
+		body.WriteByte(boolToByte(r.flag))
+	case recSubscribe:
+		body.Write(encodeField([]byte(r.topic)))
+		body.WriteByte(r.qos)
+	case recUnsubscribe:
+		body.Write(encodeField([]byte(r.topic)))
+	case recEnqueue, recRetain:
+		copied := *r.packet
+		var pk bytes.Buffer
+		copied.Write(&pk)
+		body.Write(encodeField(pk.Bytes()))
+	case recRelease, recAck, recReceive, recComplete:
+		binary.Write(&body, binary.BigEndian, r.packetID)
+	}
+
+	buf := make([]byte, headerSize, headerSize+body.Len())
+	binary.BigEndian.PutUint32(buf[0:4], uint32(9+body.Len()))
+	binary.BigEndian.PutUint64(buf[8:16], r.seq)
+	buf[16] = r.kind
+	buf = append(buf, body.Bytes()...)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:]))
+	return buf
+}
+
+// readRecord 读取一条记录, 文件正常结束时返回io.EOF
+func readRecord(r io.Reader) (*record, int, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errTornRecord
+	}
+	length := binary.BigEndian.Uint32(head[0:4])
+	if length < 9 || length > 1<<30 {
+		return nil, 0, errTornRecord
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, errTornRecord
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(head[4:8]) {
+		return nil, 0, errTornRecord
+	}
+
+	rec := &record{seq: binary.BigEndian.Uint64(data[0:8]), kind: data[8]}
+	body := bytes.NewReader(data[9:])
+	clientID, err := decodeField(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	rec.clientID = string(clientID)
+	switch rec.kind {
+	case recSessionCreate:
+		b, err := body.ReadByte()
+		if err != nil {
+			return nil, 0, err
+		}
+		rec.flag = b != 0
+	case recSubscribe, recUnsubscribe:
+		topic, err := decodeField(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		rec.topic = string(topic)
+		if rec.kind == recSubscribe {
+			if rec.qos, err = body.ReadByte(); err != nil {
+				return nil, 0, err
+			}
+		}
+	case recEnqueue, recRetain:
+		raw, err := decodeField(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		pk, err := packets.ReadPacket(bytes.NewReader(raw))
+		if err != nil {
+			return nil, 0, err
+		}
+		pub, ok := pk.(*packets.PublishPacket)
+		if !ok {
+			return nil, 0, fmt.Errorf("WAL record %d holds %s, expected PUBLISH", rec.seq, pk)
+		}
+		rec.packet = pub
+	case recRelease, recAck, recReceive, recComplete:
+		if err := binary.Read(body, binary.BigEndian, &rec.packetID); err != nil {
+			return nil, 0, err
+		}
+	case recSessionDelete:
+	default:
+		return nil, 0, fmt.Errorf("unknown WAL record type %d", rec.kind)
+	}
+	return rec, 8 + int(length), nil
+}
+
+// encodeField 4字节长度加内容
+func encodeField(value []byte) []byte {
+	b := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint32(b, uint32(len(value)))
+	return append(b, value...)
+}
+
+// decodeField 读取4字节长度加内容
+func decodeField(r *bytes.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if int64(length) > int64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	value := make([]byte, length)
+	_, err := io.ReadFull(r, value)
+	return value, err
+}
+
+// boolToByte 把布尔值转成字节
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
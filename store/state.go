@@ -0,0 +1,160 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// State 可恢复的代理状态
+type State struct {
+	Sessions map[string]*Session
+	Retained map[string]*packets.PublishPacket
+
+	order uint64 // 入队计数, 用于保持消息顺序
+}
+
+// Session 会话状态
+type Session struct {
+	ClientID      string
+	CleanSession  bool
+	Subscriptions map[string]byte
+	Inflight      map[uint16]*Message // 报文标识符 -> 未完成投递的消息
+	Received      map[uint16]bool     // 已收到, 等待PUBREL的客户端QoS 2消息的报文标识符
+}
+
+// Message 未完成投递的消息
+type Message struct {
+	Packet   *packets.PublishPacket
+	Released bool   // QoS 2消息已发送PUBREL, 等待PUBCOMP
+	order    uint64 // 入队顺序
+}
+
+// Messages 按入队顺序返回未完成投递的消息
+func (s *Session) Messages() []*Message {
+	msgs := make([]*Message, 0, len(s.Inflight))
+	for _, m := range s.Inflight {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].order < msgs[j].order })
+	return msgs
+}
+
+// newState 新建空状态
+func newState() *State {
+	return &State{
+		Sessions: make(map[string]*Session),
+		Retained: make(map[string]*packets.PublishPacket),
+	}
+}
+
+// apply 把记录应用到状态
+func (st *State) apply(rec *record) {
+	switch rec.kind {
+	case recSessionCreate:
+		s, ok := st.Sessions[rec.clientID]
+		if !ok || rec.flag || s.CleanSession {
+			s = &Session{
+				ClientID:      rec.clientID,
+				Subscriptions: make(map[string]byte),
+				Inflight:      make(map[uint16]*Message),
+				Received:      make(map[uint16]bool),
+			}
+			st.Sessions[rec.clientID] = s
+		}
+		s.CleanSession = rec.flag
+	case recSessionDelete:
+		delete(st.Sessions, rec.clientID)
+	case recSubscribe:
+		if s, ok := st.Sessions[rec.clientID]; ok {
+			s.Subscriptions[rec.topic] = rec.qos
+		}
+	case recUnsubscribe:
+		if s, ok := st.Sessions[rec.clientID]; ok {
+			delete(s.Subscriptions, rec.topic)
+		}
+	case recEnqueue:
+		if s, ok := st.Sessions[rec.clientID]; ok {
+			st.order++
+			s.Inflight[rec.packet.PacketID] = &Message{Packet: rec.packet, order: st.order}
+		}
+	case recRelease:
+		if s, ok := st.Sessions[rec.clientID]; ok {
+			if m, ok := s.Inflight[rec.packetID]; ok {
+				m.Released = true
+			}
+		}
+	case recAck:
+		if s, ok := st.Sessions[rec.clientID]; ok {
+			delete(s.Inflight, rec.packetID)
+		}
+	case recReceive:
+		if s, ok := st.Sessions[rec.clientID]; ok {
+			s.Received[rec.packetID] = true
+		}
+	case recComplete:
+		if s, ok := st.Sessions[rec.clientID]; ok {
+			delete(s.Received, rec.packetID)
+		}
+	case recRetain:
+		if len(rec.packet.Payload) == 0 {
+			delete(st.Retained, rec.packet.TopicName)
+		} else {
+			st.Retained[rec.packet.TopicName] = rec.packet
+		}
+	}
+}
+
+// records 生成能重建当前状态的记录, 用于快照
+func (st *State) records() []*record {
+	var recs []*record
+	for _, s := range st.Sessions {
+		recs = append(recs, &record{kind: recSessionCreate, clientID: s.ClientID, flag: s.CleanSession})
+		for filter, qos := range s.Subscriptions {
+			recs = append(recs, &record{kind: recSubscribe, clientID: s.ClientID, topic: filter, qos: qos})
+		}
+		for _, m := range s.Messages() {
+			recs = append(recs, &record{kind: recEnqueue, clientID: s.ClientID, packet: m.Packet})
+			if m.Released {
+				recs = append(recs, &record{kind: recRelease, clientID: s.ClientID, packetID: m.Packet.PacketID})
+			}
+		}
+		for id := range s.Received {
+			recs = append(recs, &record{kind: recReceive, clientID: s.ClientID, packetID: id})
+		}
+	}
+	for _, pk := range st.Retained {
+		recs = append(recs, &record{kind: recRetain, packet: pk})
+	}
+	return recs
+}
+
+// clone 复制状态, 报文本身不复制
+func (st *State) clone() *State {
+	c := newState()
+	c.order = st.order
+	for id, s := range st.Sessions {
+		cs := &Session{
+			ClientID:      s.ClientID,
+			CleanSession:  s.CleanSession,
+			Subscriptions: make(map[string]byte, len(s.Subscriptions)),
+			Inflight:      make(map[uint16]*Message, len(s.Inflight)),
+			Received:      make(map[uint16]bool, len(s.Received)),
+		}
+		for filter, qos := range s.Subscriptions {
+			cs.Subscriptions[filter] = qos
+		}
+		for pid, m := range s.Inflight {
+			copied := *m
+			cs.Inflight[pid] = &copied
+		}
+		for pid := range s.Received {
+			cs.Received[pid] = true
+		}
+		c.Sessions[id] = cs
+	}
+	for topic, pk := range st.Retained {
+		c.Retained[topic] = pk
+	}
+	return c
+}
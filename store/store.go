@@ -0,0 +1,356 @@
+// Package store 代理状态的预写日志(WAL)持久化
+// 会话, 订阅, 未完成投递的消息和保留消息的每次变更都先追加到WAL,
+// 启动时重放快照和WAL恢复状态, 压缩时把当前状态写成新快照并清空WAL
+package store
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+// 文件名
+const (
+	walFile      = "wal"
+	snapshotFile = "snapshot"
+)
+
+// SyncPolicy fsync策略
+type SyncPolicy int
+
+// fsync策略
+const (
+	SyncAlways   SyncPolicy = iota // 每条记录写入后fsync
+	SyncInterval                   // 按 SyncInterval 周期性fsync
+	SyncNever                      // 由操作系统决定何时落盘
+)
+
+// DefaultSyncInterval 默认的周期性fsync间隔
+const DefaultSyncInterval = time.Second
+
+// ErrClosed 存储已关闭
+var ErrClosed = errors.New("store closed")
+
+// Options 存储选项
+type Options struct {
+	Dir          string
+	Sync         SyncPolicy
+	SyncInterval time.Duration // SyncInterval策略的间隔, 为0时使用 DefaultSyncInterval
+	CompactSize  int64         // WAL超过该字节数时自动压缩, 为0时不自动压缩
+}
+
+// Store WAL存储, 可并发使用
+type Store struct {
+	opts Options
+
+	mu      sync.Mutex
+	state   *State
+	seq     uint64
+	wal     *os.File
+	w       *bufio.Writer
+	size    int64
+	dirty   bool
+	closed  bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Open 打开存储目录, 重放快照和WAL恢复状态
+// WAL末尾不完整的记录(崩溃时写了一半)会被截断
+func Open(opts Options) (*Store, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	s := &Store{opts: opts, state: newState()}
+
+	snapSeq, err := s.replay(filepath.Join(opts.Dir, snapshotFile), 0)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	walPath := filepath.Join(opts.Dir, walFile)
+	if _, err = s.replay(walPath, snapSeq); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	s.wal, err = os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.wal.Truncate(s.size); err != nil {
+		s.wal.Close()
+		return nil, err
+	}
+	if _, err = s.wal.Seek(s.size, io.SeekStart); err != nil {
+		s.wal.Close()
+		return nil, err
+	}
+	s.w = bufio.NewWriter(s.wal)
+
+	if opts.Sync == SyncInterval {
+		s.stop = make(chan struct{})
+		s.stopped = make(chan struct{})
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// State 返回当前状态的副本
+func (s *Store) State() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.clone()
+}
+
+// CreateSession 记录会话创建, clean 为true时清除同名会话的旧状态
+func (s *Store) CreateSession(clientID string, clean bool) error {
+	return s.append(&record{kind: recSessionCreate, clientID: clientID, flag: clean})
+}
+
+// DeleteSession 记录会话删除
+func (s *Store) DeleteSession(clientID string) error {
+	return s.append(&record{kind: recSessionDelete, clientID: clientID})
+}
+
+// Subscribe 记录订阅
+func (s *Store) Subscribe(clientID string, filter string, qos byte) error {
+	return s.append(&record{kind: recSubscribe, clientID: clientID, topic: filter, qos: qos})
+}
+
+// Unsubscribe 记录取消订阅
+func (s *Store) Unsubscribe(clientID string, filter string) error {
+	return s.append(&record{kind: recUnsubscribe, clientID: clientID, topic: filter})
+}
+
+// Enqueue 记录待投递给客户端的QoS 1或QoS 2消息, 以报文标识符区分
+func (s *Store) Enqueue(clientID string, pk *packets.PublishPacket) error {
+	return s.append(&record{kind: recEnqueue, clientID: clientID, packet: pk})
+}
+
+// Release 记录已为QoS 2消息发送PUBREL
+func (s *Store) Release(clientID string, packetID uint16) error {
+	return s.append(&record{kind: recRelease, clientID: clientID, packetID: packetID})
+}
+
+// Ack 记录消息投递完成(收到PUBACK或PUBCOMP)
+func (s *Store) Ack(clientID string, packetID uint16) error {
+	return s.append(&record{kind: recAck, clientID: clientID, packetID: packetID})
+}
+
+// Receive 记录收到客户端的QoS 2消息, 重连后重发的消息据此识别为重复
+func (s *Store) Receive(clientID string, packetID uint16) error {
+	return s.append(&record{kind: recReceive, clientID: clientID, packetID: packetID})
+}
+
+// Complete 记录收到客户端的PUBREL
+func (s *Store) Complete(clientID string, packetID uint16) error {
+	return s.append(&record{kind: recComplete, clientID: clientID, packetID: packetID})
+}
+
+// Retain 记录保留消息, 负载为空表示删除该主题的保留消息
+func (s *Store) Retain(pk *packets.PublishPacket) error {
+	return s.append(&record{kind: recRetain, packet: pk})
+}
+
+// Sync 把已写入的记录刷到磁盘
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.sync()
+}
+
+// Compact 把当前状态写成快照并清空WAL
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.compact()
+}
+
+// Close 刷盘并关闭存储
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	err := s.sync()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		<-s.stopped
+	}
+	return err
+}
+
+// append 追加记录并应用到状态
+func (s *Store) append(rec *record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.seq++
+	rec.seq = s.seq
+	b := rec.encode()
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.size += int64(len(b))
+	s.dirty = true
+	s.state.apply(rec)
+
+	switch s.opts.Sync {
+	case SyncAlways:
+		if err := s.sync(); err != nil {
+			return err
+		}
+	case SyncNever:
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+	}
+	if s.opts.CompactSize > 0 && s.size >= s.opts.CompactSize {
+		return s.compact()
+	}
+	return nil
+}
+
+// sync 刷新缓冲并fsync, 调用者需持有锁
+func (s *Store) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// compact 写入快照后清空WAL, 调用者需持有锁
+// 快照记录了最后一条记录的序号, 清空WAL前崩溃时重放会跳过已包含在快照中的记录
+func (s *Store) compact() error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.opts.Dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range s.state.records() {
+		rec.seq = s.seq
+		if _, err = w.Write(rec.encode()); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(s.opts.Dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err = syncDir(s.opts.Dir); err != nil {
+		return err
+	}
+
+	if err = s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.w.Reset(s.wal)
+	s.size = 0
+	return s.wal.Sync()
+}
+
+// replay 重放文件中序号大于after的记录, 返回最后一条记录的序号
+// 用于WAL时记录文件中有效内容的长度
+func (s *Store) replay(path string, after uint64) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return after, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	last := after
+	var size int64
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF || err == errTornRecord {
+			break
+		}
+		if err != nil {
+			return last, err
+		}
+		size += int64(n)
+		if rec.seq <= after {
+			continue
+		}
+		s.state.apply(rec)
+		last = rec.seq
+	}
+	if last > s.seq {
+		s.seq = last
+	}
+	if filepath.Base(path) == walFile {
+		s.size = size
+	}
+	return last, nil
+}
+
+// syncLoop 周期性fsync
+func (s *Store) syncLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.Sync()
+		}
+	}
+}
+
+// syncDir fsync目录, 保证重命名落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
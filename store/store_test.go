@@ -0,0 +1,148 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boxungo/mqtt/packets"
+)
+
+func publish(topic string, qos byte, id uint16, payload string) *packets.PublishPacket {
+	pk := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pk.Qos = qos
+	pk.PacketID = id
+	pk.TopicName = topic
+	pk.Payload = []byte(payload)
+	return pk
+}
+
+// populate 写入一组变更
+func populate(t *testing.T, s *Store) {
+	steps := []error{
+		s.CreateSession("dev1", false),
+		s.Subscribe("dev1", "a/#", 2),
+		s.Subscribe("dev1", "b", 1),
+		s.Unsubscribe("dev1", "b"),
+		s.Enqueue("dev1", publish("a/1", 1, 1, "one")),
+		s.Enqueue("dev1", publish("a/2", 2, 2, "two")),
+		s.Enqueue("dev1", publish("a/3", 2, 3, "three")),
+		s.Ack("dev1", 1),
+		s.Release("dev1", 2),
+		s.Receive("dev1", 7),
+		s.Receive("dev1", 8),
+		s.Complete("dev1", 8),
+		s.CreateSession("tmp", true),
+		s.DeleteSession("tmp"),
+		s.Retain(publish("status", 0, 0, "online")),
+		s.Retain(publish("gone", 0, 0, "x")),
+		s.Retain(publish("gone", 0, 0, "")),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d returned error: %s", i, err)
+		}
+	}
+}
+
+// check 验证 populate 之后的状态
+func check(t *testing.T, st *State) {
+	if len(st.Sessions) != 1 {
+		t.Fatalf("restored %d sessions, should be 1", len(st.Sessions))
+	}
+	s := st.Sessions["dev1"]
+	if s == nil || s.CleanSession || len(s.Subscriptions) != 1 || s.Subscriptions["a/#"] != 2 {
+		t.Fatalf("restored session is %+v", s)
+	}
+	msgs := s.Messages()
+	if len(msgs) != 2 || msgs[0].Packet.TopicName != "a/2" || !msgs[0].Released || msgs[1].Released || string(msgs[1].Packet.Payload) != "three" {
+		t.Errorf("restored inflight messages are wrong: %v", msgs)
+	}
+	if len(s.Received) != 1 || !s.Received[7] {
+		t.Errorf("restored received QoS 2 identifiers are %v, should be [7]", s.Received)
+	}
+	if len(st.Retained) != 1 || string(st.Retained["status"].Payload) != "online" {
+		t.Errorf("restored retained messages are wrong: %v", st.Retained)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Options{Dir: dir, Sync: SyncInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	populate(t, s)
+	check(t, s.State())
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟崩溃时写了一半的记录
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 40, 1, 2})
+	f.Close()
+
+	s, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, s.State())
+	if err = s.Subscribe("dev1", "c", 0); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.State().Sessions["dev1"].Subscriptions["c"] != 0 || len(s.State().Sessions["dev1"].Subscriptions) != 2 {
+		t.Errorf("record appended after a torn tail was lost")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Options{Dir: dir, Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	populate(t, s)
+	wal, err := os.ReadFile(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, walFile)); info.Size() != 0 {
+		t.Errorf("WAL is %d bytes after compaction, should be empty", info.Size())
+	}
+	s.Close()
+
+	// 模拟写入快照后, 清空WAL前崩溃
+	os.WriteFile(filepath.Join(dir, walFile), wal, 0o644)
+	s, err = Open(Options{Dir: dir, Sync: SyncAlways, CompactSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, s.State())
+	// 自动压缩
+	s.Subscribe("dev1", "c", 1)
+	s.Unsubscribe("dev1", "c")
+	if info, _ := os.Stat(filepath.Join(dir, walFile)); info.Size() >= 200 {
+		t.Errorf("WAL is %d bytes, should have been compacted", info.Size())
+	}
+	s.Close()
+
+	s, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(t, s.State())
+}